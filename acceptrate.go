@@ -0,0 +1,82 @@
+package sshego
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// acceptBucket is the token bucket behind
+// SshegoConfig.MaxAcceptsPerSec.
+type acceptBucket struct {
+	mut    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token from a bucket refilled at rate per
+// second up to burst. If none is left, take returns
+// false, unless reserve is set: then it takes the next
+// token to come, and returns how long until it does.
+func (b *acceptBucket) take(rate float64, burst int, reserve bool) (wait time.Duration, ok bool) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	now := time.Now()
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	max := float64(burst)
+	if b.last.IsZero() {
+		b.tokens = max
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if !reserve {
+		return 0, false
+	}
+	b.tokens--
+	return time.Duration(-b.tokens / rate * float64(time.Second)), true
+}
+
+// waitAcceptRate holds the accept loop of the forward
+// tunnel spec, under MaxAcceptsPerSec, until the next
+// connection may be taken. It returns ctx.Err() if ctx
+// is done first.
+func (cfg *SshegoConfig) waitAcceptRate(ctx context.Context, spec *TunnelSpec) error {
+	if cfg.MaxAcceptsPerSec <= 0 || cfg.RefuseExcessAccepts {
+		return nil
+	}
+	pause, _ := cfg.guardFor(spec).accepts.take(cfg.MaxAcceptsPerSec, cfg.AcceptBurst, true)
+	if pause <= 0 {
+		return nil
+	}
+	t := time.NewTimer(pause)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// overAcceptRate reports whether a connection just
+// accepted by the listener of the forward tunnel spec
+// is over the rate, and should be closed, under
+// RefuseExcessAccepts.
+func (cfg *SshegoConfig) overAcceptRate(spec *TunnelSpec) bool {
+	if cfg.MaxAcceptsPerSec <= 0 || !cfg.RefuseExcessAccepts {
+		return false
+	}
+	_, ok := cfg.guardFor(spec).accepts.take(cfg.MaxAcceptsPerSec, cfg.AcceptBurst, false)
+	return !ok
+}
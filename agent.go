@@ -0,0 +1,38 @@
+package sshego
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/agent"
+)
+
+// ErrNoAgentSocket is returned by SSHConnect when UseAgent
+// is set but there is no ssh-agent socket to dial.
+var ErrNoAgentSocket = fmt.Errorf("no ssh-agent socket: neither AgentSocket nor $SSH_AUTH_SOCK is set")
+
+// agentSocket returns cfg.AgentSocket, or else $SSH_AUTH_SOCK.
+func (cfg *SshegoConfig) agentSocket() string {
+	if cfg.AgentSocket != "" {
+		return cfg.AgentSocket
+	}
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// dialAgent connects to the ssh-agent, returning a func that
+// lists the keys the agent holds, as signers. The caller
+// closes conn once the handshake is done.
+func (cfg *SshegoConfig) dialAgent() (signers func() ([]ssh.Signer, error), conn net.Conn, err error) {
+	path := cfg.agentSocket()
+	if path == "" {
+		return nil, nil, ErrNoAgentSocket
+	}
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not reach ssh-agent at '%s': %w", path, err)
+	}
+	ag := agent.NewClient(conn)
+	return ag.Signers, conn, nil
+}
@@ -0,0 +1,95 @@
+package sshego
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/agent"
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/testdata"
+)
+
+func Test148UseAgentLogsInWithAgentHeldKeys(t *testing.T) {
+
+	cv.Convey("With UseAgent and no keypath, SSHConnect should authenticate with the keys held by the ssh-agent at AgentSocket, and fail when the agent has none.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// an in-process agent, on a unix socket.
+		keyring := agent.NewKeyring()
+		sock := s.SrvCfg.Tempdir + "/agent.sock"
+		ln, err := net.Listen("unix", sock)
+		panicOn(err)
+		defer ln.Close()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					agent.ServeAgent(keyring, c)
+					c.Close()
+				}()
+			}
+		}()
+
+		s.CliCfg.UseAgent = true
+		s.CliCfg.AgentSocket = sock
+		s.CliCfg.LocalToRemote.Listen.Addr = ""
+		s.CliCfg.DirectTcp = true
+
+		ctx := context.Background()
+		connect := func() error {
+			halt := ssh.NewHalter()
+			defer func() {
+				halt.RequestStop()
+				halt.MarkDone()
+			}()
+			cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, "",
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			if cli != nil {
+				cli.Close()
+			}
+			return err
+		}
+
+		// the agent holds no keys yet.
+		cv.So(connect(), cv.ShouldNotBeNil)
+
+		pem, err := ioutil.ReadFile(s.RsaPath)
+		panicOn(err)
+		priv, err := ssh.ParseRawPrivateKey(pem)
+		panicOn(err)
+		panicOn(keyring.Add(agent.AddedKey{PrivateKey: priv}))
+		cv.So(connect(), cv.ShouldBeNil)
+
+		// a key file the sshd does not know is offered first,
+		// and then the agent's keys.
+		otherKey := s.SrvCfg.Tempdir + "/other_id_rsa"
+		panicOn(ioutil.WriteFile(otherKey, testdata.PEMBytes["rsa"], 0600))
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, otherKey,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cli.Close()
+		halt.RequestStop()
+		halt.MarkDone()
+
+		s.CliCfg.AgentSocket = ""
+		t.Setenv("SSH_AUTH_SOCK", "")
+		cv.So(errors.Is(connect(), ErrNoAgentSocket), cv.ShouldBeTrue)
+		t.Setenv("SSH_AUTH_SOCK", sock)
+		cv.So(connect(), cv.ShouldBeNil)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,88 @@
+package sshego
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// syncWriteCloser is an *os.File, or the like.
+type syncWriteCloser interface {
+	io.WriteCloser
+	Sync() error
+}
+
+// createPlain opens name for writing, as os.Create does,
+// but keeps the 0600 of the temp file made by writeAtomic.
+func createPlain(name string) (syncWriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0600)
+}
+
+// createWithMode gives a create for writeAtomic that
+// sets the temp file's mode to mode, so that fn keeps
+// the mode it had before it was replaced.
+func createWithMode(mode os.FileMode) func(name string) (syncWriteCloser, error) {
+	return func(name string) (syncWriteCloser, error) {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err = f.Chmod(mode); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+}
+
+// writeAtomic replaces fn with what write writes, such that
+// a crash part way leaves either the old fn or the new one
+// whole, never a truncated file. write is given a temp file
+// in fn's directory, opened by create; once it returns, the
+// temp file is fsynced and renamed over fn, and then the
+// directory is fsynced, so that the rename is durable too.
+func writeAtomic(fn string, create func(name string) (syncWriteCloser, error), write func(w io.Writer) error) (err error) {
+	mkpath(fn)
+	dir, base := filepath.Split(fn)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, base+".new")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpName)
+		}
+	}()
+
+	f, err := create(tmpName)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, fn); err != nil {
+		return err
+	}
+
+	// best effort: not every platform can fsync a directory.
+	if d, derr := os.Open(dir); derr == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
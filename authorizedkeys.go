@@ -0,0 +1,137 @@
+package sshego
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// AuthorizedKeys is an authorized_keys store for the
+// embedded sshd: the public keys each login may present,
+// beyond the one on file for it in the HostDb. Set it as
+// cfg.AuthorizedKeys on the esshd's config. Keys can be
+// added and removed while the esshd runs; each login
+// attempt sees the store as it is then.
+//
+// A login the HostDb does not know can still sign in
+// with a key from the store, but only when the esshd
+// asks for nothing more (SkipPassphrase and SkipTOTP).
+type AuthorizedKeys struct {
+	mut sync.Mutex
+
+	// keys maps login to the marshalled
+	// key to its entry.
+	keys map[string]map[string]*AuthorizedKey
+}
+
+// AuthorizedKey is one entry in an AuthorizedKeys store.
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+
+	// Options are those given before the key on its
+	// authorized_keys line, such as no-pty. They are
+	// recorded but not enforced.
+	Options []string
+}
+
+// NewAuthorizedKeys returns an empty store.
+func NewAuthorizedKeys() *AuthorizedKeys {
+	return &AuthorizedKeys{
+		keys: make(map[string]map[string]*AuthorizedKey),
+	}
+}
+
+// Add authorizes key for login, replacing
+// any entry it already had.
+func (k *AuthorizedKeys) Add(login string, key ssh.PublicKey, comment string) {
+	k.add(login, &AuthorizedKey{Key: key, Comment: comment})
+}
+
+func (k *AuthorizedKeys) add(login string, entry *AuthorizedKey) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	m, ok := k.keys[login]
+	if !ok {
+		m = make(map[string]*AuthorizedKey)
+		k.keys[login] = m
+	}
+	m[string(entry.Key.Marshal())] = entry
+}
+
+// Remove takes key out of login's keys, reporting
+// whether it was there. It stops new logins with
+// key; sessions already logged in are untouched.
+func (k *AuthorizedKeys) Remove(login string, key ssh.PublicKey) bool {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	m, ok := k.keys[login]
+	if !ok {
+		return false
+	}
+	mk := string(key.Marshal())
+	if _, ok = m[mk]; !ok {
+		return false
+	}
+	delete(m, mk)
+	if len(m) == 0 {
+		delete(k.keys, login)
+	}
+	return true
+}
+
+// Keys lists the keys authorized for login.
+func (k *AuthorizedKeys) Keys(login string) []*AuthorizedKey {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	var list []*AuthorizedKey
+	for _, entry := range k.keys[login] {
+		list = append(list, entry)
+	}
+	return list
+}
+
+// Load adds, for login, every key in r, which is
+// in the format of an OpenSSH authorized_keys file.
+// Blank lines and # comments are skipped.
+func (k *AuthorizedKeys) Load(login string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return fmt.Errorf("authorized keys for '%s', line %v: %v", login, lineNum, err)
+		}
+		k.add(login, &AuthorizedKey{Key: key, Comment: comment, Options: options})
+	}
+	return scanner.Err()
+}
+
+// Authorize reports whether key is authorized for login,
+// and if so gives the ssh.Permissions to log in with:
+// the key's Fingerprint() under the "pubkey-fp" extension.
+// A nil store authorizes nothing.
+func (k *AuthorizedKeys) Authorize(login string, key ssh.PublicKey) (*ssh.Permissions, bool) {
+	if k == nil {
+		return nil, false
+	}
+	k.mut.Lock()
+	_, ok := k.keys[login][string(key.Marshal())]
+	k.mut.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{"pubkey-fp": Fingerprint(key)},
+	}, true
+}
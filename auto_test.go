@@ -149,7 +149,11 @@ func Test060AutoRedialWithTricorder(t *testing.T) {
 		<-serverDone2.DoneChan()
 		nc.Close()
 
-		// done with testing, cleanup
+		// done with testing, cleanup. Stop tri first: Stop
+		// closes its connection, and it would redial after
+		// the test is over.
+		tri.Halt.RequestStop()
+		<-tri.Halt.DoneChan()
 		s.SrvCfg.Esshd.Stop()
 		<-s.SrvCfg.Esshd.Halt.DoneChan()
 		cv.So(true, cv.ShouldEqual, true) // we should get here.
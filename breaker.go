@@ -0,0 +1,115 @@
+package sshego
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultBreakerCooldown is how long a tripped forward
+// listener stops accepting when BreakerCooldown is 0.
+const DefaultBreakerCooldown = 30 * time.Second
+
+// dialBreaker counts consecutive remote dial failures
+// of a forward, for SshegoConfig.BreakerFailures.
+type dialBreaker struct {
+	mut       sync.Mutex
+	fails     int
+	first     time.Time
+	openUntil time.Time
+}
+
+// forwardGuard is what is kept for each forward
+// listener, by its listen address, across restarts
+// and reconnects.
+type forwardGuard struct {
+	breaker dialBreaker
+	accepts acceptBucket
+}
+
+// guardFor returns the forwardGuard of the forward
+// tunnel spec, making it on first use.
+func (cfg *SshegoConfig) guardFor(spec *TunnelSpec) *forwardGuard {
+	cfg.fwdGuardsMu.Lock()
+	defer cfg.fwdGuardsMu.Unlock()
+	g := cfg.fwdGuards[spec.Listen.Addr]
+	if g == nil {
+		if cfg.fwdGuards == nil {
+			cfg.fwdGuards = make(map[string]*forwardGuard)
+		}
+		g = &forwardGuard{}
+		cfg.fwdGuards[spec.Listen.Addr] = g
+	}
+	return g
+}
+
+// noteForwardDial is called by NewForward with the
+// outcome of each remote dial of the forward tunnel
+// spec; err is nil on success.
+func (cfg *SshegoConfig) noteForwardDial(spec *TunnelSpec, err error) {
+	if cfg.BreakerFailures <= 0 {
+		return
+	}
+	b := &cfg.guardFor(spec).breaker
+	b.mut.Lock()
+	if err == nil {
+		b.fails = 0
+		b.mut.Unlock()
+		return
+	}
+	now := time.Now()
+	if b.fails == 0 || (cfg.BreakerWindow > 0 && now.Sub(b.first) > cfg.BreakerWindow) {
+		b.fails = 0
+		b.first = now
+	}
+	b.fails++
+	fails := b.fails
+	if fails < cfg.BreakerFailures {
+		b.mut.Unlock()
+		return
+	}
+	cooldown := cfg.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	b.openUntil = now.Add(cooldown)
+	b.fails = 0
+	b.mut.Unlock()
+
+	cfg.logger().Errorf("sshego: forward on %s: %v remote dials to %s failed in a row; not accepting for %v",
+		spec.Listen.Addr, fails, spec.Remote.Addr, cooldown)
+	if cfg.OnBreakerTrip != nil {
+		cfg.OnBreakerTrip(cfg.Nickname, fails, cooldown)
+	}
+}
+
+// waitBreaker returns once the breaker of the forward
+// tunnel spec is closed, or with ctx.Err() if ctx is
+// done first.
+func (cfg *SshegoConfig) waitBreaker(ctx context.Context, spec *TunnelSpec) error {
+	b := &cfg.guardFor(spec).breaker
+	b.mut.Lock()
+	pause := time.Until(b.openUntil)
+	b.mut.Unlock()
+	if pause <= 0 {
+		return nil
+	}
+	t := time.NewTimer(pause)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// breakerOpen reports how long the breaker of the forward
+// tunnel spec stays open, if it is, and otherwise how many
+// dials in a row have failed.
+func (cfg *SshegoConfig) breakerOpen(spec *TunnelSpec, now time.Time) (open time.Duration, fails int) {
+	b := &cfg.guardFor(spec).breaker
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.openUntil.Sub(now), b.fails
+}
@@ -54,7 +54,7 @@ func NewUHPTower(halt *ssh.Halter) *UHPTower {
 // cases, as above, you must arrange to
 // service the channel promptly.
 func (b *UHPTower) Subscribe(notify chan *UHP) (ch chan *UHP) {
-	pp("UHPTower %p sees Subscribe, notify=%p", b, notify)
+	p("UHPTower %p sees Subscribe, notify=%p", b, notify)
 
 	b.mut.Lock()
 	if notify == nil {
@@ -122,7 +122,7 @@ func (b *UHPTower) Broadcast(val *UHP) error {
 		case <-b.halt.ReqStopChan():
 			return b.internalClose()
 		case <-time.After(10 * time.Second):
-			pp("UHPTower.Broadcast() blocked: could not send for 10 seconds.")
+			p("UHPTower.Broadcast() blocked: could not send for 10 seconds.")
 			// return or panic?
 			panic("big problem: Broadcast blocked for 10 seconds! Prefer buffered channel of size 1 for Tower subscribe channels.")
 		}
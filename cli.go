@@ -3,7 +3,6 @@ package sshego
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"strings"
 	"time"
@@ -40,12 +39,20 @@ type DialConfig struct {
 	// which to read the client's RSA private key.
 	RsaPath string
 
+	// KeyPassphrase, if set, decrypts the key at RsaPath.
+	KeyPassphrase string
+
 	// the time-based one-time password configuration
 	TotpUrl string
 
 	// Pw is the passphrase
 	Pw string
 
+	// ChallengeResolver, if set, answers the
+	// keyboard-interactive prompts instead
+	// of Pw and TotpUrl. See SshegoConfig.
+	ChallengeResolver ChallengeResolver
+
 	// which sshd to connect to, host and port.
 	Sshdhost string
 	Sshdport int64
@@ -88,6 +95,19 @@ type DialConfig struct {
 
 	KeepAliveEvery time.Duration // default 1 second
 
+	// KeepAliveTimeout is passed on to SshegoConfig.KeepAliveTimeout.
+	KeepAliveTimeout time.Duration
+
+	// KeepAliveMaxMissed is passed on to SshegoConfig.KeepAliveMaxMissed.
+	KeepAliveMaxMissed int
+
+	// ReconnectJitter is passed on to SshegoConfig.ReconnectJitter.
+	ReconnectJitter float64
+
+	// IdleTimeout is passed on to SshegoConfig.IdleTimeoutDur.
+	// Zero, the default, means no idle timeout.
+	IdleTimeout time.Duration
+
 	// identify who is calling.
 	LocalNickname string
 
@@ -123,13 +143,16 @@ func (dc *DialConfig) DeriveNewConfig() (cfg *SshegoConfig, err error) {
 	cfg.AddIfNotKnown = dc.TofuAddIfNotKnown
 	cfg.Debug = dc.Verbose
 	cfg.TestAllowOneshotConnect = dc.TestAllowOneshotConnect
-	cfg.IdleTimeoutDur = 5 * time.Second
+	cfg.IdleTimeoutDur = dc.IdleTimeout
+	cfg.ReconnectJitter = dc.ReconnectJitter
 	if !dc.SkipKeepAlive {
 		if dc.KeepAliveEvery <= 0 {
 			cfg.KeepAliveEvery = time.Second // default to 1 sec.
 		} else {
 			cfg.KeepAliveEvery = dc.KeepAliveEvery
 		}
+		cfg.KeepAliveTimeout = dc.KeepAliveTimeout
+		cfg.KeepAliveMaxMissed = dc.KeepAliveMaxMissed
 	}
 
 	p("DialConfig.Dial: dc= %#v\n", dc)
@@ -143,6 +166,8 @@ func (dc *DialConfig) DeriveNewConfig() (cfg *SshegoConfig, err error) {
 	}
 	cfg.KnownHosts = dc.KnownHosts
 	cfg.PrivateKeyPath = dc.RsaPath
+	cfg.PrivateKeyPassphrase = dc.KeyPassphrase
+	cfg.ChallengeResolver = dc.ChallengeResolver
 	return cfg, nil
 }
 
@@ -191,7 +216,7 @@ func (dc *DialConfig) Dial(parCtx context.Context, cfg0 *SshegoConfig, skipDowns
 			childHalt.MarkDone()
 			if strings.Contains(err.Error(), "getsockopt: connection refused") {
 				// simple connection error, just try again in a bit
-				time.Sleep(10 * time.Millisecond)
+				time.Sleep(cfg.jitter(10 * time.Millisecond))
 				continue
 			}
 			break
@@ -234,7 +259,7 @@ func (dc *DialConfig) Dial(parCtx context.Context, cfg0 *SshegoConfig, skipDowns
 			tryUnixDomain = true
 			host = hp
 		} else {
-			log.Printf("error from net.SplitHostPort on '%s': '%v'",
+			cfg.logger().Errorf("error from net.SplitHostPort on '%s': '%v'",
 				hp, err)
 			return nil, nil, nil, fmt.Errorf("error from net.SplitHostPort "+
 				"on '%s': '%v'", hp, err)
@@ -260,7 +285,12 @@ type KeepAlivePing struct {
 
 // startKeepalives starts a background goroutine
 // that will send a keepalive on sshClientConn
-// every dur (default every second).
+// every dur (default every second), each once the
+// last was answered. If cfg.KeepAliveMaxMissed > 0,
+// a keepalive left unanswered for that many
+// KeepAliveTimeouts has the server taken for gone,
+// and sshClientConn is closed so that its listeners
+// and tunnels exit.
 //
 func (cfg *SshegoConfig) startKeepalives(ctx context.Context, dur time.Duration, sshClientConn *ssh.Client, uhp *UHP) error {
 	if dur <= 0 {
@@ -290,44 +320,83 @@ func (cfg *SshegoConfig) startKeepalives(ctx context.Context, dur time.Duration,
 			}
 		}
 	}
+	timeout := cfg.KeepAliveTimeout
+	if timeout <= 0 {
+		timeout = 10 * dur
+	}
+	type pingReply struct {
+		status  bool
+		payload []byte
+		err     error
+	}
 	go func() {
 		for {
 			select {
 			case <-time.After(dur):
-				ping.Sent = time.Now()
-				ping.Serial = serial
-				serial++
-				pingBy, err := ping.MarshalMsg(nil)
-				panicOn(err)
+			case <-sshClientConn.Halt.ReqStopChan():
+				return
+			}
+			ping.Sent = time.Now()
+			ping.Serial = serial
+			serial++
+			pingBy, err := ping.MarshalMsg(nil)
+			panicOn(err)
 
-				responseStatus, responsePayload, err := sshClientConn.SendRequest(
+			// The ping is never cancelled when its reply is late:
+			// the reply would still arrive, and be taken as the
+			// answer to the next global request on the connection.
+			// We wait for it, or close the connection.
+			replied := make(chan pingReply, 1)
+			go func() {
+				status, payload, err := sshClientConn.SendRequest(
 					ctx, "keepalive@sshego.glycerine.github.com", true, pingBy)
-				if err != nil {
-					log.Printf("%s startKeepalives: keepalive send error: '%v', notifying reconnect needed to '%#v'", cfg.Nickname, err, uhp)
-					// notify here
+				replied <- pingReply{status: status, payload: payload, err: err}
+			}()
+
+			var r pingReply
+			missed := 0
+		awaitReply:
+			for {
+				select {
+				case r = <-replied:
+					break awaitReply
+				case <-time.After(timeout):
+					missed++
+					if cfg.KeepAliveMaxMissed <= 0 || missed < cfg.KeepAliveMaxMissed {
+						cfg.logger().Debugf("%s startKeepalives: keepalive %v unanswered after %v", cfg.Nickname, ping.Serial, time.Duration(missed)*timeout)
+						continue
+					}
+					cfg.logger().Errorf("%s startKeepalives: keepalive unanswered after %v, closing the connection to '%#v'", cfg.Nickname, time.Duration(missed)*timeout, uhp)
 					cfg.ClientReconnectNeededTower.Broadcast(uhp)
-					//pp("SshegoConfig.startKeepalives() goroutine exiting!")
+					sshClientConn.Close()
+					return
+				case <-sshClientConn.Halt.ReqStopChan():
 					return
 				}
-				//pp("startKeepalives: have responseStatus: '%v'", responseStatus)
-
-				if responseStatus {
-					n := len(responsePayload)
-					if n > 0 {
-						var ping3 KeepAlivePing
-						_, err := ping3.UnmarshalMsg(responsePayload)
-						if err == nil {
-							//p("startKeepalives: have "+
-							//	"responsePayload.Replied: '%v'/serial=%v. at now='%v'",
-							//	ping3.Replied, ping3.Serial, time.Now())
-						}
+			}
+			responseStatus, responsePayload, err := r.status, r.payload, r.err
+			if err != nil {
+				cfg.logger().Errorf("%s startKeepalives: keepalive send error: '%v', notifying reconnect needed to '%#v'", cfg.Nickname, err, uhp)
+				// notify here
+				cfg.ClientReconnectNeededTower.Broadcast(uhp)
+				//pp("SshegoConfig.startKeepalives() goroutine exiting!")
+				return
+			}
+			//pp("startKeepalives: have responseStatus: '%v'", responseStatus)
+
+			if responseStatus {
+				n := len(responsePayload)
+				if n > 0 {
+					var ping3 KeepAlivePing
+					_, err := ping3.UnmarshalMsg(responsePayload)
+					if err == nil {
+						//p("startKeepalives: have "+
+						//	"responsePayload.Replied: '%v'/serial=%v. at now='%v'",
+						//	ping3.Replied, ping3.Serial, time.Now())
 					}
-				} else {
-					// !responseStatus
 				}
-
-			case <-sshClientConn.Halt.ReqStopChan():
-				return
+			} else {
+				// !responseStatus
 			}
 		}
 	}()
@@ -344,7 +413,7 @@ func (cfg *SshegoConfig) NewSSHClient(ctx context.Context, c ssh.Conn, chans <-c
 
 	// replace conn.HandleGlobalRequests with custom handler.
 	//go conn.HandleGlobalRequests(ctx, reqs)
-	go customHandleGlobalRequests(ctx, conn, reqs)
+	go cfg.customHandleGlobalRequests(ctx, conn, reqs)
 
 	go conn.HandleChannelOpens(ctx, chans)
 	go func() {
@@ -373,15 +442,19 @@ func (cfg *SshegoConfig) NewSSHClient(ctx context.Context, c ssh.Conn, chans <-c
 	return conn
 }
 
-func customHandleGlobalRequests(ctx context.Context, sshCli *ssh.Client, incoming <-chan *ssh.Request) {
+func (cfg *SshegoConfig) customHandleGlobalRequests(ctx context.Context, sshCli *ssh.Client, incoming <-chan *ssh.Request) {
 
 	for {
 		select {
-		case r := <-incoming:
+		case r, stillOpen := <-incoming:
+			if !stillOpen {
+				// the connection is gone.
+				return
+			}
 			if r == nil {
 				continue
 			}
-			log.Printf("customHandleGlobalRequests sees request r='%#v'", r)
+			cfg.logger().Debugf("customHandleGlobalRequests sees request r='%#v'", r)
 			if r.Type != "keepalive@sshego.glycerine.github.com" || len(r.Payload) == 0 {
 				// This handles keepalive messages and matches
 				// the behaviour of OpenSSH.
@@ -397,7 +470,7 @@ func customHandleGlobalRequests(ctx context.Context, sshCli *ssh.Client, incomin
 			}
 
 			now := time.Now()
-			log.Printf("customHandleGlobalRequests sees keepalive! ping: '%#v'. setting replied to now='%v'", ping, now)
+			cfg.logger().Debugf("customHandleGlobalRequests sees keepalive! ping: '%#v'. setting replied to now='%v'", ping, now)
 
 			ping.Replied = now
 			pingReplyBy, err := ping.MarshalMsg(nil)
@@ -0,0 +1,101 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ErrTooManyClients is returned by SSHConnect when the
+// cap set by SetMaxClients is reached and we were told
+// not to wait.
+var ErrTooManyClients = fmt.Errorf("too many ssh clients open")
+
+// clientSlots counts the outgoing ssh.Client
+// connections open in this process, against
+// an optional cap.
+type clientSlots struct {
+	mut  sync.Mutex
+	max  int
+	wait bool
+	open int
+
+	// freed is closed, and replaced, each
+	// time a slot is given back.
+	freed chan struct{}
+}
+
+var clientLimit = &clientSlots{freed: make(chan struct{})}
+
+// SetMaxClients caps the number of outgoing ssh.Client
+// connections that SSHConnect holds open at once, summed
+// over every SshegoConfig in the process. At the cap, a
+// further SSHConnect either waits, until a connection
+// closes or its ctx is done, or if wait is false fails
+// at once with ErrTooManyClients. max <= 0, the default,
+// means no cap. Lowering the cap closes nothing; it only
+// holds back new connections until enough have closed.
+func SetMaxClients(max int, wait bool) {
+	s := clientLimit
+	s.mut.Lock()
+	s.max, s.wait = max, wait
+	s.broadcast()
+	s.mut.Unlock()
+}
+
+// MaxClients returns the cap from SetMaxClients,
+// or 0 if there is none.
+func MaxClients() int {
+	s := clientLimit
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.max < 0 {
+		return 0
+	}
+	return s.max
+}
+
+// OpenClients returns how many outgoing ssh.Client
+// connections are open now.
+func OpenClients() int {
+	s := clientLimit
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.open
+}
+
+// acquire takes a slot, waiting for one if need be.
+func (s *clientSlots) acquire(ctx context.Context) error {
+	s.mut.Lock()
+	for s.max > 0 && s.open >= s.max {
+		if !s.wait {
+			s.mut.Unlock()
+			return fmt.Errorf("%w: cap of %v reached", ErrTooManyClients, s.max)
+		}
+		freed := s.freed
+		s.mut.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: gave up waiting: %v", ErrTooManyClients, ctx.Err())
+		}
+		s.mut.Lock()
+	}
+	s.open++
+	s.mut.Unlock()
+	return nil
+}
+
+// release gives back a slot taken by acquire.
+func (s *clientSlots) release() {
+	s.mut.Lock()
+	s.open--
+	s.broadcast()
+	s.mut.Unlock()
+}
+
+// broadcast wakes all waiters. Caller holds s.mut.
+func (s *clientSlots) broadcast() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
@@ -0,0 +1,97 @@
+package sshego
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test130MaxClientsCapsOpenConnections(t *testing.T) {
+
+	cv.Convey("With SetMaxClients, SSHConnect should fail fast with ErrTooManyClients at the cap, or wait for a slot when asked to, and OpenClients should track the connections open.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.CliCfg.LocalToRemote.Listen.Addr = ""
+		s.CliCfg.DirectTcp = true
+
+		ctx := context.Background()
+		var halts []*ssh.Halter
+		defer func() {
+			for _, h := range halts {
+				h.RequestStop()
+				h.MarkDone()
+			}
+		}()
+		connect := func(ctx context.Context) (*ssh.Client, error) {
+			// a fresh halt each time, since an expired ctx stops it.
+			halt := ssh.NewHalter()
+			halts = append(halts, halt)
+			cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			return cli, err
+		}
+		waitOpen := func(want int) bool {
+			for i := 0; i < 500; i++ {
+				if OpenClients() == want {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+
+		// clients left over from earlier tests may still be open.
+		base := OpenClients()
+		SetMaxClients(base+1, false)
+		defer SetMaxClients(0, false)
+		cv.So(MaxClients(), cv.ShouldEqual, base+1)
+
+		cli, err := connect(ctx)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(OpenClients(), cv.ShouldEqual, base+1)
+
+		_, err = connect(ctx)
+		cv.So(errors.Is(err, ErrTooManyClients), cv.ShouldBeTrue)
+		cv.So(OpenClients(), cv.ShouldEqual, base+1)
+
+		// waiting: gives up when ctx does...
+		SetMaxClients(base+1, true)
+		short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		_, err = connect(short)
+		cancel()
+		cv.So(errors.Is(err, ErrTooManyClients), cv.ShouldBeTrue)
+
+		// ...and gets in once a slot frees up.
+		got := make(chan error)
+		go func() {
+			cli2, err := connect(ctx)
+			if err == nil {
+				cli2.Close()
+			}
+			got <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case err = <-got:
+			panic("connect did not wait for a free slot")
+		default:
+		}
+		cli.Close()
+		select {
+		case err = <-got:
+			cv.So(err, cv.ShouldBeNil)
+		case <-time.After(10 * time.Second):
+			panic("connect did not proceed after a slot was freed")
+		}
+		cv.So(waitOpen(base), cv.ShouldBeTrue)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
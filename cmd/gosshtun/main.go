@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 
 	tun "github.com/glycerine/sshego"
 	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/terminal"
 )
 
 const ProgramName = "gosshtun"
@@ -29,7 +31,20 @@ func main() {
 		log.Fatalf("%s command line flag error: '%s'", ProgramName, err)
 	}
 	//p("cfg = %#v", cfg)
-	h, err := tun.NewKnownHosts(cfg.ClientKnownHostsPath, tun.KHJson)
+	var h *tun.KnownHosts
+	if cfg.KnownHostsPassphrase == "" {
+		cfg.KnownHostsPassphrase = os.Getenv(tun.KnownHostsPassphraseEnv)
+	}
+	if cfg.KnownHostsPassphrase == "" {
+		h, err = tun.NewKnownHosts(cfg.ClientKnownHostsPath, cfg.KnownHostsFormat)
+		if err == tun.ErrKnownHostsPassphrase {
+			cfg.KnownHostsPassphrase, err = readPassphrase("known hosts passphrase")
+			panicOn(err)
+		}
+	}
+	if cfg.KnownHostsPassphrase != "" {
+		h, err = tun.NewEncryptedKnownHosts(cfg.ClientKnownHostsPath, cfg.KnownHostsFormat, cfg.KnownHostsPassphrase)
+	}
 	panicOn(err)
 	cfg.KnownHosts = h
 
@@ -62,7 +77,55 @@ func main() {
 	ctx := context.Background()
 	halt := ssh.NewHalter()
 
-	_, _, err = cfg.SSHConnect(ctx, h, cfg.Username, cfg.PrivateKeyPath,
+	// under -agent, only read a key file we were pointed at.
+	keypath := cfg.PrivateKeyPath
+	if cfg.UseAgent {
+		keypath = ""
+		myflags.Visit(func(f *flag.Flag) {
+			if f.Name == "key" {
+				keypath = cfg.PrivateKeyPath
+			}
+		})
+	}
+
+	if cfg.PrivateKeyPassphrase == "" {
+		cfg.PrivateKeyPassphrase = os.Getenv(tun.PrivateKeyPassphraseEnv)
+	}
+	if cfg.PrivateKeyPassphrase == "" && keypath != "" {
+		var encErr *tun.EncryptedKeyError
+		if _, err := tun.LoadPrivateKey(keypath); errors.As(err, &encErr) {
+			cfg.PrivateKeyPassphrase, err = readPassphrase("passphrase for key '" + keypath + "'")
+			panicOn(err)
+		}
+	}
+
+	if cfg.ValidateOnly {
+		err = cfg.SSHCheck(ctx, h, cfg.SSHdLogin(), keypath,
+			cfg.SSHdServer.Host, cfg.SSHdServer.Port, passphrase, totpUrl)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%s: ok: logged in to %s:%v\n", ProgramName, cfg.SSHdServer.Host, cfg.SSHdServer.Port)
+		os.Exit(0)
+	}
+
+	if cfg.AutoReconnect && !cfg.WriteConfigOnly {
+		cfg.OnConnState = func(state tun.ConnState, err error) {
+			if err != nil {
+				log.Printf("%s: %v: %v", ProgramName, state, err)
+			} else {
+				log.Printf("%s: %v", ProgramName, state)
+			}
+		}
+		// ctx is never done, so a return means it gave up.
+		err = cfg.SSHConnectWithRetry(ctx, h, cfg.SSHdLogin(), keypath,
+			cfg.SSHdServer.Host, cfg.SSHdServer.Port, passphrase, totpUrl)
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	_, _, err = cfg.SSHConnect(ctx, h, cfg.SSHdLogin(), keypath,
 		cfg.SSHdServer.Host, cfg.SSHdServer.Port, passphrase, totpUrl, halt)
 	if err != nil {
 		fmt.Println(err.Error())
@@ -76,6 +139,20 @@ func main() {
 	}
 }
 
+// readPassphrase prompts on stderr for the passphrase
+// named by what, and reads it from the terminal on stdin
+// without echo.
+func readPassphrase(what string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", fmt.Errorf("%s: need the %s, but stdin is not a terminal to prompt on", ProgramName, what)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s: ", ProgramName, what)
+	pw, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(pw), err
+}
+
 func panicOn(err error) {
 	if err != nil {
 		panic(err)
@@ -2,15 +2,19 @@ package sshego
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
@@ -18,32 +22,211 @@ import (
 
 // SshegoConfig is the top level, main config
 type SshegoConfig struct {
+	// stats are updated atomically. See Stats().
+	// First, with HOTPCounter, for 64-bit alignment.
+	stats Stats
+
+	// HOTPCounter is the next counter to answer an HOTP
+	// (otpauth://hotp/) challenge with; each answer
+	// advances it. Zero means start from the counter=
+	// given in the url. When the config was loaded from
+	// ConfigPath, each advance is written back to that
+	// file before the code is sent.
+	HOTPCounter uint64
+
 	Nickname string
 	Halt     *ssh.Halter
 
 	KeepAliveEvery time.Duration // default 1 second.
 	SkipKeepAlive  bool
 
+	// KeepAliveTimeout is how long a keepalive may wait
+	// for its reply before it counts as missed. No other
+	// keepalive is sent meanwhile, and each further
+	// KeepAliveTimeout it goes unanswered is another
+	// miss. Default 10 * KeepAliveEvery.
+	KeepAliveTimeout time.Duration
+
+	// KeepAliveMaxMissed, if > 0, is how many misses in a
+	// row (see KeepAliveTimeout) have the server taken for
+	// gone and the connection closed, so a dropped network
+	// does not leave tunnels hanging. The default, 0,
+	// never closes the connection.
+	KeepAliveMaxMissed int
+
+	// IdleTimeoutDur, if > 0, closes a forward or reverse
+	// tunnel connection once no bytes have moved either
+	// way for that long, and is set on the channels of a
+	// Tricorder. See CopyWithIdleTimeout().
 	IdleTimeoutDur time.Duration
 
+	// OverallTimeout, if > 0, bounds the whole of an
+	// outgoing SSHConnect(): dial, handshake, auth, and
+	// listener setup. On expiry the partial connection
+	// is torn down and SSHConnect returns an error
+	// wrapping ErrConnectTimeout.
+	OverallTimeout time.Duration
+
+	// ConnectTimeout, if > 0, bounds the tcp dial to
+	// the sshd, and HandshakeTimeout, if > 0, the key
+	// exchange and authentication that follow. Either
+	// expiring gives an error wrapping ErrConnectTimeout.
+	// Zero, the default, leaves the dial to the OS's own
+	// timeout, which can be minutes.
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+
+	// HostTimeouts overrides the timeouts above for
+	// particular sshds, keyed by "host:port". A zero
+	// field in an override falls back to the
+	// config-wide value. See TimeoutsFor().
+	HostTimeouts map[string]Timeouts
+
+	// TCPFastOpen, if true, turns on TCP Fast Open, where
+	// the platform supports it (linux), for the forward
+	// and SOCKS listeners and for our outgoing tcp dials:
+	// to the sshd, and to the local end of a reverse tunnel.
+	// Short-lived tunneled connections save a round trip.
+	TCPFastOpen bool
+
 	ConfigPath string
 
 	SSHdServer    AddrHostPort // the sshd host we are logging into remotely.
 	LocalToRemote TunnelSpec
 	RemoteToLocal TunnelSpec
 
+	// LocalToRemotes and RemoteToLocals are further forward
+	// and reverse tunnels, as with repeated -L and -R flags
+	// to ssh, run over the same ssh connection as the two
+	// above. Each forward listener has its own breaker and
+	// MaxAcceptsPerSec bucket, but all share one
+	// MaxConcurrentForwards cap; RestartForward and
+	// RunForwardOnce deal with LocalToRemote alone.
+	LocalToRemotes []TunnelSpec
+	RemoteToLocals []TunnelSpec
+
+	// DynamicSOCKS, if set, is where we listen as a
+	// SOCKS5 proxy, as ssh -D does, forwarding each
+	// connection through the sshd to whatever host:port
+	// it asks for. See StartupSOCKSListener().
+	DynamicSOCKS AddrHostPort
+
 	Debug bool
 
 	AddIfNotKnown bool
 
+	// NewOKIfKnown, if set, lets a connect with AddIfNotKnown
+	// (-new) to an already known host go ahead, logging only a
+	// warning, instead of failing with ErrNewNotNeeded. For
+	// automated flows that always pass -new.
+	NewOKIfKnown bool
+
+	// VerifySSHFP, if set, lets a host key that is not in
+	// KnownHosts be accepted when it matches a DNSSEC-validated
+	// SSHFP record for the sshd's name. See VerifySSHFP().
+	// SSHFPPin then adds such a key to KnownHosts, and
+	// SSHFPResolver is the validating resolver to ask, as
+	// host:port; it defaults to the first nameserver in
+	// /etc/resolv.conf.
+	VerifySSHFP   bool
+	SSHFPPin      bool
+	SSHFPResolver string
+
+	// HostKeyVerifiers are asked, in order, about a host
+	// key that neither KnownHosts nor SSHFP vouched for;
+	// the first to accept or reject it decides. A key
+	// they all pass on is refused. See HostKeyVerifier.
+	HostKeyVerifiers []HostKeyVerifier
+
+	// HostKeyApprover, if set, is asked about a host key
+	// that is still unknown once HostKeyVerifiers have had
+	// their say, with its Fingerprint, so that a user can
+	// be shown it (see also RandomArt) and asked to accept
+	// it. A true answer adds the key to KnownHosts and lets
+	// the connection proceed, without -new and a re-run.
+	HostKeyApprover func(hostname string, remote net.Addr, key ssh.PublicKey, fp string) (bool, error)
+
 	// user login creds for client
 	Username             string // for client to login with.
 	PrivateKeyPath       string // path to user's RSA private key
 	ClientKnownHostsPath string // path to user's/client's known hosts
 
+	// PrivateKeyPassphrase, if set, decrypts the key at
+	// PrivateKeyPath. It is distinct from Pw, the login
+	// password. See LoadEncryptedPrivateKey(). Like
+	// KnownHostsPassphrase, SaveConfig never writes it
+	// out: gosshtun takes it from the environment (see
+	// PrivateKeyPassphraseEnv), or prompts for it.
+	PrivateKeyPassphrase string
+
+	// UseAgent has SSHConnect also offer the keys held
+	// by the ssh-agent listening on AgentSocket, which
+	// defaults to $SSH_AUTH_SOCK, after the key file's
+	// own. With UseAgent, the
+	// keypath given to SSHConnect may be empty, so that
+	// no private key file is read at all.
+	UseAgent    bool
+	AgentSocket string
+
+	// RequireMFA makes SSHConnect() insist on both factors:
+	// it fails before dialing unless it has a keypath and a
+	// toptUrl (or ChallengeResolver), leaves out the plain
+	// password method, and fails the connection if the sshd
+	// lets us in without both having us sign with the key
+	// and asking for the one-time code. Any keyboard-interactive
+	// prompt answered, other than for a password, counts as
+	// the code. The code is offered before the key.
+	RequireMFA bool
+
+	// ValidateOnly makes SSHConnect() a dry run: it dials,
+	// checks the host key, authenticates, and (unless
+	// SkipKeepAlive) makes one keepalive round trip, then
+	// hangs up and returns a nil client and nil error. No
+	// forward, reverse or SOCKS listener, and no -esshd,
+	// is started. See also SSHCheck().
+	ValidateOnly bool
+
+	// TOTPClockOffset is added to our clock when answering
+	// a TOTP challenge, for a known skew against the sshd:
+	// if our clock runs 20s behind the server's, set 20s.
+	// Zero, the default, uses our clock as it is.
+	TOTPClockOffset time.Duration
+
+	// Crypto, if set, restricts the ciphers, MACs, and
+	// key exchanges SSHConnect will negotiate.
+	Crypto CryptoConfig
+
+	// JumpHosts, if set, are the bastions to go through to
+	// reach the sshd, as with ssh -J: SSHConnect logs in to
+	// the first, reaches each next one through the one before,
+	// and reaches the sshd through the last. Every jump host's
+	// key is checked against KnownHosts as the sshd's is, and
+	// the same credentials are offered to each.
+	JumpHosts []HostSpec
+
+	// KnownHostsPassphrase, if set, has gosshtun keep
+	// its known hosts store encrypted at rest.
+	// See NewEncryptedKnownHosts(). SaveConfig never
+	// writes it out: gosshtun takes it from the
+	// environment (see KnownHostsPassphraseEnv), or
+	// prompts for it when the store is encrypted.
+	KnownHostsPassphrase string
+
+	// KnownHostsFormat is how gosshtun keeps its known
+	// hosts store: KHJson, the default, or KHGob, smaller
+	// and faster for a large store. A store found in the
+	// other format is still read, and is rewritten in this
+	// one. See NewKnownHosts().
+	KnownHostsFormat KnownHostsPersistFormat
+
 	TotpUrl string
 	Pw      string
 
+	// ChallengeResolver, if set, answers all
+	// keyboard-interactive prompts from the sshd,
+	// in place of the default Pw/TotpUrl answers.
+	ChallengeResolver ChallengeResolver
+
 	KnownHosts *KnownHosts
 
 	WriteConfigOut string
@@ -53,10 +236,69 @@ type SshegoConfig struct {
 
 	Quiet bool
 
+	// Logger, if set, takes this config's log output in
+	// place of DefaultLogger. Quiet still silences the
+	// per-connection notes.
+	Logger Logger
+
 	Esshd                  *Esshd
 	EmbeddedSSHdHostDbPath string
 	EmbeddedSSHd           AddrHostPort // optional local sshd, embedded.
 
+	// EmbeddedSSHdForceCommand, under -esshd, is run for
+	// every session in place of whatever shell or command
+	// the client requested, as with OpenSSH's ForceCommand.
+	// The requested command is in $SSH_ORIGINAL_COMMAND.
+	// Environment variables the client asks to set are
+	// refused.
+	EmbeddedSSHdForceCommand string
+
+	// DirectTCPIPHandler, under -esshd, is called for each
+	// direct-tcpip channel open with the login user and the
+	// requested "host:port" target, before anything is dialed;
+	// and for each direct-streamlocal one, under
+	// AllowDirectStreamLocal, with the socket path as target.
+	// A non-nil error rejects the channel, with that error as
+	// the reason given to the client. Use it to log or veto
+	// forwards.
+	DirectTCPIPHandler func(user, target string) error
+
+	// AllowDirectStreamLocal, under -esshd, honors
+	// direct-streamlocal@openssh.com channel opens, letting
+	// clients connect to unix domain sockets on the esshd
+	// host, such as /var/run/docker.sock, with the esshd's
+	// privileges. Off by default.
+	AllowDirectStreamLocal bool
+
+	// AuthFailureCallback, under -esshd, is called for each
+	// failed login attempt with the client's address, the
+	// user it offered, the method it tried, and the reason.
+	// The "none" probe that every client sends first is not
+	// reported. A connection that never completes the
+	// handshake, including one that gives up after failing
+	// auth, is also reported, with method "handshake".
+	AuthFailureCallback func(remote net.Addr, user, method string, reason error)
+
+	// AllowReverseTCP, under -esshd, honors tcpip-forward
+	// requests, letting clients set up reverse tunnels
+	// that listen on tcp ports of the esshd host. Off
+	// by default.
+	AllowReverseTCP bool
+
+	// GatewayPorts, under AllowReverseTCP, lets a client's
+	// tcpip-forward bind the address it asked for, such as
+	// 0.0.0.0, as OpenSSH's GatewayPorts clientspecified
+	// does. Off by default, when every reverse tunnel
+	// listens on loopback only.
+	GatewayPorts bool
+
+	// AllowReverseStreamLocal, under -esshd, honors
+	// streamlocal-forward@openssh.com requests, letting
+	// clients have the esshd create and listen on unix
+	// domain sockets at paths of their choosing. Off
+	// by default.
+	AllowReverseStreamLocal bool
+
 	HostDb *HostDb
 
 	AddUser string
@@ -73,8 +315,49 @@ type SshegoConfig struct {
 	SkipPassphrase bool
 	SkipRSA        bool
 
+	// SequentialAuth, under -esshd, reports an accepted
+	// public key to the client as an RFC 4252 partial
+	// success, and then asks for the keyboard-interactive
+	// passphrase and one-time code. Otherwise the key is
+	// quietly failed until the one-time code has also been
+	// seen, which clients that expect partial success
+	// chaining can find confusing.
+	SequentialAuth bool
+
 	BitLenRSAkeys int
 
+	// CachePublicKeyDecisions, under -esshd, remembers
+	// each successful user+public-key match for the
+	// rest of that connection, so that the key is
+	// not loaded and re-verified on every auth sub-step.
+	CachePublicKeyDecisions bool
+
+	// AuthorizedKeys, under -esshd, holds public keys that
+	// log a user in besides the one on file for them in the
+	// HostDb, as an authorized_keys file would. Keys can be
+	// added and removed while esshd runs. nil means only
+	// the key on file.
+	AuthorizedKeys *AuthorizedKeys
+
+	// FairShare, if set, paces the Bulk class tunnels
+	// so they leave headroom for Interactive ones.
+	FairShare *FairShare
+
+	// RateLimitBytesPerSec, if > 0, caps each forward,
+	// reverse and SOCKS tunnel at that many bytes per
+	// second in each direction, so that one busy tunnel
+	// cannot take the whole link. Zero means no limit.
+	RateLimitBytesPerSec int64
+
+	// ChannelWindowSize and ChannelMaxPacket set the
+	// per-channel flow control window and the largest
+	// packet we accept, for both client and -esshd.
+	// Zero means the defaults of 2MB and 32KB. A
+	// larger window helps bulk throughput on links
+	// with a large bandwidth-delay product.
+	ChannelWindowSize uint32
+	ChannelMaxPacket  uint32
+
 	DirectTcp   bool
 	ShowVersion bool
 
@@ -118,12 +401,149 @@ type SshegoConfig struct {
 	// all self-contained.
 	SshClient *ssh.Client
 
+	// SharedClient reference counts SshClient
+	// among cfg and the Forwarders using it.
+	// See ReleaseClient().
+	SharedClient *SharedClient
+
 	// NoAutoReconnect if true, turns off
 	// our automatic reconnect attempts when the
 	// connection is lost.
 	NoAutoReconnect bool
 
+	// ReconnectJitter spreads out the pauses between
+	// reconnect attempts, so that many tunnels that lose
+	// the same sshd at once do not all retry in lockstep.
+	// Each pause is scaled by a random factor in
+	// [1-ReconnectJitter, 1+ReconnectJitter]. Zero or
+	// negative turns jitter off. The -reconnect-jitter
+	// flag defaults to DefaultReconnectJitter.
+	ReconnectJitter float64
+
+	// AutoReconnect has gosshtun keep its tunnels up with
+	// SSHConnectWithRetry, rather than exit when the ssh
+	// connection is lost.
+	AutoReconnect bool
+
+	// ReconnectMinBackoff and ReconnectMaxBackoff bound the
+	// pause between SSHConnectWithRetry's attempts, which
+	// doubles from the first towards the second with each
+	// failure in a row. Zero means DefaultReconnectMinBackoff
+	// and DefaultReconnectMaxBackoff.
+	ReconnectMinBackoff time.Duration
+	ReconnectMaxBackoff time.Duration
+
+	// OnConnState, if set, is told each time the connection
+	// kept up by SSHConnectWithRetry changes state, with the
+	// error behind the change, if any.
+	OnConnState func(state ConnState, err error)
+
 	ClientReconnectNeededTower *UHPTower
+
+	// ConnectTraceHook, if not nil, is called
+	// with the phase timings at the end of each
+	// outgoing SSHConnect().
+	ConnectTraceHook ConnectTraceHook
+
+	// LastConnectTrace holds the timings from
+	// the most recent outgoing SSHConnect().
+	LastConnectTrace *ConnectTrace
+
+	// BannerCallback, if not nil, is called with
+	// any pre-auth banner that the sshd sends.
+	BannerCallback ssh.BannerCallback
+
+	// LogAuthMethod, if true, logs which auth
+	// method(s) the sshd accepted after each
+	// successful outgoing SSHConnect(). The same
+	// is always kept in LastConnectTrace.AuthMethods.
+	LogAuthMethod bool
+
+	// OnFirstAccept, if set, is called with cfg.Nickname
+	// once the forward listener has accepted its first
+	// connection. See also WaitFirstForwardConn().
+	OnFirstAccept func(name string)
+
+	firstFwdAccept firstAccept
+
+	// OnAcceptError, if set, is called when the forward
+	// or reverse accept loop stops on an error, such as
+	// the ssh connection under a reverse listener going
+	// away. It is not called when the loop is simply
+	// told to stop: its ctx done, or its listener closed
+	// by us. Either way the loop's goroutine exits.
+	OnAcceptError func(err error)
+
+	// BreakerFailures, if > 0, arms a circuit breaker on
+	// each forward listener: once that many of its remote
+	// dials in a row have failed, all within BreakerWindow
+	// (0 means no limit), that listener stops accepting for
+	// BreakerCooldown (0 means DefaultBreakerCooldown), and
+	// OnBreakerTrip, if set, is called. A successful dial
+	// resets the count. A remote dial here is the opening
+	// of the direct-tcpip channel, and it fails only when
+	// the sshd rejects the open. An sshd that accepts the
+	// channel first and then fails to reach the target, as
+	// the -esshd does, just closes the channel; that is
+	// not counted, and does not trip the breaker.
+	BreakerFailures int
+	BreakerWindow   time.Duration
+	BreakerCooldown time.Duration
+	OnBreakerTrip   func(name string, failures int, cooldown time.Duration)
+
+	// fwdGuards holds each forward listener's breaker
+	// and accept bucket, by listen address. See guardFor().
+	fwdGuardsMu sync.Mutex
+	fwdGuards   map[string]*forwardGuard
+
+	// MaxAcceptsPerSec, if > 0, limits how fast each forward
+	// listener takes new connections, with a token bucket of
+	// its own holding up to AcceptBurst tokens (0 means
+	// MaxAcceptsPerSec, rounded up). Connections over the
+	// rate wait in the listen backlog or, if
+	// RefuseExcessAccepts, are accepted and closed at once.
+	// This spares a fragile backend a connection storm.
+	MaxAcceptsPerSec    float64
+	AcceptBurst         int
+	RefuseExcessAccepts bool
+
+	// MaxConcurrentForwards, if > 0, caps how many connections
+	// the forward listeners forward at once. At the cap they
+	// stop accepting until a forward finishes, leaving new
+	// connections in the listen backlog, or if
+	// RefuseExcessForwards, accept them and close them at
+	// once. This keeps a connection flood from using up
+	// file descriptors and memory.
+	MaxConcurrentForwards int
+	RefuseExcessForwards  bool
+
+	fwdSlots forwardSlots
+
+	// ConnFilter, if set, is asked about each connection a
+	// forward listener accepts, by its source address, before
+	// anything is forwarded; a connection it does not allow
+	// is closed at once. For access control by source IP,
+	// say, or for logging each connection as it arrives.
+	// nil, the default, allows all.
+	ConnFilter func(src net.Addr) (allow bool)
+
+	// ForwardOnceConns is how many forward connections
+	// RunForwardOnce() serves before it tears everything
+	// down and returns. 0 means 1.
+	ForwardOnceConns int
+
+	// fwdLn is the running forward listener, and fwdCtx
+	// the ctx it was started under. See RestartForward().
+	fwdLnMu sync.Mutex
+	fwdLn   net.Listener
+	fwdCtx  context.Context
+
+	// fwdQuota, if set, limits the forward listener
+	// started next. See RunForwardOnce().
+	fwdQuota *forwardQuota
+
+	// live holds the open tunnel connections. See DebugDump().
+	live liveTunnels
 }
 
 func (cfg *SshegoConfig) ChannelHandlerSummary() (s string) {
@@ -157,11 +577,29 @@ type AddrHostPort struct {
 	Port           int64
 	UnixDomainPath string
 	Required       bool
+
+	// User, for an sshd address given as user@host:port,
+	// is the login for that sshd, in place of the
+	// top-level Username. See SSHdLogin() and ParseUserAddr().
+	User string
 }
 
 // ParseAddr fills Host and Port from Addr, breaking Addr apart at the ':'
-// using net.SplitHostPort()
+// using net.SplitHostPort(). An IPv6 host must be bracketed, as in
+// [::1]:8080; Host is then just ::1. A user@ is an error here; only
+// an sshd address takes one. See ParseUserAddr().
 func (a *AddrHostPort) ParseAddr() error {
+	return a.parseAddr(false)
+}
+
+// ParseUserAddr is ParseAddr for the address of an sshd or jump
+// host, which may begin with a user@ to log in as. That user is
+// split off into User.
+func (a *AddrHostPort) ParseUserAddr() error {
+	return a.parseAddr(true)
+}
+
+func (a *AddrHostPort) parseAddr(allowUser bool) error {
 
 	if a.Addr == "" {
 		if a.Required {
@@ -170,8 +608,35 @@ func (a *AddrHostPort) ParseAddr() error {
 		return nil
 	}
 
-	host, port, err := net.SplitHostPort(a.Addr)
+	if a.Addr[0] == '/' {
+		// a bare path names a unix-domain socket.
+		a.UnixDomainPath = a.Addr
+		return nil
+	}
+	if strings.HasPrefix(a.Addr, "unix:") {
+		// as does unix:path, relative paths too.
+		a.UnixDomainPath = a.Addr[len("unix:"):]
+		if a.UnixDomainPath == "" {
+			return fmt.Errorf("empty -%s unix socket path in '%s'", a.Title, a.Addr)
+		}
+		return nil
+	}
+
+	hostport := a.Addr
+	a.User = ""
+	if i := strings.LastIndex(hostport, "@"); i >= 0 {
+		if !allowUser {
+			return fmt.Errorf("bad -%s address '%s': only an sshd address takes a user@", a.Title, a.Addr)
+		}
+		a.User = hostport[:i]
+		hostport = hostport[i+1:]
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
 	if err != nil {
+		if strings.Count(hostport, ":") > 1 && !strings.HasPrefix(hostport, "[") {
+			return fmt.Errorf("bad -%s ip:port given; an IPv6 address must be in brackets, as in [::1]:8080: %s", a.Title, err)
+		}
 		return fmt.Errorf("bad -%s ip:port given; net.SplitHostPort() gave: %s", a.Title, err)
 	}
 	a.Host = host
@@ -197,10 +662,74 @@ func (a *AddrHostPort) ParseAddr() error {
 	return nil
 }
 
+// HostPort joins Host and Port back into a host:port,
+// bracketing an IPv6 Host, as in [::1]:8080.
+func (a *AddrHostPort) HostPort() string {
+	return net.JoinHostPort(a.Host, strconv.FormatInt(a.Port, 10))
+}
+
+// SSHdLogin returns the username to log into the -sshd
+// with: the one given in it as user@host:port, or else
+// the top-level Username.
+func (c *SshegoConfig) SSHdLogin() string {
+	if c.SSHdServer.User != "" {
+		return c.SSHdServer.User
+	}
+	return c.Username
+}
+
 // TunnelSpec represents either a forward or a reverse tunnel in SshegoConfig.
 type TunnelSpec struct {
 	Listen AddrHostPort
 	Remote AddrHostPort
+
+	// Class marks the tunnel's traffic as Interactive
+	// (the default) or Bulk, for SshegoConfig.FairShare.
+	Class TrafficClass
+
+	// ProxyProtocol, on the RemoteToLocal tunnel, starts
+	// each connection to the local Remote with a PROXY
+	// protocol v1 header naming the original client on
+	// the sshd side, so the local service can log the
+	// real source rather than 127.0.0.1.
+	ProxyProtocol bool
+
+	// Shadow, on the LocalToRemote tunnel, is a second
+	// remote that gets a copy of every byte the client
+	// sends to Remote, for trying a new backend out on
+	// live traffic. Its replies are discarded, and if it
+	// fails or falls behind it is dropped; the client
+	// only ever deals with Remote.
+	Shadow AddrHostPort
+
+	// Preface, if set, is written to Remote as soon as
+	// each tunneled connection to it is open, after any
+	// PROXY header and before any of the client's bytes:
+	// a banner or fixed handshake some backends expect.
+	Preface []byte
+
+	// GrantedAddr, on a reverse tunnel, is set once the
+	// sshd is listening, to the address it listens on. If
+	// Listen asked for port 0, this holds the port the
+	// sshd picked.
+	GrantedAddr net.Addr
+}
+
+// parseAddrs parses the addresses of one of the tunnels
+// in LocalToRemotes or RemoteToLocals, called name.
+func (t *TunnelSpec) parseAddrs(name string) error {
+	t.Listen.Title = name + ".Listen"
+	t.Remote.Title = name + ".Remote"
+	t.Shadow.Title = name + ".Shadow"
+	for _, a := range []*AddrHostPort{&t.Listen, &t.Remote, &t.Shadow} {
+		if err := a.ParseAddr(); err != nil {
+			return err
+		}
+	}
+	if t.Listen.Addr == "" || t.Remote.Addr == "" {
+		return fmt.Errorf("incomplete config: %s needs both Listen and Remote", name)
+	}
+	return nil
 }
 
 // DefineFlags should be called before myflags.Parse().
@@ -208,14 +737,26 @@ func (c *SshegoConfig) DefineFlags(fs *flag.FlagSet) {
 
 	fs.StringVar(&c.ConfigPath, "cfg", "", "path to our config file")
 	fs.StringVar(&c.WriteConfigOut, "write-config", "", "(optional) write our config to this path before doing connections")
-	fs.StringVar(&c.LocalToRemote.Listen.Addr, "listen", "", "(forward tunnel) We listen on this host:port locally, securely tunnel that traffic to sshd, then send it cleartext to -remote. The forward tunnel is active if and only if -listen is given. If host starts with a '/' then we treat it as the path to a unix-domain socket to listen on, and the port can be omitted.")
+	fs.StringVar(&c.LocalToRemote.Listen.Addr, "listen", "", "(forward tunnel) We listen on this host:port locally, securely tunnel that traffic to sshd, then send it cleartext to -remote. The forward tunnel is active if and only if -listen is given. If host starts with a '/', or is given as unix:path, then we treat it as the path to a unix-domain socket to listen on, and the port can be omitted. The socket file is removed when we stop.")
 	fs.StringVar(&c.LocalToRemote.Remote.Addr, "remote", "", "(forward tunnel) After traversing the secured forward tunnel, -listen traffic flows in cleartext from the sshd to this host:port. The foward tunnel is active only if -listen is given too.  If host starts with a '/' then we treat it as the path to a unix-domain socket to forward to, and the port can be omitted.")
 
-	fs.StringVar(&c.RemoteToLocal.Listen.Addr, "revlisten", "", "(reverse tunnel) The sshd will listen on this host:port, securely tunnel those connections to the gosshtun application, whence they will cleartext connect to the -revfwd address. The reverse tunnel is active if and only if -revlisten is given.")
-	fs.StringVar(&c.RemoteToLocal.Remote.Addr, "revfwd", "127.0.0.1:22", "(reverse tunnel) The gosshtun application will receive securely tunneled connections from -revlisten on the sshd side, and cleartext forward them to this host:port. For security, it is recommended that this be 127.0.0.1:22, so that the sshd service on your gosshtun host authenticates all remotely initiated traffic. See also the -esshd option which can be used to secure the -revfwd connection as well. The reverse tunnel is active only if -revlisten is given too.")
+	fs.StringVar(&c.LocalToRemote.Shadow.Addr, "shadow", "", "(forward tunnel) also send a copy of all -listen traffic, through the sshd, to this host:port (or unix-domain socket path), discarding its replies. For trying out a new backend alongside -remote.")
+
+	fs.Var(escapedBytes{&c.LocalToRemote.Preface}, "preface", "(forward tunnel) bytes to send to -remote on each new connection before the client's data. Go string escapes such as \\r\\n and \\x00 are understood.")
+
+	fs.StringVar(&c.RemoteToLocal.Listen.Addr, "revlisten", "", "(reverse tunnel) The sshd will listen on this host:port, securely tunnel those connections to the gosshtun application, whence they will cleartext connect to the -revfwd address. The reverse tunnel is active if and only if -revlisten is given. Given port 0, the sshd picks the port, and we log it.")
+	fs.StringVar(&c.RemoteToLocal.Remote.Addr, "revfwd", "127.0.0.1:22", "(reverse tunnel) The gosshtun application will receive securely tunneled connections from -revlisten on the sshd side, and cleartext forward them to this host:port. For security, it is recommended that this be 127.0.0.1:22, so that the sshd service on your gosshtun host authenticates all remotely initiated traffic. See also the -esshd option which can be used to secure the -revfwd connection as well. The reverse tunnel is active only if -revlisten is given too. A path, or unix:path, names a local unix-domain socket to deliver to instead, such as /var/run/docker.sock; it must exist before we start.")
+	fs.StringVar(&c.DynamicSOCKS.Addr, "socks", "", "(dynamic tunnel) listen on this host:port as a SOCKS5 proxy, like ssh -D, tunneling each connection through the sshd to the host:port it requests.")
+
+	fs.Var(escapedBytes{&c.RemoteToLocal.Preface}, "revpreface", "(reverse tunnel) bytes to send to -revfwd on each new connection, after any PROXY header and before the remote client's data. Go string escapes are understood, as for -preface.")
+	fs.BoolVar(&c.RemoteToLocal.ProxyProtocol, "revproxyproto", false, "(reverse tunnel) begin each connection to -revfwd with a PROXY protocol v1 header giving the original client's address.")
 
-	fs.StringVar(&c.SSHdServer.Addr, "sshd", "", "The remote sshd host:port that we establish a secure tunnel to; our public key must have been already deployed there.")
+	fs.StringVar(&c.SSHdServer.Addr, "sshd", "", "The remote sshd host:port that we establish a secure tunnel to; our public key must have been already deployed there. Given as user@host:port, the user overrides -user for this sshd.")
 	fs.BoolVar(&c.AddIfNotKnown, "new", false, "allow connecting to a new sshd host key, and store it for future reference. Otherwise prevent Man-In-The-Middle attacks by rejecting unknown hosts.")
+	fs.BoolVar(&c.NewOKIfKnown, "new-ok-if-known", false, "with -new, only warn, rather than fail, when the sshd host key is already known.")
+	fs.BoolVar(&c.VerifySSHFP, "sshfp", false, "accept an unknown sshd host key if it matches a DNSSEC-validated SSHFP record in DNS. Trusts the AD bit from the resolver, so use a validating resolver you trust, such as one on localhost.")
+	fs.BoolVar(&c.SSHFPPin, "sshfp-pin", false, "(with -sshfp) store a host key verified by SSHFP in the known hosts, as -new would.")
+	fs.StringVar(&c.SSHFPResolver, "sshfp-resolver", "", "(with -sshfp) host:port of the validating DNS resolver to ask. Default is the first nameserver in /etc/resolv.conf.")
 	fs.BoolVar(&c.Debug, "v", false, "verbose debug mode")
 
 	user := os.Getenv("USER")
@@ -223,11 +764,24 @@ func (c *SshegoConfig) DefineFlags(fs *flag.FlagSet) {
 
 	home := os.Getenv("HOME")
 	fs.StringVar(&c.PrivateKeyPath, "key", home+"/.ssh/id_rsa_nopw", "private key for sshd login")
+	fs.BoolVar(&c.UseAgent, "agent", false, "authenticate with the keys held by ssh-agent. The -key file is then read only if -key is given explicitly.")
+	fs.StringVar(&c.AgentSocket, "agent-socket", "", "(with -agent) path to the ssh-agent socket. Default is $SSH_AUTH_SOCK.")
+	fs.DurationVar(&c.TOTPClockOffset, "totp-offset", 0, "add this to our clock when computing the 2FA code, to make up for a known skew against the sshd's clock. Example: -totp-offset=-20s if our clock runs 20 seconds fast.")
 	fs.StringVar(&c.ClientKnownHostsPath, "known-hosts", home+"/.ssh/.sshego.cli.known.hosts", "path to sshego's own known-hosts file")
+	fs.Var(&c.KnownHostsFormat, "known-hosts-format", "format of the -known-hosts file: json, or gob, which is smaller and faster for a large store. A file in the other format is still read, and is rewritten in this one.")
+	fs.DurationVar(&c.ConnectTimeout, "connect-timeout", 0, "give up on a tcp dial to the -sshd that has not connected within this long, rather than wait on the OS, which can take minutes. Example: -connect-timeout=10s. Default 0 means no limit of our own.")
+	fs.Var(commaList{&c.Crypto.Ciphers}, "ciphers", "comma separated ciphers to offer the -sshd, most preferred first. Default: aes128-gcm@openssh.com.")
+	fs.Var(commaList{&c.Crypto.MACs}, "macs", "comma separated MACs to offer the -sshd, most preferred first. Default: the xcryptossh defaults.")
+	fs.Var(commaList{&c.Crypto.KeyExchanges}, "kex", "comma separated key exchange algorithms to offer the -sshd, most preferred first. Default: the xcryptossh defaults.")
+	fs.Var(jumpHostsFlag{&c.JumpHosts}, "jump", "reach the -sshd through these jump hosts (bastions), in order, as with ssh -J. Example: -jump ops@bastion.example.com:22,10.0.0.5. The port defaults to 22.")
+	fs.BoolVar(&c.ValidateOnly, "check", false, "only check that we can reach and log in to the sshd, and that its host key is known, then exit; no tunnels are started.")
+	fs.BoolVar(&c.AutoReconnect, "reconnect", false, "when the ssh connection is lost, reconnect with exponential backoff and bring the tunnels back up, rather than exit.")
+	fs.Float64Var(&c.ReconnectJitter, "reconnect-jitter", DefaultReconnectJitter, "scale each pause between reconnect attempts by a random factor within this fraction of 1, so that many tunnels do not retry in lockstep. 0 turns jitter off.")
 
 	fs.BoolVar(&c.Quiet, "quiet", false, "if -quiet is given, we don't log to stdout as each connection is made. The default is false; we log each tunneled connection.")
 	fs.StringVar(&c.EmbeddedSSHd.Addr, "esshd", "", "(optional) start an in-process embedded sshd (server), binding this host:port, with both RSA key and 2FA checking; useful for securing -revfwd connections. Example: 127.0.0.1:2022")
 	fs.StringVar(&c.EmbeddedSSHdHostDbPath, "esshd-host-db", home+"/.ssh/.sshego.sshd.db", "(only matters if -esshd is given) path to database holding sshd persistent state such as our host key, registered 2FA secrets, etc.")
+	fs.StringVar(&c.EmbeddedSSHdForceCommand, "esshd-force-command", "", "(only matters if -esshd is given) run this command for every session, in place of whatever the client requested. The requested command is available as $SSH_ORIGINAL_COMMAND.")
 	fs.StringVar(&c.AddUser, "adduser", "", "we will add this user to the known users database, generate a password, RSA key, and a 2FA secret/QR code.")
 	fs.StringVar(&c.DelUser, "deluser", "", "we will delete this user from the known users database.")
 	fs.IntVar(&c.SshegoSystemMutexPort, "xport", 33355, "localhost tcp-port used for internal syncrhonization and commands such as adding users to running esshd; we must be able to acquire this exclusively for our use on 127.0.0.1. If negative then we don't bind it.")
@@ -245,6 +799,8 @@ func (c *SshegoConfig) DefineFlags(fs *flag.FlagSet) {
 	c.LocalToRemote.Remote.Title = "remote"
 	c.RemoteToLocal.Listen.Title = "revlisten"
 	c.RemoteToLocal.Remote.Title = "revremote"
+	c.LocalToRemote.Shadow.Title = "shadow"
+	c.DynamicSOCKS.Title = "socks"
 }
 
 // ValidateConfig should be called after myflags.Parse().
@@ -277,6 +833,16 @@ func (c *SshegoConfig) ValidateConfig() error {
 		return fmt.Errorf("incomplete config: have -listen but not -remote")
 	}
 
+	err = c.LocalToRemote.Shadow.ParseAddr()
+	if err != nil {
+		return err
+	}
+
+	err = c.DynamicSOCKS.ParseAddr()
+	if err != nil {
+		return err
+	}
+
 	err = c.RemoteToLocal.Listen.ParseAddr()
 	if err != nil {
 		return err
@@ -291,20 +857,41 @@ func (c *SshegoConfig) ValidateConfig() error {
 		return fmt.Errorf("incomplete config: have -revlisten but not -revfwd")
 	}
 
+	for i := range c.LocalToRemotes {
+		err = c.LocalToRemotes[i].parseAddrs(fmt.Sprintf("LocalToRemotes[%v]", i))
+		if err != nil {
+			return err
+		}
+	}
+	for i := range c.RemoteToLocals {
+		err = c.RemoteToLocals[i].parseAddrs(fmt.Sprintf("RemoteToLocals[%v]", i))
+		if err != nil {
+			return err
+		}
+	}
+
 	if c.RemoteToLocal.Listen.Addr == "" &&
 		c.LocalToRemote.Listen.Addr == "" &&
+		len(c.LocalToRemotes) == 0 &&
+		len(c.RemoteToLocals) == 0 &&
+		c.DynamicSOCKS.Addr == "" &&
 		c.EmbeddedSSHd.Addr == "" &&
 		c.AddUser == "" &&
 		c.DelUser == "" {
 
 		if c.WriteConfigOut == "" {
-			return fmt.Errorf("no tunnels requested; one of -listen or -revlisten or -esshd is required")
+			return fmt.Errorf("no tunnels requested; one of -listen or -revlisten or -socks or -esshd is required")
 		} else {
 			c.WriteConfigOnly = true
 		}
 	}
 
-	err = c.SSHdServer.ParseAddr()
+	err = c.SSHdServer.ParseUserAddr()
+	if err != nil {
+		return err
+	}
+
+	err = c.Crypto.Validate()
 	if err != nil {
 		return err
 	}
@@ -370,22 +957,87 @@ func (c *SshegoConfig) LoadConfig(path string) error {
 				c.LocalToRemote.Listen.Addr = val
 			case "FWD_REMOTE_ADDR":
 				c.LocalToRemote.Remote.Addr = val
+			case "FWD_SHADOW_ADDR":
+				c.LocalToRemote.Shadow.Addr = val
+			case "FWD_PREFACE":
+				c.LocalToRemote.Preface, err = unescapeBytes(val)
+				if err != nil {
+					return fmt.Errorf("bad FWD_PREFACE in config file '%s': %s", path, err)
+				}
+			case "SOCKS_LISTEN_ADDR":
+				c.DynamicSOCKS.Addr = val
 			case "REV_LISTEN_ADDR":
 				c.RemoteToLocal.Listen.Addr = val
 			case "REV_REMOTE_ADDR":
 				c.RemoteToLocal.Remote.Addr = val
+			case "REV_PREFACE":
+				c.RemoteToLocal.Preface, err = unescapeBytes(val)
+				if err != nil {
+					return fmt.Errorf("bad REV_PREFACE in config file '%s': %s", path, err)
+				}
+			case "REV_PROXY_PROTOCOL":
+				c.RemoteToLocal.ProxyProtocol = stringToBool(val)
 			case "SSHD_LOGIN_USERNAME":
 				c.Username = subEnv(val, "USER")
 			case "SSH_PRIVATE_KEY_PATH":
 				c.PrivateKeyPath = subEnv(val, "HOME")
+			case "SSH_USE_AGENT":
+				c.UseAgent = stringToBool(val)
+			case "SSH_AGENT_SOCKET":
+				c.AgentSocket = val
+			case "SSH_HOTP_COUNTER":
+				c.HOTPCounter, err = strconv.ParseUint(val, 10, 64)
+				if err != nil {
+					return fmt.Errorf("bad SSH_HOTP_COUNTER in config file '%s': %s", path, err)
+				}
+			case "SSH_CONNECT_TIMEOUT":
+				c.ConnectTimeout, err = time.ParseDuration(val)
+				if err != nil {
+					return fmt.Errorf("bad SSH_CONNECT_TIMEOUT in config file '%s': %s", path, err)
+				}
+			case "SSH_TOTP_CLOCK_OFFSET":
+				c.TOTPClockOffset, err = time.ParseDuration(val)
+				if err != nil {
+					return fmt.Errorf("bad SSH_TOTP_CLOCK_OFFSET in config file '%s': %s", path, err)
+				}
+			case "SSH_AUTO_RECONNECT":
+				c.AutoReconnect = stringToBool(val)
 			case "SSH_KNOWN_HOSTS_PATH":
 				c.ClientKnownHostsPath = subEnv(val, "HOME")
+			case "SSH_CIPHERS":
+				c.Crypto.Ciphers = splitCommaList(val)
+			case "SSH_MACS":
+				c.Crypto.MACs = splitCommaList(val)
+			case "SSH_KEX":
+				c.Crypto.KeyExchanges = splitCommaList(val)
+			case "SSH_JUMP_HOSTS":
+				c.JumpHosts, err = ParseJumpHosts(val)
+				if err != nil {
+					return fmt.Errorf("bad SSH_JUMP_HOSTS in config file '%s': %s", path, err)
+				}
+			case "SSH_KNOWN_HOSTS_FORMAT":
+				err = c.KnownHostsFormat.Set(val)
+				if err != nil {
+					return fmt.Errorf("bad SSH_KNOWN_HOSTS_FORMAT in config file '%s': %s", path, err)
+				}
+			case "SSH_VERIFY_SSHFP":
+				c.VerifySSHFP = stringToBool(val)
+			case "SSH_SSHFP_PIN":
+				c.SSHFPPin = stringToBool(val)
+			case "SSH_SSHFP_RESOLVER":
+				c.SSHFPResolver = val
 			case "QUIET":
 				c.Quiet = stringToBool(val)
 			case "EMBEDDED_SSHD_HOST_DB_PATH":
 				c.EmbeddedSSHdHostDbPath = subEnv(val, "HOME")
 			case "EMBEDDED_SSHD_LISTEN_ADDR":
 				c.EmbeddedSSHd.Addr = val
+			case "EMBEDDED_SSHD_FORCE_COMMAND":
+				cmd, err := unescapeBytes(val)
+				if err != nil {
+					return fmt.Errorf("bad EMBEDDED_SSHD_FORCE_COMMAND in config file '%s': %s", path, err)
+				}
+				c.EmbeddedSSHdForceCommand = string(cmd)
 			case "EMBEDDED_SSHD_COMMAND_XPORT":
 				c.SshegoSystemMutexPortString = val
 				prt, err := strconv.Atoi(val)
@@ -434,16 +1086,66 @@ func (c *SshegoConfig) SaveConfig(fd io.Writer) error {
 	fmt.Fprintf(fd, "SSHD_ADDR=\"%s\"\n", c.SSHdServer.Addr)
 	fmt.Fprintf(fd, "FWD_LISTEN_ADDR=\"%s\"\n", c.LocalToRemote.Listen.Addr)
 	fmt.Fprintf(fd, "FWD_REMOTE_ADDR=\"%s\"\n", c.LocalToRemote.Remote.Addr)
+	if c.LocalToRemote.Shadow.Addr != "" {
+		fmt.Fprintf(fd, "FWD_SHADOW_ADDR=\"%s\"\n", c.LocalToRemote.Shadow.Addr)
+	}
+	if len(c.LocalToRemote.Preface) > 0 {
+		fmt.Fprintf(fd, "FWD_PREFACE=\"%s\"\n", escapeBytes(c.LocalToRemote.Preface))
+	}
+	if c.DynamicSOCKS.Addr != "" {
+		fmt.Fprintf(fd, "SOCKS_LISTEN_ADDR=\"%s\"\n", c.DynamicSOCKS.Addr)
+	}
 	fmt.Fprintf(fd, "REV_LISTEN_ADDR=\"%s\"\n", c.RemoteToLocal.Listen.Addr)
 	fmt.Fprintf(fd, "REV_REMOTE_ADDR=\"%s\"\n", c.RemoteToLocal.Remote.Addr)
+	if len(c.RemoteToLocal.Preface) > 0 {
+		fmt.Fprintf(fd, "REV_PREFACE=\"%s\"\n", escapeBytes(c.RemoteToLocal.Preface))
+	}
+	fmt.Fprintf(fd, "REV_PROXY_PROTOCOL=\"%s\"\n", boolToString(c.RemoteToLocal.ProxyProtocol))
 	fmt.Fprintf(fd, "SSHD_LOGIN_USERNAME=\"%s\"\n", c.Username)
 	fmt.Fprintf(fd, "SSH_PRIVATE_KEY_PATH=\"%s\"\n", c.PrivateKeyPath)
+	if c.UseAgent {
+		fmt.Fprintf(fd, "SSH_USE_AGENT=\"%s\"\n", boolToString(c.UseAgent))
+	}
+	if c.AgentSocket != "" {
+		fmt.Fprintf(fd, "SSH_AGENT_SOCKET=\"%s\"\n", c.AgentSocket)
+	}
+	if c.HOTPCounter != 0 {
+		fmt.Fprintf(fd, "SSH_HOTP_COUNTER=\"%v\"\n", c.HOTPCounter)
+	}
+	if c.ConnectTimeout != 0 {
+		fmt.Fprintf(fd, "SSH_CONNECT_TIMEOUT=\"%v\"\n", c.ConnectTimeout)
+	}
+	if c.TOTPClockOffset != 0 {
+		fmt.Fprintf(fd, "SSH_TOTP_CLOCK_OFFSET=\"%v\"\n", c.TOTPClockOffset)
+	}
+	if c.AutoReconnect {
+		fmt.Fprintf(fd, "SSH_AUTO_RECONNECT=\"%s\"\n", boolToString(c.AutoReconnect))
+	}
 	fmt.Fprintf(fd, "SSH_KNOWN_HOSTS_PATH=\"%s\"\n", c.ClientKnownHostsPath)
+	if len(c.Crypto.Ciphers) > 0 {
+		fmt.Fprintf(fd, "SSH_CIPHERS=\"%s\"\n", strings.Join(c.Crypto.Ciphers, ","))
+	}
+	if len(c.Crypto.MACs) > 0 {
+		fmt.Fprintf(fd, "SSH_MACS=\"%s\"\n", strings.Join(c.Crypto.MACs, ","))
+	}
+	if len(c.Crypto.KeyExchanges) > 0 {
+		fmt.Fprintf(fd, "SSH_KEX=\"%s\"\n", strings.Join(c.Crypto.KeyExchanges, ","))
+	}
+	if len(c.JumpHosts) > 0 {
+		fmt.Fprintf(fd, "SSH_JUMP_HOSTS=\"%s\"\n", jumpHostsString(c.JumpHosts))
+	}
+	if c.KnownHostsFormat != KHJson {
+		fmt.Fprintf(fd, "SSH_KNOWN_HOSTS_FORMAT=\"%s\"\n", c.KnownHostsFormat)
+	}
+	fmt.Fprintf(fd, "SSH_VERIFY_SSHFP=\"%s\"\n", boolToString(c.VerifySSHFP))
+	fmt.Fprintf(fd, "SSH_SSHFP_PIN=\"%s\"\n", boolToString(c.SSHFPPin))
+	fmt.Fprintf(fd, "SSH_SSHFP_RESOLVER=\"%s\"\n", c.SSHFPResolver)
 	fmt.Fprintf(fd, "QUIET=\"%s\"\n", boolToString(c.Quiet))
 
 	fmt.Fprintf(fd, "#\n# optional sshd server config\n#\n")
 	fmt.Fprintf(fd, "EMBEDDED_SSHD_HOST_DB_PATH=\"%s\"\n", c.EmbeddedSSHdHostDbPath)
 	fmt.Fprintf(fd, "EMBEDDED_SSHD_LISTEN_ADDR=\"%s\"\n", c.EmbeddedSSHd.Addr)
+	fmt.Fprintf(fd, "EMBEDDED_SSHD_FORCE_COMMAND=\"%s\"\n", escapeBytes([]byte(c.EmbeddedSSHdForceCommand)))
 	c.SshegoSystemMutexPortString = fmt.Sprintf(
 		"%v", c.SshegoSystemMutexPort)
 	fmt.Fprintf(fd, "EMBEDDED_SSHD_COMMAND_XPORT=\"%s\"\n", c.SshegoSystemMutexPortString)
@@ -461,6 +1163,83 @@ func (c *SshegoConfig) SaveConfig(fd io.Writer) error {
 	return err
 }
 
+// hotpSaveMu serializes saveHOTPCounter's rewrites.
+var hotpSaveMu sync.Mutex
+
+// saveHOTPCounter writes *counter, as SSH_HOTP_COUNTER,
+// into the config file at path, leaving its other lines
+// be. The file is replaced atomically, so that a crash
+// cannot lose the counter and have a code answered twice.
+// If path is a symlink, the file it points to is the one
+// replaced, and that file keeps its mode.
+func saveHOTPCounter(path string, counter *uint64) error {
+	hotpSaveMu.Lock()
+	defer hotpSaveMu.Unlock()
+
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	by, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// read under the lock, so the last
+	// write always has the latest counter.
+	line := fmt.Sprintf("SSH_HOTP_COUNTER=\"%v\"", atomic.LoadUint64(counter))
+	lines := strings.Split(strings.TrimRight(string(by), "\n"), "\n")
+	found := false
+	for i, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "SSH_HOTP_COUNTER=") {
+			lines[i] = line
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, line)
+	}
+	return writeAtomic(path, createWithMode(fi.Mode().Perm()), func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+		return err
+	})
+}
+
+// escapedBytes is a flag.Value for bytes written
+// as the inside of a Go string literal, so that
+// "HELO\r\n" or "\x00\x01" can be given.
+type escapedBytes struct{ b *[]byte }
+
+func (e escapedBytes) String() string {
+	if e.b == nil {
+		return ""
+	}
+	return escapeBytes(*e.b)
+}
+
+func (e escapedBytes) Set(s string) (err error) {
+	*e.b, err = unescapeBytes(s)
+	return
+}
+
+// escapeBytes renders b as the inside of a Go string
+// literal; unescapeBytes reverses it.
+func escapeBytes(b []byte) string {
+	q := strconv.Quote(string(b))
+	return q[1 : len(q)-1]
+}
+
+func unescapeBytes(s string) ([]byte, error) {
+	u, err := strconv.Unquote(`"` + s + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("could not unescape '%s': %s", s, err)
+	}
+	return []byte(u), nil
+}
+
 func trim(s string) string {
 	if s == "" {
 		return s
@@ -0,0 +1,39 @@
+package sshego
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test123SSHdAddrCarriesItsOwnUser(t *testing.T) {
+
+	cv.Convey("An -sshd given as user@host:port should log in as that user, falling back to -user when no user is given with the address.", t, func() {
+		cfg := NewSshegoConfig()
+		cfg.Username = "alice"
+
+		cfg.SSHdServer.Addr = "10.0.0.5:2222"
+		cv.So(cfg.SSHdServer.ParseUserAddr(), cv.ShouldBeNil)
+		cv.So(cfg.SSHdLogin(), cv.ShouldEqual, "alice")
+
+		cfg.SSHdServer.Addr = "bastion-ops@10.0.0.5:2222"
+		cv.So(cfg.SSHdServer.ParseUserAddr(), cv.ShouldBeNil)
+		cv.So(cfg.SSHdServer.Host, cv.ShouldEqual, "10.0.0.5")
+		cv.So(cfg.SSHdServer.Port, cv.ShouldEqual, 2222)
+		cv.So(cfg.SSHdLogin(), cv.ShouldEqual, "bastion-ops")
+
+		// only the last '@' separates the user from the host.
+		cfg.SSHdServer.Addr = "bob@example.com@[::1]:22"
+		cv.So(cfg.SSHdServer.ParseUserAddr(), cv.ShouldBeNil)
+		cv.So(cfg.SSHdServer.Host, cv.ShouldEqual, "::1")
+		cv.So(cfg.SSHdLogin(), cv.ShouldEqual, "bob@example.com")
+
+		cfg.SSHdServer.Addr = "10.0.0.6:22"
+		cv.So(cfg.SSHdServer.ParseUserAddr(), cv.ShouldBeNil)
+		cv.So(cfg.SSHdLogin(), cv.ShouldEqual, "alice")
+
+		// other addresses take no user@.
+		cfg.LocalToRemote.Listen.Addr = "bob@127.0.0.1:8080"
+		cv.So(cfg.LocalToRemote.Listen.ParseAddr(), cv.ShouldNotBeNil)
+	})
+}
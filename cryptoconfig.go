@@ -0,0 +1,97 @@
+package sshego
+
+import (
+	"fmt"
+	"strings"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// CryptoConfig restricts the algorithms SSHConnect offers
+// the sshd, in order of preference, say to meet a policy
+// that forbids legacy ciphers. An empty list leaves that
+// kind as it was: aes128-gcm@openssh.com alone for the
+// cipher, and the xcryptossh defaults for the others.
+// See ssh.AllAlgorithms() for the names that can be given.
+type CryptoConfig struct {
+	Ciphers      []string
+	MACs         []string
+	KeyExchanges []string
+}
+
+// ErrUnsupportedAlgorithm is wrapped in the error from
+// CryptoConfig.Validate(), and so from SSHConnect(), for
+// an algorithm that xcryptossh cannot negotiate.
+var ErrUnsupportedAlgorithm = fmt.Errorf("unsupported algorithm")
+
+// Validate checks that every algorithm named
+// in c is one that xcryptossh supports.
+func (c *CryptoConfig) Validate() error {
+	all := ssh.AllAlgorithms()
+	check := func(kind string, names, known []string) error {
+		for _, name := range names {
+			if !stringInSlice(name, known) {
+				return fmt.Errorf("%w: %s '%s'; xcryptossh supports: %s", ErrUnsupportedAlgorithm, kind, name, strings.Join(known, ", "))
+			}
+		}
+		return nil
+	}
+	if err := check("cipher", c.Ciphers, all.Ciphers); err != nil {
+		return err
+	}
+	if err := check("MAC", c.MACs, all.MACs); err != nil {
+		return err
+	}
+	return check("key exchange", c.KeyExchanges, all.KeyExchanges)
+}
+
+// apply sets the algorithms of sc from c.
+func (c *CryptoConfig) apply(sc *ssh.Config) {
+	sc.Ciphers = getCiphers()
+	if len(c.Ciphers) > 0 {
+		sc.Ciphers = c.Ciphers
+	}
+	if len(c.MACs) > 0 {
+		sc.MACs = c.MACs
+	}
+	if len(c.KeyExchanges) > 0 {
+		sc.KeyExchanges = c.KeyExchanges
+	}
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// commaList is a flag.Value for a comma
+// separated list, such as -ciphers.
+type commaList struct{ list *[]string }
+
+func (c commaList) String() string {
+	if c.list == nil {
+		return ""
+	}
+	return strings.Join(*c.list, ",")
+}
+
+func (c commaList) Set(s string) error {
+	*c.list = splitCommaList(s)
+	return nil
+}
+
+// splitCommaList splits s at commas, dropping
+// spaces and empty entries.
+func splitCommaList(s string) []string {
+	var list []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+	return list
+}
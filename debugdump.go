@@ -0,0 +1,175 @@
+package sshego
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// liveTunnels tracks the forward and reverse
+// connections of a config that are still running,
+// for DebugDump.
+type liveTunnels struct {
+	mut sync.Mutex
+	m   map[*shovelPair]*liveTunnel
+}
+
+type liveTunnel struct {
+	kind          string
+	local, remote net.Addr
+	started       time.Time
+
+	// up carries bytes toward the sshd, down back from it.
+	up, down *shovel
+	sp       *shovelPair
+}
+
+// trackTunnel registers sp, already started, until it is done.
+func (cfg *SshegoConfig) trackTunnel(kind string, local, remote net.Addr, up, down *shovel, sp *shovelPair) {
+	lt := &liveTunnel{
+		kind:    kind,
+		local:   local,
+		remote:  remote,
+		started: time.Now(),
+		up:      up,
+		down:    down,
+		sp:      sp,
+	}
+	t := &cfg.live
+	t.mut.Lock()
+	if t.m == nil {
+		t.m = make(map[*shovelPair]*liveTunnel)
+	}
+	t.m[sp] = lt
+	t.mut.Unlock()
+	go func() {
+		<-sp.Halt.DoneChan()
+		t.mut.Lock()
+		delete(t.m, sp)
+		t.mut.Unlock()
+	}()
+}
+
+// CloseTunnels stops every forward, reverse and SOCKS
+// connection open under cfg, the ones that DebugDump and
+// Topology list, closing both ends of each. The listeners
+// and the ssh connection are left up. It returns how many
+// connections it closed.
+func (cfg *SshegoConfig) CloseTunnels() int {
+	tunnels := cfg.live.snapshot()
+	for _, lt := range tunnels {
+		lt.sp.Stop()
+	}
+	return len(tunnels)
+}
+
+// snapshot returns the open tunnel connections, oldest first.
+func (t *liveTunnels) snapshot() []*liveTunnel {
+	t.mut.Lock()
+	tunnels := make([]*liveTunnel, 0, len(t.m))
+	for _, lt := range t.m {
+		tunnels = append(tunnels, lt)
+	}
+	t.mut.Unlock()
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].started.Before(tunnels[j].started)
+	})
+	return tunnels
+}
+
+// state is "running", or "stopping" once a
+// shutdown of the connection has begun.
+func (lt *liveTunnel) state() string {
+	if lt.sp.Halt.IsStopRequested() {
+		return "stopping"
+	}
+	return "running"
+}
+
+// DebugDump describes what cfg is doing right now, for a bug
+// report: the tunnels configured, the ssh connection, the
+// forward listener, the Stats, and each forward and reverse
+// connection still open, with its addresses, age, byte counts
+// and state. It never blocks on a connect in progress.
+func (cfg *SshegoConfig) DebugDump() string {
+	var b bytes.Buffer
+	now := time.Now()
+	fmt.Fprintf(&b, "sshego DebugDump of config '%s' at %s\n", cfg.Nickname, now.Format(time.RFC3339Nano))
+	fmt.Fprintf(&b, "  sshd: %s\n", cfg.SSHdServer.Addr)
+	if cfg.LocalToRemote.Listen.Addr != "" {
+		fmt.Fprintf(&b, "  forward: listen %s -> remote %s\n", cfg.LocalToRemote.Listen.Addr, cfg.LocalToRemote.Remote.Addr)
+	}
+	for _, spec := range cfg.LocalToRemotes {
+		fmt.Fprintf(&b, "  forward: listen %s -> remote %s\n", spec.Listen.Addr, spec.Remote.Addr)
+	}
+	if cfg.DynamicSOCKS.Addr != "" {
+		fmt.Fprintf(&b, "  socks: listen %s\n", cfg.DynamicSOCKS.Addr)
+	}
+	if cfg.RemoteToLocal.Listen.Addr != "" {
+		fmt.Fprintf(&b, "  reverse: revlisten %s -> revfwd %s\n", cfg.RemoteToLocal.Listen.Addr, cfg.RemoteToLocal.Remote.Addr)
+	}
+	for _, spec := range cfg.RemoteToLocals {
+		fmt.Fprintf(&b, "  reverse: revlisten %s -> revfwd %s\n", spec.Listen.Addr, spec.Remote.Addr)
+	}
+
+	// SSHConnect holds cfg.Mut throughout; don't wait on it.
+	if cfg.Mut.TryLock() {
+		cli, nc := cfg.SshClient, cfg.Underlying
+		cfg.Mut.Unlock()
+		switch {
+		case cli == nil:
+			fmt.Fprintf(&b, "  ssh client: not connected\n")
+		case nc != nil:
+			fmt.Fprintf(&b, "  ssh client: connected, %s -> %s, server version '%s'\n",
+				nc.LocalAddr(), nc.RemoteAddr(), cli.ServerVersion())
+		default:
+			fmt.Fprintf(&b, "  ssh client: connected, server version '%s'\n", cli.ServerVersion())
+		}
+	} else {
+		fmt.Fprintf(&b, "  ssh client: SSHConnect in progress\n")
+	}
+	fmt.Fprintf(&b, "  ssh clients open in process: %v (max %v)\n", OpenClients(), MaxClients())
+
+	cfg.fwdLnMu.Lock()
+	if cfg.fwdLn != nil {
+		fmt.Fprintf(&b, "  forward listener: %s\n", cfg.fwdLn.Addr())
+	}
+	cfg.fwdLnMu.Unlock()
+	specs := cfg.LocalToRemotes
+	if cfg.LocalToRemote.Listen.Addr != "" {
+		specs = append([]TunnelSpec{cfg.LocalToRemote}, specs...)
+	}
+	for i := range specs {
+		if open, fails := cfg.breakerOpen(&specs[i], now); open > 0 {
+			fmt.Fprintf(&b, "  forward breaker on %s: tripped, accepting again in %v\n", specs[i].Listen.Addr, open)
+		} else if fails > 0 {
+			fmt.Fprintf(&b, "  forward breaker on %s: %v dial failure(s) in a row\n", specs[i].Listen.Addr, fails)
+		}
+	}
+	if cfg.MaxConcurrentForwards > 0 {
+		cfg.fwdSlots.mut.Lock()
+		fmt.Fprintf(&b, "  forwards open: %v (max %v)\n", cfg.fwdSlots.open, cfg.MaxConcurrentForwards)
+		cfg.fwdSlots.mut.Unlock()
+	}
+
+	fmt.Fprintf(&b, "  %s\n", cfg.Stats())
+
+	tunnels := cfg.live.snapshot()
+	fmt.Fprintf(&b, "  open tunnel connections: %v\n", len(tunnels))
+	for i, lt := range tunnels {
+		fmt.Fprintf(&b, "    %v: %s %s -> %s, %s, up %v bytes, down %v bytes, age %v",
+			i, lt.kind, lt.local, lt.remote, lt.state(),
+			atomic.LoadInt64(&lt.up.written), atomic.LoadInt64(&lt.down.written),
+			now.Sub(lt.started).Round(time.Millisecond))
+		if lt.up.active != nil {
+			last := time.Unix(0, atomic.LoadInt64(lt.up.active))
+			fmt.Fprintf(&b, ", idle %v of %v", now.Sub(last).Round(time.Millisecond), lt.up.idle)
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	return b.String()
+}
@@ -2,9 +2,8 @@ package sshego
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"net"
+	"strconv"
 
 	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
@@ -25,16 +24,24 @@ const minus2_uint32 uint32 = 0xFFFFFFFE
 const minus10_uint32 uint32 = 0xFFFFFFF6
 
 // server side: handle channel type "direct-tcpip"  - RFC 4254 7.2
-// ca can be nil.
-func handleDirectTcp(ctx context.Context, parentHalt *ssh.Halter, newChannel ssh.NewChannel, ca *ConnectionAlert) {
-	pp("handleDirectTcp called!")
+// ca and veto can be nil.
+func (cfg *SshegoConfig) handleDirectTcp(ctx context.Context, parentHalt *ssh.Halter, newChannel ssh.NewChannel, ca *ConnectionAlert, user string, veto func(user, target string) error) {
+	cfg.logger().Debugf("handleDirectTcp called!")
 
 	p := &channelOpenDirectMsg{}
 	ssh.Unmarshal(newChannel.ExtraData(), p)
-	targetAddr := fmt.Sprintf("%s:%d", p.Rhost, p.Rport)
-	log.Printf("direct-tcpip got channelOpenDirectMsg request to destination %s",
+	targetAddr := net.JoinHostPort(p.Rhost, strconv.Itoa(int(p.Rport)))
+	cfg.logger().Infof("direct-tcpip got channelOpenDirectMsg request to destination %s",
 		targetAddr)
 
+	if veto != nil {
+		if err := veto(user, targetAddr); err != nil {
+			cfg.logger().Infof("direct-tcpip to %s for user '%s' rejected: %s", targetAddr, user, err)
+			newChannel.Reject(ssh.Prohibited, err.Error())
+			return
+		}
+	}
+
 	channel, req, err := newChannel.Accept() // (Channel, <-chan *Request, error)
 	panicOn(err)
 	go ssh.DiscardRequests(ctx, req, parentHalt)
@@ -43,7 +50,6 @@ func handleDirectTcp(ctx context.Context, parentHalt *ssh.Halter, newChannel ssh
 
 		var targetConn net.Conn
 		var err error
-		addr := fmt.Sprintf("%s:%d", p.Rhost, p.Rport)
 		switch port {
 		case minus2_uint32:
 			// unix domain request
@@ -65,10 +71,10 @@ func handleDirectTcp(ctx context.Context, parentHalt *ssh.Halter, newChannel ssh
 			targetConn, err = net.Dial("tcp", targetAddr)
 		}
 		if err != nil {
-			log.Printf("sshd direct.go could not forward connection to addr: '%s'", addr)
+			cfg.logger().Errorf("sshd direct.go could not forward connection to addr: '%s'", targetAddr)
 			return
 		}
-		log.Printf("sshd direct.go forwarding direct connection to addr: '%s'", addr)
+		cfg.logger().Infof("sshd direct.go forwarding direct connection to addr: '%s'", targetAddr)
 
 		sp := newShovelPair(false)
 		parentHalt.AddDownstream(sp.Halt)
@@ -76,6 +82,60 @@ func handleDirectTcp(ctx context.Context, parentHalt *ssh.Halter, newChannel ssh
 	}(channel, p.Rhost, p.Rport)
 }
 
+// streamLocalOpenDirectMsg is the payload of a
+// "direct-streamlocal@openssh.com" channel open, per
+// section 2.4 of openssh-portable/PROTOCOL.
+type streamLocalOpenDirectMsg struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// server side: handle channel type "direct-streamlocal@openssh.com",
+// the unix-domain socket analog of "direct-tcpip".
+func (cfg *SshegoConfig) handleDirectStreamLocal(ctx context.Context, parentHalt *ssh.Halter, newChannel ssh.NewChannel, user string, veto func(user, target string) error) {
+
+	if !cfg.AllowDirectStreamLocal {
+		cfg.logger().Infof("direct-streamlocal for user '%s' rejected: AllowDirectStreamLocal is off", user)
+		newChannel.Reject(ssh.Prohibited, "direct-streamlocal is not allowed")
+		return
+	}
+
+	p := &streamLocalOpenDirectMsg{}
+	err := ssh.Unmarshal(newChannel.ExtraData(), p)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "could not parse direct-streamlocal request")
+		return
+	}
+	cfg.logger().Infof("direct-streamlocal request to unix domain socket '%s'", p.SocketPath)
+
+	if veto != nil {
+		if err := veto(user, p.SocketPath); err != nil {
+			cfg.logger().Infof("direct-streamlocal to '%s' for user '%s' rejected: %s", p.SocketPath, user, err)
+			newChannel.Reject(ssh.Prohibited, err.Error())
+			return
+		}
+	}
+
+	targetConn, err := net.Dial("unix", p.SocketPath)
+	if err != nil {
+		cfg.logger().Errorf("sshd direct.go could not forward connection to unix domain socket '%s': %s", p.SocketPath, err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, req, err := newChannel.Accept()
+	if err != nil {
+		targetConn.Close()
+		return
+	}
+	go ssh.DiscardRequests(ctx, req, parentHalt)
+
+	sp := newShovelPair(false)
+	parentHalt.AddDownstream(sp.Halt)
+	sp.Start(targetConn, channel, "socketBehindSshd<-fromDirectClient", "fromDirectClient<-socketBehindSshd")
+}
+
 // client side
 func dialDirect(ctx context.Context, c *ssh.Client, laddr string, lport int, raddr string, rport int, parentHalt *ssh.Halter) (ssh.Channel, error) {
 	msg := channelOpenDirectMsg{
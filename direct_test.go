@@ -0,0 +1,134 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test124DirectTCPIPHandlerCanVetoForwards(t *testing.T) {
+
+	cv.Convey("The -esshd should call DirectTCPIPHandler with the user and target of each direct-tcpip open, reject the channel when it returns an error, and forward as usual when it returns nil.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		tcpSrvLsn, tcpSrvPort := GetAvailPort()
+		defer tcpSrvLsn.Close()
+		serverDone := ssh.NewHalter()
+		StartBackgroundTestTcpServer(serverDone, payloadByteCount, confirmationPayload, confirmationReply, tcpSrvLsn, nil)
+		allowed := fmt.Sprintf("127.0.0.1:%v", tcpSrvPort)
+		denied := "10.9.8.7:22"
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		var mut sync.Mutex
+		var seen []string
+		s.SrvCfg.DirectTCPIPHandler = func(user, target string) error {
+			mut.Lock()
+			seen = append(seen, user+" "+target)
+			mut.Unlock()
+			if target == denied {
+				return fmt.Errorf("target not on the audit allowlist")
+			}
+			return nil
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		_, err = cli.Dial("tcp", denied)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "target not on the audit allowlist")
+
+		ch, err := cli.Dial("tcp", allowed)
+		cv.So(err, cv.ShouldBeNil)
+		_, err = ch.Write([]byte(confirmationPayload))
+		cv.So(err, cv.ShouldBeNil)
+		rep := make([]byte, payloadByteCount)
+		_, err = io.ReadFull(ch, rep)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(rep), cv.ShouldEqual, confirmationReply)
+		ch.Close()
+
+		mut.Lock()
+		cv.So(seen, cv.ShouldResemble, []string{s.Mylogin + " " + denied, s.Mylogin + " " + allowed})
+		mut.Unlock()
+
+		serverDone.RequestStop()
+		<-serverDone.DoneChan()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test129ChannelsCountTheirPayloadBytes(t *testing.T) {
+
+	cv.Convey("An ssh.Channel should count the payload bytes it reads and writes, each way separately, as seen through BytesRead() and BytesWritten().", t, func() {
+
+		up, down := 10, 30
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		go func() {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			b := make([]byte, up)
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+			c.Write([]byte(RandomString(down)))
+			io.Copy(io.Discard, c)
+		}()
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		conn, err := cli.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", targetPort))
+		cv.So(err, cv.ShouldBeNil)
+		ch, ok := conn.(ssh.Channel)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(ch.BytesRead(), cv.ShouldEqual, 0)
+		cv.So(ch.BytesWritten(), cv.ShouldEqual, 0)
+
+		_, err = ch.Write([]byte(RandomString(up)))
+		cv.So(err, cv.ShouldBeNil)
+		_, err = io.ReadFull(ch, make([]byte, down))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ch.BytesWritten(), cv.ShouldEqual, up)
+		cv.So(ch.BytesRead(), cv.ShouldEqual, down)
+		ch.Close()
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
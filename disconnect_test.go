@@ -0,0 +1,83 @@
+package sshego
+
+import (
+	"context"
+	cryrand "crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test121WaitSurfacesDisconnectReason(t *testing.T) {
+
+	cv.Convey("When the sshd sends SSH_MSG_DISCONNECT, the client's Wait() should return an error carrying the reason code and message, and DisconnectReason should take it apart; a plain network error should not look like a disconnect.", t, func() {
+
+		priv, err := rsa.GenerateKey(cryrand.Reader, 2048)
+		panicOn(err)
+		hostKey, err := ssh.NewSignerFromKey(priv)
+		panicOn(err)
+
+		srvHalt := ssh.NewHalter()
+		srvCfg := &ssh.ServerConfig{
+			NoClientAuth: true,
+			Config:       ssh.Config{Halt: srvHalt},
+		}
+		srvCfg.AddHostKey(hostKey)
+
+		lsn, err := net.Listen("tcp", "127.0.0.1:0")
+		panicOn(err)
+		defer lsn.Close()
+
+		ctx := context.Background()
+		kicked := make(chan error, 1)
+		go func() {
+			nc, err := lsn.Accept()
+			if err != nil {
+				kicked <- err
+				return
+			}
+			sc, _, reqs, err := ssh.NewServerConn(ctx, nc, srvCfg)
+			if err != nil {
+				kicked <- err
+				return
+			}
+			go ssh.DiscardRequests(ctx, reqs, srvHalt)
+			kicked <- sc.Conn.(interface {
+				Disconnect(reason uint32, message string) error
+			}).Disconnect(ssh.DisconnectByApplication, "kicked by admin")
+		}()
+
+		cliHalt := ssh.NewHalter()
+		defer cliHalt.RequestStop()
+		cli, err := ssh.Dial(ctx, "tcp", lsn.Addr().String(), &ssh.ClientConfig{
+			User:            "alice",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Config:          ssh.Config{Halt: cliHalt},
+		})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(<-kicked, cv.ShouldBeNil)
+
+		waitErr := make(chan error, 1)
+		go func() { waitErr <- cli.Wait() }()
+		select {
+		case err = <-waitErr:
+		case <-time.After(10 * time.Second):
+			panic("Wait() never returned after the disconnect")
+		}
+		reason, msg, ok := ssh.DisconnectReason(err)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(reason, cv.ShouldEqual, ssh.DisconnectByApplication)
+		cv.So(msg, cv.ShouldEqual, "kicked by admin")
+		cv.So(err.Error(), cv.ShouldContainSubstring, "kicked by admin")
+
+		_, _, ok = ssh.DisconnectReason(&net.OpError{Op: "read", Err: fmt.Errorf("connection reset by peer")})
+		cv.So(ok, cv.ShouldBeFalse)
+
+		srvHalt.RequestStop()
+	})
+}
@@ -0,0 +1,59 @@
+package sshego
+
+import (
+	"context"
+	"sync"
+)
+
+// firstAccept tracks whether the forward listener has
+// accepted its first connection yet.
+type firstAccept struct {
+	mut  sync.Mutex
+	ch   chan struct{}
+	done bool
+}
+
+func (f *firstAccept) channel() chan struct{} {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.ch == nil {
+		f.ch = make(chan struct{})
+	}
+	return f.ch
+}
+
+// note returns true only on the first call.
+func (f *firstAccept) note() bool {
+	ch := f.channel()
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.done {
+		return false
+	}
+	f.done = true
+	close(ch)
+	return true
+}
+
+// WaitFirstForwardConn blocks until the forward
+// listener (cfg.LocalToRemote) has accepted its first
+// connection, or until ctx is done. It may be called
+// before SSHConnect(). Useful to sequence a service
+// startup that needs the tunnel to be in actual use,
+// not just listening.
+func (cfg *SshegoConfig) WaitFirstForwardConn(ctx context.Context) error {
+	select {
+	case <-cfg.firstFwdAccept.channel():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// noteForwardAccept is called by the forward listener
+// on every accept; only the first one counts.
+func (cfg *SshegoConfig) noteForwardAccept() {
+	if cfg.firstFwdAccept.note() && cfg.OnFirstAccept != nil {
+		cfg.OnFirstAccept(cfg.Nickname)
+	}
+}
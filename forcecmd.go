@@ -0,0 +1,93 @@
+package sshego
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// handleForcedCommand serves a "session" channel when
+// cfg.EmbeddedSSHdForceCommand is set. Like OpenSSH's ForceCommand,
+// whatever the client asked for -- a shell or an exec
+// of some command -- we run cfg.EmbeddedSSHdForceCommand instead,
+// with the client's requested command (if any) in
+// the SSH_ORIGINAL_COMMAND environment variable.
+func (cfg *SshegoConfig) handleForcedCommand(connection ssh.Channel, requests <-chan *ssh.Request) {
+	var once sync.Once
+	for req := range requests {
+		switch req.Type {
+		case "exec", "shell":
+			var orig string
+			if req.Type == "exec" {
+				var payload struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				orig = payload.Command
+			}
+			started := false
+			once.Do(func() {
+				started = true
+				req.Reply(true, nil)
+				go cfg.runForcedCommand(connection, orig)
+			})
+			if !started {
+				// only one command per session.
+				req.Reply(false, nil)
+			}
+		case "pty-req":
+			// accepted, but the forced command
+			// runs without a pty in any case.
+			req.Reply(true, nil)
+		case "env":
+			// refused: variables such as LD_PRELOAD or
+			// BASH_ENV would let the client change what
+			// the forced command does.
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// runForcedCommand runs cfg.EmbeddedSSHdForceCommand with its stdin,
+// stdout, and stderr attached to connection, reports the
+// exit status to the client, and then closes connection.
+func (cfg *SshegoConfig) runForcedCommand(connection ssh.Channel, orig string) {
+	defer connection.Close()
+
+	cfg.logger().Infof("esshd: running ForceCommand '%s' in place of requested command '%s'", cfg.EmbeddedSSHdForceCommand, orig)
+	cmd := exec.Command("bash", "-c", cfg.EmbeddedSSHdForceCommand)
+	cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+orig)
+	cmd.Stdout = connection
+	cmd.Stderr = connection.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cfg.logger().Errorf("esshd: could not get stdin for ForceCommand: '%s'", err)
+		return
+	}
+	go func() {
+		io.Copy(stdin, connection)
+		stdin.Close()
+	}()
+
+	status := uint32(0)
+	err = cmd.Run()
+	if err != nil {
+		status = 255
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = uint32(exitErr.ExitCode())
+		} else {
+			cfg.logger().Errorf("esshd: ForceCommand '%s' failed: '%s'", cfg.EmbeddedSSHdForceCommand, err)
+		}
+	}
+	connection.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
@@ -0,0 +1,91 @@
+package sshego
+
+import (
+	"context"
+	"sync"
+)
+
+// forwardSlots counts the forwarded connections open,
+// against SshegoConfig.MaxConcurrentForwards.
+type forwardSlots struct {
+	mut  sync.Mutex
+	open int
+
+	// freed, if not nil, is closed when
+	// a slot is given back.
+	freed chan struct{}
+}
+
+// waitFree waits until fewer than max slots are taken.
+func (s *forwardSlots) waitFree(ctx context.Context, max int) error {
+	s.mut.Lock()
+	for s.open >= max {
+		if s.freed == nil {
+			s.freed = make(chan struct{})
+		}
+		freed := s.freed
+		s.mut.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.mut.Lock()
+	}
+	s.mut.Unlock()
+	return nil
+}
+
+// take takes a slot, if fewer than max are taken
+// (any number, for max <= 0). Otherwise it waits
+// for one if wait is set, or returns false.
+func (s *forwardSlots) take(ctx context.Context, max int, wait bool) (bool, error) {
+	for {
+		if max > 0 && wait {
+			if err := s.waitFree(ctx, max); err != nil {
+				return false, err
+			}
+		}
+		s.mut.Lock()
+		if max <= 0 || s.open < max {
+			s.open++
+			s.mut.Unlock()
+			return true, nil
+		}
+		s.mut.Unlock()
+		if !wait {
+			return false, nil
+		}
+		// another listener took the slot first; wait again.
+	}
+}
+
+// release gives back a slot taken by take.
+func (s *forwardSlots) release() {
+	s.mut.Lock()
+	s.open--
+	if s.freed != nil {
+		close(s.freed)
+		s.freed = nil
+	}
+	s.mut.Unlock()
+}
+
+// waitForwardSlot holds the forward listener back from
+// accepting while MaxConcurrentForwards connections are
+// being forwarded, unless RefuseExcessForwards.
+func (cfg *SshegoConfig) waitForwardSlot(ctx context.Context) error {
+	if cfg.MaxConcurrentForwards <= 0 || cfg.RefuseExcessForwards {
+		return nil
+	}
+	return cfg.fwdSlots.waitFree(ctx, cfg.MaxConcurrentForwards)
+}
+
+// takeForwardSlot takes a slot for a connection the forward
+// listener has accepted. It reports false, under
+// RefuseExcessForwards, when the connection is over the cap
+// and should be closed. A slot taken is given back with
+// cfg.fwdSlots.release() once its forward is done.
+func (cfg *SshegoConfig) takeForwardSlot(ctx context.Context) (bool, error) {
+	return cfg.fwdSlots.take(ctx, cfg.MaxConcurrentForwards, !cfg.RefuseExcessForwards)
+}
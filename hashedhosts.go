@@ -0,0 +1,157 @@
+package sshego
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// hashedHostMagic starts a hostname hashed as OpenSSH
+// does under HashKnownHosts: |1|base64(salt)|base64(hash),
+// the hash being HMAC-SHA1 of the name keyed by the salt.
+const hashedHostMagic = "|1|"
+
+// isHashedHost reports whether name is in hashed form.
+func isHashedHost(name string) bool {
+	return strings.HasPrefix(name, hashedHostMagic)
+}
+
+// hashHost returns hostport, a host:port as held in
+// SplitHostnames, hashed under a fresh random salt.
+func hashHost(hostport string) string {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return hashedHostMagic + base64.StdEncoding.EncodeToString(salt) + "|" +
+		base64.StdEncoding.EncodeToString(hostHMAC(salt, hostport))
+}
+
+// hostHMAC is the HMAC-SHA1 of hostport, keyed by salt, over
+// the name as OpenSSH writes it: host alone for port 22,
+// else [host]:port.
+func hostHMAC(salt []byte, hostport string) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(openSSHHostName(hostport)))
+	return mac.Sum(nil)
+}
+
+// openSSHHostName turns our host:port into
+// the form used in a known_hosts file.
+func openSSHHostName(hostport string) string {
+	i := strings.LastIndex(hostport, ":")
+	if i < 0 {
+		return hostport
+	}
+	if hostport[i+1:] == "22" {
+		return hostport[:i]
+	}
+	return "[" + hostport[:i] + "]:" + hostport[i+1:]
+}
+
+// hostNameMatches reports whether name, a SplitHostnames
+// entry, plain or hashed, is hostport.
+func hostNameMatches(name, hostport string) bool {
+	if !isHashedHost(name) {
+		return name == hostport
+	}
+	parts := strings.Split(name[len(hashedHostMagic):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(hostHMAC(salt, hostport), want)
+}
+
+// knownAs reports whether v has been seen under
+// hostport, looking through hashed names too.
+func (v *ServerPubKey) knownAs(hostport string) bool {
+	v.Mut.Lock()
+	defer v.Mut.Unlock()
+	return v.knownAsLocked(hostport) != ""
+}
+
+// knownAsLocked returns the entry of v naming
+// hostport, or "" if none. v.Mut must be held.
+func (v *ServerPubKey) knownAsLocked(hostport string) string {
+	if _, ok := v.SplitHostnames[hostport]; ok {
+		return hostport
+	}
+	for name := range v.SplitHostnames {
+		if hostNameMatches(name, hostport) {
+			return name
+		}
+	}
+	if hostNameMatches(v.Hostname, hostport) {
+		return v.Hostname
+	}
+	return ""
+}
+
+// storedHostName is hostport as h records it:
+// hashed if h.HashHostnames, else as is.
+func (h *KnownHosts) storedHostName(hostport string) string {
+	if h.HashHostnames && !isHashedHost(hostport) {
+		return hashHost(hostport)
+	}
+	return hostport
+}
+
+// addHostName records that v was seen under
+// hostport, unless it already has been.
+func (h *KnownHosts) addHostName(v *ServerPubKey, hostport string) {
+	if !v.knownAs(hostport) {
+		v.AddHostPort(h.storedHostName(hostport))
+	}
+}
+
+// HashAll replaces every plaintext hostname in h with its
+// hashed form, as ssh-keygen -H does to a known_hosts
+// file, sets HashHostnames, and Syncs.
+func (h *KnownHosts) HashAll() error {
+	if h.ReadOnly {
+		return fmt.Errorf("HashAll: %w", ErrKnownHostsReadOnly)
+	}
+	h.Mut.Lock()
+	h.HashHostnames = true
+	for _, v := range h.Hosts {
+		v.hashNames()
+	}
+	h.Mut.Unlock()
+	return h.syncAll()
+}
+
+// hashNames replaces the plaintext names of v
+// with their hashed forms.
+func (v *ServerPubKey) hashNames() {
+	v.Mut.Lock()
+	defer v.Mut.Unlock()
+	hashed := make(map[string]bool, len(v.SplitHostnames))
+	renamed := make(map[string]string, len(v.SplitHostnames))
+	for name := range v.SplitHostnames {
+		hn := name
+		if !isHashedHost(name) {
+			hn = hashHost(name)
+		}
+		hashed[hn] = true
+		renamed[name] = hn
+	}
+	if hn, ok := renamed[v.Hostname]; ok {
+		v.Hostname = hn
+	} else if v.Hostname != "" && !isHashedHost(v.Hostname) {
+		v.Hostname = hashHost(v.Hostname)
+		hashed[v.Hostname] = true
+	}
+	v.SplitHostnames = hashed
+	v.AlreadySaved = false
+}
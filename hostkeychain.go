@@ -0,0 +1,173 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// HostKeyVerdict is what a HostKeyVerifier
+// makes of a server's host key.
+type HostKeyVerdict int
+
+const (
+	// HostKeyPass has no opinion, and hands the
+	// key on to the next verifier in the chain.
+	HostKeyPass HostKeyVerdict = 0
+
+	// HostKeyAccept trusts the key; later
+	// verifiers are not asked.
+	HostKeyAccept HostKeyVerdict = 1
+
+	// HostKeyReject fails the handshake; later
+	// verifiers are not asked.
+	HostKeyReject HostKeyVerdict = 2
+)
+
+func (v HostKeyVerdict) String() string {
+	switch v {
+	case HostKeyPass:
+		return "Pass"
+	case HostKeyAccept:
+		return "Accept"
+	case HostKeyReject:
+		return "Reject"
+	}
+	return ""
+}
+
+// HostKeyVerifier is one source of trust in a server's
+// host key: a CA, an inventory service, a prompt. A
+// non-nil error rejects the key whatever the verdict.
+type HostKeyVerifier func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error)
+
+// ChainHostKeyVerifiers returns a verifier that asks each
+// of vs in turn, stopping at the first that accepts or
+// rejects. If all of them pass, so does the chain.
+func ChainHostKeyVerifiers(vs ...HostKeyVerifier) HostKeyVerifier {
+	return func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error) {
+		for _, v := range vs {
+			verdict, err := v(ctx, hostname, remote, key)
+			if err != nil {
+				return HostKeyReject, err
+			}
+			switch verdict {
+			case HostKeyAccept:
+				return HostKeyAccept, nil
+			case HostKeyReject:
+				return HostKeyReject, fmt.Errorf("host key for '%s' rejected", hostname)
+			}
+		}
+		return HostKeyPass, nil
+	}
+}
+
+// hostKeyChain is what SSHConnect checks a server's host
+// key with: h first, so that a banned or mismatched key
+// is refused and a known one let in, then SSHFP if
+// VerifySSHFP is set, then cfg.HostKeyVerifiers in order,
+// and last of all cfg.HostKeyApprover, if set. A key that
+// all of them pass on is refused.
+func (cfg *SshegoConfig) hostKeyChain(h *KnownHosts) HostKeyVerifier {
+	vs := []HostKeyVerifier{cfg.knownHostsVerifier(h)}
+	if cfg.VerifySSHFP {
+		vs = append(vs, cfg.sshfpVerifier(h))
+	}
+	vs = append(vs, cfg.HostKeyVerifiers...)
+	if cfg.HostKeyApprover != nil {
+		vs = append(vs, cfg.approverVerifier(h))
+	}
+	chain := ChainHostKeyVerifiers(vs...)
+
+	return func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error) {
+		verdict, err := chain(ctx, hostname, remote, key)
+		if err == nil && verdict == HostKeyPass {
+			return HostKeyReject, fmt.Errorf("unknown server; could be Man-In-The-Middle attack.  If this is first time setup, you must use -new to allow the new host")
+		}
+		return verdict, err
+	}
+}
+
+// knownHostsVerifier checks the key against h, adding it
+// if cfg.AddIfNotKnown, and passes on keys h has not seen.
+func (cfg *SshegoConfig) knownHostsVerifier(h *KnownHosts) HostKeyVerifier {
+	return func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error) {
+		pubBytes := ssh.MarshalAuthorizedKey(key)
+		hostStatus, spubkey, err := h.HostAlreadyKnown(hostname, remote, key, pubBytes, cfg.AddIfNotKnown, cfg.TestAllowOneshotConnect)
+		h.Mut.Lock()
+		h.curStatus = hostStatus
+		h.curHost = spubkey
+		h.Mut.Unlock()
+
+		if err == ErrNewNotNeeded && cfg.NewOKIfKnown {
+			cfg.logger().Infof("sshego: warning: host '%s' is already known; -new was not needed.", hostname)
+			err = nil
+		}
+		if err != nil {
+			// this is strict checking of hosts here, any non-nil error
+			// will fail the ssh handshake.
+			return HostKeyReject, err
+		}
+
+		switch hostStatus {
+		case Banned:
+			return HostKeyReject, fmt.Errorf("banned server")
+		case KnownRecordMismatch:
+			return HostKeyReject, fmt.Errorf("known record mismatch")
+		case Unknown:
+			return HostKeyPass, nil
+		}
+		return HostKeyAccept, nil
+	}
+}
+
+// sshfpVerifier accepts a key vouched for by DNSSEC-validated
+// SSHFP records, adding it to h if cfg.SSHFPPin, and passes
+// on any other.
+func (cfg *SshegoConfig) sshfpVerifier(h *KnownHosts) HostKeyVerifier {
+	return func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error) {
+		err := VerifySSHFP(ctx, cfg.sshfpResolver(), hostname, key)
+		if err != nil {
+			if !cfg.Quiet {
+				cfg.logger().Infof("sshego: SSHFP did not vouch for '%s': %v", hostname, err)
+			}
+			return HostKeyPass, nil
+		}
+		if !cfg.Quiet {
+			cfg.logger().Infof("sshego: host key %s for '%s' verified by SSHFP.", ssh.FingerprintSHA256(key), hostname)
+		}
+		if cfg.SSHFPPin {
+			// the key stands on SSHFP alone if it cannot be pinned.
+			if _, _, err := h.AddNeeded(true, true, hostname, remote, string(ssh.MarshalAuthorizedKey(key)), key, nil); err != nil {
+				cfg.logger().Errorf("sshego: could not pin SSHFP-verified host key for '%s': %v", hostname, err)
+			}
+		}
+		return HostKeyAccept, nil
+	}
+}
+
+// approverVerifier puts a key nothing else vouched for to
+// cfg.HostKeyApprover, and on a yes adds it to h, as -new
+// would, with h's current status AddedNew.
+func (cfg *SshegoConfig) approverVerifier(h *KnownHosts) HostKeyVerifier {
+	return func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error) {
+		ok, err := cfg.HostKeyApprover(hostname, remote, key, Fingerprint(key))
+		if err != nil {
+			return HostKeyReject, err
+		}
+		if !ok {
+			return HostKeyReject, fmt.Errorf("host key %s for '%s' was not approved", Fingerprint(key), hostname)
+		}
+		_, record, err := h.AddNeeded(true, true, hostname, remote, string(ssh.MarshalAuthorizedKey(key)), key, nil)
+		if err != nil {
+			return HostKeyReject, err
+		}
+		h.Mut.Lock()
+		h.curStatus = AddedNew
+		h.curHost = record
+		h.Mut.Unlock()
+		return HostKeyAccept, nil
+	}
+}
@@ -0,0 +1,156 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test147HostKeyVerifiersAreAskedInOrderAfterKnownHosts(t *testing.T) {
+
+	cv.Convey("HostKeyVerifiers should be asked, in order, only about host keys KnownHosts does not know; the first to accept or reject decides, and a key they all pass on is refused.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.CliCfg.AddIfNotKnown = false
+		s.CliCfg.TestAllowOneshotConnect = false
+		s.CliCfg.LocalToRemote.Listen.Addr = ""
+		s.CliCfg.DirectTcp = true
+
+		ctx := context.Background()
+		connect := func() error {
+			halt := ssh.NewHalter()
+			defer func() {
+				halt.RequestStop()
+				halt.MarkDone()
+			}()
+			_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			return err
+		}
+
+		var asked []string
+		verifier := func(name string, verdict HostKeyVerdict) HostKeyVerifier {
+			return func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error) {
+				asked = append(asked, name)
+				return verdict, nil
+			}
+		}
+
+		// nobody vouches: refused, as before.
+		s.CliCfg.HostKeyVerifiers = []HostKeyVerifier{verifier("a", HostKeyPass)}
+		cv.So(connect(), cv.ShouldNotBeNil)
+		cv.So(asked, cv.ShouldResemble, []string{"a"})
+
+		// the first to decide wins, and later ones are not asked.
+		asked = nil
+		s.CliCfg.HostKeyVerifiers = []HostKeyVerifier{verifier("a", HostKeyPass), verifier("b", HostKeyReject), verifier("c", HostKeyAccept)}
+		cv.So(connect(), cv.ShouldNotBeNil)
+		cv.So(asked, cv.ShouldResemble, []string{"a", "b"})
+
+		asked = nil
+		s.CliCfg.HostKeyVerifiers = []HostKeyVerifier{
+			verifier("a", HostKeyPass),
+			ChainHostKeyVerifiers(verifier("b1", HostKeyPass), verifier("b2", HostKeyAccept)),
+			verifier("c", HostKeyReject),
+		}
+		cv.So(connect(), cv.ShouldBeNil)
+		cv.So(asked, cv.ShouldResemble, []string{"a", "b1", "b2"})
+
+		// an error rejects, whatever the verdict.
+		asked = nil
+		s.CliCfg.HostKeyVerifiers = []HostKeyVerifier{
+			func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error) {
+				return HostKeyAccept, fmt.Errorf("inventory says no")
+			},
+		}
+		err := connect()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "inventory says no")
+
+		// a key KnownHosts knows never reaches the verifiers.
+		s.CliCfg.HostKeyVerifiers = nil
+		s.CliCfg.AddIfNotKnown = true
+		connect() // adds the key, then asks for a re-run without -new.
+		s.CliCfg.AddIfNotKnown = false
+		s.CliCfg.HostKeyVerifiers = []HostKeyVerifier{verifier("a", HostKeyReject)}
+		cv.So(connect(), cv.ShouldBeNil)
+		cv.So(asked, cv.ShouldBeEmpty)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test153HostKeyApproverCanAcceptAnUnknownHostAtConnectTime(t *testing.T) {
+
+	cv.Convey("HostKeyApprover should be shown an unknown host key's fingerprint; a yes should store the key and let SSHConnect proceed without -new, a no or an error should fail it.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.CliCfg.AddIfNotKnown = false
+		s.CliCfg.TestAllowOneshotConnect = false
+		s.CliCfg.LocalToRemote.Listen.Addr = ""
+		s.CliCfg.DirectTcp = true
+
+		ctx := context.Background()
+		connect := func() error {
+			halt := ssh.NewHalter()
+			defer func() {
+				halt.RequestStop()
+				halt.MarkDone()
+			}()
+			_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			return err
+		}
+
+		hostKey := s.SrvCfg.HostDb.HostSshSigner.PublicKey()
+		pubBytes := string(ssh.MarshalAuthorizedKey(hostKey))
+		pinned := func() bool {
+			s.CliCfg.KnownHosts.Mut.Lock()
+			defer s.CliCfg.KnownHosts.Mut.Unlock()
+			_, ok := s.CliCfg.KnownHosts.Hosts[pubBytes]
+			return ok
+		}
+		var shown []string
+		answer := func(ok bool, err error) {
+			s.CliCfg.HostKeyApprover = func(hostname string, remote net.Addr, key ssh.PublicKey, fp string) (bool, error) {
+				shown = append(shown, fp)
+				return ok, err
+			}
+		}
+
+		answer(false, nil)
+		cv.So(connect(), cv.ShouldNotBeNil)
+		cv.So(shown, cv.ShouldResemble, []string{Fingerprint(hostKey)})
+
+		answer(true, fmt.Errorf("stdin closed"))
+		cv.So(connect(), cv.ShouldNotBeNil)
+		cv.So(pinned(), cv.ShouldBeFalse)
+
+		shown = nil
+		answer(true, nil)
+		cv.So(connect(), cv.ShouldBeNil)
+		cv.So(len(shown), cv.ShouldEqual, 1)
+		cv.So(pinned(), cv.ShouldBeTrue)
+
+		// now known, it is not asked about again.
+		shown = nil
+		answer(false, nil)
+		cv.So(connect(), cv.ShouldBeNil)
+		cv.So(shown, cv.ShouldBeEmpty)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
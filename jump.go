@@ -0,0 +1,194 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// HostSpec names a jump host (a bastion) on the
+// way to the sshd, as ssh -J does.
+type HostSpec struct {
+	Host string
+	Port int64
+
+	// User to log in to the jump host as. Empty
+	// means the user we log in to the sshd as.
+	User string
+}
+
+// HostPort is the host:port of s, bracketing an IPv6 Host.
+func (s HostSpec) HostPort() string {
+	return net.JoinHostPort(s.Host, strconv.FormatInt(s.Port, 10))
+}
+
+// String gives s as ParseHostSpec takes it.
+func (s HostSpec) String() string {
+	if s.User != "" {
+		return s.User + "@" + s.HostPort()
+	}
+	return s.HostPort()
+}
+
+// ParseHostSpec reads a jump host given as [user@]host[:port],
+// as for ssh -J. The port defaults to 22.
+func ParseHostSpec(s string) (HostSpec, error) {
+	hostport := s
+	if i := strings.LastIndex(hostport, "@"); i >= 0 {
+		hostport = hostport[i+1:]
+	}
+	if !strings.Contains(hostport, ":") {
+		s += ":22"
+	}
+	a := &AddrHostPort{Title: "jump", Addr: s}
+	if err := a.ParseUserAddr(); err != nil {
+		return HostSpec{}, err
+	}
+	if a.UnixDomainPath != "" {
+		return HostSpec{}, fmt.Errorf("bad -jump host '%s': must be a host:port", s)
+	}
+	return HostSpec{Host: a.Host, Port: a.Port, User: a.User}, nil
+}
+
+// ParseJumpHosts reads a comma separated list of
+// jump hosts, each as ParseHostSpec takes them.
+func ParseJumpHosts(s string) ([]HostSpec, error) {
+	var hops []HostSpec
+	for _, hop := range strings.Split(s, ",") {
+		hop = strings.TrimSpace(hop)
+		if hop == "" {
+			continue
+		}
+		spec, err := ParseHostSpec(hop)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, spec)
+	}
+	return hops, nil
+}
+
+// jumpHostsFlag is a flag.Value for -jump.
+type jumpHostsFlag struct{ hops *[]HostSpec }
+
+func (j jumpHostsFlag) String() string {
+	if j.hops == nil {
+		return ""
+	}
+	return jumpHostsString(*j.hops)
+}
+
+func (j jumpHostsFlag) Set(s string) (err error) {
+	*j.hops, err = ParseJumpHosts(s)
+	return
+}
+
+func jumpHostsString(hops []HostSpec) string {
+	s := make([]string, len(hops))
+	for i, hop := range hops {
+		s[i] = hop.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// jumpChain is the logged in jump hosts, and
+// conn, the channel through the last of them
+// to the sshd.
+type jumpChain struct {
+	clients []*ssh.Client
+	conn    net.Conn
+}
+
+// close hangs up on the jump hosts, last first.
+func (j *jumpChain) close() {
+	if j == nil {
+		return
+	}
+	if j.conn != nil {
+		j.conn.Close()
+	}
+	for i := len(j.clients) - 1; i >= 0; i-- {
+		j.clients[i].Close()
+	}
+}
+
+// dialJumps logs in to each of cfg.JumpHosts in turn, reaching
+// each one after the first through a direct-tcpip channel from
+// the one before, and returns the chain with a channel from
+// the last of them to addr, the sshd, for the handshake with
+// it. config is used for every jump host, under its own User
+// if given, so that config.HostKeyCallback checks each jump
+// host's key just as it checks the sshd's. The chain lives
+// on ctx; cancelling dialCtx aborts it while it is made.
+func (cfg *SshegoConfig) dialJumps(ctx, dialCtx context.Context, addr string, config *ssh.ClientConfig, halt *ssh.Halter) (*jumpChain, error) {
+	j := &jumpChain{}
+	var conn net.Conn
+	for i, hop := range cfg.JumpHosts {
+		hostport := hop.HostPort()
+		var err error
+		if i == 0 {
+			conn, err = cfg.dialer(config.Timeout).DialContext(dialCtx, "tcp", hostport)
+			err = dialTimeoutError(hostport, config.Timeout, err)
+		} else {
+			conn, err = j.dial(ctx, dialCtx, hostport)
+		}
+		if err != nil {
+			j.close()
+			return nil, fmt.Errorf("could not reach jump host '%s': %w", hostport, err)
+		}
+
+		hopCfg := *config
+		hopCfg.HostPort = hostport
+		if hop.User != "" {
+			hopCfg.User = hop.User
+		}
+		var handshakeExpired *time.Timer
+		if handshake := cfg.TimeoutsFor(hostport).Handshake; handshake > 0 {
+			handshakeExpired = time.AfterFunc(handshake, func() { conn.Close() })
+		}
+		hopConn := conn
+		stopAbort := context.AfterFunc(dialCtx, func() { hopConn.Close() })
+		c, chans, reqs, err := ssh.NewClientConn(ctx, conn, hostport, &hopCfg)
+		stopAbort()
+		if handshakeExpired != nil {
+			handshakeExpired.Stop()
+		}
+		if err != nil {
+			conn.Close()
+			j.close()
+			return nil, fmt.Errorf("could not log in to jump host '%s': %w", hostport, err)
+		}
+		j.clients = append(j.clients, cfg.NewSSHClient(ctx, c, chans, reqs, halt))
+	}
+
+	var err error
+	j.conn, err = j.dial(ctx, dialCtx, addr)
+	if err != nil {
+		j.close()
+		return nil, fmt.Errorf("could not reach '%s' from jump host '%s': %w", addr, cfg.JumpHosts[len(cfg.JumpHosts)-1].HostPort(), err)
+	}
+	return j, nil
+}
+
+// dial opens a channel from the last jump host to hostport,
+// hanging up on that host if dialCtx is cancelled first.
+func (j *jumpChain) dial(ctx, dialCtx context.Context, hostport string) (net.Conn, error) {
+	last := j.clients[len(j.clients)-1]
+	stopAbort := context.AfterFunc(dialCtx, func() { last.Close() })
+	ch, err := last.DialWithContext(ctx, "tcp", hostport)
+	stopAbort()
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := ch.(net.Conn)
+	if !ok {
+		ch.Close()
+		return nil, fmt.Errorf("channel to '%s' is not a net.Conn", hostport)
+	}
+	return conn, nil
+}
@@ -0,0 +1,136 @@
+package sshego
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptrand "crypto/rand"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/snappy"
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted known hosts store is the snappy-compressed
+// json or gob payload, sealed with AES-256-GCM under a key
+// derived from the passphrase by scrypt. On disk it is:
+//
+//	khCryptMagic | 16 byte salt | 12 byte nonce | ciphertext
+//
+// The magic doubles as the GCM additional data, so that the
+// header cannot be swapped without detection.
+var khCryptMagic = []byte("sshego-known-hosts-aes256gcm-scrypt-v1\n")
+
+const khCryptSaltLen = 16
+
+// ErrKnownHostsPassphrase is returned when an encrypted known
+// hosts store cannot be opened with the passphrase given, or
+// was opened with no passphrase at all.
+var ErrKnownHostsPassphrase = fmt.Errorf("known hosts store is encrypted: missing or wrong passphrase")
+
+// KnownHostsPassphraseEnv names the environment variable
+// gosshtun reads the known hosts passphrase from, so that
+// it need not be kept in a config file.
+const KnownHostsPassphraseEnv = "SSHEGO_KNOWN_HOSTS_PASSPHRASE"
+
+// NewEncryptedKnownHosts is NewKnownHosts for a store that
+// is kept encrypted at rest under passphrase. Only the KHJson
+// and KHGob formats can be encrypted. An existing plaintext
+// store is read as usual, and is encrypted on the next Sync();
+// any plaintext .prev backup left from before should then
+// be removed by hand.
+func NewEncryptedKnownHosts(filepath string, format KnownHostsPersistFormat, passphrase string) (*KnownHosts, error) {
+	if format != KHJson && format != KHGob {
+		return nil, fmt.Errorf("NewEncryptedKnownHosts: only the KHJson and KHGob formats can be encrypted, not %v", format)
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("NewEncryptedKnownHosts: passphrase must not be empty")
+	}
+	return newKnownHosts(filepath, format, []byte(passphrase))
+}
+
+// khCryptKey derives the AES-256 key from passphrase and salt.
+func khCryptKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+}
+
+// isEncryptedKnownHosts reports whether the file
+// fn begins with the encrypted store header.
+func isEncryptedKnownHosts(fn string) bool {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	hdr := make([]byte, len(khCryptMagic))
+	_, err = io.ReadFull(f, hdr)
+	return err == nil && isSealed(hdr)
+}
+
+// isSealed reports whether by begins with
+// the encrypted store header.
+func isSealed(by []byte) bool {
+	return bytes.HasPrefix(by, khCryptMagic)
+}
+
+// seal compresses and encrypts plain under s.passphrase,
+// giving the encrypted store as it is kept on disk.
+func (s *KnownHosts) seal(plain []byte) ([]byte, error) {
+	salt := make([]byte, khCryptSaltLen)
+	if _, err := cryptrand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := khCryptAEAD(s.passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := cryptrand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, khCryptMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, snappy.Encode(nil, plain), khCryptMagic), nil
+}
+
+// unseal returns the decrypted and
+// uncompressed contents of by, made by seal.
+func (s *KnownHosts) unseal(by []byte) ([]byte, error) {
+	if len(s.passphrase) == 0 {
+		return nil, ErrKnownHostsPassphrase
+	}
+	hdrLen := len(khCryptMagic) + khCryptSaltLen
+	if len(by) < hdrLen || !isSealed(by) {
+		return nil, fmt.Errorf("not an encrypted known hosts store")
+	}
+	gcm, err := khCryptAEAD(s.passphrase, by[len(khCryptMagic):hdrLen])
+	if err != nil {
+		return nil, err
+	}
+	if len(by) < hdrLen+gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted known hosts store is truncated")
+	}
+	nonce := by[hdrLen : hdrLen+gcm.NonceSize()]
+	sealed := by[hdrLen+gcm.NonceSize():]
+	compressed, err := gcm.Open(nil, nonce, sealed, khCryptMagic)
+	if err != nil {
+		return nil, ErrKnownHostsPassphrase
+	}
+	return snappy.Decode(nil, compressed)
+}
+
+func khCryptAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := khCryptKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
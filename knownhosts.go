@@ -4,16 +4,19 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"github.com/golang/snappy"
 )
 
 // KnownHosts represents in Hosts a hash map of host identifier (ip or name)
@@ -35,9 +38,64 @@ type KnownHosts struct {
 	// NoSave means we don't touch the files we read from
 	NoSave bool
 
+	// ReadOnly is for a trust store that is provisioned
+	// elsewhere and must never be changed by us. Sync()
+	// and ReplaceAll() fail with ErrKnownHostsReadOnly,
+	// and an unknown host is rejected even under
+	// AddIfNotKnown (-new) rather than added.
+	ReadOnly bool
+
+	// SkipHostKeyCheckOnLocalhost is the leniency HostAlreadyKnown
+	// shows a known key seen on localhost or 127.0.0.1 under
+	// AddIfNotKnown (-new): the loopback name is quietly added
+	// to it. NewKnownHosts and LoadSshKnownHosts set it true.
+	// Set it false to have the key checked, and reported, just
+	// as it would be for any other host; for tests that
+	// impersonate servers on loopback.
+	SkipHostKeyCheckOnLocalhost bool
+
+	// ConfirmAdds makes adding a host two-phase. Under
+	// AddIfNotKnown (-new), an unknown host still comes
+	// back as AddedNew, but its record is held pending,
+	// and only stored once the caller, having shown the
+	// fingerprint to a user say, calls ConfirmAdd(record).
+	// RejectAdd(record) drops it instead.
+	ConfirmAdds bool
+
+	// pending holds records awaiting ConfirmAdd,
+	// keyed like Hosts.
+	pending map[string]*ServerPubKey
+
+	// OpenSSHMirrorPath, if set, has Sync() also write
+	// the complete store as a standard OpenSSH known_hosts
+	// file at this path, so that ssh, scp, and git can
+	// share the same trust database. The mirror is
+	// rewritten in full on each Sync().
+	OpenSSHMirrorPath string
+
+	// OpenSSHMirrorOnly means Sync() writes only the
+	// OpenSSHMirrorPath file, and skips the native format.
+	OpenSSHMirrorOnly bool
+
+	// HashHostnames stores the hostnames of hosts added
+	// from now on hashed, in the |1|salt|hash form of
+	// OpenSSH's HashKnownHosts, rather than in the clear.
+	// Hashed names, whether ours or read from an OpenSSH
+	// file, are matched by hashing the name connected to.
+	// HashAll() hashes the names already stored.
+	HashHostnames bool
+
+	// passphrase, if set, encrypts the json/gob
+	// store at rest. See NewEncryptedKnownHosts().
+	passphrase []byte
+
 	Mut sync.Mutex
 }
 
+// ErrKnownHostsReadOnly is returned on any attempt
+// to change a KnownHosts that has ReadOnly set.
+var ErrKnownHostsReadOnly = fmt.Errorf("known hosts store is read-only")
+
 // ServerPubKey stores the RSA public keys for a particular known server. This
 // structure is stored in KnownHosts.Hosts.
 type ServerPubKey struct {
@@ -62,6 +120,12 @@ type ServerPubKey struct {
 	Port                     string
 	LineInFileOneBased       int
 
+	// Tags hold free-form bookkeeping, such as the owner
+	// or the ticket that got this host trusted. Set them
+	// with KnownHosts.SetTag. Only the json and gob formats
+	// store Tags; an ssh_known_hosts file keeps just Comment.
+	Tags map[string]string
+
 	// if AlreadySaved, then we don't need to append.
 	AlreadySaved bool
 
@@ -69,6 +133,13 @@ type ServerPubKey struct {
 	Mut sync.Mutex
 }
 
+// KnownHostsPersistFormat is how a KnownHosts is
+// kept on disk. KHJson and KHGob stores are snappy
+// compressed, in a file named for the format, with
+// a .json.snappy or .gob.snappy suffix; a KHSsh store
+// is an OpenSSH known_hosts file, with no suffix.
+// Gob is the smaller and faster of the two for large
+// stores; json can be read by other tools.
 type KnownHostsPersistFormat int
 
 const (
@@ -77,44 +148,109 @@ const (
 	KHSsh  KnownHostsPersistFormat = 2
 )
 
+func (f KnownHostsPersistFormat) String() string {
+	switch f {
+	case KHJson:
+		return "json"
+	case KHGob:
+		return "gob"
+	case KHSsh:
+		return "ssh"
+	}
+	return fmt.Sprintf("KnownHostsPersistFormat(%d)", int(f))
+}
+
+// Set makes a *KnownHostsPersistFormat a flag.Value,
+// taking "json", "gob", or "ssh".
+func (f *KnownHostsPersistFormat) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "json":
+		*f = KHJson
+	case "gob":
+		*f = KHGob
+	case "ssh":
+		*f = KHSsh
+	default:
+		return fmt.Errorf("unknown known hosts format '%s': use json, gob, or ssh", s)
+	}
+	return nil
+}
+
+// suffix is the file name suffix for a store in format f.
+func (f KnownHostsPersistFormat) suffix() string {
+	switch f {
+	case KHJson:
+		return ".json.snappy"
+	case KHGob:
+		return ".gob.snappy"
+	}
+	return ""
+}
+
 // NewKnownHosts creats a new KnownHosts structure.
 // filepathPrefix does not include the
-// PersistFormat suffix. If filepathPrefix + defaultFileFormat()
-// exists as a file on disk, then we read the
+// PersistFormat suffix. If filepathPrefix + the suffix
+// for format exists as a file on disk, then we read the
 // contents of that file into the new KnownHosts.
 //
+// For KHJson and KHGob, the format is also detected from
+// the file: a filepath given with its .json.snappy or
+// .gob.snappy suffix is read, and kept, in that format;
+// and should there be no store in format, a store in the
+// other is read instead, to be written out in format on
+// the next Sync(). So an existing .json.snappy store
+// loads as before when KHGob is asked for.
+//
 // The returned KnownHosts will remember the
 // filepathPrefix for future saves.
 //
 func NewKnownHosts(filepath string, format KnownHostsPersistFormat) (*KnownHosts, error) {
+	return newKnownHosts(filepath, format, nil)
+}
+
+func newKnownHosts(filepath string, format KnownHostsPersistFormat, passphrase []byte) (*KnownHosts, error) {
 	p("NewKnownHosts called, with filepath = '%s', format='%v'", filepath, format)
 
+	if format == KHJson || format == KHGob {
+		for _, f := range []KnownHostsPersistFormat{KHJson, KHGob} {
+			if strings.HasSuffix(filepath, f.suffix()) {
+				filepath = strings.TrimSuffix(filepath, f.suffix())
+				format = f
+			}
+		}
+	}
+
 	h := &KnownHosts{
-		PersistFormat: format,
+		PersistFormat:               format,
+		passphrase:                  passphrase,
+		SkipHostKeyCheckOnLocalhost: true,
 	}
 
 	h.FilepathPrefix = filepath
-	fn := filepath
-	switch format {
-	case KHJson:
-		h.PersistFormatSuffix = ".json.snappy"
-	case KHGob:
-		h.PersistFormatSuffix = ".gob.snappy"
+	h.PersistFormatSuffix = format.suffix()
+	fn := filepath + h.PersistFormatSuffix
+	readFormat := format
+	if !fileExists(fn) {
+		switch format {
+		case KHJson:
+			readFormat = KHGob
+		case KHGob:
+			readFormat = KHJson
+		}
+		if other := filepath + readFormat.suffix(); fileExists(other) {
+			fn = other
+		} else {
+			readFormat = format
+		}
 	}
-	fn += h.PersistFormatSuffix
 
 	var err error
 	if fileExists(fn) {
 		//pp("fn '%s' exists in NewKnownHosts(). format = %v\n", fn, format)
 
 		switch format {
-		case KHJson:
-			err = h.readJSONSnappy(fn)
-			if err != nil {
-				return nil, err
-			}
-		case KHGob:
-			err = h.readGobSnappy(fn)
+		case KHJson, KHGob:
+			err = h.loadFile(fn, readFormat)
 			if err != nil {
 				return nil, err
 			}
@@ -170,16 +306,27 @@ func KnownHostsEqual(a, b *KnownHosts) (bool, error) {
 }
 
 // Sync writes the contents of the KnownHosts structure to the
-// file h.FilepathPrefix + h.PersistFormat (for json/gob); to
-// just h.FilepathPrefix for "ssh_known_hosts" format.
+// file h.FilepathPrefix + h.PersistFormat's suffix (for json/gob);
+// to just h.FilepathPrefix for "ssh_known_hosts" format. Setting
+// h.PersistFormat to KHGob, say, has the next Sync write gob.
+// If h.OpenSSHMirrorPath is set, the OpenSSH format mirror
+// is written as well (or instead, given h.OpenSSHMirrorOnly).
 func (h *KnownHosts) Sync() (err error) {
-	fn := h.FilepathPrefix + h.PersistFormatSuffix
-	switch h.PersistFormat {
-	case KHJson:
-		err = h.saveJSONSnappy(fn)
+	if h.ReadOnly {
+		return ErrKnownHostsReadOnly
+	}
+	if h.OpenSSHMirrorPath != "" {
+		err = h.saveSshKnownHostsMirror(h.OpenSSHMirrorPath)
 		panicOn(err)
-	case KHGob:
-		err = h.saveGobSnappy(fn)
+		if h.OpenSSHMirrorOnly {
+			return
+		}
+	}
+	switch h.PersistFormat {
+	case KHJson, KHGob:
+		// the format may have been changed since h was made.
+		h.PersistFormatSuffix = h.PersistFormat.suffix()
+		err = h.saveFile(h.FilepathPrefix + h.PersistFormatSuffix)
 		panicOn(err)
 	case KHSsh:
 		err = h.saveSshKnownHosts()
@@ -190,6 +337,616 @@ func (h *KnownHosts) Sync() (err error) {
 	return
 }
 
+// Save writes h to w just as Sync writes it to h's file:
+// the json or gob of h.PersistFormat, snappy compressed, and
+// encrypted if h has a passphrase. For KHSsh, w gets every
+// host as an OpenSSH known_hosts line. Nothing on the
+// filesystem is touched, so w may be a database blob, say.
+// Load reads it back.
+func (h *KnownHosts) Save(w io.Writer) error {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+
+	var dat []byte
+	var err error
+	switch h.PersistFormat {
+	case KHJson:
+		dat, err = h.encodeJSON()
+	case KHGob:
+		dat, err = h.encodeGob()
+	case KHSsh:
+		return h.writeSshKnownHostsLines(w)
+	default:
+		return fmt.Errorf("unknown persistence format: %v", h.PersistFormat)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(h.passphrase) > 0 {
+		sealed, err := h.seal(dat)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(sealed)
+		return err
+	}
+	sw := snappy.NewBufferedWriter(w)
+	if _, err = sw.Write(dat); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// Load replaces the hosts in h with those read from r, in
+// the form Save writes for h.PersistFormat. An encrypted
+// store needs h to have been made by NewEncryptedKnownHosts,
+// with the same passphrase. Like Save, Load never touches
+// the filesystem. If r does not decode, h is left as it was.
+func (h *KnownHosts) Load(r io.Reader) error {
+	return h.load(r, h.PersistFormat)
+}
+
+// load is Load, reading format rather than h.PersistFormat,
+// which is left as it is.
+func (h *KnownHosts) load(r io.Reader, format KnownHostsPersistFormat) error {
+	by, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+
+	// decode into fresh, and only swap its hosts in once the
+	// whole of r has been read without error, so that a bad
+	// blob leaves h as it was.
+	fresh := &KnownHosts{}
+	if format == KHSsh {
+		fresh.Hosts = make(map[string]*ServerPubKey)
+		err = fresh.parseSshKnownHosts("Load", by)
+	} else {
+		var dat []byte
+		if isSealed(by) {
+			dat, err = h.unseal(by)
+		} else {
+			dat, err = ioutil.ReadAll(snappy.NewReader(bytes.NewReader(by)))
+		}
+		if err != nil {
+			return err
+		}
+		switch format {
+		case KHJson:
+			err = fresh.decodeJSON(dat)
+		case KHGob:
+			err = fresh.decodeGob(dat)
+		default:
+			return fmt.Errorf("unknown persistence format: %v", format)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if fresh.Hosts == nil {
+		fresh.Hosts = make(map[string]*ServerPubKey)
+	}
+	h.Hosts = fresh.Hosts
+	h.curHost = nil
+	return nil
+}
+
+// saveFile Saves h to fn, without ever leaving
+// a half written fn. The plaintext fn is first
+// copied to fn.prev, as a backup.
+func (h *KnownHosts) saveFile(fn string) error {
+	t0 := time.Now()
+	if len(h.passphrase) == 0 {
+		// for backups
+		//exec.Command("mv", fn+".prev", fn+".prev.prev").Run()
+		exec.Command("cp", "-p", fn, fn+".prev").Run()
+	}
+
+	// don't blow away the last good (fn) until the new version is completely written.
+	err := writeAtomic(fn, createPlain, h.Save)
+
+	DefaultLogger.Debugf("saveFile('%s') took %v", fn, time.Since(t0))
+	return err
+}
+
+// loadFile Loads h from the file fn, in format.
+func (h *KnownHosts) loadFile(fn string, format KnownHostsPersistFormat) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	DefaultLogger.Infof("loadFile() is restoring state from file '%s'.", fn)
+	return h.load(f, format)
+}
+
+// ReplaceAll swaps in hosts as the complete set of known
+// hosts, discarding everything h held before, and then
+// Syncs. It is meant for pushing a centrally managed trust
+// list, so nothing of the old set is merged in. The keys of
+// hosts are the authorized_keys form of each host's public
+// key, as in h.Hosts; they are checked and normalized before
+// anything is swapped, so a bad entry leaves h untouched.
+// h keeps copies of the records, so the caller may go on
+// using hosts afterwards without touching h.
+func (h *KnownHosts) ReplaceAll(hosts map[string]*ServerPubKey) error {
+	if h.ReadOnly {
+		return fmt.Errorf("ReplaceAll: %w", ErrKnownHostsReadOnly)
+	}
+	fresh := make(map[string]*ServerPubKey, len(hosts))
+	for k, v := range hosts {
+		if v == nil {
+			return fmt.Errorf("ReplaceAll: nil record for key '%s'", k)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			return fmt.Errorf("ReplaceAll: could not parse key '%s': %s", k, err)
+		}
+		human := string(ssh.MarshalAuthorizedKey(key))
+		c := v.clone()
+		c.HumanKey = human
+		c.AlreadySaved = false
+		fresh[human] = c
+	}
+
+	h.Mut.Lock()
+	h.Hosts = fresh
+	h.curHost = nil
+	h.Mut.Unlock()
+
+	return h.syncAll()
+}
+
+// syncAll is Sync, except that an ssh_known_hosts file
+// is rewritten in full rather than appended to, so that
+// records changed in place are not written twice.
+func (h *KnownHosts) syncAll() error {
+	if h.PersistFormat == KHSsh && !h.OpenSSHMirrorOnly && !h.ReadOnly {
+		if err := h.saveSshKnownHostsMirror(h.FilepathPrefix); err != nil {
+			return err
+		}
+		h.Mut.Lock()
+		for _, v := range h.Hosts {
+			v.AlreadySaved = !h.NoSave
+		}
+		h.Mut.Unlock()
+	}
+	return h.Sync()
+}
+
+// ErrAddPending is wrapped in the error returned with
+// AddedNew when h.ConfirmAdds holds the new record back.
+var ErrAddPending = fmt.Errorf("new host key is pending: call ConfirmAdd() to store it")
+
+// PendingAdds returns the records held back by
+// ConfirmAdds, awaiting ConfirmAdd or RejectAdd.
+func (h *KnownHosts) PendingAdds() []*ServerPubKey {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	r := make([]*ServerPubKey, 0, len(h.pending))
+	for _, v := range h.pending {
+		r = append(r, v)
+	}
+	return r
+}
+
+// ConfirmAdd stores record, a pending add returned
+// with AddedNew under h.ConfirmAdds, and Syncs.
+func (h *KnownHosts) ConfirmAdd(record *ServerPubKey) error {
+	if h.ReadOnly {
+		return fmt.Errorf("ConfirmAdd: %w", ErrKnownHostsReadOnly)
+	}
+	v, err := h.takePending("ConfirmAdd", record)
+	if err != nil {
+		return err
+	}
+	h.Mut.Lock()
+	prior, already := h.Hosts[v.HumanKey]
+	if !already {
+		h.Hosts[v.HumanKey] = v
+		h.Mut.Unlock()
+		return h.Sync()
+	}
+	h.Mut.Unlock()
+
+	// two or more names under the same key.
+	v.Mut.Lock()
+	names := make([]string, 0, len(v.SplitHostnames))
+	for hn := range v.SplitHostnames {
+		names = append(names, hn)
+	}
+	v.Mut.Unlock()
+	for _, hn := range names {
+		prior.AddHostPort(hn)
+	}
+	return h.Sync()
+}
+
+// RejectAdd drops record, a pending add returned
+// with AddedNew under h.ConfirmAdds, unstored.
+func (h *KnownHosts) RejectAdd(record *ServerPubKey) error {
+	_, err := h.takePending("RejectAdd", record)
+	return err
+}
+
+// takePending removes record from h.pending and returns it.
+func (h *KnownHosts) takePending(caller string, record *ServerPubKey) (*ServerPubKey, error) {
+	if record == nil {
+		return nil, fmt.Errorf("%s: nil record", caller)
+	}
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	v, ok := h.pending[record.HumanKey]
+	if !ok {
+		return nil, fmt.Errorf("%s: key for '%s' is not pending: %w", caller, record.Hostname, ErrNoSuchHostKey)
+	}
+	delete(h.pending, record.HumanKey)
+	return v, nil
+}
+
+// ErrNoSuchHostKey is returned by SetComment and
+// SetTag for a key that is not in the store.
+var ErrNoSuchHostKey = fmt.Errorf("no such host key in known hosts")
+
+// SetComment replaces the free-form comment on the
+// record for key, and Syncs. The comment is a single
+// line; in an ssh_known_hosts file it ends the line.
+func (h *KnownHosts) SetComment(key ssh.PublicKey, comment string) error {
+	if strings.ContainsAny(comment, "\r\n") {
+		return fmt.Errorf("SetComment: comment must be a single line: '%s'", comment)
+	}
+	return h.annotate("SetComment", key, func(v *ServerPubKey) {
+		v.Comment = comment
+	})
+}
+
+// SetTag sets tag name to value on the record for key,
+// and Syncs. An empty value removes the tag.
+func (h *KnownHosts) SetTag(key ssh.PublicKey, name, value string) error {
+	if name == "" {
+		return fmt.Errorf("SetTag: tag name cannot be empty")
+	}
+	return h.annotate("SetTag", key, func(v *ServerPubKey) {
+		if value == "" {
+			delete(v.Tags, name)
+			return
+		}
+		if v.Tags == nil {
+			v.Tags = make(map[string]string)
+		}
+		v.Tags[name] = value
+	})
+}
+
+// annotate applies change to the record for key
+// under its lock, then saves the store.
+func (h *KnownHosts) annotate(caller string, key ssh.PublicKey, change func(v *ServerPubKey)) error {
+	if h.ReadOnly {
+		return fmt.Errorf("%s: %w", caller, ErrKnownHostsReadOnly)
+	}
+	h.Mut.Lock()
+	v, ok := h.Hosts[string(ssh.MarshalAuthorizedKey(key))]
+	h.Mut.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: key %s: %w", caller, Fingerprint(key), ErrNoSuchHostKey)
+	}
+	v.Mut.Lock()
+	change(v)
+	v.Mut.Unlock()
+	return h.syncAll()
+}
+
+// KnownHost describes one record of a KnownHosts,
+// as returned by List.
+type KnownHost struct {
+	// Hostnames are the host:port names the key
+	// has been seen under, sorted.
+	Hostnames   []string
+	Keytype     string
+	Fingerprint string
+	Banned      bool
+	Comment     string
+
+	// Tags is a copy; change them with SetTag.
+	Tags map[string]string
+}
+
+// List returns every host in h, with its comment
+// and tags, sorted by first hostname.
+func (h *KnownHosts) List() []KnownHost {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+
+	r := make([]KnownHost, 0, len(h.Hosts))
+	for _, v := range h.Hosts {
+		v.Mut.Lock()
+		kh := KnownHost{
+			Keytype: v.Keytype,
+			Banned:  v.ServerBanned,
+			Comment: v.Comment,
+		}
+		for hn := range v.SplitHostnames {
+			kh.Hostnames = append(kh.Hostnames, hn)
+		}
+		if len(kh.Hostnames) == 0 && v.Hostname != "" {
+			kh.Hostnames = []string{v.Hostname}
+		}
+		if len(v.Tags) > 0 {
+			kh.Tags = make(map[string]string, len(v.Tags))
+			for k, t := range v.Tags {
+				kh.Tags[k] = t
+			}
+		}
+		v.Mut.Unlock()
+		sort.Strings(kh.Hostnames)
+		if key, err := v.PublicKey(); err == nil {
+			kh.Fingerprint = Fingerprint(key)
+			kh.Keytype = key.Type()
+		}
+		r = append(r, kh)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		a, b := "", ""
+		if len(r[i].Hostnames) > 0 {
+			a = r[i].Hostnames[0]
+		}
+		if len(r[j].Hostnames) > 0 {
+			b = r[j].Hostnames[0]
+		}
+		if a != b {
+			return a < b
+		}
+		return r[i].Fingerprint < r[j].Fingerprint
+	})
+	return r
+}
+
+// RemoveHost forgets hostname, given as host, host:port or
+// [host]:port, with port 22 if none. A key known under other
+// names as well keeps those; a key left with no names is
+// deleted. RemoveHost reports whether hostname was found,
+// and if so Syncs, rewriting an ssh_known_hosts file in full.
+func (h *KnownHosts) RemoveHost(hostname string) (bool, error) {
+	if h.ReadOnly {
+		return false, fmt.Errorf("RemoveHost: %w", ErrKnownHostsReadOnly)
+	}
+	name := knownHostName(hostname)
+
+	found := false
+	h.Mut.Lock()
+	for k, v := range h.Hosts {
+		v.Mut.Lock()
+		entry := v.knownAsLocked(name)
+		if entry == "" {
+			v.Mut.Unlock()
+			continue
+		}
+		found = true
+		h.forgetName(k, v, entry)
+		v.Mut.Unlock()
+	}
+	h.Mut.Unlock()
+
+	if !found {
+		return false, nil
+	}
+	return true, h.syncAll()
+}
+
+// AddHostKey trusts key for hostname (host, host:port or
+// [host]:port), besides any keys already trusted for it,
+// and Syncs. A host may have several keys: any of them is
+// then KnownOK, so a rotated-in key can be staged before
+// the server starts presenting it, and the old key removed
+// later with RemoveHostKey.
+func (h *KnownHosts) AddHostKey(hostname string, key ssh.PublicKey) error {
+	if h.ReadOnly {
+		return fmt.Errorf("AddHostKey: %w", ErrKnownHostsReadOnly)
+	}
+	name := knownHostName(hostname)
+	human := string(ssh.MarshalAuthorizedKey(key))
+
+	h.Mut.Lock()
+	if h.Hosts == nil {
+		h.Hosts = make(map[string]*ServerPubKey)
+	}
+	v, already := h.Hosts[human]
+	if !already {
+		v = &ServerPubKey{
+			Hostname:                 h.storedHostName(name),
+			HumanKey:                 human,
+			Keytype:                  key.Type(),
+			Base64EncodededPublicKey: Base64ofPublicKey(key),
+			Comment: fmt.Sprintf("added_by_sshego_on_%v",
+				time.Now().Format(time.RFC3339)),
+			SplitHostnames: make(map[string]bool),
+		}
+		v.AddHostPort(v.Hostname)
+		h.Hosts[human] = v
+	}
+	h.Mut.Unlock()
+	if already {
+		h.addHostName(v, name)
+	}
+	return h.syncAll()
+}
+
+// RemoveHostKey stops trusting key for hostname, leaving
+// any other keys of the host alone, and reports whether
+// it had been trusted. See AddHostKey and RemoveHost.
+func (h *KnownHosts) RemoveHostKey(hostname string, key ssh.PublicKey) (bool, error) {
+	if h.ReadOnly {
+		return false, fmt.Errorf("RemoveHostKey: %w", ErrKnownHostsReadOnly)
+	}
+	name := knownHostName(hostname)
+	human := string(ssh.MarshalAuthorizedKey(key))
+
+	h.Mut.Lock()
+	v, ok := h.Hosts[human]
+	if !ok {
+		h.Mut.Unlock()
+		return false, nil
+	}
+	v.Mut.Lock()
+	entry := v.knownAsLocked(name)
+	if entry != "" {
+		h.forgetName(human, v, entry)
+	}
+	v.Mut.Unlock()
+	h.Mut.Unlock()
+	if entry == "" {
+		return false, nil
+	}
+	return true, h.syncAll()
+}
+
+// hasHost reports whether any key is trusted for hostport.
+func (h *KnownHosts) hasHost(hostport string) bool {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	for _, v := range h.Hosts {
+		if v.knownAs(hostport) {
+			return true
+		}
+	}
+	return false
+}
+
+// lenientLocalhost reports whether hostname is a loopback
+// name that, under SkipHostKeyCheckOnLocalhost, goes unchecked.
+func (h *KnownHosts) lenientLocalhost(hostname string) bool {
+	return h.SkipHostKeyCheckOnLocalhost && (strings.HasPrefix(hostname, "localhost") || strings.HasPrefix(hostname, "127.0.0.1"))
+}
+
+// HostKeys returns every key trusted for hostname
+// (host, host:port or [host]:port), sorted by fingerprint.
+func (h *KnownHosts) HostKeys(hostname string) []ssh.PublicKey {
+	name := knownHostName(hostname)
+	var keys []ssh.PublicKey
+	h.Mut.Lock()
+	for _, v := range h.Hosts {
+		if !v.knownAs(name) {
+			continue
+		}
+		if key, err := v.PublicKey(); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	h.Mut.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return Fingerprint(keys[i]) < Fingerprint(keys[j])
+	})
+	return keys
+}
+
+// LastStatus returns the outcome of the most recent host
+// key check against h: KnownOK for a host we knew,
+// AddedNew for one just added under -new, and so on.
+func (h *KnownHosts) LastStatus() HostState {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	return h.curStatus
+}
+
+// LastHost returns a copy of the record the most recent
+// host key check against h matched or added, or nil if
+// it matched none, or the record is gone since.
+func (h *KnownHosts) LastHost() *ServerPubKey {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	if h.curHost == nil {
+		return nil
+	}
+	return h.curHost.clone()
+}
+
+// forgetName removes name from v, the record under k,
+// deleting v once it has no names left. Both h.Mut
+// and v.Mut must be held.
+func (h *KnownHosts) forgetName(k string, v *ServerPubKey, name string) {
+	delete(v.SplitHostnames, name)
+	if len(v.SplitHostnames) == 0 {
+		delete(h.Hosts, k)
+	} else if v.Hostname == name {
+		rest := make([]string, 0, len(v.SplitHostnames))
+		for hn := range v.SplitHostnames {
+			rest = append(rest, hn)
+		}
+		sort.Strings(rest)
+		v.Hostname = rest[0]
+	}
+	v.AlreadySaved = false
+	if h.curHost == v && h.Hosts[k] != v {
+		h.curHost = nil
+	}
+}
+
+// knownHostName puts hostname in the host:port form
+// that SplitHostnames and Hostname hold.
+func knownHostName(hostname string) string {
+	if host, port, err := net.SplitHostPort(hostname); err == nil {
+		return host + ":" + port
+	}
+	return strings.Trim(hostname, "[]") + ":22"
+}
+
+// ListHosts returns a copy of every record in h, sorted
+// by Hostname and then key. Changing the copies changes
+// nothing in h; use SetComment, SetTag or RemoveHost.
+func (h *KnownHosts) ListHosts() []*ServerPubKey {
+	h.Mut.Lock()
+	r := make([]*ServerPubKey, 0, len(h.Hosts))
+	for _, v := range h.Hosts {
+		r = append(r, v.clone())
+	}
+	h.Mut.Unlock()
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Hostname != r[j].Hostname {
+			return r[i].Hostname < r[j].Hostname
+		}
+		return r[i].HumanKey < r[j].HumanKey
+	})
+	return r
+}
+
+// clone returns a deep copy of v, with a fresh Mut.
+func (v *ServerPubKey) clone() *ServerPubKey {
+	v.Mut.Lock()
+	defer v.Mut.Unlock()
+	c := &ServerPubKey{
+		Hostname:                 v.Hostname,
+		HumanKey:                 v.HumanKey,
+		ServerBanned:             v.ServerBanned,
+		remote:                   v.remote,
+		Markers:                  v.Markers,
+		Hostnames:                v.Hostnames,
+		Keytype:                  v.Keytype,
+		Base64EncodededPublicKey: v.Base64EncodededPublicKey,
+		Comment:                  v.Comment,
+		Port:                     v.Port,
+		LineInFileOneBased:       v.LineInFileOneBased,
+		AlreadySaved:             v.AlreadySaved,
+	}
+	if v.SplitHostnames != nil {
+		c.SplitHostnames = make(map[string]bool, len(v.SplitHostnames))
+		for hn, b := range v.SplitHostnames {
+			c.SplitHostnames[hn] = b
+		}
+	}
+	if v.Tags != nil {
+		c.Tags = make(map[string]string, len(v.Tags))
+		for k, t := range v.Tags {
+			c.Tags[k] = t
+		}
+	}
+	return c
+}
+
 // Close cleans up and prepares for shutdown. It calls h.Sync() to write
 // the state to disk.
 func (h *KnownHosts) Close() {
@@ -204,9 +961,10 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 	//pp("top of LoadSshKnownHosts for path = '%s'", path)
 
 	h := &KnownHosts{
-		Hosts:          make(map[string]*ServerPubKey),
-		FilepathPrefix: path,
-		PersistFormat:  KHSsh,
+		Hosts:                       make(map[string]*ServerPubKey),
+		FilepathPrefix:              path,
+		PersistFormat:               KHSsh,
+		SkipHostKeyCheckOnLocalhost: true,
 	}
 
 	if !fileExists(path) {
@@ -217,6 +975,15 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = h.parseSshKnownHosts(path, by); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseSshKnownHosts adds to h.Hosts the hosts in by, the
+// contents of the known_hosts file path.
+func (h *KnownHosts) parseSshKnownHosts(path string, by []byte) error {
 
 	killRightBracket := strings.NewReplacer("]", "")
 
@@ -227,15 +994,11 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 		if line == "" || line[0] == '#' {
 			continue
 		}
-		// skip hashed hostnames
-		if line[0] == '|' {
-			continue
-		}
 		splt := strings.Split(line, " ")
 		//pp("for line i = %v, splt = %#v\n", i, splt)
 		n := len(splt)
-		if n < 3 || n > 5 {
-			return nil, fmt.Errorf("known_hosts file '%s' did not have 3/4/5 fields on line %v: '%s'", path, i+1, lines[i])
+		if n < 3 {
+			return fmt.Errorf("known_hosts file '%s' did not have at least 3 fields on line %v: '%s'", path, i+1, lines[i])
 		}
 		b := 0
 		markers := ""
@@ -243,17 +1006,18 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 			markers = splt[0]
 			b = 1
 			if strings.Contains(markers, "@revoked") {
-				log.Printf("ignoring @revoked host key at line %v of path '%s': '%s'", i+1, path, lines[i])
+				DefaultLogger.Infof("ignoring @revoked host key at line %v of path '%s': '%s'", i+1, path, lines[i])
 				continue
 			}
 			if strings.Contains(markers, "@cert-authority") {
-				log.Printf("ignoring @cert-authority host key at line %v of path '%s': '%s'", i+1, path, lines[i])
+				DefaultLogger.Infof("ignoring @cert-authority host key at line %v of path '%s': '%s'", i+1, path, lines[i])
 				continue
 			}
 		}
 		comment := ""
 		if b+3 < n {
-			comment = splt[b+3]
+			// the comment runs to the end of the line.
+			comment = strings.Join(splt[b+3:], " ")
 		}
 		pubkey := ServerPubKey{
 			Markers:                  markers,
@@ -272,6 +1036,11 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 		for k := range hosts {
 			hst := hosts[k]
 			//pp("processing hst = '%s'\n", hst)
+			if isHashedHost(hst) {
+				pubkey.Hostname = hst
+				pubkey.SplitHostnames[hst] = true
+				continue
+			}
 			if hst[0] == '[' {
 				hst = hst[1:]
 				hst = killRightBracket.Replace(hst)
@@ -295,18 +1064,22 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 
 			hst := hosts[k]
 			//pp("processing hst = '%s'\n", hst)
-			if hst[0] == '[' {
-				hst = hst[1:]
-				hst = killRightBracket.Replace(hst)
-				//pp("after killing [], hst = '%s'\n", hst)
-			}
-			hostport := strings.Split(hst, ":")
-			//p("hostport = '%#v'\n", hostport)
-			if len(hostport) > 1 {
-				hst = hostport[0]
-				ourpubkey.Port = hostport[1]
+			if isHashedHost(hst) {
+				ourpubkey.Hostname = hst
+			} else {
+				if hst[0] == '[' {
+					hst = hst[1:]
+					hst = killRightBracket.Replace(hst)
+					//pp("after killing [], hst = '%s'\n", hst)
+				}
+				hostport := strings.Split(hst, ":")
+				//p("hostport = '%#v'\n", hostport)
+				if len(hostport) > 1 {
+					hst = hostport[0]
+					ourpubkey.Port = hostport[1]
+				}
+				ourpubkey.Hostname = hst + ":" + ourpubkey.Port
 			}
-			ourpubkey.Hostname = hst + ":" + ourpubkey.Port
 
 			// unbase64 the public key to get []byte, then string() that
 			// to get the key of h.Hosts
@@ -315,14 +1088,14 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 			expand := make([]byte, expandedMaxSize)
 			n, err := base64.StdEncoding.Decode(expand, []byte(ourpubkey.Base64EncodededPublicKey))
 			if err != nil {
-				log.Printf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s' we find the following error: could not base64 decode the public key field. detailed error: '%s'", path, i+1, lines[i], err)
+				DefaultLogger.Errorf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s' we find the following error: could not base64 decode the public key field. detailed error: '%s'", path, i+1, lines[i], err)
 				continue
 			}
 			expand = expand[:n]
 
 			xkey, err := ssh.ParsePublicKey(expand)
 			if err != nil {
-				log.Printf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s' we find the following error: could not ssh.ParsePublicKey(). detailed error: '%s'", path, i+1, lines[i], err)
+				DefaultLogger.Errorf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s' we find the following error: could not ssh.ParsePublicKey(). detailed error: '%s'", path, i+1, lines[i], err)
 				continue
 			}
 			se := string(ssh.MarshalAuthorizedKey(xkey))
@@ -331,7 +1104,7 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 			/* don't resolve now, this may be slow:
 			ourpubkey.remote, err = net.ResolveTCPAddr("tcp", ourpubkey.Hostname+":"+ourpubkey.Port)
 			if err != nil {
-				log.Printf("warning: ignoring entry known_hosts file '%s' on line %v: '%s' we find the following error: could not resolve the hostname '%s'. detailed error: '%s'", path, i+1, lines[i], ourpubkey.Hostname, err)
+				DefaultLogger.Errorf("warning: ignoring entry known_hosts file '%s' on line %v: '%s' we find the following error: could not resolve the hostname '%s'. detailed error: '%s'", path, i+1, lines[i], ourpubkey.Hostname, err)
 			}
 			*/
 			ourpubkey.AlreadySaved = true
@@ -350,7 +1123,7 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 		}
 	}
 
-	return h, nil
+	return nil
 }
 
 func (s *KnownHosts) saveSshKnownHosts() error {
@@ -379,45 +1152,188 @@ func (s *KnownHosts) saveSshKnownHosts() error {
 			continue
 		}
 
-		hostname := ""
-		if len(v.SplitHostnames) == 1 {
-			hn := v.Hostname
-			hp := strings.Split(hn, ":")
-			//pp("hn='%v', hp='%#v'", hn, hp)
-			if hp[1] != "22" {
-				hn = "[" + hp[0] + "]:" + hp[1]
+		for _, line := range v.sshKnownHostsLines() {
+			_, err = fmt.Fprintf(f, "%s\n", line)
+			if err != nil {
+				return fmt.Errorf("could not append to file '%s': '%s'", fn, err)
 			}
-			hostname = hn
-		} else {
-			// put all hostnames under this one key.
-			k := 0
-			for tmp := range v.SplitHostnames {
-				hp := strings.Split(tmp, ":")
-				if len(hp) != 2 {
-					panic(fmt.Sprintf("must be 2 parts here, but we got '%s'", tmp))
-				}
-				hn := "[" + hp[0] + "]:" + hp[1]
-				if k == 0 {
-					hostname = hn
-				} else {
-					hostname += "," + hn
-				}
-				k++
+		}
+		v.AlreadySaved = true
+	}
+
+	return f.Sync()
+}
+
+// saveSshKnownHostsMirror rewrites fn in full
+// with every host in s, in OpenSSH known_hosts format.
+func (s *KnownHosts) saveSshKnownHostsMirror(fn string) error {
+	s.Mut.Lock()
+	defer s.Mut.Unlock()
+
+	if s.NoSave {
+		return nil
+	}
+	return s.writeSshKnownHosts(fn)
+}
+
+// writeSshKnownHosts does the work of saveSshKnownHostsMirror
+// and ExportOpenSSHKnownHosts. s.Mut must be held.
+func (s *KnownHosts) writeSshKnownHosts(fn string) error {
+	// don't blow away the last good (fn) until the new version is completely written.
+	err := writeAtomic(fn, createPlain, s.writeSshKnownHostsLines)
+	if err != nil {
+		return fmt.Errorf("could not write file '%s': '%s'", fn, err)
+	}
+	return nil
+}
+
+// writeSshKnownHostsLines writes every host in s to w
+// in OpenSSH known_hosts format. s.Mut must be held.
+func (s *KnownHosts) writeSshKnownHostsLines(w io.Writer) error {
+	for _, v := range s.Hosts {
+		for _, line := range v.sshKnownHostsLines() {
+			if v.ServerBanned && !strings.Contains(v.Markers, "@revoked") {
+				line = "@revoked " + line
+			}
+			if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+				return err
 			}
 		}
+	}
+	return nil
+}
 
-		_, err = fmt.Fprintf(f, "%s %s %s %s\n",
+// ImportOpenSSHKnownHosts reads the OpenSSH known_hosts
+// file at path, as LoadSshKnownHosts does, and merges its
+// hosts into h: a key h already has gains the file's names
+// for it, and any other key is added. A host may have
+// several keys, one per line. Names are hashed on the way
+// in if h.HashHostnames. h is then Synced.
+func (h *KnownHosts) ImportOpenSSHKnownHosts(path string) error {
+	if h.ReadOnly {
+		return fmt.Errorf("ImportOpenSSHKnownHosts: %w", ErrKnownHostsReadOnly)
+	}
+	from, err := LoadSshKnownHosts(path)
+	if err != nil {
+		return fmt.Errorf("ImportOpenSSHKnownHosts: %v", err)
+	}
+
+	h.Mut.Lock()
+	if h.Hosts == nil {
+		h.Hosts = make(map[string]*ServerPubKey)
+	}
+	for k, v := range from.Hosts {
+		prior, already := h.Hosts[k]
+		if !already {
+			if h.HashHostnames {
+				v.hashNames()
+			}
+			v.AlreadySaved = false
+			h.Hosts[k] = v
+			continue
+		}
+		v.Mut.Lock()
+		names := make([]string, 0, len(v.SplitHostnames))
+		for name := range v.SplitHostnames {
+			names = append(names, name)
+		}
+		v.Mut.Unlock()
+		for _, name := range names {
+			h.addHostName(prior, name)
+		}
+	}
+	h.Mut.Unlock()
+
+	return h.syncAll()
+}
+
+// ExportOpenSSHKnownHosts writes every host in h to path
+// as an OpenSSH known_hosts file, for ssh, scp and git to
+// use, replacing any file there. Banned keys are written
+// as @revoked.
+func (h *KnownHosts) ExportOpenSSHKnownHosts(path string) error {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	if err := h.writeSshKnownHosts(path); err != nil {
+		return fmt.Errorf("ExportOpenSSHKnownHosts: %v", err)
+	}
+	return nil
+}
+
+// sshKnownHostsLines renders v as lines of an OpenSSH
+// known_hosts file, without newlines: one for its plain
+// hostnames, and one for each hashed hostname, since
+// OpenSSH allows but a single hashed name per line.
+func (v *ServerPubKey) sshKnownHostsLines() (lines []string) {
+	v.Mut.Lock()
+	defer v.Mut.Unlock()
+
+	render := func(hostname string) string {
+		line := fmt.Sprintf("%s %s %s %s",
 			hostname,
 			v.Keytype,
 			v.Base64EncodededPublicKey,
 			v.Comment)
-		if err != nil {
-			return fmt.Errorf("could not append to file '%s': '%s'", fn, err)
+		if v.Markers != "" {
+			line = v.Markers + " " + line
 		}
-		v.AlreadySaved = true
+		return line
 	}
 
-	return nil
+	var plain []string
+	for tmp := range v.SplitHostnames {
+		if isHashedHost(tmp) {
+			lines = append(lines, render(tmp))
+		} else {
+			plain = append(plain, tmp)
+		}
+	}
+	sort.Strings(lines)
+
+	hostname := ""
+	if len(v.SplitHostnames) == 1 && len(plain) == 1 {
+		hn := v.Hostname
+		hp := strings.Split(hn, ":")
+		//pp("hn='%v', hp='%#v'", hn, hp)
+		if hp[1] != "22" {
+			hn = "[" + hp[0] + "]:" + hp[1]
+		}
+		hostname = hn
+	} else {
+		// put all plain hostnames under this one key.
+		for k, tmp := range plain {
+			hp := strings.Split(tmp, ":")
+			if len(hp) != 2 {
+				panic(fmt.Sprintf("must be 2 parts here, but we got '%s'", tmp))
+			}
+			hn := "[" + hp[0] + "]:" + hp[1]
+			if k == 0 {
+				hostname = hn
+			} else {
+				hostname += "," + hn
+			}
+		}
+	}
+	if hostname != "" {
+		lines = append([]string{render(hostname)}, lines...)
+	}
+	return lines
+}
+
+// PublicKey parses the stored key back into an ssh.PublicKey,
+// for comparison or to take its Fingerprint() without
+// reconnecting. It reads HumanKey, or if that is empty,
+// Keytype and Base64EncodededPublicKey.
+func (v *ServerPubKey) PublicKey() (ssh.PublicKey, error) {
+	human := v.HumanKey
+	if human == "" {
+		human = v.Keytype + " " + v.Base64EncodededPublicKey
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(human))
+	if err != nil {
+		return nil, fmt.Errorf("ServerPubKey.PublicKey() for host '%s': %v", v.Hostname, err)
+	}
+	return key, nil
 }
 
 func Base64ofPublicKey(key ssh.PublicKey) string {
@@ -1,11 +1,21 @@
 package sshego
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/glycerine/go-unsnap-stream"
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/testdata"
+	"github.com/golang/snappy"
 
 	cv "github.com/glycerine/goconvey/convey"
 )
@@ -302,3 +312,903 @@ func Test303DedupKnownHosts(t *testing.T) {
 
 	})
 }
+
+func Test304SyncWritesOpenSSHMirror(t *testing.T) {
+
+	cv.Convey("With OpenSSHMirrorPath set, Sync() should also write a standard OpenSSH known_hosts file that LoadSshKnownHosts() reads back identically; with OpenSSHMirrorOnly it should skip the native format.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		h, err := LoadSshKnownHosts(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+
+		// switch h over to the native json format.
+		h.PersistFormat = KHJson
+		h.PersistFormatSuffix = ".json.snappy"
+		h.FilepathPrefix = tmpdir + "/kh"
+		h.OpenSSHMirrorPath = tmpdir + "/mirror_known_hosts"
+		h.Sync()
+
+		cv.So(fileExists(tmpdir+"/kh.json.snappy"), cv.ShouldBeTrue)
+		mirror, err := LoadSshKnownHosts(h.OpenSSHMirrorPath)
+		panicOn(err)
+		same, err := KnownHostsEqual(h, mirror)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+
+		h.FilepathPrefix = tmpdir + "/kh2"
+		h.OpenSSHMirrorOnly = true
+		h.Sync()
+		cv.So(fileExists(tmpdir+"/kh2.json.snappy"), cv.ShouldBeFalse)
+	})
+}
+
+func Test305EncryptedKnownHostsStore(t *testing.T) {
+
+	cv.Convey("NewEncryptedKnownHosts() should keep the json store encrypted at rest, readable only with the right passphrase.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		orig, err := LoadSshKnownHosts(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+
+		prefix := tmpdir + "/kh"
+		h, err := NewEncryptedKnownHosts(prefix, KHJson, "correct horse")
+		cv.So(err, cv.ShouldBeNil)
+		h.Hosts = orig.Hosts
+		h.Sync()
+
+		fn := prefix + h.PersistFormatSuffix
+		cv.So(isEncryptedKnownHosts(fn), cv.ShouldBeTrue)
+		by, err := ioutil.ReadFile(fn)
+		panicOn(err)
+		for _, v := range orig.Hosts {
+			cv.So(string(by), cv.ShouldNotContainSubstring, v.Hostname)
+		}
+
+		back, err := NewEncryptedKnownHosts(prefix, KHJson, "correct horse")
+		cv.So(err, cv.ShouldBeNil)
+		same, err := KnownHostsEqual(orig, back)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+
+		_, err = NewEncryptedKnownHosts(prefix, KHJson, "wrong horse")
+		cv.So(err, cv.ShouldEqual, ErrKnownHostsPassphrase)
+
+		_, err = NewKnownHosts(prefix, KHJson)
+		cv.So(err, cv.ShouldEqual, ErrKnownHostsPassphrase)
+
+		// the ssh_known_hosts format cannot be encrypted.
+		_, err = NewEncryptedKnownHosts(prefix, KHSsh, "correct horse")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// the passphrase is never written to a config file.
+		cfg := NewSshegoConfig()
+		cfg.KnownHostsPassphrase = "correct horse"
+		var buf bytes.Buffer
+		panicOn(cfg.SaveConfig(&buf))
+		cv.So(buf.String(), cv.ShouldNotContainSubstring, "correct horse")
+	})
+}
+
+func Test306NewOnAKnownHostIsATypedError(t *testing.T) {
+
+	cv.Convey("HostAlreadyKnown() with addIfNotKnown on an already known host should say KnownOK, with ErrNewNotNeeded for SSHConnect to fail or, under NewOKIfKnown, merely warn about.", t, func() {
+		h, err := LoadSshKnownHosts("./testdata/fake_known_hosts")
+		panicOn(err)
+
+		for pubBytes, rec := range h.Hosts {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubBytes))
+			panicOn(err)
+
+			state, _, err := h.HostAlreadyKnown(rec.Hostname, nil, key, []byte(pubBytes), true, false)
+			cv.So(state, cv.ShouldEqual, KnownOK)
+			cv.So(err, cv.ShouldEqual, ErrNewNotNeeded)
+
+			state, _, err = h.HostAlreadyKnown(rec.Hostname, nil, key, []byte(pubBytes), false, false)
+			cv.So(state, cv.ShouldEqual, KnownOK)
+			cv.So(err, cv.ShouldBeNil)
+		}
+	})
+}
+
+func Test307ReplaceAllSwapsTheWholeStore(t *testing.T) {
+
+	cv.Convey("ReplaceAll() should swap in the given hosts as the complete trust list, and Sync them, so that a reload sees only the new set.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		orig, err := LoadSshKnownHosts(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+		cv.So(len(orig.Hosts), cv.ShouldEqual, 4)
+
+		// keep two of the four, keyed without the
+		// trailing newline that ReplaceAll restores.
+		pushed := make(map[string]*ServerPubKey)
+		for k, v := range orig.Hosts {
+			if len(pushed) == 2 {
+				break
+			}
+			pushed[strings.TrimSpace(k)] = v
+		}
+
+		for _, format := range []KnownHostsPersistFormat{KHJson, KHSsh} {
+			var h *KnownHosts
+			if format == KHSsh {
+				by, err := ioutil.ReadFile(origdir + "/testdata/fake_known_hosts")
+				panicOn(err)
+				panicOn(ioutil.WriteFile(tmpdir+"/known_hosts", by, 0600))
+				h, err = LoadSshKnownHosts(tmpdir + "/known_hosts")
+				panicOn(err)
+			} else {
+				h, err = NewKnownHosts(tmpdir+"/kh", KHJson)
+				panicOn(err)
+				h.Hosts = orig.Hosts
+				h.Sync()
+			}
+
+			cv.So(h.ReplaceAll(pushed), cv.ShouldBeNil)
+			cv.So(len(h.Hosts), cv.ShouldEqual, 2)
+
+			var back *KnownHosts
+			if format == KHSsh {
+				back, err = LoadSshKnownHosts(tmpdir + "/known_hosts")
+			} else {
+				back, err = NewKnownHosts(tmpdir+"/kh", KHJson)
+			}
+			panicOn(err)
+			same, err := KnownHostsEqual(h, back)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(same, cv.ShouldBeTrue)
+
+			// a bad key leaves the store as it was.
+			err = h.ReplaceAll(map[string]*ServerPubKey{"not a key": &ServerPubKey{}})
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(len(h.Hosts), cv.ShouldEqual, 2)
+		}
+
+		// the store holds copies: changing the
+		// caller's records later does not reach
+		// into the store.
+		for _, v := range pushed {
+			v.ServerBanned = true
+		}
+		h, err := NewKnownHosts(tmpdir+"/kh3", KHJson)
+		panicOn(err)
+		cv.So(h.ReplaceAll(pushed), cv.ShouldBeNil)
+		for k, v := range pushed {
+			v.ServerBanned = false
+			cv.So(h.Hosts[k+"\n"].ServerBanned, cv.ShouldBeTrue)
+		}
+	})
+}
+
+func Test309ServerPubKeyParsesBackToAPublicKey(t *testing.T) {
+
+	cv.Convey("ServerPubKey.PublicKey() should give back the ssh.PublicKey stored in HumanKey, or in Keytype and Base64EncodededPublicKey when HumanKey is empty, and fail on garbage.", t, func() {
+		h, err := LoadSshKnownHosts("./testdata/fake_known_hosts")
+		panicOn(err)
+
+		for pubBytes, rec := range h.Hosts {
+			want, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubBytes))
+			panicOn(err)
+
+			key, err := rec.PublicKey()
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(Fingerprint(key), cv.ShouldEqual, Fingerprint(want))
+
+			bare := &ServerPubKey{
+				Keytype:                  want.Type(),
+				Base64EncodededPublicKey: Base64ofPublicKey(want),
+			}
+			key, err = bare.PublicKey()
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(key.Marshal(), cv.ShouldResemble, want.Marshal())
+		}
+
+		_, err = (&ServerPubKey{Hostname: "bad", HumanKey: "not a key"}).PublicKey()
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+}
+
+func Test310ReadOnlyKnownHostsNeverChange(t *testing.T) {
+
+	cv.Convey("A ReadOnly KnownHosts should refuse to Sync or ReplaceAll, and HostAlreadyKnown should reject an unknown host with ErrKnownHostsReadOnly even when asked to add it, while known hosts still check out.", t, func() {
+		h, err := LoadSshKnownHosts("./testdata/fake_known_hosts")
+		panicOn(err)
+		h.ReadOnly = true
+		n := len(h.Hosts)
+
+		cv.So(h.Sync(), cv.ShouldEqual, ErrKnownHostsReadOnly)
+		cv.So(errors.Is(h.ReplaceAll(nil), ErrKnownHostsReadOnly), cv.ShouldBeTrue)
+		cv.So(len(h.Hosts), cv.ShouldEqual, n)
+
+		for pubBytes, rec := range h.Hosts {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubBytes))
+			panicOn(err)
+			state, _, err := h.HostAlreadyKnown(rec.Hostname, nil, key, []byte(pubBytes), false, false)
+			cv.So(state, cv.ShouldEqual, KnownOK)
+			cv.So(err, cv.ShouldBeNil)
+		}
+
+		signer, err := ssh.ParsePrivateKey(testdata.PEMBytes["ed25519"])
+		panicOn(err)
+		key := signer.PublicKey()
+		pubBytes := ssh.MarshalAuthorizedKey(key)
+		state, _, err := h.HostAlreadyKnown("newhost.example.com:22", nil, key, pubBytes, true, true)
+		cv.So(state, cv.ShouldEqual, Unknown)
+		cv.So(errors.Is(err, ErrKnownHostsReadOnly), cv.ShouldBeTrue)
+		cv.So(len(h.Hosts), cv.ShouldEqual, n)
+	})
+}
+
+func Test311CommentsAndTagsArePersistedAndListed(t *testing.T) {
+
+	cv.Convey("SetComment() and SetTag() should annotate a known host, survive a reload (tags in json only), and show up in List().", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		by, err := ioutil.ReadFile(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+		panicOn(ioutil.WriteFile(tmpdir+"/known_hosts", by, 0600))
+		orig, err := LoadSshKnownHosts(tmpdir + "/known_hosts")
+		panicOn(err)
+
+		var key ssh.PublicKey
+		for _, v := range orig.Hosts {
+			key, err = v.PublicKey()
+			panicOn(err)
+			break
+		}
+		fp := Fingerprint(key)
+		find := func(h *KnownHosts) (r KnownHost) {
+			for _, kh := range h.List() {
+				if kh.Fingerprint == fp {
+					r = kh
+				}
+			}
+			return
+		}
+
+		js, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		js.Hosts = orig.Hosts
+		js.Sync()
+
+		for _, h := range []*KnownHosts{js, orig} {
+			cv.So(h.SetComment(key, "prod db bastion"), cv.ShouldBeNil)
+			cv.So(h.SetTag(key, "owner", "dba-team"), cv.ShouldBeNil)
+			cv.So(h.SetTag(key, "ticket", "OPS-12"), cv.ShouldBeNil)
+			cv.So(h.SetTag(key, "ticket", ""), cv.ShouldBeNil)
+		}
+
+		jsBack, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		kh := find(jsBack)
+		cv.So(kh.Comment, cv.ShouldEqual, "prod db bastion")
+		cv.So(kh.Tags, cv.ShouldResemble, map[string]string{"owner": "dba-team"})
+		cv.So(len(kh.Hostnames), cv.ShouldBeGreaterThan, 0)
+
+		// the ssh format is rewritten, not appended to,
+		// and keeps the multi-word comment.
+		sshBack, err := LoadSshKnownHosts(tmpdir + "/known_hosts")
+		panicOn(err)
+		cv.So(len(sshBack.Hosts), cv.ShouldEqual, len(orig.Hosts))
+		cv.So(find(sshBack).Comment, cv.ShouldEqual, "prod db bastion")
+
+		// List is sorted and hands out copies.
+		all := js.List()
+		cv.So(len(all), cv.ShouldEqual, len(orig.Hosts))
+		for i := 1; i < len(all); i++ {
+			cv.So(all[i-1].Hostnames[0] <= all[i].Hostnames[0], cv.ShouldBeTrue)
+		}
+		find(js).Tags["owner"] = "mallory"
+		cv.So(find(js).Tags["owner"], cv.ShouldEqual, "dba-team")
+
+		// errors.
+		other, err := ssh.ParsePrivateKey(testdata.PEMBytes["ed25519"])
+		panicOn(err)
+		cv.So(errors.Is(js.SetTag(other.PublicKey(), "a", "b"), ErrNoSuchHostKey), cv.ShouldBeTrue)
+		cv.So(js.SetComment(key, "two\nlines"), cv.ShouldNotBeNil)
+		js.ReadOnly = true
+		cv.So(errors.Is(js.SetComment(key, "x"), ErrKnownHostsReadOnly), cv.ShouldBeTrue)
+	})
+}
+
+func Test312ConfirmAddsHoldsNewHostsUntilConfirmed(t *testing.T) {
+
+	cv.Convey("With ConfirmAdds, -new should report AddedNew with the record but store nothing until ConfirmAdd(record); RejectAdd(record) should drop it.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		h, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		h.ConfirmAdds = true
+
+		seen := func(name string) (HostState, *ServerPubKey, error) {
+			signer, err := ssh.ParsePrivateKey(testdata.PEMBytes[name])
+			panicOn(err)
+			key := signer.PublicKey()
+			return h.HostAlreadyKnown("example.com:22", nil, key, ssh.MarshalAuthorizedKey(key), true, false)
+		}
+
+		state, rec, err := seen("ed25519")
+		cv.So(state, cv.ShouldEqual, AddedNew)
+		cv.So(errors.Is(err, ErrAddPending), cv.ShouldBeTrue)
+		cv.So(rec, cv.ShouldNotBeNil)
+		cv.So(len(h.Hosts), cv.ShouldEqual, 0)
+		cv.So(len(h.PendingAdds()), cv.ShouldEqual, 1)
+
+		// seen again before confirming: still one pending record.
+		_, rec2, _ := seen("ed25519")
+		cv.So(rec2, cv.ShouldEqual, rec)
+
+		cv.So(h.ConfirmAdd(rec), cv.ShouldBeNil)
+		cv.So(len(h.PendingAdds()), cv.ShouldEqual, 0)
+		back, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		cv.So(len(back.Hosts), cv.ShouldEqual, 1)
+
+		// now known.
+		h.ConfirmAdds = false
+		state, _, err = seen("ed25519")
+		cv.So(state, cv.ShouldEqual, KnownOK)
+		h.ConfirmAdds = true
+
+		// a rejected key is never stored.
+		_, rec, _ = seen("rsa")
+		cv.So(h.RejectAdd(rec), cv.ShouldBeNil)
+		cv.So(len(h.Hosts), cv.ShouldEqual, 1)
+		cv.So(errors.Is(h.ConfirmAdd(rec), ErrNoSuchHostKey), cv.ShouldBeTrue)
+	})
+}
+
+func Test313RemoveHostForgetsAHostAndListHostsIsSorted(t *testing.T) {
+
+	cv.Convey("ListHosts() should hand out sorted copies, and RemoveHost() should forget a host and persist that, in both ssh and json formats.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		by, err := ioutil.ReadFile(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+		panicOn(ioutil.WriteFile(tmpdir+"/known_hosts", by, 0600))
+		sshh, err := LoadSshKnownHosts(tmpdir + "/known_hosts")
+		panicOn(err)
+		n := len(sshh.Hosts)
+		cv.So(n, cv.ShouldBeGreaterThan, 1)
+
+		all := sshh.ListHosts()
+		cv.So(len(all), cv.ShouldEqual, n)
+		for i := 1; i < len(all); i++ {
+			cv.So(all[i-1].Hostname <= all[i].Hostname, cv.ShouldBeTrue)
+		}
+		all[0].Comment = "changed"
+		cv.So(sshh.ListHosts()[0].Comment, cv.ShouldNotEqual, "changed")
+
+		js, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		for _, v := range sshh.ListHosts() {
+			js.Hosts[v.HumanKey] = v
+		}
+		js.Sync()
+
+		has := func(h *KnownHosts, name string) bool {
+			for _, v := range h.ListHosts() {
+				if v.SplitHostnames[name] {
+					return true
+				}
+			}
+			return false
+		}
+		for _, h := range []*KnownHosts{sshh, js} {
+			cv.So(has(h, "10.0.0.200:22"), cv.ShouldBeTrue)
+			found, err := h.RemoveHost("10.0.0.200")
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(found, cv.ShouldBeTrue)
+			cv.So(has(h, "10.0.0.200:22"), cv.ShouldBeFalse)
+			cv.So(len(h.Hosts), cv.ShouldEqual, n-1)
+
+			found, err = h.RemoveHost("10.9.9.9:22")
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(found, cv.ShouldBeFalse)
+		}
+
+		sshBack, err := LoadSshKnownHosts(tmpdir + "/known_hosts")
+		panicOn(err)
+		cv.So(len(sshBack.Hosts), cv.ShouldEqual, n-1)
+		cv.So(has(sshBack, "10.0.0.200:22"), cv.ShouldBeFalse)
+		cv.So(has(sshBack, "10.0.0.201:22"), cv.ShouldBeTrue)
+
+		jsBack, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		cv.So(len(jsBack.Hosts), cv.ShouldEqual, n-1)
+		cv.So(has(jsBack, "10.0.0.200:22"), cv.ShouldBeFalse)
+
+		jsBack.ReadOnly = true
+		_, err = jsBack.RemoveHost("10.0.0.201:22")
+		cv.So(errors.Is(err, ErrKnownHostsReadOnly), cv.ShouldBeTrue)
+	})
+}
+
+func Test314HashedHostnamesMatchLikeOpenSSH(t *testing.T) {
+
+	cv.Convey("Hostnames hashed by OpenSSH's HashKnownHosts should be matched, and HashHostnames and HashAll() should keep plaintext hostnames out of the stores.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		plain, err := LoadSshKnownHosts(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+		var key ssh.PublicKey
+		for _, v := range plain.Hosts {
+			if v.SplitHostnames["10.0.0.201:22"] {
+				key, err = v.PublicKey()
+				panicOn(err)
+			}
+		}
+		cv.So(key, cv.ShouldNotBeNil)
+		pubBytes := ssh.MarshalAuthorizedKey(key)
+		state := func(h *KnownHosts, hostname string) HostState {
+			st, _, _ := h.HostAlreadyKnown(hostname, nil, key, pubBytes, false, false)
+			return st
+		}
+
+		// written by ssh-keygen -H, with 10.0.0.201 also on port 2222.
+		hashed, err := LoadSshKnownHosts(origdir + "/testdata/fake_known_hosts_hashed")
+		panicOn(err)
+		cv.So(len(hashed.Hosts), cv.ShouldEqual, len(plain.Hosts))
+		cv.So(state(hashed, "10.0.0.201:22"), cv.ShouldEqual, KnownOK)
+		cv.So(state(hashed, "10.0.0.201:2222"), cv.ShouldEqual, KnownOK)
+		cv.So(state(hashed, "10.0.0.201:2200"), cv.ShouldEqual, KnownRecordMismatch)
+		cv.So(state(hashed, "10.0.0.209:22"), cv.ShouldEqual, KnownRecordMismatch)
+
+		// HashAll rewrites an ssh_known_hosts file with no plaintext names.
+		by, err := ioutil.ReadFile(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+		panicOn(ioutil.WriteFile(tmpdir+"/known_hosts", by, 0600))
+		sshh, err := LoadSshKnownHosts(tmpdir + "/known_hosts")
+		panicOn(err)
+		cv.So(sshh.HashAll(), cv.ShouldBeNil)
+		by, err = ioutil.ReadFile(tmpdir + "/known_hosts")
+		panicOn(err)
+		cv.So(string(by), cv.ShouldNotContainSubstring, "10.0.0.")
+		sshBack, err := LoadSshKnownHosts(tmpdir + "/known_hosts")
+		panicOn(err)
+		cv.So(len(sshBack.Hosts), cv.ShouldEqual, len(plain.Hosts))
+		cv.So(state(sshBack, "10.0.0.201:22"), cv.ShouldEqual, KnownOK)
+		found, err := sshBack.RemoveHost("10.0.0.201")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(found, cv.ShouldBeTrue)
+		cv.So(len(sshBack.Hosts), cv.ShouldEqual, len(plain.Hosts)-1)
+
+		// with HashHostnames, hosts added are stored hashed.
+		js, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		js.HashHostnames = true
+		st, _, err := js.HostAlreadyKnown("example.com:2022", nil, key, pubBytes, true, true)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(st, cv.ShouldEqual, KnownOK)
+		js.HostAlreadyKnown("example.com:22", nil, key, pubBytes, true, true)
+		js.Sync()
+		jsBack, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		all := jsBack.List()
+		cv.So(len(all), cv.ShouldEqual, 1)
+		cv.So(len(all[0].Hostnames), cv.ShouldEqual, 2)
+		for _, hn := range all[0].Hostnames {
+			cv.So(isHashedHost(hn), cv.ShouldBeTrue)
+		}
+		cv.So(state(jsBack, "example.com:2022"), cv.ShouldEqual, KnownOK)
+		cv.So(state(jsBack, "example.com:22"), cv.ShouldEqual, KnownOK)
+		cv.So(state(jsBack, "example.org:22"), cv.ShouldEqual, KnownRecordMismatch)
+	})
+}
+
+func Test315ImportAndExportOpenSSHKnownHosts(t *testing.T) {
+
+	cv.Convey("ImportOpenSSHKnownHosts() should merge an OpenSSH known_hosts file into the store, several keys per host included, and ExportOpenSSHKnownHosts() should write it all back out.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		pub := func(name string) ssh.PublicKey {
+			signer, err := ssh.ParsePrivateKey(testdata.PEMBytes[name])
+			panicOn(err)
+			return signer.PublicKey()
+		}
+		rsa, ed := pub("rsa"), pub("ed25519")
+		line := func(hosts string, key ssh.PublicKey) string {
+			return hosts + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		}
+		file := strings.Join([]string{
+			"# fleet known hosts",
+			"",
+			line("db1.example", rsa) + " the new key",
+			line("db1.example,[db1.example]:2222", ed),
+			"   ",
+		}, "\n")
+		panicOn(ioutil.WriteFile(tmpdir+"/known_hosts", []byte(file), 0600))
+
+		// the store already knows ed under another name.
+		h, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		h.HostAlreadyKnown("old.example:22", nil, ed, ssh.MarshalAuthorizedKey(ed), true, true)
+
+		cv.So(h.ImportOpenSSHKnownHosts(tmpdir+"/known_hosts"), cv.ShouldBeNil)
+		state := func(h *KnownHosts, hostname string, key ssh.PublicKey) HostState {
+			st, _, _ := h.HostAlreadyKnown(hostname, nil, key, ssh.MarshalAuthorizedKey(key), false, false)
+			return st
+		}
+		check := func(h *KnownHosts) {
+			cv.So(len(h.Hosts), cv.ShouldEqual, 2)
+			cv.So(state(h, "db1.example:22", rsa), cv.ShouldEqual, KnownOK)
+			cv.So(state(h, "db1.example:22", ed), cv.ShouldEqual, KnownOK)
+			cv.So(state(h, "db1.example:2222", ed), cv.ShouldEqual, KnownOK)
+			cv.So(state(h, "old.example:22", ed), cv.ShouldEqual, KnownOK)
+			cv.So(state(h, "db1.example:2222", rsa), cv.ShouldEqual, KnownRecordMismatch)
+		}
+		check(h)
+		back, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		check(back)
+
+		cv.So(h.ExportOpenSSHKnownHosts(tmpdir+"/exported"), cv.ShouldBeNil)
+		exported, err := LoadSshKnownHosts(tmpdir + "/exported")
+		panicOn(err)
+		check(exported)
+		cv.So(exported.Hosts[string(ssh.MarshalAuthorizedKey(rsa))].Comment, cv.ShouldEqual, "the new key")
+
+		cv.So(h.ImportOpenSSHKnownHosts(tmpdir+"/no-such-file"), cv.ShouldNotBeNil)
+		h.ReadOnly = true
+		cv.So(errors.Is(h.ImportOpenSSHKnownHosts(tmpdir+"/known_hosts"), ErrKnownHostsReadOnly), cv.ShouldBeTrue)
+	})
+}
+
+func Test316NoLocalhostSkipChecksLoopbackLikeAnyHost(t *testing.T) {
+
+	cv.Convey("Under -new, a known key seen on 127.0.0.1 should be quietly given that name, unless SkipHostKeyCheckOnLocalhost is cleared: then it is checked as for any other host.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		h, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		signer, err := ssh.ParsePrivateKey(testdata.PEMBytes["ed25519"])
+		panicOn(err)
+		key := signer.PublicKey()
+		pubBytes := ssh.MarshalAuthorizedKey(key)
+		h.HostAlreadyKnown("127.0.0.1:2022", nil, key, pubBytes, true, true)
+
+		// lenient, by default.
+		cv.So(h.SkipHostKeyCheckOnLocalhost, cv.ShouldBeTrue)
+		state, _, err := h.HostAlreadyKnown("127.0.0.1:2022", nil, key, pubBytes, true, false)
+		cv.So(state, cv.ShouldEqual, AddedNew)
+		cv.So(err, cv.ShouldNotEqual, ErrNewNotNeeded)
+
+		h.SkipHostKeyCheckOnLocalhost = false
+		state, _, err = h.HostAlreadyKnown("127.0.0.1:2022", nil, key, pubBytes, true, false)
+		cv.So(state, cv.ShouldEqual, KnownOK)
+		cv.So(err, cv.ShouldEqual, ErrNewNotNeeded)
+
+		// without -new, a name the key was never seen under is a mismatch.
+		state, _, _ = h.HostAlreadyKnown("127.0.0.1:2200", nil, key, pubBytes, false, false)
+		cv.So(state, cv.ShouldEqual, KnownRecordMismatch)
+		state, _, err = h.HostAlreadyKnown("127.0.0.1:2022", nil, key, pubBytes, false, false)
+		cv.So(state, cv.ShouldEqual, KnownOK)
+		cv.So(err, cv.ShouldBeNil)
+	})
+}
+
+func Test317AHostMayHoldSeveralKeysForRotation(t *testing.T) {
+
+	cv.Convey("AddHostKey should stage a second key for a host, after which either key is KnownOK; a key the host was never given is a mismatch, and RemoveHostKey retires the old key.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		h, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		key := func(name string) ssh.PublicKey {
+			signer, err := ssh.ParsePrivateKey(testdata.PEMBytes[name])
+			panicOn(err)
+			return signer.PublicKey()
+		}
+		oldKey, newKey, otherKey := key("rsa"), key("ed25519"), key("ecdsa")
+		state := func(h *KnownHosts, hostport string, k ssh.PublicKey) HostState {
+			st, _, _ := h.HostAlreadyKnown(hostport, nil, k, ssh.MarshalAuthorizedKey(k), false, false)
+			return st
+		}
+
+		panicOn(h.AddHostKey("db1.example", oldKey))
+		cv.So(state(h, "db1.example:22", oldKey), cv.ShouldEqual, KnownOK)
+		cv.So(state(h, "db1.example:22", newKey), cv.ShouldEqual, KnownRecordMismatch)
+		cv.So(state(h, "db2.example:22", newKey), cv.ShouldEqual, Unknown)
+
+		// stage the rotation.
+		panicOn(h.AddHostKey("db1.example:22", newKey))
+		cv.So(state(h, "db1.example:22", oldKey), cv.ShouldEqual, KnownOK)
+		cv.So(state(h, "db1.example:22", newKey), cv.ShouldEqual, KnownOK)
+		cv.So(state(h, "db1.example:22", otherKey), cv.ShouldEqual, KnownRecordMismatch)
+		cv.So(len(h.HostKeys("db1.example")), cv.ShouldEqual, 2)
+
+		// a key already held for another host is merged, not duplicated.
+		panicOn(h.AddHostKey("[db3.example]:2222", otherKey))
+		panicOn(h.AddHostKey("db1.example", otherKey))
+		cv.So(state(h, "db1.example:22", otherKey), cv.ShouldEqual, KnownOK)
+		cv.So(state(h, "db3.example:2222", otherKey), cv.ShouldEqual, KnownOK)
+
+		// survives a reload.
+		back, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		cv.So(len(back.HostKeys("db1.example:22")), cv.ShouldEqual, 3)
+
+		// retire the old key.
+		gone, err := h.RemoveHostKey("db1.example", oldKey)
+		panicOn(err)
+		cv.So(gone, cv.ShouldBeTrue)
+		gone, err = h.RemoveHostKey("db1.example", oldKey)
+		panicOn(err)
+		cv.So(gone, cv.ShouldBeFalse)
+		cv.So(state(h, "db1.example:22", oldKey), cv.ShouldEqual, KnownRecordMismatch)
+		cv.So(state(h, "db1.example:22", newKey), cv.ShouldEqual, KnownOK)
+		cv.So(state(h, "db3.example:2222", otherKey), cv.ShouldEqual, KnownOK)
+
+		h.ReadOnly = true
+		cv.So(errors.Is(h.AddHostKey("db1.example", oldKey), ErrKnownHostsReadOnly), cv.ShouldBeTrue)
+	})
+}
+
+func Test318LastStatusAndLastHostReportTheHostKeyCheck(t *testing.T) {
+
+	cv.Convey("after SSHConnect, LastStatus and LastHost should tell whether the host was just added under -new, or already known, and give its record.", t, func() {
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		h := s.CliCfg.KnownHosts
+		cv.So(h.LastStatus(), cv.ShouldEqual, Unknown)
+		cv.So(h.LastHost(), cv.ShouldBeNil)
+
+		connect := func() error {
+			halt := ssh.NewHalter()
+			defer halt.RequestStop()
+			cli, _, err := s.CliCfg.SSHConnect(context.Background(), h, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			if err == nil {
+				cli.Close()
+			}
+			return err
+		}
+
+		// -new adds the host, then asks for a re-run without it.
+		s.CliCfg.TestAllowOneshotConnect = false
+		cv.So(connect(), cv.ShouldNotBeNil)
+		cv.So(h.LastStatus(), cv.ShouldEqual, AddedNew)
+		added := h.LastHost()
+		cv.So(added, cv.ShouldNotBeNil)
+
+		s.CliCfg.AddIfNotKnown = false
+		cv.So(connect(), cv.ShouldBeNil)
+		cv.So(h.LastStatus(), cv.ShouldEqual, KnownOK)
+		known := h.LastHost()
+		cv.So(known, cv.ShouldNotBeNil)
+		cv.So(known.HumanKey, cv.ShouldEqual, added.HumanKey)
+
+		// a copy: changing it leaves h alone.
+		known.Comment = "changed"
+		cv.So(h.LastHost().Comment, cv.ShouldNotEqual, "changed")
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test319SyncReplacesTheStoreAtomically(t *testing.T) {
+
+	cv.Convey("Sync should replace the store whole, by way of a temp file renamed into place, so that a write failing part way leaves the last good store, and no temp file, behind.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		signer, err := ssh.ParsePrivateKey(testdata.PEMBytes["ed25519"])
+		panicOn(err)
+		key := signer.PublicKey()
+
+		dir := tmpdir + "/store"
+		h, err := NewKnownHosts(dir+"/kh", KHJson)
+		panicOn(err)
+		panicOn(h.AddHostKey("db1.example", key))
+		fn := h.FilepathPrefix + h.PersistFormatSuffix
+		good, err := ioutil.ReadFile(fn)
+		panicOn(err)
+
+		// a write that dies part way.
+		err = writeAtomic(fn, createPlain, func(w io.Writer) error {
+			w.Write([]byte("half a store"))
+			return fmt.Errorf("crashed")
+		})
+		cv.So(err, cv.ShouldNotBeNil)
+		now, err := ioutil.ReadFile(fn)
+		panicOn(err)
+		cv.So(bytes.Equal(now, good), cv.ShouldBeTrue)
+
+		back, err := NewKnownHosts(dir+"/kh", KHJson)
+		panicOn(err)
+		cv.So(len(back.HostKeys("db1.example")), cv.ShouldEqual, 1)
+
+		// only the store, and its .prev backup, remain.
+		names, err := filepath.Glob(dir + "/*")
+		panicOn(err)
+		cv.So(len(names), cv.ShouldBeGreaterThan, 0)
+		for _, name := range names {
+			cv.So(strings.Contains(name, ".new"), cv.ShouldBeFalse)
+		}
+	})
+}
+
+func Test320SaveAndLoadWithoutTheFilesystem(t *testing.T) {
+
+	cv.Convey("Save should write the store to an io.Writer just as Sync writes it to the file, and Load should read it back, for plain, encrypted, and ssh_known_hosts stores, without touching the filesystem.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		orig, err := LoadSshKnownHosts(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+
+		h, err := NewKnownHosts(tmpdir+"/kh", KHJson)
+		panicOn(err)
+		h.Hosts = orig.Hosts
+		var blob bytes.Buffer
+		cv.So(h.Save(&blob), cv.ShouldBeNil)
+		names, err := filepath.Glob(tmpdir + "/*")
+		panicOn(err)
+		cv.So(len(names), cv.ShouldEqual, 0)
+
+		back := &KnownHosts{PersistFormat: KHJson}
+		cv.So(back.Load(bytes.NewReader(blob.Bytes())), cv.ShouldBeNil)
+		same, err := KnownHostsEqual(orig, back)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+
+		// Sync writes just what Save does.
+		panicOn(h.Sync())
+		onDisk, err := ioutil.ReadFile(tmpdir + "/kh.json.snappy")
+		panicOn(err)
+		cv.So(bytes.Equal(onDisk, blob.Bytes()), cv.ShouldBeTrue)
+
+		// Load replaces what was there, rather than merging.
+		signer, err := ssh.ParsePrivateKey(testdata.PEMBytes["ed25519"])
+		panicOn(err)
+		panicOn(back.AddHostKey("extra.example", signer.PublicKey()))
+		cv.So(back.Load(bytes.NewReader(blob.Bytes())), cv.ShouldBeNil)
+		cv.So(len(back.HostKeys("extra.example")), cv.ShouldEqual, 0)
+
+		// a blob that does not decode leaves the store as it was,
+		// and still writable.
+		var bad bytes.Buffer
+		sw := snappy.NewBufferedWriter(&bad)
+		_, err = sw.Write([]byte(`{"Hosts": not json`))
+		panicOn(err)
+		panicOn(sw.Close())
+		cv.So(back.Load(&bad), cv.ShouldNotBeNil)
+		same, err = KnownHostsEqual(orig, back)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+		panicOn(back.AddHostKey("extra.example", signer.PublicKey()))
+		cv.So(len(back.HostKeys("extra.example")), cv.ShouldEqual, 1)
+
+		// a store saved encrypted needs the passphrase to Load.
+		enc, err := NewEncryptedKnownHosts(tmpdir+"/enc", KHJson, "correct horse")
+		panicOn(err)
+		enc.Hosts = orig.Hosts
+		blob.Reset()
+		cv.So(enc.Save(&blob), cv.ShouldBeNil)
+		cv.So(isSealed(blob.Bytes()), cv.ShouldBeTrue)
+		cv.So(back.Load(bytes.NewReader(blob.Bytes())), cv.ShouldEqual, ErrKnownHostsPassphrase)
+		encBack, err := NewEncryptedKnownHosts(tmpdir+"/enc", KHJson, "correct horse")
+		panicOn(err)
+		cv.So(encBack.Load(bytes.NewReader(blob.Bytes())), cv.ShouldBeNil)
+		same, err = KnownHostsEqual(orig, encBack)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+
+		// and an ssh_known_hosts store round trips as OpenSSH lines.
+		blob.Reset()
+		cv.So(orig.Save(&blob), cv.ShouldBeNil)
+		cv.So(blob.String(), cv.ShouldContainSubstring, "ssh-rsa ")
+		sshBack := &KnownHosts{PersistFormat: KHSsh}
+		cv.So(sshBack.Load(&blob), cv.ShouldBeNil)
+		for k := range orig.Hosts {
+			_, ok := sshBack.Hosts[k]
+			cv.So(ok, cv.ShouldBeTrue)
+		}
+
+		names, err = filepath.Glob(tmpdir + "/enc*")
+		panicOn(err)
+		cv.So(len(names), cv.ShouldEqual, 0)
+	})
+}
+
+func Test321StoresWrittenBeforeSaveStillLoad(t *testing.T) {
+
+	cv.Convey("A .json.snappy store written by the unsnap stream writer, as Sync used to, should still load.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		orig, err := LoadSshKnownHosts(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+		js := &KnownHosts{Hosts: orig.Hosts, PersistFormat: KHJson}
+		by, err := js.encodeJSON()
+		panicOn(err)
+
+		f, err := unsnap.Create(tmpdir + "/old.json.snappy")
+		panicOn(err)
+		_, err = f.Write(by)
+		panicOn(err)
+		panicOn(f.Close())
+
+		back, err := NewKnownHosts(tmpdir+"/old", KHJson)
+		cv.So(err, cv.ShouldBeNil)
+		same, err := KnownHostsEqual(orig, back)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+	})
+}
+
+func Test322GobStoreIsSelectableAndDetected(t *testing.T) {
+
+	cv.Convey("Setting PersistFormat to KHGob should have Sync write a .gob.snappy store that reads back the same, and NewKnownHosts should find an existing store by its suffix whatever format it was asked for.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		orig, err := LoadSshKnownHosts(origdir + "/testdata/fake_known_hosts")
+		panicOn(err)
+
+		prefix := tmpdir + "/kh"
+		h, err := NewKnownHosts(prefix, KHJson)
+		panicOn(err)
+		h.Hosts = orig.Hosts
+		panicOn(h.Sync())
+		cv.So(fileExists(prefix+".json.snappy"), cv.ShouldBeTrue)
+
+		// a json store loads when gob is asked for...
+		back, err := NewKnownHosts(prefix, KHGob)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(back.PersistFormat, cv.ShouldEqual, KHGob)
+		same, err := KnownHostsEqual(orig, back)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+
+		// ...and is then written as gob.
+		panicOn(back.Sync())
+		cv.So(fileExists(prefix+".gob.snappy"), cv.ShouldBeTrue)
+		gobBack, err := NewKnownHosts(prefix, KHGob)
+		cv.So(err, cv.ShouldBeNil)
+		same, err = KnownHostsEqual(orig, gobBack)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+
+		// a path given with its suffix picks the format.
+		byName, err := NewKnownHosts(prefix+".gob.snappy", KHJson)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(byName.PersistFormat, cv.ShouldEqual, KHGob)
+		cv.So(byName.FilepathPrefix, cv.ShouldEqual, prefix)
+		same, err = KnownHostsEqual(orig, byName)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+
+		// Save and Load honor the format too, encrypted or not.
+		enc, err := NewEncryptedKnownHosts(tmpdir+"/enc", KHGob, "correct horse")
+		panicOn(err)
+		enc.Hosts = orig.Hosts
+		var blob bytes.Buffer
+		cv.So(enc.Save(&blob), cv.ShouldBeNil)
+		encBack, err := NewEncryptedKnownHosts(tmpdir+"/enc", KHGob, "correct horse")
+		panicOn(err)
+		cv.So(encBack.Load(&blob), cv.ShouldBeNil)
+		same, err = KnownHostsEqual(orig, encBack)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(same, cv.ShouldBeTrue)
+
+		var f KnownHostsPersistFormat
+		cv.So(f.Set("gob"), cv.ShouldBeNil)
+		cv.So(f, cv.ShouldEqual, KHGob)
+		cv.So(f.String(), cv.ShouldEqual, "gob")
+		cv.So(f.Set("xml"), cv.ShouldNotBeNil)
+	})
+}
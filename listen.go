@@ -3,7 +3,6 @@ package sshego
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"sync"
 	"time"
@@ -105,7 +104,7 @@ func (bs *BasicServer) Listen(laddr string) (*BasicListener, error) {
 // Together, Listen() then Accept() replace Start().
 func (e *Esshd) Listen(bs *BasicServer) (*BasicListener, error) {
 
-	log.Printf("Esshd.Listen() called. %s", SourceVersion())
+	e.cfg.logger().Infof("Esshd.Listen() called. %s", SourceVersion())
 
 	p("about to listen on %v", e.cfg.EmbeddedSSHd.Addr)
 	// Once a ServerConfig has been configured, connections can be
@@ -122,6 +121,7 @@ func (e *Esshd) Listen(bs *BasicServer) (*BasicListener, error) {
 		return nil, fmt.Errorf("failed to listen for connection on %v: %v",
 			e.cfg.EmbeddedSSHd.Addr, err)
 	}
+	e.setBound(listener.Addr())
 
 	return &BasicListener{
 		bs:    bs,
@@ -0,0 +1,50 @@
+package sshego
+
+import (
+	"log"
+)
+
+// Logger takes what sshego has to say: Debugf the
+// developer tracing, Infof the notes on connections
+// and listeners made, and Errorf what went wrong. Set
+// SshegoConfig.Logger to send one config's output to
+// zap, logrus and the like, or DefaultLogger for the
+// rest of the package.
+type Logger interface {
+	Debugf(format string, a ...interface{})
+	Infof(format string, a ...interface{})
+	Errorf(format string, a ...interface{})
+}
+
+// DefaultLogger is used by a SshegoConfig with no Logger
+// of its own, and by code with no config at hand, such as
+// KnownHosts. Out of the box it drops debug output,
+// unless Verbose, and hands the rest to the standard
+// library's log package.
+var DefaultLogger Logger = stdLogger{}
+
+// stdLogger is the standard library's log package.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, a ...interface{}) {
+	if Verbose {
+		tSPrintf(format, a...)
+	}
+}
+
+func (stdLogger) Infof(format string, a ...interface{}) {
+	log.Printf(format, a...)
+}
+
+func (stdLogger) Errorf(format string, a ...interface{}) {
+	log.Printf(format, a...)
+}
+
+// logger is cfg.Logger, or DefaultLogger if that
+// is not set. cfg may be nil.
+func (cfg *SshegoConfig) logger() Logger {
+	if cfg == nil || cfg.Logger == nil {
+		return DefaultLogger
+	}
+	return cfg.Logger
+}
@@ -0,0 +1,71 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// recordingLogger keeps each line logged, prefixed by its level.
+type recordingLogger struct {
+	mut   sync.Mutex
+	lines []string
+}
+
+func (r *recordingLogger) add(level, format string, a ...interface{}) {
+	r.mut.Lock()
+	r.lines = append(r.lines, level+" "+fmt.Sprintf(format, a...))
+	r.mut.Unlock()
+}
+
+func (r *recordingLogger) Debugf(format string, a ...interface{}) { r.add("debug", format, a...) }
+func (r *recordingLogger) Infof(format string, a ...interface{})  { r.add("info", format, a...) }
+func (r *recordingLogger) Errorf(format string, a ...interface{}) { r.add("error", format, a...) }
+
+func (r *recordingLogger) saw(prefix string) bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for _, line := range r.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func Test159ConfigLoggerTakesTheLogOutput(t *testing.T) {
+
+	cv.Convey("a SshegoConfig with no Logger should log to DefaultLogger, and one with a Logger should log to it instead.", t, func() {
+
+		var nilCfg *SshegoConfig
+		cv.So(nilCfg.logger() == DefaultLogger, cv.ShouldBeTrue)
+		cv.So(NewSshegoConfig().logger() == DefaultLogger, cv.ShouldBeTrue)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		rec := &recordingLogger{}
+		s.CliCfg.Logger = rec
+		s.CliCfg.LogAuthMethod = true
+		cv.So(s.CliCfg.logger() == Logger(rec), cv.ShouldBeTrue)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cli.Close()
+		cv.So(rec.saw("info sshego: authenticated to "+s.SrvCfg.EmbeddedSSHd.Addr), cv.ShouldBeTrue)
+
+		halt.RequestStop()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,113 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// forwardQuota has the forward listener serve a fixed
+// number of connections, for RunForwardOnce, and notes
+// when the last of them has finished.
+type forwardQuota struct {
+	mut    sync.Mutex
+	left   int // connections still to accept.
+	open   int // forwards still running.
+	failed int // connections whose remote dial failed.
+	closed bool
+	done   chan struct{}
+}
+
+func newForwardQuota(n int) *forwardQuota {
+	return &forwardQuota{left: n, done: make(chan struct{})}
+}
+
+// served counts one accepted connection, forwarded by fwd,
+// or nil if the forward could not be set up. It returns
+// true once the quota is used up, when the listener
+// should stop accepting.
+func (q *forwardQuota) served(fwd *Forwarder) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.left--
+	if fwd == nil {
+		q.failed++
+	} else {
+		q.open++
+		go func() {
+			<-fwd.shovelPair.Halt.DoneChan()
+			q.mut.Lock()
+			q.open--
+			q.check()
+			q.mut.Unlock()
+		}()
+	}
+	q.check()
+	return q.left <= 0
+}
+
+// check closes q.done once every connection has been
+// accepted and forwarded. The caller holds q.mut.
+func (q *forwardQuota) check() {
+	if !q.closed && q.left <= 0 && q.open == 0 {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+// RunForwardOnce is a one-shot port forwarder, for scripts:
+// it connects to cfg.SSHdServer, listens on
+// cfg.LocalToRemote.Listen, and forwards the first
+// cfg.ForwardOnceConns connections (one, if that is 0) on to
+// cfg.LocalToRemote.Remote. Once all of them have finished,
+// or ctx is done, it closes the listener and the ssh
+// connection and returns. The login comes from cfg.Username,
+// cfg.PrivateKeyPath, cfg.Pw and cfg.TotpUrl, checked against
+// cfg.KnownHosts. The error is ctx.Err() if ctx ended the
+// run, and notes any connections whose remote could not be
+// reached.
+func RunForwardOnce(ctx context.Context, cfg *SshegoConfig) (err error) {
+	if cfg.LocalToRemote.Listen.Addr == "" {
+		return fmt.Errorf("RunForwardOnce(): no forward to run, cfg.LocalToRemote.Listen is not set")
+	}
+	n := cfg.ForwardOnceConns
+	if n <= 0 {
+		n = 1
+	}
+	q := newForwardQuota(n)
+	cfg.fwdLnMu.Lock()
+	cfg.fwdQuota = q
+	cfg.fwdLnMu.Unlock()
+	defer func() {
+		cfg.fwdLnMu.Lock()
+		cfg.fwdQuota = nil
+		cfg.fwdLnMu.Unlock()
+	}()
+
+	halt := ssh.NewHalter()
+	defer func() {
+		halt.RequestStop()
+		halt.MarkDone()
+	}()
+	cli, _, err := cfg.SSHConnect(ctx, cfg.KnownHosts, cfg.SSHdLogin(), cfg.PrivateKeyPath,
+		cfg.SSHdServer.Host, cfg.SSHdServer.Port, cfg.Pw, cfg.TotpUrl, halt)
+	if err != nil {
+		return fmt.Errorf("RunForwardOnce(): %w", err)
+	}
+	defer cfg.dropClient(cli)
+
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	q.mut.Lock()
+	failed := q.failed
+	q.mut.Unlock()
+	if failed > 0 {
+		return fmt.Errorf("RunForwardOnce(): %v of %v connection(s) could not reach remote '%s'", failed, n, cfg.LocalToRemote.Remote.Addr)
+	}
+	return nil
+}
@@ -3,76 +3,89 @@ package sshego
 import (
 	"bytes"
 	"encoding/gob"
-	"fmt"
-	"log"
-	"net"
-	"os/exec"
-	"time"
-
-	"github.com/glycerine/go-unsnap-stream"
-	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
 
-func (s *KnownHosts) saveGobSnappy(fn string) error {
-	mkpath(fn)
+// gob cannot encode the sync.Mutex in a KnownHosts or a
+// ServerPubKey, so the gob is made of these copies, less
+// the locks. Only the hosts go into the gob; unlike with
+// json, the settings of the KnownHosts, such as ReadOnly,
+// are left as they were by a load.
+type knownHostsGob struct {
+	Hosts map[string]*serverPubKeyGob
+}
 
-	t0 := time.Now()
+type serverPubKeyGob struct {
+	Hostname                 string
+	HumanKey                 string
+	ServerBanned             bool
+	Markers                  string
+	Hostnames                string
+	SplitHostnames           map[string]bool
+	Keytype                  string
+	Base64EncodededPublicKey string
+	Comment                  string
+	Port                     string
+	LineInFileOneBased       int
+	Tags                     map[string]string
+	AlreadySaved             bool
+}
 
-	gob.Register(s)
-	gob.Register(net.TCPAddr{})
-	gob.Register(new(ssh.PublicKey))
+// encodeGob is the gob that Save writes for KHGob.
+// s.Mut must be held.
+func (s *KnownHosts) encodeGob() ([]byte, error) {
+	g := knownHostsGob{Hosts: make(map[string]*serverPubKeyGob, len(s.Hosts))}
+	for k, v := range s.Hosts {
+		v.Mut.Lock()
+		g.Hosts[k] = &serverPubKeyGob{
+			Hostname:                 v.Hostname,
+			HumanKey:                 v.HumanKey,
+			ServerBanned:             v.ServerBanned,
+			Markers:                  v.Markers,
+			Hostnames:                v.Hostnames,
+			SplitHostnames:           v.SplitHostnames,
+			Keytype:                  v.Keytype,
+			Base64EncodededPublicKey: v.Base64EncodededPublicKey,
+			Comment:                  v.Comment,
+			Port:                     v.Port,
+			LineInFileOneBased:       v.LineInFileOneBased,
+			Tags:                     v.Tags,
+			AlreadySaved:             v.AlreadySaved,
+		}
+		v.Mut.Unlock()
+	}
 
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf) // Will write to buf
-
-	// Encode (send) some values.
-	err := enc.Encode(s)
-	if err != nil {
-		panic(fmt.Sprintf("encode error: %v", err))
-	}
-
-	// don't blow away the last good (fn) until the new version is completely written.
-	fnNew := fn + ".new"
-
-	//exec.Command("mv", fn+".prev", fn+".prev.prev").Run()
-	exec.Command("cp", "-p", fn, fn+".prev").Run()
-
-	var file *unsnap.SnappyFile
-	file, err = unsnap.Create(fnNew)
-	if err != nil {
-		panic(fmt.Sprintf("problem creating s outfile '%s': %s", fn, err))
+	if err := enc.Encode(&g); err != nil {
+		return nil, err
 	}
-	defer file.Close()
-
-	drainable := buf
-	_, err = drainable.WriteTo(file)
-
-	file.Sync()
-	file.Close()
-	exec.Command("mv", fnNew, fn).Run()
-
-	log.Printf("saveGobSnappy() took %v", time.Since(t0))
-
-	return err
+	return buf.Bytes(), nil
 }
 
-func (s *KnownHosts) readGobSnappy(fn string) error {
-
-	f, err := unsnap.Open(fn)
-	if err != nil {
+// decodeGob is encodeGob in reverse, for Load.
+func (s *KnownHosts) decodeGob(dat []byte) error {
+	var g knownHostsGob
+	dec := gob.NewDecoder(bytes.NewReader(dat))
+	if err := dec.Decode(&g); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	log.Printf("readgob() is restoring ceptor server state from file '%s'.", fn)
-
-	// Decode (receive) and print the values.
-	dec := gob.NewDecoder(f)
-
-	err = dec.Decode(&s)
-	if err != nil {
-		panic(fmt.Sprintf("decode error 1: %v", err))
+	s.Hosts = make(map[string]*ServerPubKey, len(g.Hosts))
+	for k, v := range g.Hosts {
+		s.Hosts[k] = &ServerPubKey{
+			Hostname:                 v.Hostname,
+			HumanKey:                 v.HumanKey,
+			ServerBanned:             v.ServerBanned,
+			Markers:                  v.Markers,
+			Hostnames:                v.Hostnames,
+			SplitHostnames:           v.SplitHostnames,
+			Keytype:                  v.Keytype,
+			Base64EncodededPublicKey: v.Base64EncodededPublicKey,
+			Comment:                  v.Comment,
+			Port:                     v.Port,
+			LineInFileOneBased:       v.LineInFileOneBased,
+			Tags:                     v.Tags,
+			AlreadySaved:             v.AlreadySaved,
+		}
 	}
-
-	return err
+	return nil
 }
@@ -0,0 +1,27 @@
+package sshego
+
+import (
+	"fmt"
+	"net"
+)
+
+// proxyHeaderV1 renders the human-readable PROXY protocol
+// (version 1) header announcing a connection from src to
+// dst, as described at
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+// When either end is not a tcp address, as with a
+// forwarded unix-domain socket, the UNKNOWN form is given.
+func proxyHeaderV1(src, dst net.Addr) string {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || s.IP == nil || d.IP == nil {
+		return "PROXY UNKNOWN\r\n"
+	}
+	family := "TCP4"
+	sip, dip := s.IP.To4(), d.IP.To4()
+	if sip == nil || dip == nil {
+		family = "TCP6"
+		sip, dip = s.IP.To16(), d.IP.To16()
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, sip, dip, s.Port, d.Port)
+}
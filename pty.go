@@ -47,7 +47,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"os/exec"
 	"sync"
 
@@ -97,7 +96,13 @@ func (cfg *SshegoConfig) handleChannel(ctx context.Context, newChannel ssh.NewCh
 	t := newChannel.ChannelType()
 
 	if t == "direct-tcpip" {
-		handleDirectTcp(ctx, cfg.Halt, newChannel, ca)
+		cfg.handleDirectTcp(ctx, cfg.Halt, newChannel, ca, sshconn.User(), cfg.DirectTCPIPHandler)
+		return
+	}
+
+	if t == "direct-streamlocal@openssh.com" {
+		go cfg.handleDirectStreamLocal(ctx, cfg.Halt, newChannel, sshconn.User(), cfg.DirectTCPIPHandler)
+		return
 	}
 
 	if t != "session" {
@@ -118,7 +123,12 @@ func (cfg *SshegoConfig) handleChannel(ctx context.Context, newChannel ssh.NewCh
 	// request for another logical connection
 	connection, requests, err := newChannel.Accept()
 	if err != nil {
-		log.Printf("Could not accept channel (%s)", err)
+		cfg.logger().Errorf("Could not accept channel (%s)", err)
+		return
+	}
+
+	if cfg.EmbeddedSSHdForceCommand != "" {
+		go cfg.handleForcedCommand(connection, requests)
 		return
 	}
 
@@ -130,16 +140,16 @@ func (cfg *SshegoConfig) handleChannel(ctx context.Context, newChannel ssh.NewCh
 		connection.Close()
 		_, err := bash.Process.Wait()
 		if err != nil {
-			log.Printf("Failed to exit bash (%s)", err)
+			cfg.logger().Errorf("Failed to exit bash (%s)", err)
 		}
-		log.Printf("Session closed")
+		cfg.logger().Infof("Session closed")
 	}
 
 	// Allocate a terminal for this channel
-	log.Print("Successful login, creating pty...")
+	cfg.logger().Infof("Successful login, creating pty...")
 	bashf, err := ptyStart(bash)
 	if err != nil {
-		log.Printf("Could not start pty (%s)", err)
+		cfg.logger().Errorf("Could not start pty (%s)", err)
 		close()
 		return
 	}
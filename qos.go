@@ -0,0 +1,109 @@
+package sshego
+
+import (
+	"sync"
+	"time"
+)
+
+// TrafficClass tags a tunnel as interactive or bulk for
+// the purposes of FairShare pacing. The zero value is
+// Interactive, so tunnels are never paced unless they
+// are explicitly marked Bulk.
+type TrafficClass int
+
+const (
+	Interactive TrafficClass = 0
+	Bulk        TrafficClass = 1
+)
+
+func (c TrafficClass) String() string {
+	switch c {
+	case Interactive:
+		return "Interactive"
+	case Bulk:
+		return "Bulk"
+	}
+	return "UnknownTrafficClass"
+}
+
+// FairShare keeps interactive tunnels responsive when they
+// share one ssh connection with bulk transfers. Since ssh
+// windowing is per-channel but the TCP connection underneath
+// is shared, a big download can fill the pipe and queue up
+// keystrokes behind it. FairShare paces Bulk shovels to
+// BulkBytesPerSec whenever an Interactive shovel has moved
+// data within the last InteractiveWindow. When no interactive
+// traffic has been seen recently, bulk runs at full speed.
+//
+// Set it on SshegoConfig.FairShare, and mark the bulk tunnels
+// with TunnelSpec.Class = Bulk. One FairShare should be
+// shared by all the tunnels over a given ssh connection.
+type FairShare struct {
+	BulkBytesPerSec   int64
+	InteractiveWindow time.Duration
+
+	mut             sync.Mutex
+	lastInteractive time.Time
+
+	// token bucket for bulk, refilled at BulkBytesPerSec.
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewFairShare returns a FairShare that limits bulk tunnels
+// to bulkBytesPerSec while interactive traffic has been seen
+// in the last 2 seconds.
+func NewFairShare(bulkBytesPerSec int64) *FairShare {
+	return &FairShare{
+		BulkBytesPerSec:   bulkBytesPerSec,
+		InteractiveWindow: 2 * time.Second,
+	}
+}
+
+// pacer returns the function that a shovel of class c
+// calls after each write of n bytes. It gives how long
+// the shovel should then wait before writing more.
+func (f *FairShare) pacer(c TrafficClass) func(n int) time.Duration {
+	if f == nil {
+		return nil
+	}
+	if c == Bulk {
+		return f.bulkWrote
+	}
+	return f.interactiveWrote
+}
+
+func (f *FairShare) interactiveWrote(n int) time.Duration {
+	f.mut.Lock()
+	f.lastInteractive = time.Now()
+	f.mut.Unlock()
+	return 0
+}
+
+// bulkWrote returns the wait needed to hold bulk traffic
+// to BulkBytesPerSec while interactive traffic is active.
+func (f *FairShare) bulkWrote(n int) time.Duration {
+	f.mut.Lock()
+	now := time.Now()
+	if f.BulkBytesPerSec <= 0 || now.Sub(f.lastInteractive) > f.InteractiveWindow {
+		// no contention; reset the bucket.
+		f.tokens = float64(f.BulkBytesPerSec)
+		f.lastRefill = now
+		f.mut.Unlock()
+		return 0
+	}
+	rate := float64(f.BulkBytesPerSec)
+	f.tokens += now.Sub(f.lastRefill).Seconds() * rate
+	if f.tokens > rate {
+		// allow at most a second's worth of burst.
+		f.tokens = rate
+	}
+	f.lastRefill = now
+	f.tokens -= float64(n)
+	var wait time.Duration
+	if f.tokens < 0 {
+		wait = time.Duration(-f.tokens / rate * float64(time.Second))
+	}
+	f.mut.Unlock()
+	return wait
+}
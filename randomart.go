@@ -0,0 +1,134 @@
+package sshego
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// the randomart field, as in OpenSSH's sshkey.c.
+const (
+	artWidth  = 17
+	artHeight = 9
+
+	// artSymbols are drawn for a square visited 0, 1, 2...
+	// times; the last two mark the start and the end.
+	artSymbols = " .o+=*BOX@%&#/^SE"
+)
+
+// RandomArt draws the SHA256 digest of k as the bordered
+// 17x9 "drunken bishop" picture that ssh-keygen -lv and
+// VisualHostKey print, title and all. A person tends to
+// notice a changed picture sooner than a changed
+// Fingerprint. There is no trailing newline.
+func RandomArt(k ssh.PublicKey) string {
+	digest := sha256.Sum256(k.Marshal())
+
+	var field [artWidth][artHeight]int
+	end := len(artSymbols) - 1
+	x, y := artWidth/2, artHeight/2
+	for _, b := range digest {
+		// each byte moves the bishop four times,
+		// two bits a move, low bits first.
+		for i := 0; i < 4; i++ {
+			if b&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = clampInt(x, 0, artWidth-1)
+			y = clampInt(y, 0, artHeight-1)
+			if field[x][y] < end-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[artWidth/2][artHeight/2] = end - 1
+	field[x][y] = end
+
+	title := fmt.Sprintf("[%s %d]", artKeyType(k), artKeyBits(k))
+	if len(title) > artWidth+1 {
+		title = fmt.Sprintf("[%s]", artKeyType(k))
+	}
+
+	var art strings.Builder
+	art.WriteString(artBorder(title) + "\n")
+	for y := 0; y < artHeight; y++ {
+		art.WriteByte('|')
+		for x := 0; x < artWidth; x++ {
+			art.WriteByte(artSymbols[field[x][y]])
+		}
+		art.WriteString("|\n")
+	}
+	art.WriteString(artBorder("[SHA256]"))
+	return art.String()
+}
+
+// artBorder is a top or bottom edge with label centered.
+func artBorder(label string) string {
+	left := (artWidth - len(label)) / 2
+	if left < 0 {
+		left = 0
+	}
+	right := artWidth - left - len(label)
+	if right < 0 {
+		right = 0
+	}
+	return "+" + strings.Repeat("-", left) + label + strings.Repeat("-", right) + "+"
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// artKeyType is the key type as OpenSSH titles the art.
+func artKeyType(k ssh.PublicKey) string {
+	switch k.Type() {
+	case ssh.KeyAlgoRSA:
+		return "RSA"
+	case ssh.KeyAlgoDSA:
+		return "DSA"
+	case ssh.KeyAlgoED25519:
+		return "ED25519"
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return "ECDSA"
+	}
+	return strings.ToUpper(k.Type())
+}
+
+// artKeyBits is the size of k in bits, or 0 if unknown.
+func artKeyBits(k ssh.PublicKey) int {
+	if k.Type() == ssh.KeyAlgoED25519 {
+		return 256
+	}
+	ck, ok := k.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch pub := ck.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return pub.N.BitLen()
+	case *dsa.PublicKey:
+		return pub.P.BitLen()
+	case *ecdsa.PublicKey:
+		return pub.Curve.Params().BitSize
+	}
+	return 0
+}
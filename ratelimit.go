@@ -0,0 +1,39 @@
+package sshego
+
+import (
+	"time"
+)
+
+// byteRate is the token bucket behind
+// SshegoConfig.RateLimitBytesPerSec. It paces
+// one shovel, so needs no lock.
+type byteRate struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteRate(bytesPerSec int64) *byteRate {
+	return &byteRate{rate: float64(bytesPerSec)}
+}
+
+// wrote takes n tokens, and returns how long to wait
+// for the bucket to refill enough to cover them. At
+// most a second's worth of burst is allowed.
+func (b *byteRate) wrote(n int) time.Duration {
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,171 @@
+package sshego
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// ConnState is the state of the ssh connection
+// kept up by SSHConnectWithRetry.
+type ConnState int
+
+const (
+	// ConnConnected means SSHConnect succeeded, and
+	// the configured listeners are up.
+	ConnConnected ConnState = 1
+
+	// ConnReconnecting means the connection was lost,
+	// or an attempt at it failed, and another attempt
+	// will follow after a pause.
+	ConnReconnecting ConnState = 2
+
+	// ConnClosed means ctx is done, or an attempt
+	// failed in a way that retrying cannot fix, and
+	// SSHConnectWithRetry is returning.
+	ConnClosed ConnState = 3
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnected:
+		return "Connected"
+	case ConnReconnecting:
+		return "Reconnecting"
+	case ConnClosed:
+		return "Closed"
+	}
+	return ""
+}
+
+// defaults for SshegoConfig.ReconnectMinBackoff
+// and SshegoConfig.ReconnectMaxBackoff.
+const (
+	DefaultReconnectMinBackoff = time.Second
+	DefaultReconnectMaxBackoff = time.Minute
+)
+
+// ErrConnectionLost is what OnConnState is told
+// when an established ssh connection goes away.
+var ErrConnectionLost = fmt.Errorf("ssh connection lost")
+
+// SSHConnectWithRetry keeps an SSHConnect() to sshdHost up
+// until ctx is done, and then returns ctx.Err(). Whenever
+// the connection is lost, or an attempt at it fails, it
+// pauses and tries again, bringing all of cfg's forward,
+// reverse and SOCKS listeners back up with it. An attempt
+// that fails for good, as a refused host key or login does,
+// is returned at once rather than retried; see
+// permanentConnectError. The embedded sshd, if any, is
+// started once and runs until ctx is done; with it alone
+// configured, there is nothing to reconnect. The pause
+// runs from cfg.ReconnectMinBackoff, doubling with each
+// failure in a row up to cfg.ReconnectMaxBackoff, and is
+// jittered as cfg.ReconnectJitter says. Each change of
+// state goes to cfg.OnConnState, if set. The client in
+// use at any time is cfg.SshClient. A lost connection is
+// only noticed if the ssh.Client closes, so leave
+// keepalives on, with KeepAliveMaxMissed set.
+func (cfg *SshegoConfig) SSHConnectWithRetry(ctx context.Context, h *KnownHosts, username string, keypath string, sshdHost string, sshdPort int64, passphrase string, toptUrl string) error {
+	// each attempt's listeners stop with its halter, but
+	// the embedded sshd lives as long as ctx.
+	cfg.Mut.Lock()
+	err := cfg.startEsshd(ctx)
+	esshd := cfg.Esshd != nil
+	cfg.Mut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	minPause, maxPause := cfg.reconnectBackoff()
+	pause := minPause
+	for {
+		halt := ssh.NewHalter()
+		cli, _, err := cfg.SSHConnect(ctx, h, username, keypath, sshdHost, sshdPort, passphrase, toptUrl, halt)
+		if err == nil && cli == nil {
+			halt.RequestStop()
+			halt.MarkDone()
+			if !esshd {
+				return fmt.Errorf("SSHConnectWithRetry(): no tunnels configured, so nothing to keep connected")
+			}
+			<-ctx.Done()
+			cfg.connState(ConnClosed, ctx.Err())
+			return ctx.Err()
+		}
+		if err == nil {
+			pause = minPause
+			cfg.connState(ConnConnected, nil)
+			lost := make(chan struct{})
+			go func() {
+				cli.Wait()
+				close(lost)
+			}()
+			select {
+			case <-lost:
+				err = ErrConnectionLost
+			case <-ctx.Done():
+			}
+			cfg.dropClient(cli)
+		}
+		// stopping halt cancels the ctx that the
+		// listeners of this attempt accept under.
+		halt.RequestStop()
+		halt.MarkDone()
+		if ctx.Err() != nil {
+			cfg.connState(ConnClosed, ctx.Err())
+			return ctx.Err()
+		}
+		if permanentConnectError(err) {
+			cfg.connState(ConnClosed, err)
+			return err
+		}
+
+		cfg.connState(ConnReconnecting, err)
+		select {
+		case <-time.After(cfg.jitter(pause)):
+		case <-ctx.Done():
+			cfg.connState(ConnClosed, ctx.Err())
+			return ctx.Err()
+		}
+		if pause *= 2; pause > maxPause {
+			pause = maxPause
+		}
+	}
+}
+
+// permanentConnectError reports whether err, from
+// SSHConnect, would only come back on a retry: the sshd's
+// host key or our login was refused, or the config asks
+// for what cannot be had.
+func permanentConnectError(err error) bool {
+	return errors.Is(err, ErrHostKeyRejected) ||
+		errors.Is(err, ErrAuthFailed) ||
+		errors.Is(err, ErrMFARequired) ||
+		errors.Is(err, ErrUnsupportedAlgorithm) ||
+		errors.Is(err, ErrBadOtpURL)
+}
+
+// reconnectBackoff gives the bounds on the pause
+// between SSHConnectWithRetry's attempts.
+func (cfg *SshegoConfig) reconnectBackoff() (minPause, maxPause time.Duration) {
+	minPause, maxPause = cfg.ReconnectMinBackoff, cfg.ReconnectMaxBackoff
+	if minPause <= 0 {
+		minPause = DefaultReconnectMinBackoff
+	}
+	if maxPause <= 0 {
+		maxPause = DefaultReconnectMaxBackoff
+	}
+	if maxPause < minPause {
+		maxPause = minPause
+	}
+	return
+}
+
+func (cfg *SshegoConfig) connState(state ConnState, err error) {
+	if cfg.OnConnState != nil {
+		cfg.OnConnState(state, err)
+	}
+}
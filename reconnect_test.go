@@ -0,0 +1,204 @@
+package sshego
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test155SSHConnectWithRetryRedialsAndRestoresTheForward(t *testing.T) {
+
+	cv.Convey("SSHConnectWithRetry should reconnect after the ssh connection is lost, bring the forward listener back up, report each change of state, and return once its ctx is cancelled.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// echoes one line per connection.
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		go func() {
+			for {
+				c, err := target.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					line, err := bufio.NewReader(c).ReadString('\n')
+					if err == nil {
+						fmt.Fprintf(c, "echo:%s", line)
+					}
+				}(c)
+			}
+		}()
+
+		cfg := s.CliCfg
+		cfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		cv.So(cfg.LocalToRemote.Remote.ParseAddr(), cv.ShouldBeNil)
+		cfg.ReconnectMinBackoff = 50 * time.Millisecond
+		cfg.ReconnectMaxBackoff = 200 * time.Millisecond
+		cfg.Quiet = true
+
+		type change struct {
+			state ConnState
+			err   error
+		}
+		changes := make(chan change, 100)
+		cfg.OnConnState = func(state ConnState, err error) {
+			changes <- change{state, err}
+		}
+		next := func() change {
+			select {
+			case c := <-changes:
+				return c
+			case <-time.After(10 * time.Second):
+				panic("no change of state within 10s")
+			}
+		}
+		echo := func(msg string) string {
+			var c net.Conn
+			var err error
+			for j := 0; j < 300; j++ {
+				c, err = net.Dial("tcp", cfg.LocalToRemote.Listen.Addr)
+				if err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			panicOn(err)
+			defer c.Close()
+			fmt.Fprintf(c, "%s\n", msg)
+			line, _ := bufio.NewReader(c).ReadString('\n')
+			return line
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ran := make(chan error, 1)
+		go func() {
+			ran <- cfg.SSHConnectWithRetry(ctx, cfg.KnownHosts, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp)
+		}()
+
+		cv.So(next().state, cv.ShouldEqual, ConnConnected)
+		cv.So(echo("one"), cv.ShouldEqual, "echo:one\n")
+
+		// lose the connection.
+		cfg.Mut.Lock()
+		first := cfg.SshClient
+		cfg.Mut.Unlock()
+		first.Close()
+
+		c := next()
+		cv.So(c.state, cv.ShouldEqual, ConnReconnecting)
+		cv.So(errors.Is(c.err, ErrConnectionLost), cv.ShouldBeTrue)
+		// an attempt may fail while the old listener lets go.
+		for c.state != ConnConnected {
+			c = next()
+		}
+		cv.So(echo("two"), cv.ShouldEqual, "echo:two\n")
+		cfg.Mut.Lock()
+		cv.So(cfg.SshClient, cv.ShouldNotEqual, first)
+		cfg.Mut.Unlock()
+
+		cancel()
+		select {
+		case err := <-ran:
+			cv.So(errors.Is(err, context.Canceled), cv.ShouldBeTrue)
+		case <-time.After(10 * time.Second):
+			panic("SSHConnectWithRetry did not return after its ctx was cancelled")
+		}
+		cv.So(next().state, cv.ShouldEqual, ConnClosed)
+		cv.So(cfg.SshClient, cv.ShouldBeNil)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test176SSHConnectWithRetryGivesUpOnPermanentErrorsAndKeepsAnEsshdUp(t *testing.T) {
+
+	cv.Convey("SSHConnectWithRetry should return at once, without retrying, when the host key or the login is refused; and with only an embedded sshd configured, it should start it and keep it up until its ctx is cancelled.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		cfg := s.CliCfg
+		cfg.ReconnectMinBackoff = 50 * time.Millisecond
+		cfg.ReconnectMaxBackoff = 50 * time.Millisecond
+		cfg.Quiet = true
+		var states []ConnState
+		cfg.OnConnState = func(state ConnState, err error) {
+			states = append(states, state)
+		}
+		retry := func(pw string) error {
+			states = nil
+			ran := make(chan error, 1)
+			go func() {
+				ran <- cfg.SSHConnectWithRetry(context.Background(), cfg.KnownHosts, s.Mylogin, s.RsaPath,
+					s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, pw, s.Totp)
+			}()
+			select {
+			case err := <-ran:
+				return err
+			case <-time.After(10 * time.Second):
+				panic("SSHConnectWithRetry kept retrying a permanent error")
+			}
+		}
+
+		// the sshd's host key is not in our known hosts.
+		cfg.AddIfNotKnown = false
+		err := retry(s.Pw)
+		cv.So(errors.Is(err, ErrHostKeyRejected), cv.ShouldBeTrue)
+		cv.So(states, cv.ShouldResemble, []ConnState{ConnClosed})
+
+		cfg.AddIfNotKnown = true
+		err = retry("not-the-password")
+		cv.So(errors.Is(err, ErrAuthFailed), cv.ShouldBeTrue)
+		cv.So(states, cv.ShouldResemble, []ConnState{ConnClosed})
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+
+		// an embedded sshd alone.
+		e := MakeTestSshClientAndServer(false)
+		defer TempDirCleanup(e.SrvCfg.Origdir, e.SrvCfg.Tempdir)
+		srv := e.SrvCfg
+		srv.Esshd = nil
+		srv.LocalToRemote.Listen.Addr = ""
+		srv.RemoteToLocal.Listen.Addr = ""
+		srv.DynamicSOCKS.Addr = ""
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ran := make(chan error, 1)
+		go func() {
+			ran <- srv.SSHConnectWithRetry(ctx, srv.KnownHosts, "", "", "127.0.0.1", 22, "", "")
+		}()
+		cv.So(WaitUntilAddrListening(srv.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		select {
+		case err := <-ran:
+			panic(fmt.Sprintf("SSHConnectWithRetry returned '%v' with an embedded sshd to keep up", err))
+		case <-time.After(100 * time.Millisecond):
+		}
+		cancel()
+		select {
+		case err := <-ran:
+			cv.So(errors.Is(err, context.Canceled), cv.ShouldBeTrue)
+		case <-time.After(10 * time.Second):
+			panic("SSHConnectWithRetry did not return after its ctx was cancelled")
+		}
+		srv.Mut.Lock()
+		esshd := srv.Esshd
+		srv.Mut.Unlock()
+		<-esshd.Halt.DoneChan()
+	})
+}
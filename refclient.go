@@ -0,0 +1,98 @@
+package sshego
+
+import (
+	"fmt"
+	"sync"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// ErrClientClosed is returned by SharedClient.Acquire
+// once the last reference has been released.
+var ErrClientClosed = fmt.Errorf("shared ssh client already closed")
+
+// SharedClient reference counts an *ssh.Client that
+// several tunnels multiplex over, so that closing one
+// Forwarder does not tear down the others. The
+// underlying Client is closed only when the last
+// reference is released.
+type SharedClient struct {
+	Client *ssh.Client
+
+	mut    sync.Mutex
+	refs   int
+	closed bool
+}
+
+// NewSharedClient returns a SharedClient holding
+// one reference to cli, owned by the caller.
+func NewSharedClient(cli *ssh.Client) *SharedClient {
+	return &SharedClient{
+		Client: cli,
+		refs:   1,
+	}
+}
+
+// Acquire adds a reference. Each successful Acquire
+// must be matched by exactly one Release.
+func (c *SharedClient) Acquire() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	c.refs++
+	return nil
+}
+
+// Release drops a reference, closing the
+// underlying Client when none remain.
+func (c *SharedClient) Release() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	c.refs--
+	if c.refs > 0 {
+		return nil
+	}
+	c.closed = true
+	return c.Client.Close()
+}
+
+// Refs reports the number of outstanding references.
+func (c *SharedClient) Refs() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.refs
+}
+
+// ReleaseClient drops cfg's own reference to the
+// client established by SSHConnect(). The client
+// stays up until any Forwarders still using it
+// are Close()-ed as well.
+func (cfg *SshegoConfig) ReleaseClient() error {
+	cfg.Mut.Lock()
+	shared := cfg.SharedClient
+	cfg.Mut.Unlock()
+	if shared == nil {
+		return nil
+	}
+	return shared.Release()
+}
+
+// dropClient closes cli, and forgets it if it is
+// still the client that cfg holds.
+func (cfg *SshegoConfig) dropClient(cli *ssh.Client) {
+	cli.Close()
+	cfg.Mut.Lock()
+	if cfg.SshClient == cli {
+		cfg.SshClient = nil
+		cfg.Underlying = nil
+	}
+	if cfg.SharedClient != nil && cfg.SharedClient.Client == cli {
+		cfg.SharedClient = nil
+	}
+	cfg.Mut.Unlock()
+}
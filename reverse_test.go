@@ -0,0 +1,361 @@
+package sshego
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test122ReverseTunnelThroughEsshd(t *testing.T) {
+
+	cv.Convey("With AllowReverseTCP, the -esshd should accept a tcpip-forward, and bytes should flow both ways from its port back to our local -revfwd server. A failed local dial should close the remote side, and teardown should release the forwarded port and every goroutine the tunnel started.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.SrvCfg.AllowReverseTCP = true
+
+		tcpSrvLsn, tcpSrvPort := GetAvailPort()
+		mgr := ssh.NewHalter()
+		StartBackgroundTestTcpServer(mgr, payloadByteCount, confirmationPayload, confirmationReply, tcpSrvLsn, nil)
+
+		revLsn, revPort := GetAvailPort()
+		revLsn.Close()
+		revAddr := fmt.Sprintf("127.0.0.1:%v", revPort)
+
+		goroBefore := runtime.NumGoroutine()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		s.CliCfg.RemoteToLocal.Listen.Addr = revAddr
+		s.CliCfg.RemoteToLocal.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", tcpSrvPort)
+		cv.So(s.CliCfg.RemoteToLocal.Listen.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.RemoteToLocal.Remote.ParseAddr(), cv.ShouldBeNil)
+		_, err = s.CliCfg.StartupReverseListener(ctx, cli)
+		cv.So(err, cv.ShouldBeNil)
+
+		fromRemoteSide, err := net.Dial("tcp", revAddr)
+		cv.So(err, cv.ShouldBeNil)
+		VerifyClientServerExchangeAcrossSshd(fromRemoteSide, confirmationPayload, confirmationReply, payloadByteCount)
+		mgr.RequestStop()
+		<-mgr.DoneChan()
+		fromRemoteSide.Close()
+		tcpSrvLsn.Close()
+
+		// with nobody listening locally, the remote
+		// side should be hung up on, not left open.
+		orphan, err := net.Dial("tcp", revAddr)
+		cv.So(err, cv.ShouldBeNil)
+		orphan.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = orphan.Read(make([]byte, 1))
+		cv.So(err, cv.ShouldEqual, io.EOF)
+		orphan.Close()
+
+		// teardown releases the forwarded port on the
+		// esshd host, and once the esshd is stopped too,
+		// no goroutine started since goroBefore remains.
+		cancel()
+		halt.RequestStop()
+		halt.MarkDone()
+		cli.Close()
+		cv.So(WaitUntilAddrAvailable(revAddr, 100*time.Millisecond, 100), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+
+		var goroAfter int
+		for i := 0; i < 100; i++ {
+			goroAfter = runtime.NumGoroutine()
+			if goroAfter <= goroBefore {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cv.So(goroAfter, cv.ShouldBeLessThanOrEqualTo, goroBefore)
+	})
+}
+
+func Test125ReverseTunnelSendsProxyHeader(t *testing.T) {
+
+	cv.Convey("With RemoteToLocal.ProxyProtocol, each reverse connection should reach the local -revfwd service prefixed by a PROXY v1 header naming the original client on the sshd side.", t, func() {
+
+		cv.So(proxyHeaderV1(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}),
+			cv.ShouldEqual, "PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\n")
+		cv.So(proxyHeaderV1(&net.UnixAddr{Name: "@", Net: "unix"}, &net.UnixAddr{Name: "/tmp/s", Net: "unix"}),
+			cv.ShouldEqual, "PROXY UNKNOWN\r\n")
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.SrvCfg.AllowReverseTCP = true
+
+		// the local service reports the first line it gets.
+		localLsn, localPort := GetAvailPort()
+		defer localLsn.Close()
+		firstLine := make(chan string, 1)
+		go func() {
+			conn, err := localLsn.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			firstLine <- line
+		}()
+
+		revLsn, revPort := GetAvailPort()
+		revLsn.Close()
+		revAddr := fmt.Sprintf("127.0.0.1:%v", revPort)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		s.CliCfg.RemoteToLocal.Listen.Addr = revAddr
+		s.CliCfg.RemoteToLocal.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", localPort)
+		s.CliCfg.RemoteToLocal.ProxyProtocol = true
+		cv.So(s.CliCfg.RemoteToLocal.Listen.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.RemoteToLocal.Remote.ParseAddr(), cv.ShouldBeNil)
+		_, err = s.CliCfg.StartupReverseListener(ctx, cli)
+		cv.So(err, cv.ShouldBeNil)
+
+		fromRemoteSide, err := net.Dial("tcp", revAddr)
+		cv.So(err, cv.ShouldBeNil)
+		defer fromRemoteSide.Close()
+		origin := fromRemoteSide.LocalAddr().(*net.TCPAddr)
+
+		select {
+		case line := <-firstLine:
+			cv.So(line, cv.ShouldEqual, fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %v %v\r\n", origin.Port, revPort))
+		case <-time.After(10 * time.Second):
+			panic("no PROXY header reached the local service")
+		}
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test140OnAcceptErrorReportsALostReverseListener(t *testing.T) {
+
+	cv.Convey("OnAcceptError should hear why a reverse accept loop stopped when its ssh connection goes away, but not when a forward listener is closed or its ctx is cancelled.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.SrvCfg.AllowReverseTCP = true
+
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.Quiet = true
+
+		acceptErrs := make(chan error, 10)
+		s.CliCfg.OnAcceptError = func(err error) {
+			acceptErrs <- err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		// closing the forward listener ourselves is no error.
+		cv.So(s.CliCfg.RestartForward(s.CliCfg.Nickname), cv.ShouldBeNil)
+
+		revLsn, revPort := GetAvailPort()
+		revLsn.Close()
+		revAddr := fmt.Sprintf("127.0.0.1:%v", revPort)
+		s.CliCfg.RemoteToLocal.Listen.Addr = revAddr
+		s.CliCfg.RemoteToLocal.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		cv.So(s.CliCfg.RemoteToLocal.Listen.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.RemoteToLocal.Remote.ParseAddr(), cv.ShouldBeNil)
+		_, err = s.CliCfg.StartupReverseListener(ctx, cli)
+		cv.So(err, cv.ShouldBeNil)
+
+		time.Sleep(100 * time.Millisecond)
+		cv.So(len(acceptErrs), cv.ShouldEqual, 0)
+
+		cli.Close()
+		select {
+		case err := <-acceptErrs:
+			cv.So(err.Error(), cv.ShouldContainSubstring, "reverse listener for "+revAddr)
+		case <-time.After(10 * time.Second):
+			panic("OnAcceptError was not called after the ssh connection closed")
+		}
+
+		// the forward loop, stopped by ctx, stays quiet.
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		cv.So(len(acceptErrs), cv.ShouldEqual, 0)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test144ReverseCloseAndCloseTunnelsHangUpBothEnds(t *testing.T) {
+
+	cv.Convey("Reverse.Close should close both the remote side and the local -revfwd connection, and CloseTunnels should do the same for every tunnel still open.", t, func() {
+
+		// each local connection reports when it ends.
+		local, localPort := GetAvailPort()
+		defer local.Close()
+		ended := make(chan bool, 10)
+		go func() {
+			for {
+				c, err := local.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					io.Copy(ioutil.Discard, c)
+					c.Close()
+					ended <- true
+				}(c)
+			}
+		}()
+		waitEnded := func() bool {
+			select {
+			case <-ended:
+				return true
+			case <-time.After(5 * time.Second):
+				return false
+			}
+		}
+
+		cfg := NewSshegoConfig()
+		cfg.RemoteToLocal.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", localPort)
+		cv.So(cfg.RemoteToLocal.Remote.ParseAddr(), cv.ShouldBeNil)
+
+		// stands in for the ssh channel from the sshd.
+		open := func() (*Reverse, net.Conn) {
+			remoteSide, fromRemote := net.Pipe()
+			rev, err := cfg.StartNewReverse(nil, fromRemote)
+			panicOn(err)
+			return rev, remoteSide
+		}
+		hungUp := func(c net.Conn) bool {
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err := c.Read(make([]byte, 1))
+			return err == io.EOF || err == io.ErrClosedPipe
+		}
+
+		rev, remoteSide := open()
+		cv.So(rev.Close(), cv.ShouldBeNil)
+		cv.So(rev.Close(), cv.ShouldBeNil)
+		cv.So(hungUp(remoteSide), cv.ShouldBeTrue)
+		cv.So(waitEnded(), cv.ShouldBeTrue)
+
+		_, a := open()
+		_, b := open()
+		cv.So(len(cfg.Topology().Conns), cv.ShouldEqual, 2)
+		cv.So(cfg.CloseTunnels(), cv.ShouldEqual, 2)
+		cv.So(hungUp(a), cv.ShouldBeTrue)
+		cv.So(hungUp(b), cv.ShouldBeTrue)
+		cv.So(waitEnded(), cv.ShouldBeTrue)
+		cv.So(waitEnded(), cv.ShouldBeTrue)
+		for i := 0; i < 100 && len(cfg.Topology().Conns) > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cv.So(cfg.Topology().Conns, cv.ShouldBeEmpty)
+	})
+}
+
+func Test164ReverseListenerReportsThePortTheSshdPicked(t *testing.T) {
+
+	cv.Convey("Given -revlisten on port 0, StartupReverseListener should return, and keep in GrantedAddr, the port the sshd actually listens on, and connections to it should reach our -revfwd server.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.SrvCfg.AllowReverseTCP = true
+
+		tcpSrvLsn, tcpSrvPort := GetAvailPort()
+		defer tcpSrvLsn.Close()
+		mgr := ssh.NewHalter()
+		StartBackgroundTestTcpServer(mgr, payloadByteCount, confirmationPayload, confirmationReply, tcpSrvLsn, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		s.CliCfg.RemoteToLocal.Listen.Addr = "127.0.0.1:0"
+		s.CliCfg.RemoteToLocal.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", tcpSrvPort)
+		cv.So(s.CliCfg.RemoteToLocal.Listen.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.RemoteToLocal.Remote.ParseAddr(), cv.ShouldBeNil)
+		granted, err := s.CliCfg.StartupReverseListener(ctx, cli)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(granted, cv.ShouldNotBeNil)
+		cv.So(granted.(*net.TCPAddr).Port, cv.ShouldBeGreaterThan, 0)
+		cv.So(s.CliCfg.RemoteToLocal.GrantedAddr, cv.ShouldEqual, granted)
+
+		fromRemoteSide, err := net.Dial("tcp", granted.String())
+		cv.So(err, cv.ShouldBeNil)
+		VerifyClientServerExchangeAcrossSshd(fromRemoteSide, confirmationPayload, confirmationReply, payloadByteCount)
+		fromRemoteSide.Close()
+		mgr.RequestStop()
+		<-mgr.DoneChan()
+
+		cli.Close()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test175ReverseTCPBindsLoopbackUnlessGatewayPorts(t *testing.T) {
+
+	cv.Convey("An esshd tcpip-forward for 0.0.0.0 should listen on loopback only, unless GatewayPorts lets it bind the address the client asked for.", t, func() {
+
+		req := ssh.Marshal(&tcpipForwardMsg{Addr: "0.0.0.0", Rport: 0})
+		for _, gatewayPorts := range []bool{false, true} {
+			f := &remoteForwards{lsns: make(map[string]net.Listener), log: DefaultLogger, gatewayPorts: gatewayPorts}
+			ok, reply := f.listenTCP(context.Background(), req, nil, nil)
+			cv.So(ok, cv.ShouldBeTrue)
+			var granted struct{ Port uint32 }
+			cv.So(ssh.Unmarshal(reply, &granted), cv.ShouldBeNil)
+
+			lsn := f.lsns[tcpipForwardKey("0.0.0.0", granted.Port)]
+			cv.So(lsn, cv.ShouldNotBeNil)
+			cv.So(lsn.Addr().(*net.TCPAddr).IP.IsLoopback(), cv.ShouldEqual, !gatewayPorts)
+			f.closeAll()
+		}
+	})
+}
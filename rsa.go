@@ -2,14 +2,18 @@ package sshego
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	cryptrand "crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	xed25519 "golang.org/x/crypto/ed25519"
 )
 
 // GenRSAKeyPair generates an RSA keypair of length bits. If rsa_file != "", we write
@@ -72,20 +76,156 @@ func RSAToSSHPublicKey(pubkey *rsa.PublicKey) []byte {
 }
 
 // LoadRSAPrivateKey reads a private key from path on disk.
+// Despite the name it takes any key type that LoadPrivateKey
+// does, and is kept for backward compatibility.
 func LoadRSAPrivateKey(path string) (privkey ssh.Signer, err error) {
+	return LoadPrivateKey(path)
+}
+
+// LoadPrivateKey reads a private key from path on disk,
+// going by its PEM block type: RSA PRIVATE KEY, EC PRIVATE KEY,
+// DSA PRIVATE KEY, OPENSSH PRIVATE KEY (what ssh-keygen writes
+// by default, for rsa and ed25519 keys), or PKCS#8 PRIVATE KEY,
+// as openssl writes ed25519 keys.
+func LoadPrivateKey(path string) (privkey ssh.Signer, err error) {
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("got error '%s' trying to read path '%s'", err, path)
 	}
 
-	privkey, err = ssh.ParsePrivateKey(buf)
+	privkey, err = parsePrivateKey(buf)
 	if err != nil {
+		if privateKeyEncrypted(buf) {
+			return nil, &EncryptedKeyError{Path: path}
+		}
+		// a common mistake: pointing at id_rsa.pub
+		// instead of id_rsa.
+		if _, _, _, _, perr := ssh.ParseAuthorizedKey(buf); perr == nil {
+			return nil, &NotPrivateKeyError{Path: path, IsPublicKey: true, Err: err}
+		}
+		if !bytes.Contains(buf, []byte("PRIVATE KEY")) {
+			return nil, &NotPrivateKeyError{Path: path, Err: err}
+		}
 		return nil, fmt.Errorf("got error '%s' trying to parse private key from path '%s'", err, path)
 	}
 
 	return privkey, err
 }
 
+// parsePrivateKey adds PKCS#8 to what ssh.ParsePrivateKey takes.
+func parsePrivateKey(buf []byte) (ssh.Signer, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return ssh.ParsePrivateKey(buf)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		// the ssh package knows only the x/crypto type.
+		key = xed25519.PrivateKey(k)
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// PrivateKeyPassphraseEnv names the environment variable
+// gosshtun reads the private key passphrase from.
+const PrivateKeyPassphraseEnv = "SSHEGO_PRIVATE_KEY_PASSPHRASE"
+
+// LoadEncryptedPrivateKey reads a private key that may be
+// protected by keyPassphrase from path on disk. This is the
+// passphrase of the key file, not the login password given to
+// the sshd. Both legacy PEM encryption (Proc-Type: 4,ENCRYPTED)
+// and the OpenSSH format ssh-keygen writes by default are
+// supported; of the latter, aes256-ctr and aes256-cbc encrypted
+// RSA and ed25519 keys.
+// A key that is not encrypted loads as with
+// LoadPrivateKey, and keyPassphrase is ignored. An encrypted key
+// with an empty keyPassphrase gives an *EncryptedKeyError.
+func LoadEncryptedPrivateKey(path, keyPassphrase string) (privkey ssh.Signer, err error) {
+	if keyPassphrase == "" {
+		return LoadPrivateKey(path)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("got error '%s' trying to read path '%s'", err, path)
+	}
+	if !privateKeyEncrypted(buf) {
+		return LoadPrivateKey(path)
+	}
+	privkey, err = ssh.ParsePrivateKeyWithPassphrase(buf, []byte(keyPassphrase))
+	if err != nil {
+		if err == x509.IncorrectPasswordError {
+			return nil, fmt.Errorf("private key '%s': %w", path, err)
+		}
+		return nil, fmt.Errorf("got error '%s' trying to parse encrypted private key from path '%s'", err, path)
+	}
+	return privkey, nil
+}
+
+// EncryptedKeyError is returned by LoadPrivateKey, and by
+// LoadEncryptedPrivateKey when no passphrase is given, for
+// a key file at Path that is protected by a passphrase.
+type EncryptedKeyError struct {
+	Path string
+}
+
+func (e *EncryptedKeyError) Error() string {
+	return fmt.Sprintf("private key '%s' is encrypted: a key passphrase is needed to load it", e.Path)
+}
+
+// privateKeyEncrypted reports if buf holds a PEM private key
+// encrypted in either the legacy PEM way, or the OpenSSH one.
+func privateKeyEncrypted(buf []byte) bool {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return false
+	}
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return true
+	}
+	if block.Type != "OPENSSH PRIVATE KEY" {
+		return false
+	}
+	// "openssh-key-v1\x00", then the cipher name as an ssh string.
+	magic := "openssh-key-v1\x00"
+	b := block.Bytes
+	if len(b) < len(magic)+4 || string(b[:len(magic)]) != magic {
+		return false
+	}
+	b = b[len(magic):]
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return false
+	}
+	return string(b[4:4+n]) != "none"
+}
+
+// NotPrivateKeyError is returned by LoadPrivateKey when
+// the file at Path holds no private key at all, for instance
+// when given the public key id_rsa.pub instead of id_rsa.
+type NotPrivateKeyError struct {
+	Path string
+
+	// IsPublicKey is true if Path held a public key.
+	IsPublicKey bool
+
+	// Err is the underlying parse error.
+	Err error
+}
+
+func (e *NotPrivateKeyError) Error() string {
+	if e.IsPublicKey {
+		return fmt.Sprintf("keypath '%s' is not a private key: it holds a public key; did you mean the file without the .pub suffix?", e.Path)
+	}
+	return fmt.Sprintf("keypath '%s' is not a private key: '%s'", e.Path, e.Err)
+}
+
+func (e *NotPrivateKeyError) Unwrap() error {
+	return e.Err
+}
+
 // LoadRSAPublicKey reads a public key from path on disk. By convention
 // these keys end in '.pub', but that is not verified here.
 func LoadRSAPublicKey(path string) (pubkey ssh.PublicKey, err error) {
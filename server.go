@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"image/png"
 	"io/ioutil"
-	"log"
 	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,13 +38,108 @@ type Esshd struct {
 	mut sync.Mutex
 
 	cr *CommandRecv
+
+	// banner is protected by mut.
+	banner string
+
+	// boundAddr is protected by mut. ready is
+	// closed once boundAddr is set.
+	boundAddr net.Addr
+	ready     chan struct{}
+
+	// conns holds the ssh connections esshd has
+	// handshaken and not yet seen close, for Stop
+	// to close. Protected by mut.
+	conns map[ssh.Conn]bool
+}
+
+// SetBanner sets the text that esshd sends to each
+// client before authentication, such as a legal
+// warning. An empty text sends no banner. It takes
+// effect for connections accepted afterwards.
+func (e *Esshd) SetBanner(text string) {
+	e.mut.Lock()
+	e.banner = text
+	e.mut.Unlock()
+}
+
+func (e *Esshd) getBanner() string {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.banner
+}
+
+// BoundAddr is the address esshd actually listens
+// on, with the port chosen by the OS if
+// cfg.EmbeddedSSHd asked for port 0. It is nil
+// until Ready() is closed.
+func (e *Esshd) BoundAddr() net.Addr {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.boundAddr
+}
+
+// Ready is closed once esshd's listener is bound and
+// accepting connections, so a caller can connect
+// to BoundAddr() without sleeping first. If the
+// listen fails, Ready is never closed; the error
+// is logged.
+func (e *Esshd) Ready() <-chan struct{} {
+	return e.ready
+}
+
+// setBound records the listener's addr and closes ready,
+// the first time it is called.
+func (e *Esshd) setBound(addr net.Addr) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.boundAddr == nil {
+		e.boundAddr = addr
+		close(e.ready)
+	}
 }
 
+// track notes c as one for Stop to close,
+// until c closes by itself.
+func (e *Esshd) track(c ssh.Conn) {
+	e.mut.Lock()
+	e.conns[c] = true
+	e.mut.Unlock()
+	go func() {
+		c.Wait()
+		e.mut.Lock()
+		delete(e.conns, c)
+		e.mut.Unlock()
+	}()
+}
+
+// closeConns closes every connection esshd is tracking.
+func (e *Esshd) closeConns() {
+	e.mut.Lock()
+	conns := make([]ssh.Conn, 0, len(e.conns))
+	for c := range e.conns {
+		conns = append(conns, c)
+	}
+	e.mut.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// Stop shuts down an esshd begun with Start: it stops
+// accepting, closes the ssh connections esshd has
+// accepted, and returns once the Start goroutine has
+// exited and the listening port (and the -xport) is
+// free again, so that a new esshd can bind it at once.
 func (e *Esshd) Stop() error {
 	e.Halt.RequestStop()
 	<-e.Halt.DoneChan()
 
-	if -1 == WaitUntilAddrAvailable(e.cfg.EmbeddedSSHd.Addr, 100*time.Millisecond, 100) {
+	addr := e.cfg.EmbeddedSSHd.Addr
+	if bound := e.BoundAddr(); bound != nil {
+		addr = bound.String()
+	}
+	if -1 == WaitUntilAddrAvailable(addr, 100*time.Millisecond, 100) {
 		return fmt.Errorf("esshd never stopped; after 10 seconds of waits")
 	}
 
@@ -69,6 +166,8 @@ func (cfg *SshegoConfig) NewEsshd() *Esshd {
 		delUserReq:           make(chan *User),
 		replyWithDeletedDone: make(chan bool),
 		updateHostKey:        make(chan ssh.Signer),
+		ready:                make(chan struct{}),
+		conns:                make(map[ssh.Conn]bool),
 	}
 	if srv.cfg.HostDb == nil {
 		err := srv.cfg.NewHostDb()
@@ -98,6 +197,11 @@ type PerAttempt struct {
 	Config *ssh.ServerConfig
 
 	cfg *SshegoConfig
+
+	// pubKeyOK caches successful user+key matches
+	// for the life of this connection, when
+	// cfg.CachePublicKeyDecisions is set.
+	pubKeyOK map[string]bool
 }
 
 func NewPerAttempt(s *AuthState, cfg *SshegoConfig) *PerAttempt {
@@ -213,7 +317,7 @@ func (cr *CommandRecv) Start(ctx context.Context) error {
 				// read from it
 				err = nConn.SetReadDeadline(time.Now().Add(time.Second))
 				if err != nil {
-					log.Printf("warning: CommandRecv: nConn.Read ignoring "+
+					cr.cfg.logger().Infof("warning: CommandRecv: nConn.Read ignoring "+
 						"SetReadDeadline error %v", err)
 					nConn.Close()
 					continue mainloop
@@ -222,7 +326,7 @@ func (cr *CommandRecv) Start(ctx context.Context) error {
 				by := make([]byte, len(NewUserCmd))
 				_, err := nConn.Read(by)
 				if err != nil {
-					log.Printf("warning: CommandRecv: nConn.Read ignoring "+
+					cr.cfg.logger().Infof("warning: CommandRecv: nConn.Read ignoring "+
 						"Read error '%v'; could be timeout.", err)
 					nConn.Close()
 					continue mainloop
@@ -230,11 +334,11 @@ func (cr *CommandRecv) Start(ctx context.Context) error {
 				cmd := string(by)
 				switch cmd {
 				case NewUserCmdStr:
-					log.Printf("CommandRecv: we got a NEWUSER command")
+					cr.cfg.logger().Infof("CommandRecv: we got a NEWUSER command")
 				case DelUserCmdStr:
-					log.Printf("CommandRecv: we got a DELUSER command")
+					cr.cfg.logger().Infof("CommandRecv: we got a DELUSER command")
 				default:
-					log.Printf("warning: CommandRecv: nConn.Read ignoring "+
+					cr.cfg.logger().Infof("warning: CommandRecv: nConn.Read ignoring "+
 						"unrecognized command '%v'", cmd)
 					nConn.Close()
 					continue mainloop
@@ -245,19 +349,19 @@ func (cr *CommandRecv) Start(ctx context.Context) error {
 				reader := msgp.NewReader(nConn)
 				err = newUser.DecodeMsg(reader)
 				if err != nil {
-					log.Printf("warning: saw NEWUSER/DELUSER preamble but got"+
+					cr.cfg.logger().Infof("warning: saw NEWUSER/DELUSER preamble but got"+
 						" error reading the User data: %v", err)
 					nConn.Close()
 					continue mainloop
 				}
-				log.Printf("CommandRecv: %s '%v' with email '%v'", cmd, newUser.MyLogin, newUser.MyEmail)
+				cr.cfg.logger().Infof("CommandRecv: %s '%v' with email '%v'", cmd, newUser.MyLogin, newUser.MyEmail)
 
 				if cmd == DelUserCmdStr {
 					// make the delete request
 					select {
 					case cr.delUserReq <- newUser:
 					case <-time.After(10 * time.Second):
-						log.Printf("warning: unable to deliver delUser request " +
+						cr.cfg.logger().Errorf("warning: unable to deliver delUser request " +
 							"after 10 seconds")
 					case <-cr.reqStop:
 						return
@@ -289,7 +393,7 @@ func (cr *CommandRecv) Start(ctx context.Context) error {
 					select {
 					case cr.addUserReq <- newUser:
 					case <-time.After(10 * time.Second):
-						log.Printf("warning: unable to deliver newUser request" +
+						cr.cfg.logger().Errorf("warning: unable to deliver newUser request" +
 							"after 10 seconds")
 					case <-cr.reqStop:
 						return
@@ -348,16 +452,11 @@ func (e *Esshd) Start(ctx context.Context) {
 		if e.cfg.EmbeddedSSHd.UnixDomainPath != "" {
 			domain = "unix"
 		}
-		listener, err := net.Listen(domain, e.cfg.EmbeddedSSHd.Addr)
-		if err != nil {
-			msg := fmt.Sprintf("failed to listen for connection on %v: %v",
-				e.cfg.EmbeddedSSHd.Addr, err)
-			log.Printf(msg)
-			//panic(msg)
-			return
-		}
+		var listener net.Listener
 
-		// cleanup, any which way we return
+		// cleanup, any which way we return, so
+		// that Stop() returns even if we never
+		// got to listen.
 		defer func() {
 			if e.cr != nil {
 				close(e.cr.reqStop)
@@ -365,9 +464,20 @@ func (e *Esshd) Start(ctx context.Context) {
 			if listener != nil {
 				listener.Close()
 			}
+			e.closeConns()
 			e.Halt.MarkDone()
 		}()
 
+		listener, err := net.Listen(domain, e.cfg.EmbeddedSSHd.Addr)
+		if err != nil {
+			msg := fmt.Sprintf("failed to listen for connection on %v: %v",
+				e.cfg.EmbeddedSSHd.Addr, err)
+			e.cfg.logger().Errorf("%s", msg)
+			//panic(msg)
+			return
+		}
+		e.setBound(listener.Addr())
+
 		p("info: Essh.Start() in server.go: listening on "+
 			"domain '%s', addr: '%s'", domain, e.cfg.EmbeddedSSHd.Addr)
 		for {
@@ -452,17 +562,25 @@ func (a *PerAttempt) PerConnection(ctx context.Context, nConn net.Conn, ca *Conn
 	sshConn, chans, reqs, err := ssh.NewServerConn(ctx, nConn, a.Config)
 	if err != nil {
 		msg := fmt.Errorf("%v sshego PerAttempt.PerConnection() did not handshake: %v", loc, err)
-		p(msg.Error())
+		p("%s", msg)
+		if cb := a.cfg.AuthFailureCallback; cb != nil {
+			cb(nConn.RemoteAddr(), "", "handshake", err)
+		}
 		return msg
 	}
 
+	if e := a.cfg.Esshd; e != nil {
+		e.track(sshConn)
+	}
+
 	p("%s done with handshake. handlers in force: '%s'", loc, a.cfg.ChannelHandlerSummary())
 
 	p("server %s sees new SSH connection from %s (%s)", sshConn.LocalAddr(), sshConn.RemoteAddr(), sshConn.ClientVersion())
 
 	// The incoming Request channel must be serviced.
-	// Discard all global out-of-band Requests, except for keepalives.
-	go DiscardRequestsExceptKeepalives(ctx, reqs, a.cfg.Esshd.Halt.ReqStopChan())
+	// Discard all global out-of-band Requests, except for keepalives
+	// and streamlocal-forward requests.
+	go a.cfg.handleGlobalRequests(ctx, reqs, sshConn, a.cfg.Esshd.Halt.ReqStopChan())
 	// Accept all channels
 	go a.cfg.handleChannels(ctx, chans, sshConn, ca)
 
@@ -482,25 +600,7 @@ func DiscardRequestsExceptKeepalives(ctx context.Context, in <-chan *ssh.Request
 				return
 			}
 			if req != nil && req.WantReply {
-				if req.Type != "keepalive@sshego.glycerine.github.com" || len(req.Payload) == 0 {
-					req.Reply(false, nil)
-					continue
-				}
-				// respond to keepalive pings
-				var ping KeepAlivePing
-				_, err := ping.UnmarshalMsg(req.Payload)
-				if err != nil {
-					req.Reply(false, nil)
-					continue
-				}
-
-				now := time.Now()
-				//p("sshego server.go: discardRequestsExceptKeepalives sees keepalive %v! ping.Sent: '%v'. setting replied to now='%v'", ping.Serial, ping.Sent, now)
-
-				ping.Replied = now
-				pingReplyBy, err := ping.MarshalMsg(nil)
-				panicOn(err)
-				req.Reply(true, pingReplyBy)
+				replyToKeepalive(req)
 			}
 		case <-reqStop:
 			return
@@ -510,6 +610,30 @@ func DiscardRequestsExceptKeepalives(ctx context.Context, in <-chan *ssh.Request
 	}
 }
 
+// replyToKeepalive answers a keepalive ping, and
+// declines any other request.
+func replyToKeepalive(req *ssh.Request) {
+	if req.Type != "keepalive@sshego.glycerine.github.com" || len(req.Payload) == 0 {
+		req.Reply(false, nil)
+		return
+	}
+	// respond to keepalive pings
+	var ping KeepAlivePing
+	_, err := ping.UnmarshalMsg(req.Payload)
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	now := time.Now()
+	//p("sshego server.go: discardRequestsExceptKeepalives sees keepalive %v! ping.Sent: '%v'. setting replied to now='%v'", ping.Serial, ping.Sent, now)
+
+	ping.Replied = now
+	pingReplyBy, err := ping.MarshalMsg(nil)
+	panicOn(err)
+	req.Reply(true, pingReplyBy)
+}
+
 type TOTP struct {
 	UserEmail string
 	Issuer    string
@@ -567,7 +691,8 @@ func (w *TOTP) LoadFromFile(path string) error {
 }
 
 func (w *TOTP) IsValid(passcode string, mylogin string) bool {
-	valid := totp.Validate(passcode, w.Key.Secret())
+	valid, err := totp.ValidateCustom(passcode, w.Key.Secret(), time.Now().UTC(), totpOpts(w.Key))
+	valid = valid && err == nil
 
 	if valid {
 		p("Login '%s' successfully used their "+
@@ -581,6 +706,47 @@ func (w *TOTP) IsValid(passcode string, mylogin string) bool {
 	return valid
 }
 
+// totpOpts are the options to compute and check the
+// codes of key with: those of Google Authenticator, but
+// for the period= of key's url, if it gives one.
+func totpOpts(key *otp.Key) totp.ValidateOpts {
+	opts := totp.ValidateOpts{
+		Period:    30,
+		Skew:      1,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	if u, err := url.Parse(key.String()); err == nil {
+		if sec, err := strconv.ParseUint(u.Query().Get("period"), 10, 32); err == nil && sec > 0 {
+			opts.Period = uint(sec)
+		}
+	}
+	return opts
+}
+
+// TOTPCodes returns the one-time codes that the otpauth://
+// url would give for the window holding t, and for the
+// windows just before and after it. A window is the url's
+// period=, or 30 seconds by default. Comparing these
+// against what a client sent helps diagnose clock skew.
+func TOTPCodes(url string, t time.Time) (prev, cur, next string, err error) {
+	key, err := otp.NewKeyFromURL(strings.TrimSpace(url))
+	if err != nil {
+		return
+	}
+	secret := key.Secret()
+	opts := totpOpts(key)
+	period := time.Duration(opts.Period) * time.Second
+	if prev, err = totp.GenerateCodeCustom(secret, t.Add(-period), opts); err != nil {
+		return
+	}
+	if cur, err = totp.GenerateCodeCustom(secret, t, opts); err != nil {
+		return
+	}
+	next, err = totp.GenerateCodeCustom(secret, t.Add(period), opts)
+	return
+}
+
 func NewTOTP(userEmail, issuer string) (w *TOTP, err error) {
 
 	key, err := totp.Generate(totp.GenerateOpts{
@@ -660,7 +826,7 @@ func (a *PerAttempt) KeyboardInteractiveCallback(ctx context.Context, conn ssh.C
 	}
 
 	if !knownUser {
-		log.Printf("unrecognized login '%s' from remoteAddr '%s' at %v",
+		a.cfg.logger().Infof("unrecognized login '%s' from remoteAddr '%s' at %v",
 			mylogin, remoteAddr, now)
 		return nil, keyFail
 	}
@@ -672,9 +838,8 @@ func (a *PerAttempt) KeyboardInteractiveCallback(ctx context.Context, conn ssh.C
 		firstPassOK = true
 	}
 	p("KeyboardInteractiveCallback, first pass-phrase accepted: %v; ans[0] was user-attempting-login provided this cleartext: '%s'; our stored scrypted pw is: '%s'", firstPassOK, ans[0], user.ScryptedPassword)
-	user.RestoreTotp()
 
-	if a.cfg.SkipTOTP || (len(ans[totpIdx]) > 0 && user.oneTime.IsValid(ans[totpIdx], mylogin)) {
+	if a.cfg.SkipTOTP || a.cfg.HostDb.ValidateTOTP(mylogin, ans[totpIdx]) {
 		timeOK = true
 	}
 
@@ -717,6 +882,9 @@ func (a *PerAttempt) AuthLogCallback(conn ssh.ConnMetadata, method string, err e
 	} else {
 		p("login failure! auth-log-callback: user %q, method %q: %v",
 			conn.User(), method, err)
+		if cb := a.cfg.AuthFailureCallback; cb != nil && method != "none" {
+			cb(conn.RemoteAddr(), conn.User(), method, err)
+		}
 	}
 }
 
@@ -742,16 +910,40 @@ func (a *PerAttempt) PublicKeyCallback(c ssh.ConnMetadata, providedPubKey ssh.Pu
 
 	user, foundUser := a.cfg.HostDb.Persist.Users.Get2(mylogin)
 	if !foundUser {
-		log.Printf("unrecognized user '%s' from remoteAddr '%s' at %v",
+		// a key in the AuthorizedKeys store can log in
+		// a user we have no record of, when no one-time
+		// step is asked for.
+		if authPerm, ok := a.cfg.AuthorizedKeys.Authorize(mylogin, providedPubKey); ok {
+			p("PublicKeyCallback: AuthorizedKeys has the key for user '%s', who is not in the HostDb", mylogin)
+			a.PublicKeyOK = true
+			if !a.OneTimeOK {
+				return nil, a.needOneTime(unknown)
+			}
+			return authPerm, nil
+		}
+		a.cfg.logger().Infof("unrecognized user '%s' from remoteAddr '%s' at %v",
 			mylogin, remoteAddr, now)
-		log.Printf("debug: my userdb is = '%s'\n", a.cfg.HostDb)
+		a.cfg.logger().Debugf("debug: my userdb is = '%s'\n", a.cfg.HostDb)
 		return nil, unknown
 	}
 	p("PublicKeyCallback sees login attempt for recognized user '%v'", user.MyLogin)
 
+	providedPubKeyStr := string(providedPubKey.Marshal())
+
+	// already matched this key for this user on this
+	// connection? then skip re-loading and re-comparing.
+	cacheKey := mylogin + "\x00" + providedPubKeyStr
+	if a.cfg.CachePublicKeyDecisions && a.pubKeyOK[cacheKey] {
+		p("PublicKeyCallback: cached public key match for user '%s'", mylogin)
+		a.PublicKeyOK = true
+		if !a.OneTimeOK {
+			return nil, a.needOneTime(unknown)
+		}
+		return nil, nil
+	}
+
 	// update user.FirstLoginTm / LastLoginTm
 
-	providedPubKeyStr := string(providedPubKey.Marshal())
 	providedPubKeyFinger := Fingerprint(providedPubKey)
 
 	// save the public key and when we saw it
@@ -782,39 +974,60 @@ func (a *PerAttempt) PublicKeyCallback(c ssh.ConnMetadata, providedPubKey ssh.Pu
 		// okay now to actually accept the login when
 
 		if a.PublicKeyOK && a.OneTimeOK {
-			perm = nil
 			rerr = nil
 			p("PublicKeyCallback: defer sees pub-key and one-time okay, authorizing login")
 		}
 	}()
 
-	// load up the public key
-	p("loading public key from '%s'", user.PublicKeyPath)
-	onfilePubKey, err := LoadRSAPublicKey(user.PublicKeyPath)
-	if err != nil {
-		return nil, unknown
-	}
-	onfilePubKeyFinger := Fingerprint(onfilePubKey)
-	p("ok: successful load of public key from '%s'... pub fingerprint = '%s'",
-		user.PublicKeyPath, onfilePubKeyFinger)
+	// the AuthorizedKeys store first, then the key on file.
+	authPerm, authorized := a.cfg.AuthorizedKeys.Authorize(mylogin, providedPubKey)
+	if !authorized {
+		// load up the public key
+		p("loading public key from '%s'", user.PublicKeyPath)
+		onfilePubKey, err := LoadRSAPublicKey(user.PublicKeyPath)
+		if err != nil {
+			return nil, unknown
+		}
+		onfilePubKeyFinger := Fingerprint(onfilePubKey)
+		p("ok: successful load of public key from '%s'... pub fingerprint = '%s'",
+			user.PublicKeyPath, onfilePubKeyFinger)
 
-	//	if a.State.AuthorizedKeysMap[string(providedPubKey.Marshal())] {
-	onfilePubKeyStr := string(onfilePubKey.Marshal())
-	if onfilePubKeyStr == providedPubKeyStr {
-		p("we have a public key match for user '%s', key fingerprint = '%s'", mylogin, onfilePubKeyFinger)
-		updated.AcceptedCount++
-		a.PublicKeyOK = true
-		// although we note this, we don't reveal this to the client.
-		if !a.OneTimeOK {
-			p("public-key succeeded however keyboard interactive did not (yet).")
+		if string(onfilePubKey.Marshal()) != providedPubKeyStr {
+			p("public key mismatch; onfilePubKey (%s) did not match providedPubKey (%s)",
+				onfilePubKeyFinger, providedPubKeyFinger)
 			return nil, unknown
 		}
-		return nil, nil
-	} else {
-		p("public key mismatch; onfilePubKey (%s) did not match providedPubKey (%s)",
-			onfilePubKeyFinger, Fingerprint(providedPubKey))
 	}
-	return nil, unknown
+	p("we have a public key match for user '%s', key fingerprint = '%s'", mylogin, providedPubKeyFinger)
+	updated.AcceptedCount++
+	a.PublicKeyOK = true
+	if a.cfg.CachePublicKeyDecisions {
+		if a.pubKeyOK == nil {
+			a.pubKeyOK = make(map[string]bool)
+		}
+		a.pubKeyOK[cacheKey] = true
+	}
+	// although we note this, we don't reveal this to the client,
+	// unless SequentialAuth has us report a partial success.
+	if !a.OneTimeOK {
+		p("public-key succeeded however keyboard interactive did not (yet).")
+		return nil, a.needOneTime(unknown)
+	}
+	return authPerm, nil
+}
+
+// needOneTime is the PublicKeyCallback error for a good key
+// when the keyboard-interactive step is still to come: a
+// partial success under SequentialAuth, otherwise unknown.
+func (a *PerAttempt) needOneTime(unknown error) error {
+	if !a.cfg.SequentialAuth || a.Config == nil || a.Config.KeyboardInteractiveCallback == nil {
+		return unknown
+	}
+	return &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: a.KeyboardInteractiveCallback,
+		},
+	}
 }
 
 func (a *AuthState) LoadPublicKeys(authorizedKeysPath string) error {
@@ -865,12 +1078,21 @@ func (a *PerAttempt) SetTripleConfig() {
 		KeyboardInteractiveCallback: a.KeyboardInteractiveCallback,
 		AuthLogCallback:             a.AuthLogCallback,
 		Config: ssh.Config{
-			Ciphers:      getCiphers(),
-			KeyExchanges: []string{kexAlgoCurve25519SHA256},
-			Halt:         a.cfg.Halt,
+			Ciphers:           getCiphers(),
+			KeyExchanges:      []string{kexAlgoCurve25519SHA256},
+			Halt:              a.cfg.Halt,
+			ChannelWindowSize: a.cfg.ChannelWindowSize,
+			ChannelMaxPacket:  a.cfg.ChannelMaxPacket,
 		},
 		ServerVersion: "SSH-2.0-OpenSSH_6.9",
 	}
+	if a.cfg.Esshd != nil {
+		if banner := a.cfg.Esshd.getBanner(); banner != "" {
+			a.Config.BannerCallback = func(ssh.ConnMetadata) string {
+				return banner
+			}
+		}
+	}
 	a.Config.AddHostKey(a.State.HostKey)
 }
 
@@ -1,18 +1,24 @@
 package sshego
 
 import (
+	"bytes"
 	"context"
 	cryrand "crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	cv "github.com/glycerine/goconvey/convey"
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/testdata"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
 )
 
 func Test101StartupAndShutdown(t *testing.T) {
@@ -218,3 +224,530 @@ func (a *AuthState) InitTestData() error {
 	}
 	return nil
 }
+
+// fakeConnMeta provides just enough ssh.ConnMetadata
+// to drive the auth callbacks directly.
+type fakeConnMeta struct {
+	user string
+}
+
+func (m *fakeConnMeta) User() string          { return m.user }
+func (m *fakeConnMeta) SessionID() []byte     { return nil }
+func (m *fakeConnMeta) ClientVersion() []byte { return nil }
+func (m *fakeConnMeta) ServerVersion() []byte { return nil }
+func (m *fakeConnMeta) RemoteAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (m *fakeConnMeta) LocalAddr() net.Addr   { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func Test106PublicKeyDecisionCache(t *testing.T) {
+
+	cv.Convey("With CachePublicKeyDecisions, the -esshd should remember a successful user+key match for the rest of the connection, and not re-load the user's key on later auth sub-steps.", t, func() {
+
+		s := MakeTestSshClientAndServer(false)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+
+		signer, err := LoadRSAPrivateKey(s.RsaPath)
+		panicOn(err)
+		pub := signer.PublicKey()
+		conn := &fakeConnMeta{user: s.Mylogin}
+
+		s.SrvCfg.CachePublicKeyDecisions = true
+		cached := NewPerAttempt(NewAuthState(nil), s.SrvCfg)
+		plain := NewPerAttempt(NewAuthState(nil), s.SrvCfg)
+		plain.cfg = &SshegoConfig{HostDb: s.SrvCfg.HostDb}
+
+		cached.PublicKeyCallback(conn, pub)
+		cv.So(cached.PublicKeyOK, cv.ShouldBeTrue)
+		plain.PublicKeyCallback(conn, pub)
+		cv.So(plain.PublicKeyOK, cv.ShouldBeTrue)
+
+		// with the key file gone, only the cache can vouch for the key.
+		user, ok := s.SrvCfg.HostDb.Persist.Users.Get2(s.Mylogin)
+		cv.So(ok, cv.ShouldBeTrue)
+		panicOn(os.Remove(user.PublicKeyPath))
+
+		cached.PublicKeyOK = false
+		cached.PublicKeyCallback(conn, pub)
+		cv.So(cached.PublicKeyOK, cv.ShouldBeTrue)
+
+		plain.PublicKeyOK = false
+		plain.PublicKeyCallback(conn, pub)
+		cv.So(plain.PublicKeyOK, cv.ShouldBeFalse)
+
+		// a different key is not vouched for by the cache.
+		_, other, err := GenRSAKeyPair(s.SrvCfg.Tempdir+"/other_rsa", 1024, "other@example.com")
+		panicOn(err)
+		fresh := NewPerAttempt(NewAuthState(nil), s.SrvCfg)
+		fresh.pubKeyOK = cached.pubKeyOK
+		fresh.PublicKeyCallback(conn, other.PublicKey())
+		cv.So(fresh.PublicKeyOK, cv.ShouldBeFalse)
+	})
+}
+
+func Test112EsshdForceCommand(t *testing.T) {
+
+	cv.Convey("With ForceCommand set, the -esshd should run it for every session in place of the command the client asked for, passing the request along in SSH_ORIGINAL_COMMAND.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.SrvCfg.EmbeddedSSHdForceCommand = `echo "forced:$SSH_ORIGINAL_COMMAND"; exit 3`
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		sess, err := cli.NewSession(ctx)
+		panicOn(err)
+		out, err := sess.Output("rm -rf /important")
+		cv.So(string(out), cv.ShouldEqual, "forced:rm -rf /important\n")
+		exitErr, ok := err.(*ssh.ExitError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(exitErr.ExitStatus(), cv.ShouldEqual, 3)
+
+		// the client may not set the forced command's environment.
+		sess2, err := cli.NewSession(ctx)
+		panicOn(err)
+		cv.So(sess2.Setenv("BASH_ENV", "/tmp/evil"), cv.ShouldNotBeNil)
+		sess2.Close()
+
+		// a command with quotes survives a save and load.
+		var buf bytes.Buffer
+		panicOn(s.SrvCfg.SaveConfig(&buf))
+		path := s.SrvCfg.Tempdir + "/forced.config"
+		panicOn(ioutil.WriteFile(path, buf.Bytes(), 0600))
+		back := NewSshegoConfig()
+		panicOn(back.LoadConfig(path))
+		cv.So(back.EmbeddedSSHdForceCommand, cv.ShouldEqual, s.SrvCfg.EmbeddedSSHdForceCommand)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test113ChannelWindowAndPacketSizes(t *testing.T) {
+
+	cv.Convey("Raising ChannelWindowSize and ChannelMaxPacket on both client and -esshd should still carry data intact.", t, func() {
+
+		s := MakeTestSshClientAndServer(false)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		for _, c := range []*SshegoConfig{s.SrvCfg, s.CliCfg} {
+			c.ChannelWindowSize = 8 << 20
+			c.ChannelMaxPacket = 128 << 10
+		}
+		s.SrvCfg.EmbeddedSSHdForceCommand = `head -c 3000000 /dev/zero`
+
+		ctx := context.Background()
+		s.SrvCfg.Esshd.Start(ctx)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		sess, err := cli.NewSession(ctx)
+		panicOn(err)
+		out, err := sess.Output("")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(out), cv.ShouldEqual, 3000000)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test118SequentialAuthReportsPartialSuccess(t *testing.T) {
+
+	cv.Convey("With SequentialAuth, the -esshd should answer a good public key with an RFC 4252 partial success, and the client should carry on to keyboard-interactive to finish the login; neither factor alone should do.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.SrvCfg.SequentialAuth = true
+
+		// the public key step alone reports partial success.
+		signer, err := LoadRSAPrivateKey(s.RsaPath)
+		panicOn(err)
+		a := NewPerAttempt(NewAuthState(nil), s.SrvCfg)
+		a.SetupAuthRequirements()
+		_, err = a.PublicKeyCallback(&fakeConnMeta{user: s.Mylogin}, signer.PublicKey())
+		partial, ok := err.(*ssh.PartialSuccessError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(partial.Next.PublicKeyCallback, cv.ShouldBeNil)
+		cv.So(partial.Next.KeyboardInteractiveCallback, cv.ShouldNotBeNil)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+
+		// key, then passphrase and one-time code.
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli, cv.ShouldNotBeNil)
+		cv.So(s.CliCfg.LastConnectTrace.AuthMethods, cv.ShouldResemble, []string{"publickey", "keyboard-interactive"})
+
+		// key only.
+		_, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, "", "", halt)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// passphrase and one-time code only.
+		_, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, "",
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test119TOTPCodesGivesAdjacentWindows(t *testing.T) {
+
+	cv.Convey("TOTPCodes should give the one-time codes for the window holding t and for the windows on either side of it.", t, func() {
+
+		w, err := NewTOTP("alice@example.com", "sshego-test")
+		panicOn(err)
+		url := w.Key.String()
+		secret := w.Key.Secret()
+
+		now := time.Unix(1500000015, 0)
+		prev, cur, next, err := TOTPCodes(url, now)
+		cv.So(err, cv.ShouldBeNil)
+
+		want := func(t time.Time) string {
+			code, err := totp.GenerateCode(secret, t)
+			panicOn(err)
+			return code
+		}
+		cv.So(prev, cv.ShouldEqual, want(now.Add(-30*time.Second)))
+		cv.So(cur, cv.ShouldEqual, want(now))
+		cv.So(next, cv.ShouldEqual, want(now.Add(30*time.Second)))
+		cv.So(prev, cv.ShouldNotEqual, cur)
+
+		// the same window gives the same codes.
+		_, cur2, _, err := TOTPCodes(url, now.Add(10*time.Second))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cur2, cv.ShouldEqual, cur)
+
+		// a url with its own period= is honoured, both here
+		// and by the sshd's check of a code.
+		key, err := totp.Generate(totp.GenerateOpts{Issuer: "sshego-test", AccountName: "bob@example.com", Period: 60})
+		panicOn(err)
+		prev, cur, next, err = TOTPCodes(key.String(), now)
+		cv.So(err, cv.ShouldBeNil)
+		opts := totp.ValidateOpts{Period: 60, Digits: otp.DigitsSix}
+		want60 := func(t time.Time) string {
+			code, err := totp.GenerateCodeCustom(key.Secret(), t, opts)
+			panicOn(err)
+			return code
+		}
+		cv.So(prev, cv.ShouldEqual, want60(now.Add(-60*time.Second)))
+		cv.So(cur, cv.ShouldEqual, want60(now))
+		cv.So(next, cv.ShouldEqual, want60(now.Add(60*time.Second)))
+
+		w60 := &TOTP{Key: key}
+		cv.So(w60.IsValid(want60(time.Now()), "bob"), cv.ShouldBeTrue)
+		cv.So(w60.IsValid(want60(time.Now().Add(-150*time.Second)), "bob"), cv.ShouldBeFalse)
+
+		_, _, _, err = TOTPCodes("not a url %%", now)
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+}
+
+func Test120EsshdSendsPreAuthBanner(t *testing.T) {
+
+	cv.Convey("After SetBanner, the -esshd should send its banner to each client before authentication, and the client should hand it to the BannerCallback.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		banner := "Authorized use only. Activity may be monitored.\n"
+		s.SrvCfg.Esshd.SetBanner(banner)
+
+		var got []string
+		s.CliCfg.BannerCallback = func(message string) error {
+			got = append(got, message)
+			return nil
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(got, cv.ShouldResemble, []string{banner})
+
+		// a BannerCallback error abandons the login.
+		s.CliCfg.BannerCallback = func(message string) error {
+			return fmt.Errorf("banner refused")
+		}
+		_, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "banner refused")
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test126EsshdReportsFailedLogins(t *testing.T) {
+
+	cv.Convey("The -esshd should hand each failed login, and each connection that never completes the handshake, to the AuthFailureCallback with the remote address, user, method, and reason.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		type failure struct {
+			host   string
+			user   string
+			method string
+			failed bool
+		}
+		var mut sync.Mutex
+		var got []failure
+		s.SrvCfg.AuthFailureCallback = func(remote net.Addr, user, method string, reason error) {
+			host, _, err := net.SplitHostPort(remote.String())
+			panicOn(err)
+			mut.Lock()
+			got = append(got, failure{host: host, user: user, method: method, failed: reason != nil})
+			mut.Unlock()
+		}
+		saw := func(want failure) bool {
+			for i := 0; i < 100; i++ {
+				mut.Lock()
+				for _, f := range got {
+					if f == want {
+						mut.Unlock()
+						return true
+					}
+				}
+				mut.Unlock()
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, "wrong-password", s.Totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(saw(failure{host: "127.0.0.1", user: s.Mylogin, method: "keyboard-interactive", failed: true}), cv.ShouldBeTrue)
+
+		// a client that never speaks ssh fails the handshake.
+		conn, err := net.Dial("tcp", s.SrvCfg.EmbeddedSSHd.Addr)
+		panicOn(err)
+		fmt.Fprintf(conn, "GET / HTTP/1.0\r\n\r\n")
+		conn.Close()
+		cv.So(saw(failure{host: "127.0.0.1", user: "", method: "handshake", failed: true}), cv.ShouldBeTrue)
+
+		mut.Lock()
+		for _, f := range got {
+			cv.So(f.method, cv.ShouldNotEqual, "none")
+		}
+		mut.Unlock()
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test170EsshdReportsBoundAddrWhenReady(t *testing.T) {
+
+	cv.Convey("Given port 0 for the -esshd address, Ready() should close once esshd is accepting, and BoundAddr() should then give the port the OS chose, so we can connect without sleeping.", t, func() {
+		cfg, r1 := GenTestConfig()
+		r1() // release the held-open ports.
+		defer TempDirCleanup(cfg.Origdir, cfg.Tempdir)
+		cfg.EmbeddedSSHd.Addr = "127.0.0.1:0"
+		panicOn(cfg.EmbeddedSSHd.ParseAddr())
+		cfg.NewEsshd()
+		cv.So(cfg.Esshd.BoundAddr(), cv.ShouldBeNil)
+
+		cfg.Esshd.Start(context.Background())
+		select {
+		case <-cfg.Esshd.Ready():
+		case <-time.After(10 * time.Second):
+			panic("esshd never became ready")
+		}
+		addr := cfg.Esshd.BoundAddr()
+		cv.So(addr, cv.ShouldNotBeNil)
+		cv.So(addr.(*net.TCPAddr).Port, cv.ShouldNotEqual, 0)
+
+		// no sleep: esshd should already be accepting, and sends its version first.
+		conn, err := net.Dial("tcp", addr.String())
+		cv.So(err, cv.ShouldBeNil)
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		version := make([]byte, 8)
+		_, err = io.ReadFull(conn, version)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(version), cv.ShouldEqual, "SSH-2.0-")
+		conn.Close()
+
+		cv.So(cfg.Esshd.Stop(), cv.ShouldBeNil)
+		<-cfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test171EsshdStopClosesLoggedInConnections(t *testing.T) {
+
+	cv.Convey("Esshd.Stop() should close the ssh connections esshd has accepted, not just its listener, and return with the port free for a new esshd.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		cli, _, err := s.CliCfg.SSHConnect(context.Background(), s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		closed := make(chan struct{})
+		go func() {
+			cli.Wait()
+			close(closed)
+		}()
+
+		cv.So(s.SrvCfg.Esshd.Stop(), cv.ShouldBeNil)
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+
+		select {
+		case <-closed:
+		case <-time.After(10 * time.Second):
+			panic("client connection still open after Esshd.Stop()")
+		}
+
+		lsn, err := net.Listen("tcp", s.SrvCfg.EmbeddedSSHd.Addr)
+		cv.So(err, cv.ShouldBeNil)
+		lsn.Close()
+	})
+}
+
+func Test172AuthorizedKeysLogInUsersByTheirPublicKeys(t *testing.T) {
+
+	cv.Convey("A key added to the -esshd's AuthorizedKeys store, at runtime, should log its user in as the key on file does, and stop doing so once removed.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		otherPath := s.SrvCfg.Tempdir + "/other_rsa"
+		_, other, err := GenRSAKeyPair(otherPath, 1024, "other@example.com")
+		panicOn(err)
+		keys := NewAuthorizedKeys()
+		s.SrvCfg.AuthorizedKeys = keys
+
+		connect := func() error {
+			halt := ssh.NewHalter()
+			defer func() {
+				halt.RequestStop()
+				halt.MarkDone()
+			}()
+			_, _, err := s.CliCfg.SSHConnect(context.Background(), s.CliCfg.KnownHosts, s.Mylogin, otherPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			return err
+		}
+		cv.So(connect(), cv.ShouldNotBeNil)
+
+		pubLine, err := ioutil.ReadFile(otherPath + ".pub")
+		panicOn(err)
+		cv.So(keys.Load(s.Mylogin, strings.NewReader("# added at runtime\n\n"+string(pubLine))), cv.ShouldBeNil)
+		list := keys.Keys(s.Mylogin)
+		cv.So(len(list), cv.ShouldEqual, 1)
+		cv.So(list[0].Comment, cv.ShouldEqual, "other@example.com")
+		cv.So(connect(), cv.ShouldBeNil)
+
+		cv.So(keys.Remove(s.Mylogin, other.PublicKey()), cv.ShouldBeTrue)
+		cv.So(keys.Remove(s.Mylogin, other.PublicKey()), cv.ShouldBeFalse)
+		cv.So(connect(), cv.ShouldNotBeNil)
+
+		// a login the HostDb does not know needs nothing but
+		// its key, when no one-time step is asked for, and gets
+		// the key's fingerprint in its permissions.
+		keys.Add("stranger", other.PublicKey(), "")
+		a := NewPerAttempt(NewAuthState(nil), s.SrvCfg)
+		a.OneTimeOK = true
+		perm, err := a.PublicKeyCallback(&fakeConnMeta{user: "stranger"}, other.PublicKey())
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(perm.Extensions["pubkey-fp"], cv.ShouldEqual, Fingerprint(other.PublicKey()))
+		_, err = a.PublicKeyCallback(&fakeConnMeta{user: "nobody"}, other.PublicKey())
+		cv.So(err, cv.ShouldNotBeNil)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test173EnrollTOTPReplacesAUsersSecret(t *testing.T) {
+
+	cv.Convey("EnrollTOTP should give a user a new TOTP secret, kept in the HostDb, whose codes ValidateTOTP and so the -esshd's keyboard-interactive login then take in place of the old secret's.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		h := s.SrvCfg.HostDb
+
+		_, cur, _, err := TOTPCodes(s.Totp, time.Now())
+		panicOn(err)
+		cv.So(h.ValidateTOTP(s.Mylogin, cur), cv.ShouldBeTrue)
+
+		url, png, err := h.EnrollTOTP(s.Mylogin)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(url, cv.ShouldStartWith, "otpauth://totp/")
+		cv.So(string(png), cv.ShouldStartWith, "\x89PNG")
+		user, ok := h.Persist.Users.Get2(s.Mylogin)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(user.TOTPorig, cv.ShouldEqual, url)
+		onDisk, err := ioutil.ReadFile(user.QrPath)
+		panicOn(err)
+		cv.So(onDisk, cv.ShouldResemble, png)
+
+		_, cur, _, err = TOTPCodes(url, time.Now())
+		panicOn(err)
+		cv.So(h.ValidateTOTP(s.Mylogin, cur), cv.ShouldBeTrue)
+		cv.So(h.ValidateTOTP(s.Mylogin, ""), cv.ShouldBeFalse)
+		cv.So(h.ValidateTOTP("nobody", cur), cv.ShouldBeFalse)
+		_, _, err = h.EnrollTOTP("nobody")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		connect := func(totpUrl string) error {
+			halt := ssh.NewHalter()
+			defer func() {
+				halt.RequestStop()
+				halt.MarkDone()
+			}()
+			_, _, err := s.CliCfg.SSHConnect(context.Background(), s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, totpUrl, halt)
+			return err
+		}
+		cv.So(connect(s.Totp), cv.ShouldNotBeNil)
+		cv.So(connect(url), cv.ShouldBeNil)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
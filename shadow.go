@@ -0,0 +1,118 @@
+package sshego
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// shadowQueueLen is how many writes a shadow
+// remote may fall behind before it is dropped.
+const shadowQueueLen = 256
+
+// shadowConn is the primary remote of a forward, teeing
+// everything written to it out to a shadow remote as well.
+// The primary alone sets the pace: copies for the shadow
+// are queued, and a shadow that errors or falls more than
+// shadowQueueLen writes behind is dropped. The shadow's
+// replies are read and discarded. Reads, deadlines and
+// addresses are those of the primary.
+type shadowConn struct {
+	net.Conn
+
+	shadow  net.Conn
+	label   string
+	log     Logger
+	copies  chan []byte
+	closing chan struct{}
+
+	closeOnce sync.Once
+	dropOnce  sync.Once
+	dropped   chan struct{}
+}
+
+func newShadowConn(primary, shadow net.Conn, label string, log Logger) *shadowConn {
+	c := &shadowConn{
+		Conn:    primary,
+		shadow:  shadow,
+		label:   label,
+		log:     log,
+		copies:  make(chan []byte, shadowQueueLen),
+		closing: make(chan struct{}),
+		dropped: make(chan struct{}),
+	}
+	go c.feed()
+	go io.Copy(ioutil.Discard, shadow)
+	return c
+}
+
+// Write writes p to the primary, and queues
+// what the primary took for the shadow.
+func (c *shadowConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		select {
+		case <-c.dropped:
+		case c.copies <- append([]byte(nil), p[:n]...):
+		default:
+			c.drop("it fell behind")
+		}
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the primary, if it can
+// be, once the shadow has been sent what is queued.
+func (c *shadowConn) CloseWrite() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close closes the primary. The shadow is closed
+// once it has been sent what is queued.
+func (c *shadowConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	return c.Conn.Close()
+}
+
+func (c *shadowConn) feed() {
+	defer c.drop("")
+	for {
+		select {
+		case b := <-c.copies:
+			if _, err := c.shadow.Write(b); err != nil {
+				c.drop(err.Error())
+				return
+			}
+		case <-c.closing:
+			for {
+				select {
+				case b := <-c.copies:
+					if _, err := c.shadow.Write(b); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-c.dropped:
+			return
+		}
+	}
+}
+
+// drop stops sending to the shadow and closes it,
+// logging why unless why is empty.
+func (c *shadowConn) drop(why string) {
+	c.dropOnce.Do(func() {
+		if why != "" {
+			c.log.Infof("sshego: dropping shadow remote for %s: %s", c.label, why)
+		}
+		close(c.dropped)
+		c.shadow.Close()
+	})
+}
@@ -0,0 +1,101 @@
+package sshego
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test133ShadowRemoteGetsACopyOfClientTraffic(t *testing.T) {
+
+	cv.Convey("With LocalToRemote.Shadow set, a forward should send the client's bytes to both Remote and Shadow, and hand the client only Remote's replies.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// each backend answers a line with its name prefixed,
+		// and reports the lines it was sent.
+		serve := func(ln net.Listener, name string, got chan string) {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					br := bufio.NewReader(c)
+					for {
+						line, err := br.ReadString('\n')
+						if err != nil {
+							return
+						}
+						got <- line
+						fmt.Fprintf(c, "%s:%s", name, line)
+					}
+				}(c)
+			}
+		}
+		primary, primaryPort := GetAvailPort()
+		defer primary.Close()
+		shadow, shadowPort := GetAvailPort()
+		defer shadow.Close()
+		primaryGot := make(chan string, 10)
+		shadowGot := make(chan string, 10)
+		go serve(primary, "primary", primaryGot)
+		go serve(shadow, "shadow", shadowGot)
+
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", primaryPort)
+		s.CliCfg.LocalToRemote.Shadow.Addr = fmt.Sprintf("127.0.0.1:%v", shadowPort)
+		s.CliCfg.Quiet = true
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+		panicOn(err)
+		br := bufio.NewReader(c)
+		for _, msg := range []string{"one\n", "two\n"} {
+			io.WriteString(c, msg)
+			line, err := br.ReadString('\n')
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(line, cv.ShouldEqual, "primary:"+msg)
+		}
+		wait := func(got chan string) string {
+			select {
+			case line := <-got:
+				return line
+			case <-time.After(5 * time.Second):
+				return "timeout"
+			}
+		}
+		cv.So(wait(primaryGot)+wait(primaryGot), cv.ShouldEqual, "one\ntwo\n")
+		cv.So(wait(shadowGot)+wait(shadowGot), cv.ShouldEqual, "one\ntwo\n")
+		c.Close()
+
+		// a shadow that is down leaves the forward working.
+		shadow.Close()
+		c, err = net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+		panicOn(err)
+		fmt.Fprintf(c, "three\n")
+		line, err := bufio.NewReader(c).ReadString('\n')
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(line, cv.ShouldEqual, "primary:three\n")
+		c.Close()
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
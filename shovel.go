@@ -1,8 +1,12 @@
 package sshego
 
 import (
+	"context"
 	"io"
+	"net"
 	"os"
+	"sync/atomic"
+	"time"
 
 	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
@@ -12,12 +16,43 @@ import (
 // You can request that the shovel stop by closing ReqStop,
 // and wait until Done is closed to know that it is finished.
 type shovel struct {
+	// written counts the bytes written, atomically.
+	// First, for 64-bit alignment.
+	written int64
+
 	Halt *ssh.Halter
 
 	// logging functionality, off by default
 	DoLog     bool
 	LogReads  io.Writer
 	LogWrites io.Writer
+
+	// pace, if set, is called after each write
+	// with the byte count, and gives how long to
+	// wait before the next. See FairShare.
+	pace func(n int) time.Duration
+
+	// limit, if set, holds the shovel to a
+	// byte rate. See RateLimitBytesPerSec.
+	limit *byteRate
+
+	// count, if set, is atomically incremented
+	// by each write's byte count. See Stats.
+	count *int64
+
+	// idle, if > 0, stops the shovel once no bytes
+	// have moved for that long; active holds the
+	// UnixNano time of the last progress, shared
+	// with the other shovel of the pair.
+	idle   time.Duration
+	active *int64
+
+	// draining is set atomically by drain(); src is
+	// the reader it interrupts. copied is closed when
+	// the copy loop returns.
+	draining int32
+	src      io.Reader
+	copied   chan struct{}
 }
 
 // make a new Shovel
@@ -27,6 +62,7 @@ func newShovel(doLog bool) *shovel {
 		DoLog:     doLog,
 		LogReads:  os.Stdout,
 		LogWrites: os.Stdout,
+		copied:    make(chan struct{}),
 	}
 }
 
@@ -38,13 +74,14 @@ type writerNilCloser struct{ io.Writer }
 
 func (wc *writerNilCloser) Close() error { return nil }
 
-// Start starts the shovel doing an io.Copy from r to w. The
+// Start starts the shovel doing a copyFull from r to w. The
 // goroutine that is running the copy will close the Ready
-// channel just before starting the io.Copy. The
+// channel just before starting the copy. The
 // label parameter allows reporting on when a specific shovel
 // was shut down.
 func (s *shovel) Start(w io.WriteCloser, r io.ReadCloser, label string) {
 
+	s.src = r
 	if s.DoLog {
 		// TeeReader returns a Reader that writes to w what it reads from r.
 		// All reads from r performed through it are matched with
@@ -58,27 +95,220 @@ func (s *shovel) Start(w io.WriteCloser, r io.ReadCloser, label string) {
 	go func() {
 		var err error
 		var n int64
+		drained := false
 		defer func() {
-			s.Halt.MarkDone()
+			close(s.copied)
+			// a drained shovel leaves closing to Drain,
+			// so as not to cut off its partner.
+			if !drained {
+				s.Halt.MarkDone()
+			}
 			p("shovel %s copied %d bytes before shutting down", label, n)
 		}()
 		s.Halt.MarkReady()
-		n, err = io.Copy(w, r)
+		dr := &drainReader{Reader: r, draining: &s.draining}
+		n, err = copyIdle(w, dr, make([]byte, shovelBufSize), s.idle, s.active, s.afterWrite())
+		if dr.drained {
+			drained = true
+			// let the far end see EOF after our last byte.
+			if cw, ok := w.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+			return
+		}
 		if err != nil {
 			// don't freak out, the network connection got closed most likely.
 			// e.g. read tcp 127.0.0.1:33631: use of closed network connection
-			//panic(fmt.Sprintf("in Shovel '%s', io.Copy failed: %v\n", label, err))
+			//panic(fmt.Sprintf("in Shovel '%s', copy failed: %v\n", label, err))
 			return
 		}
 	}()
 	go func() {
 		<-s.Halt.ReqStopChan()
-		r.Close() // causes io.Copy to finish
+		r.Close() // causes copyFull to finish
 		w.Close()
 		s.Halt.MarkDone()
 	}()
 }
 
+// afterWrite combines written, count, pace and limit into
+// the callback that copyFull makes after each write.
+func (s *shovel) afterWrite() func(n int) {
+	count, pace, limit := s.count, s.pace, s.limit
+	return func(n int) {
+		atomic.AddInt64(&s.written, int64(n))
+		if count != nil {
+			atomic.AddInt64(count, int64(n))
+		}
+		var wait time.Duration
+		if pace != nil {
+			wait = pace(n)
+		}
+		if limit != nil {
+			if w := limit.wrote(n); w > wait {
+				wait = w
+			}
+		}
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-s.Halt.ReqStopChan():
+			}
+		}
+	}
+}
+
+// shovelBufSize is the size of each shovel's copy buffer.
+const shovelBufSize = 32 * 1024
+
+// copyFull is io.CopyBuffer, except that a short write
+// is not an error: we keep writing the remainder of
+// what was read until it is all delivered, or until
+// the writer returns an error. io.Copy would
+// instead stop with io.ErrShortWrite and drop the rest.
+// If pace is not nil, it is called after each write.
+func copyFull(w io.Writer, r io.Reader, buf []byte, pace func(n int)) (written int64, err error) {
+	return copyIdle(w, r, buf, 0, nil, pace)
+}
+
+// CopyWithIdleTimeout copies from src to dst until EOF or
+// an error, as io.Copy does, but gives up with a timeout
+// error once idle passes without a byte read from src.
+// The timer restarts on every read that makes progress, so
+// a long but steady transfer is never cut off. src must
+// have a SetReadDeadline method, as net.Conn and
+// ssh.Channel do, or no timeout is applied; the deadline
+// is cleared again on return. idle <= 0 means no timeout.
+//
+// A plain io.Copy cannot do this, since each of its
+// Reads would need a fresh deadline set beforehand.
+func CopyWithIdleTimeout(dst io.Writer, src io.Reader, idle time.Duration) (written int64, err error) {
+	return copyIdle(dst, src, make([]byte, shovelBufSize), idle, nil, nil)
+}
+
+// readDeadliner is the part of net.Conn and
+// ssh.Channel that copyIdle needs.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// copyIdle is copyFull with an idle timeout, as described
+// at CopyWithIdleTimeout. If active is not nil, it is the
+// UnixNano time of the last progress, which we update and
+// which another copy may update too: a read that times
+// out while active shows progress within idle is retried.
+// This lets the two directions of a tunnel share one idle
+// clock, so a long download does not time out the quiet
+// upload direction.
+func copyIdle(w io.Writer, r io.Reader, buf []byte, idle time.Duration, active *int64, pace func(n int)) (written int64, err error) {
+	dl, _ := r.(readDeadliner)
+	if idle <= 0 {
+		dl = nil
+	}
+	if dl != nil {
+		if active == nil {
+			active = new(int64)
+		}
+		atomic.StoreInt64(active, time.Now().UnixNano())
+		defer dl.SetReadDeadline(time.Time{})
+	}
+	for {
+		if dl != nil {
+			last := time.Unix(0, atomic.LoadInt64(active))
+			dl.SetReadDeadline(last.Add(idle))
+		}
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			if dl != nil {
+				atomic.StoreInt64(active, time.Now().UnixNano())
+			}
+			nw, werr := writeAll(w, buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if pace != nil {
+				pace(nw)
+			}
+			if dl != nil {
+				// time spent writing, or held back by
+				// pace, is not time spent idle.
+				atomic.StoreInt64(active, time.Now().UnixNano())
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return written, nil
+			}
+			if ne, ok := rerr.(net.Error); ok && ne.Timeout() && dl != nil &&
+				time.Since(time.Unix(0, atomic.LoadInt64(active))) < idle {
+				// the other direction moved meanwhile.
+				continue
+			}
+			return written, rerr
+		}
+	}
+}
+
+// writeAll writes all of p to w, retrying after
+// short writes. A writer that makes no progress
+// and returns no error gets io.ErrShortWrite.
+func writeAll(w io.Writer, p []byte) (n int, err error) {
+	for n < len(p) {
+		var nw int
+		nw, err = w.Write(p[n:])
+		if nw < 0 || nw > len(p)-n {
+			return n, io.ErrShortWrite
+		}
+		n += nw
+		if err != nil {
+			return n, err
+		}
+		if nw == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// drain has the copy loop end, without error, once any
+// read in progress returns and its bytes are written.
+func (s *shovel) drain() {
+	atomic.StoreInt32(&s.draining, 1)
+	if d, ok := s.src.(readDeadliner); ok {
+		// wake a blocked Read.
+		d.SetReadDeadline(time.Now())
+	}
+}
+
+// drainReader reads as EOF once draining is set,
+// including the read that draining interrupted.
+type drainReader struct {
+	io.Reader
+	draining *int32
+	drained  bool
+}
+
+func (d *drainReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(d.draining) != 0 {
+		d.drained = true
+		return 0, io.EOF
+	}
+	n, err := d.Reader.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(d.draining) != 0 {
+		d.drained = true
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (d *drainReader) SetReadDeadline(t time.Time) error {
+	if rd, ok := d.Reader.(readDeadliner); ok {
+		return rd.SetReadDeadline(t)
+	}
+	return nil
+}
+
 // stop the shovel goroutine. returns only once the goroutine is done.
 func (s *shovel) Stop() {
 	s.Halt.RequestStop()
@@ -107,6 +337,47 @@ func newShovelPair(doLog bool) *shovelPair {
 	return pair
 }
 
+// setIdleTimeout has the pair stop once neither of
+// its shovels has moved a byte for idle. Call it
+// before Start. idle <= 0 means no timeout.
+func (s *shovelPair) setIdleTimeout(idle time.Duration) {
+	active := new(int64)
+	s.AB.idle, s.AB.active = idle, active
+	s.BA.idle, s.BA.active = idle, active
+}
+
+// setClass has both shovels of the pair paced by f
+// as traffic of class c. f may be nil.
+func (s *shovelPair) setClass(f *FairShare, c TrafficClass) {
+	s.AB.pace = f.pacer(c)
+	s.BA.pace = f.pacer(c)
+}
+
+// setRateLimit holds each shovel of the pair to
+// bytesPerSec. Call it before Start. bytesPerSec
+// <= 0 means no limit.
+func (s *shovelPair) setRateLimit(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		return
+	}
+	s.AB.limit = newByteRate(bytesPerSec)
+	s.BA.limit = newByteRate(bytesPerSec)
+}
+
+// countInto has the pair add the bytes that the a<-b
+// shovel writes into *ab, and those of the b<-a shovel
+// into *ba. Call it before Start.
+func (s *shovelPair) countInto(ab, ba *int64) {
+	s.AB.count = ab
+	s.BA.count = ba
+}
+
+// bytes returns how many bytes the a<-b and the b<-a
+// shovels have written so far.
+func (s *shovelPair) bytes() (ab, ba int64) {
+	return atomic.LoadInt64(&s.AB.written), atomic.LoadInt64(&s.BA.written)
+}
+
 // Start the pair of shovels. abLabel will label the a<-b shovel. baLabel will
 // label the b<-a shovel.
 func (s *shovelPair) Start(a io.ReadWriteCloser, b io.ReadWriteCloser, abLabel string, baLabel string) {
@@ -138,3 +409,29 @@ func (s *shovelPair) Stop() {
 	s.AB.Stop()
 	s.BA.Stop()
 }
+
+// Drain shuts the pair down gracefully. Both shovels stop
+// reading once any read in progress returns, finish writing
+// what they have already read, and then half-close their
+// writers where CloseWrite is supported, so each far end
+// sees EOF after the last byte. Once both are finished,
+// Drain closes everything, as Stop does. If ctx is done
+// first, Drain stops the pair at once and returns ctx.Err().
+// A read blocked on a source without SetReadDeadline, as
+// net.Conn and ssh.Channel have, can only be ended by ctx.
+func (s *shovelPair) Drain(ctx context.Context) (err error) {
+	s.AB.drain()
+	s.BA.drain()
+	for _, copied := range []chan struct{}{s.AB.copied, s.BA.copied} {
+		select {
+		case <-copied:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+	s.Stop()
+	return err
+}
@@ -2,6 +2,13 @@ package sshego
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -65,3 +72,360 @@ func (m *mockRwc) Write(p []byte) (n int, err error) {
 func (m *mockRwc) Close() error {
 	return nil
 }
+
+func TestShovelRetriesShortWrites(t *testing.T) {
+
+	cv.Convey("a Shovel should deliver every byte even when the writer only accepts a few bytes per Write", t, func() {
+
+		payload := []byte(RandomString(100000))
+		a := newMockRwc(payload)
+		b := &shortWriteRwc{mockRwc: newMockRwc(nil), max: 7}
+
+		s := newShovel(false)
+		s.Start(b, a, "b<-a")
+		<-s.Halt.DoneChan()
+		cv.So(b.sink.Len(), cv.ShouldEqual, len(payload))
+		cv.So(bytes.Equal(b.sink.Bytes(), payload), cv.ShouldBeTrue)
+		cv.So(b.writes, cv.ShouldBeGreaterThan, len(payload)/7-1)
+	})
+
+	cv.Convey("copyFull should report io.ErrShortWrite, rather than spin, when the writer makes no progress", t, func() {
+
+		b := &shortWriteRwc{mockRwc: newMockRwc(nil), max: 0}
+		n, err := copyFull(b, bytes.NewBufferString("hello"), make([]byte, 16), nil)
+		cv.So(n, cv.ShouldEqual, 0)
+		cv.So(err, cv.ShouldEqual, io.ErrShortWrite)
+	})
+}
+
+// shortWriteRwc accepts at most max bytes per Write,
+// and reports no error for the rest: a short write.
+type shortWriteRwc struct {
+	*mockRwc
+	max    int
+	writes int
+}
+
+func (m *shortWriteRwc) Write(p []byte) (n int, err error) {
+	m.writes++
+	if len(p) > m.max {
+		p = p[:m.max]
+	}
+	return m.sink.Write(p)
+}
+
+func TestFairSharePacesBulkOnlyWhenInteractiveIsActive(t *testing.T) {
+
+	cv.Convey("a Bulk shovel under FairShare should run at full speed alone, but be paced to BulkBytesPerSec while an Interactive shovel is moving data", t, func() {
+
+		rate := int64(32 * 1024)
+		payload := []byte(RandomString(int(3 * rate)))
+
+		copyBulk := func(f *FairShare) time.Duration {
+			t0 := time.Now()
+			sink := newMockRwc(nil)
+			s := newShovel(false)
+			s.pace = f.pacer(Bulk)
+			_, err := copyFull(sink, bytes.NewBuffer(payload), make([]byte, shovelBufSize), s.afterWrite())
+			panicOn(err)
+			cv.So(sink.sink.Len(), cv.ShouldEqual, len(payload))
+			return time.Since(t0)
+		}
+
+		f := NewFairShare(rate)
+		cv.So(copyBulk(f), cv.ShouldBeLessThan, 500*time.Millisecond)
+
+		// keystrokes flowing on an interactive tunnel.
+		stop := make(chan bool)
+		defer close(stop)
+		interactive := f.pacer(Interactive)
+		interactive(1)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(50 * time.Millisecond):
+					interactive(1)
+				}
+			}
+		}()
+		cv.So(copyBulk(f), cv.ShouldBeGreaterThan, 1500*time.Millisecond)
+
+		// a shovel held back by the pacing lets go
+		// as soon as it is asked to stop.
+		slow := NewFairShare(1)
+		slow.pacer(Interactive)(1)
+		s := newShovel(false)
+		s.pace = slow.pacer(Bulk)
+		paced := make(chan struct{})
+		go func() {
+			s.afterWrite()(1000)
+			close(paced)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		s.Halt.RequestStop()
+		returned := false
+		select {
+		case <-paced:
+			returned = true
+		case <-time.After(time.Second):
+		}
+		cv.So(returned, cv.ShouldBeTrue)
+
+		// nil FairShare never paces.
+		var none *FairShare
+		cv.So(none.pacer(Bulk), cv.ShouldBeNil)
+	})
+}
+
+func TestCopyWithIdleTimeoutRestartsOnProgress(t *testing.T) {
+
+	cv.Convey("CopyWithIdleTimeout should keep copying while bytes keep arriving more often than the idle timeout, and stop with a timeout error once they do not", t, func() {
+
+		idle := 200 * time.Millisecond
+		src, feed := net.Pipe()
+		defer src.Close()
+
+		go func() {
+			// steady, but slow: 6 writes across 3 idle periods.
+			for i := 0; i < 6; i++ {
+				feed.Write([]byte("tick"))
+				time.Sleep(idle / 2)
+			}
+			// then go quiet without closing.
+		}()
+
+		var sink bytes.Buffer
+		t0 := time.Now()
+		n, err := CopyWithIdleTimeout(&sink, src, idle)
+		elapsed := time.Since(t0)
+
+		cv.So(n, cv.ShouldEqual, 24)
+		cv.So(sink.String(), cv.ShouldEqual, strings.Repeat("tick", 6))
+		cv.So(err, cv.ShouldNotBeNil)
+		ne, ok := err.(net.Error)
+		cv.So(ok && ne.Timeout(), cv.ShouldBeTrue)
+		cv.So(elapsed, cv.ShouldBeGreaterThan, 3*idle)
+		feed.Close()
+
+		// EOF is not an error, as with io.Copy.
+		src2, feed2 := net.Pipe()
+		go func() {
+			feed2.Write([]byte("done"))
+			feed2.Close()
+		}()
+		sink.Reset()
+		n, err = CopyWithIdleTimeout(&sink, src2, idle)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(n, cv.ShouldEqual, 4)
+		src2.Close()
+
+		// a pause for pacing, longer than idle, is not idle.
+		src3, feed3 := net.Pipe()
+		go func() {
+			feed3.Write([]byte("slow"))
+			feed3.Write([]byte("down"))
+			feed3.Close()
+		}()
+		sink.Reset()
+		pace := func(n int) { time.Sleep(2 * idle) }
+		n, err = copyIdle(&sink, src3, make([]byte, 4), idle, nil, pace)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(sink.String(), cv.ShouldEqual, "slowdown")
+		src3.Close()
+	})
+}
+
+func TestShovelPairSharesOneIdleClock(t *testing.T) {
+
+	cv.Convey("a ShovelPair with an idle timeout should stay up while either direction is moving, and stop once both have been quiet for the timeout", t, func() {
+
+		idle := 200 * time.Millisecond
+		a, aPeer := net.Pipe()
+		b, bPeer := net.Pipe()
+		go io.Copy(ioutil.Discard, aPeer)
+
+		s := newShovelPair(false)
+		s.setIdleTimeout(idle)
+		s.Start(a, b, "a<-b", "b<-a")
+		<-s.Halt.ReadyChan()
+
+		// only b->a moves; a->b stays quiet throughout.
+		for i := 0; i < 8; i++ {
+			_, err := bPeer.Write([]byte("download"))
+			cv.So(err, cv.ShouldBeNil)
+			time.Sleep(idle / 4)
+		}
+		select {
+		case <-s.Halt.DoneChan():
+			panic("shovelPair stopped while one direction was busy")
+		default:
+		}
+
+		select {
+		case <-s.Halt.DoneChan():
+		case <-time.After(10 * idle):
+			panic("shovelPair did not stop after going idle")
+		}
+		aPeer.Close()
+		bPeer.Close()
+	})
+}
+
+// tcpPair returns the two ends of a loopback tcp connection.
+func tcpPair() (net.Conn, net.Conn) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOn(err)
+	defer lsn.Close()
+	c, err := net.Dial("tcp", lsn.Addr().String())
+	panicOn(err)
+	s, err := lsn.Accept()
+	panicOn(err)
+	return c, s
+}
+
+// pipeRwc reads from a pipe that has no deadlines.
+type pipeRwc struct {
+	*io.PipeReader
+}
+
+func (p *pipeRwc) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestShovelPairDrainFlushesAndHalfCloses(t *testing.T) {
+
+	cv.Convey("Drain should let a ShovelPair deliver what it has read, waiting for a write still in flight, hand each far end an EOF after the last byte, and return; or give up when ctx does", t, func() {
+
+		a, aPeer := tcpPair()
+		b, bPeer := tcpPair()
+		defer aPeer.Close()
+		defer bPeer.Close()
+
+		s := newShovelPair(false)
+		var ab, ba int64
+		s.countInto(&ab, &ba)
+		s.Start(a, b, "a<-b", "b<-a")
+		<-s.Halt.ReadyChan()
+
+		payload := RandomString(100000)
+		_, err := bPeer.Write([]byte(payload))
+		cv.So(err, cv.ShouldBeNil)
+
+		got := make(chan string)
+		go func() {
+			by, _ := ioutil.ReadAll(aPeer)
+			got <- string(by)
+		}()
+
+		// let the shovel read the payload; Drain must
+		// not cut off what it has already read.
+		for i := 0; atomic.LoadInt64(&ab) < int64(len(payload)); i++ {
+			if i > 500 {
+				panic("payload never made it through the shovel")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cv.So(s.Drain(ctx), cv.ShouldBeNil)
+		select {
+		case <-s.Halt.DoneChan():
+		case <-time.After(5 * time.Second):
+			panic("shovelPair not done after Drain")
+		}
+
+		// ReadAll returning means aPeer saw EOF.
+		select {
+		case g := <-got:
+			cv.So(g, cv.ShouldEqual, payload)
+		case <-time.After(5 * time.Second):
+			panic("far end never saw EOF after Drain")
+		}
+
+		// a write still in flight: net.Pipe blocks it
+		// until aPeer2 reads, and Drain must wait for it.
+		a2, aPeer2 := net.Pipe()
+		b2, bPeer2 := tcpPair()
+		defer aPeer2.Close()
+		defer bPeer2.Close()
+		s3 := newShovelPair(false)
+		s3.Start(a2, b2, "a<-b", "b<-a")
+		<-s3.Halt.ReadyChan()
+		go bPeer2.Write([]byte(payload))
+		time.Sleep(100 * time.Millisecond)
+
+		drained := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			drained <- s3.Drain(ctx)
+		}()
+		select {
+		case <-drained:
+			panic("Drain returned with a write still in flight")
+		case <-time.After(200 * time.Millisecond):
+		}
+		go func() {
+			by, _ := ioutil.ReadAll(aPeer2)
+			got <- string(by)
+		}()
+		select {
+		case err := <-drained:
+			cv.So(err, cv.ShouldBeNil)
+		case <-time.After(5 * time.Second):
+			panic("Drain never returned once the write could finish")
+		}
+		select {
+		case g := <-got:
+			cv.So(len(g), cv.ShouldBeGreaterThan, 0)
+			cv.So(strings.HasPrefix(payload, g), cv.ShouldBeTrue)
+		case <-time.After(5 * time.Second):
+			panic("far end never saw EOF after Drain")
+		}
+
+		// a source without deadlines can only be abandoned.
+		pr1, pw1 := io.Pipe()
+		pr2, pw2 := io.Pipe()
+		defer pw1.Close()
+		defer pw2.Close()
+		s2 := newShovelPair(false)
+		s2.Start(&pipeRwc{pr1}, &pipeRwc{pr2}, "a<-b", "b<-a")
+		<-s2.Halt.ReadyChan()
+		short, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel2()
+		cv.So(errors.Is(s2.Drain(short), context.DeadlineExceeded), cv.ShouldBeTrue)
+	})
+}
+
+func TestShovelPairRateLimitCapsEachDirection(t *testing.T) {
+
+	cv.Convey("a ShovelPair with a rate limit should take about size/rate to move size bytes after a second's burst, and still stop promptly when asked", t, func() {
+
+		const rate = 100 * 1024
+		a, aPeer := net.Pipe()
+		b, bPeer := net.Pipe()
+		go io.Copy(ioutil.Discard, bPeer)
+
+		s := newShovelPair(false)
+		s.setRateLimit(rate)
+		s.Start(a, b, "a<-b", "b<-a")
+		<-s.Halt.ReadyChan()
+
+		// a burst of one second's worth, then two more seconds.
+		t0 := time.Now()
+		payload := make([]byte, 3*rate)
+		_, err := aPeer.Write(payload)
+		cv.So(err, cv.ShouldBeNil)
+		took := time.Since(t0)
+		cv.So(took, cv.ShouldBeGreaterThan, 1500*time.Millisecond)
+		cv.So(took, cv.ShouldBeLessThan, 5*time.Second)
+
+		// a shovel waiting on its limit stops at once.
+		aPeer.Write(payload[:rate])
+		t0 = time.Now()
+		s.Stop()
+		cv.So(time.Since(t0), cv.ShouldBeLessThan, time.Second)
+		aPeer.Close()
+		bPeer.Close()
+	})
+}
@@ -0,0 +1,200 @@
+package sshego
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// SOCKS5, per RFC 1928: the parts that ssh -D speaks.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksSucceeded        = 0x00
+	socksHostUnreachable  = 0x04
+	socksCmdNotSupported  = 0x07
+	socksAtypNotSupported = 0x08
+)
+
+// socksHandshakeTimeLimit bounds how long a SOCKS
+// client may take to say where it wants to go.
+const socksHandshakeTimeLimit = 10 * time.Second
+
+// socksError is a failed SOCKS request, with
+// the reply code to send the client.
+type socksError struct {
+	code byte
+	msg  string
+}
+
+func (e *socksError) Error() string { return e.msg }
+
+// StartupSOCKSListener listens on cfg.DynamicSOCKS as a
+// SOCKS5 proxy, in the manner of ssh -D: each CONNECT
+// request is dialed, by host:port, through sshClientConn,
+// and the client is then forwarded to it as by NewForward.
+// IPv4, IPv6 and domain-name targets are understood;
+// only the no-authentication method is offered. The
+// listener runs until ctx is done.
+func (cfg *SshegoConfig) StartupSOCKSListener(ctx context.Context, sshClientConn *ssh.Client) error {
+	laddr, err := net.ResolveTCPAddr("tcp", cfg.DynamicSOCKS.HostPort())
+	if err != nil {
+		return fmt.Errorf("could not -socks listen on %s: %s", cfg.DynamicSOCKS.Addr, err)
+	}
+	ln, err := cfg.listenTCP(laddr)
+	if err != nil {
+		return fmt.Errorf("could not -socks listen on %s: %s", cfg.DynamicSOCKS.Addr, err)
+	}
+	sshClientConn.TmpCtx = ctx
+	go func() {
+		for {
+			fromBrowser, err := acceptWithContext(ctx, ln)
+			if err != nil {
+				cfg.logger().Errorf("sshego: SOCKS listener on %s stopping: Accept error: '%s'", cfg.DynamicSOCKS.Addr, err)
+				ln.Close()
+				cfg.acceptStopped(ctx, "SOCKS listener on "+cfg.DynamicSOCKS.Addr, err)
+				return
+			}
+			go cfg.newSOCKSForward(ctx, sshClientConn, fromBrowser)
+		}
+	}()
+	return nil
+}
+
+// newSOCKSForward reads the SOCKS request on fromBrowser,
+// dials its target through sshClientConn, and starts the
+// shovels between them.
+func (cfg *SshegoConfig) newSOCKSForward(ctx context.Context, sshClientConn *ssh.Client, fromBrowser net.Conn) {
+	fromBrowser.SetDeadline(time.Now().Add(socksHandshakeTimeLimit))
+	target, err := socksHandshake(fromBrowser)
+	if err != nil {
+		cfg.logger().Errorf("sshego: SOCKS request from %s failed: %s", fromBrowser.RemoteAddr(), err)
+		if se, ok := err.(*socksError); ok {
+			socksReply(fromBrowser, se.code)
+		}
+		fromBrowser.Close()
+		return
+	}
+	if !cfg.Quiet {
+		cfg.logger().Infof("sshego: SOCKS connection on %s, forwarding --> to sshd host %s, and thence --> to %s\n", cfg.DynamicSOCKS.Addr, cfg.SSHdServer.Addr, target)
+	}
+
+	channelToSSHd, err := sshClientConn.Dial("tcp", target)
+	if err != nil {
+		cfg.logger().Errorf("sshego: SOCKS remote dial to '%s' error: %s", target, err)
+		socksReply(fromBrowser, socksHostUnreachable)
+		fromBrowser.Close()
+		return
+	}
+	if err := socksReply(fromBrowser, socksSucceeded); err != nil {
+		channelToSSHd.Close()
+		fromBrowser.Close()
+		return
+	}
+	fromBrowser.SetDeadline(time.Time{})
+
+	sp := newShovelPair(false)
+	sp.setClass(cfg.FairShare, cfg.LocalToRemote.Class)
+	sp.setIdleTimeout(cfg.IdleTimeoutDur)
+	sp.setRateLimit(cfg.RateLimitBytesPerSec)
+	sp.countInto(&cfg.stats.BytesDown, &cfg.stats.BytesUp)
+	sp.Start(fromBrowser, channelToSSHd, "fromBrowser<-channelToSSHd", "channelToSSHd<-fromBrowser")
+	cfg.trackTunnel("socks", fromBrowser.RemoteAddr(), &hostPortAddr{network: "tcp", addr: target}, sp.BA, sp.AB, sp)
+	atomic.AddInt64(&cfg.stats.Forwards, 1)
+}
+
+// socksHandshake reads the client's greeting and CONNECT
+// request from rw, and returns the host:port it asks for.
+// A *socksError carries the reply code for a request
+// we must refuse.
+func socksHandshake(rw io.ReadWriter) (target string, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(rw, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("not SOCKS5: version %v", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err = rw.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", fmt.Errorf("client does not offer the no-authentication method")
+	}
+
+	var req [4]byte
+	if _, err = io.ReadFull(rw, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("not SOCKS5: version %v", req[0])
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err = io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err = io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err = io.ReadFull(rw, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err = io.ReadFull(rw, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", &socksError{code: socksAtypNotSupported, msg: fmt.Sprintf("address type %v not supported", req[3])}
+	}
+	var port [2]byte
+	if _, err = io.ReadFull(rw, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		return "", &socksError{code: socksCmdNotSupported, msg: fmt.Sprintf("command %v not supported, only CONNECT", req[1])}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply answers a CONNECT request with code. We do
+// not know the address the sshd bound, so give 0.0.0.0:0.
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,158 @@
+package sshego
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// socksConnect does a SOCKS5 handshake on c asking for
+// the address in req (atyp, address, port), and returns
+// the reply code.
+func socksConnect(c net.Conn, cmd byte, req []byte) byte {
+	_, err := c.Write([]byte{socksVersion, 1, socksNoAuth})
+	panicOn(err)
+	var sel [2]byte
+	_, err = io.ReadFull(c, sel[:])
+	panicOn(err)
+	if sel[1] != socksNoAuth {
+		panic(fmt.Sprintf("proxy chose method %v", sel[1]))
+	}
+	_, err = c.Write(append([]byte{socksVersion, cmd, 0}, req...))
+	panicOn(err)
+	var reply [10]byte
+	_, err = io.ReadFull(c, reply[:])
+	panicOn(err)
+	return reply[1]
+}
+
+func socksPort(port int) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(port))
+	return b[:]
+}
+
+func Test141SOCKSListenerForwardsToTheRequestedTarget(t *testing.T) {
+
+	cv.Convey("With DynamicSOCKS set, SSHConnect should start a SOCKS5 proxy that tunnels CONNECTs to IPv4 and domain-name targets through the sshd, and refuses other commands.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// echoes one line per connection.
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		go func() {
+			for {
+				c, err := target.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					line, err := bufio.NewReader(c).ReadString('\n')
+					if err == nil {
+						fmt.Fprintf(c, "echo:%s", line)
+					}
+				}(c)
+			}
+		}()
+
+		socksLsn, socksLsnPort := GetAvailPort()
+		socksLsn.Close()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.DynamicSOCKS.Addr = fmt.Sprintf("127.0.0.1:%v", socksLsnPort)
+		cv.So(s.CliCfg.DynamicSOCKS.ParseAddr(), cv.ShouldBeNil)
+		s.CliCfg.Quiet = true
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		ipv4 := append([]byte{socksAtypIPv4, 127, 0, 0, 1}, socksPort(targetPort)...)
+		domain := append(append([]byte{socksAtypDomain, byte(len("localhost"))}, "localhost"...), socksPort(targetPort)...)
+		for i, req := range [][]byte{ipv4, domain} {
+			c, err := net.Dial("tcp", s.CliCfg.DynamicSOCKS.Addr)
+			panicOn(err)
+			cv.So(socksConnect(c, socksCmdConnect, req), cv.ShouldEqual, socksSucceeded)
+			fmt.Fprintf(c, "hi%v\n", i)
+			line, err := bufio.NewReader(c).ReadString('\n')
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(line, cv.ShouldEqual, fmt.Sprintf("echo:hi%v\n", i))
+			c.Close()
+		}
+
+		// BIND is refused.
+		c, err := net.Dial("tcp", s.CliCfg.DynamicSOCKS.Addr)
+		panicOn(err)
+		cv.So(socksConnect(c, 2, ipv4), cv.ShouldEqual, socksCmdNotSupported)
+		c.Close()
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+// socksPeer is the client side of a SOCKS handshake held
+// in memory: reads come from in, writes go to out.
+type socksPeer struct {
+	in  *bytes.Buffer
+	out bytes.Buffer
+}
+
+func (p *socksPeer) Read(b []byte) (int, error)  { return p.in.Read(b) }
+func (p *socksPeer) Write(b []byte) (int, error) { return p.out.Write(b) }
+
+func TestSOCKSHandshakeParsesEachAddressType(t *testing.T) {
+
+	cv.Convey("socksHandshake should give host:port for IPv4, IPv6 and domain-name CONNECT requests, and a socksError for an unknown address type.", t, func() {
+
+		greeting := []byte{socksVersion, 2, 0x02, socksNoAuth}
+		connect := []byte{socksVersion, socksCmdConnect, 0}
+		ask := func(addr []byte) (string, []byte, error) {
+			in := append(append(append([]byte{}, greeting...), connect...), addr...)
+			p := &socksPeer{in: bytes.NewBuffer(in)}
+			target, err := socksHandshake(p)
+			return target, p.out.Bytes(), err
+		}
+
+		target, out, err := ask(append([]byte{socksAtypIPv4, 10, 1, 2, 3}, socksPort(80)...))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(target, cv.ShouldEqual, "10.1.2.3:80")
+		cv.So(out, cv.ShouldResemble, []byte{socksVersion, socksNoAuth})
+
+		ipv6 := append([]byte{socksAtypIPv6}, net.ParseIP("2001:db8::1")...)
+		target, _, err = ask(append(ipv6, socksPort(8080)...))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(target, cv.ShouldEqual, "[2001:db8::1]:8080")
+
+		target, _, err = ask(append(append([]byte{socksAtypDomain, 11}, "example.com"...), socksPort(443)...))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(target, cv.ShouldEqual, "example.com:443")
+
+		_, _, err = ask([]byte{9, 0, 0})
+		se, ok := err.(*socksError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(se.code, cv.ShouldEqual, socksAtypNotSupported)
+
+		// a client that only offers username/password is turned away.
+		p := &socksPeer{in: bytes.NewBuffer([]byte{socksVersion, 1, 0x02})}
+		_, err = socksHandshake(p)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(p.out.Bytes(), cv.ShouldResemble, []byte{socksVersion, socksNoAcceptable})
+	})
+}
@@ -0,0 +1,326 @@
+package sshego
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	cryrand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// SSHFP records (RFC 4255, RFC 6594) publish host key
+// fingerprints in DNS. We do not validate DNSSEC signatures
+// ourselves; as with OpenSSH's VerifyHostKeyDNS, we ask a
+// validating resolver and trust its AD (authenticated data)
+// bit. So the resolver must be one you trust, reached over
+// a path you trust: typically a validating resolver on
+// localhost.
+
+// ErrSSHFPNoMatch is returned when DNS holds no DNSSEC-validated
+// SSHFP record matching the host key we were shown.
+var ErrSSHFPNoMatch = fmt.Errorf("no DNSSEC-validated SSHFP record matches the host key")
+
+const (
+	dnsTypeSSHFP = 44
+	dnsTypeOPT   = 41
+	dnsClassIN   = 1
+
+	dnsFlagQR = 1 << 15
+	dnsFlagTC = 1 << 9
+	dnsFlagRD = 1 << 8
+	dnsFlagAD = 1 << 5
+
+	// sshfpSHA256 is the only fingerprint type we
+	// accept; type 1, SHA-1, is too weak to rely on.
+	sshfpSHA256 = 2
+)
+
+// sshfpAlgorithm gives the SSHFP algorithm number
+// for an ssh key type, or 0 if there is none.
+func sshfpAlgorithm(keyType string) uint8 {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return 1
+	case ssh.KeyAlgoDSA:
+		return 2
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return 3
+	case ssh.KeyAlgoED25519:
+		return 4
+	}
+	return 0
+}
+
+// sshfpRecord is the RDATA of one SSHFP record.
+type sshfpRecord struct {
+	Algorithm   uint8
+	Type        uint8
+	Fingerprint []byte
+}
+
+// VerifySSHFP checks key against the SSHFP records for
+// hostname (a bare name, or a host:port) held in DNS,
+// asking the resolver at resolver (host:port). It returns
+// nil only when the answer was DNSSEC-validated and one
+// of its SHA-256 records matches key.
+func VerifySSHFP(ctx context.Context, resolver, hostname string, key ssh.PublicKey) error {
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	alg := sshfpAlgorithm(key.Type())
+	if alg == 0 {
+		return fmt.Errorf("VerifySSHFP: no SSHFP algorithm for key type '%s'", key.Type())
+	}
+	recs, authenticated, err := lookupSSHFP(ctx, resolver, hostname)
+	if err != nil {
+		return fmt.Errorf("VerifySSHFP: lookup of '%s' at '%s' failed: %v", hostname, resolver, err)
+	}
+	if !authenticated {
+		return fmt.Errorf("VerifySSHFP: answer for '%s' was not DNSSEC-validated: %w", hostname, ErrSSHFPNoMatch)
+	}
+	want := sha256.Sum256(key.Marshal())
+	for _, r := range recs {
+		if r.Algorithm == alg && r.Type == sshfpSHA256 && bytes.Equal(r.Fingerprint, want[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("VerifySSHFP: '%s' has %v SSHFP record(s), none for key %s: %w",
+		hostname, len(recs), ssh.FingerprintSHA256(key), ErrSSHFPNoMatch)
+}
+
+// sshfpResolver returns cfg.SSHFPResolver, or else the
+// first nameserver in /etc/resolv.conf.
+func (cfg *SshegoConfig) sshfpResolver() string {
+	if cfg.SSHFPResolver != "" {
+		return cfg.SSHFPResolver
+	}
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// lookupSSHFP queries resolver for the SSHFP records of name,
+// over udp, and again over tcp if the answer was truncated.
+// authenticated reports the AD bit of the answer.
+func lookupSSHFP(ctx context.Context, resolver, name string) (recs []sshfpRecord, authenticated bool, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+	}
+	// an unpredictable id makes a forged reply harder
+	// to slip in ahead of the resolver's.
+	var idBuf [2]byte
+	if _, err := cryrand.Read(idBuf[:]); err != nil {
+		return nil, false, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+	query, err := dnsQuery(id, name, dnsTypeSSHFP)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := dnsExchange(ctx, "udp", resolver, query)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(resp) >= 4 && binary.BigEndian.Uint16(resp[2:])&dnsFlagTC != 0 {
+		resp, err = dnsExchange(ctx, "tcp", resolver, query)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return parseSSHFPResponse(id, name, resp)
+}
+
+// dnsQuery builds a recursive query for name and qtype,
+// with an EDNS0 OPT record setting the DO bit, and the AD
+// bit set to ask for the validation result (RFC 6840).
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	var b bytes.Buffer
+	hdr := []uint16{id, dnsFlagRD | dnsFlagAD, 1, 0, 0, 1}
+	for _, v := range hdr {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("bad dns name '%s'", name)
+		}
+		b.WriteByte(byte(len(label)))
+		b.WriteString(label)
+	}
+	b.WriteByte(0)
+	binary.Write(&b, binary.BigEndian, []uint16{qtype, dnsClassIN})
+
+	// OPT: root name, type, udp size, ext-rcode/version, DO, no rdata.
+	b.WriteByte(0)
+	binary.Write(&b, binary.BigEndian, []uint16{dnsTypeOPT, 4096, 0, 1 << 15, 0})
+	return b.Bytes(), nil
+}
+
+// dnsExchange sends query to server and returns the reply.
+func dnsExchange(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// parseSSHFPResponse picks the SSHFP records out of
+// the answer section of the dns reply msg, after checking
+// that msg answers our query: id, and one question for
+// the SSHFP records of name in class IN.
+func parseSSHFPResponse(id uint16, name string, msg []byte) (recs []sshfpRecord, authenticated bool, err error) {
+	if len(msg) < 12 {
+		return nil, false, fmt.Errorf("dns reply too short")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	switch {
+	case binary.BigEndian.Uint16(msg) != id:
+		return nil, false, fmt.Errorf("dns reply id mismatch")
+	case flags&dnsFlagQR == 0:
+		return nil, false, fmt.Errorf("dns reply is not a response")
+	case flags&0xf != 0:
+		return nil, false, fmt.Errorf("dns reply has rcode %v", flags&0xf)
+	}
+	authenticated = flags&dnsFlagAD != 0
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	if qdcount != 1 {
+		return nil, false, fmt.Errorf("dns reply has %v questions, not 1", qdcount)
+	}
+	qname, off, err := readDNSName(msg, 12)
+	if err != nil {
+		return nil, false, err
+	}
+	if off+4 > len(msg) {
+		return nil, false, fmt.Errorf("dns reply truncated in question")
+	}
+	qtype := binary.BigEndian.Uint16(msg[off:])
+	qclass := binary.BigEndian.Uint16(msg[off+2:])
+	off += 4
+	switch {
+	case !strings.EqualFold(qname, strings.TrimSuffix(name, ".")):
+		return nil, false, fmt.Errorf("dns reply is for '%s', not '%s'", qname, name)
+	case qtype != dnsTypeSSHFP || qclass != dnsClassIN:
+		return nil, false, fmt.Errorf("dns reply is for type %v class %v, not SSHFP IN", qtype, qclass)
+	}
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, false, err
+		}
+		if off+10 > len(msg) {
+			return nil, false, fmt.Errorf("dns reply truncated in answer %v", i)
+		}
+		rrtype := binary.BigEndian.Uint16(msg[off:])
+		rrclass := binary.BigEndian.Uint16(msg[off+2:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, false, fmt.Errorf("dns reply truncated in answer %v", i)
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+		if rrtype != dnsTypeSSHFP || rrclass != dnsClassIN || len(rdata) < 3 {
+			// e.g. a CNAME, or the RRSIG over the set.
+			continue
+		}
+		recs = append(recs, sshfpRecord{
+			Algorithm:   rdata[0],
+			Type:        rdata[1],
+			Fingerprint: append([]byte{}, rdata[2:]...),
+		})
+	}
+	return recs, authenticated, nil
+}
+
+// readDNSName reads the uncompressed name starting at off,
+// as in the question of a reply, and returns it without
+// the trailing dot, along with the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("dns name runs past end of reply")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return strings.Join(labels, "."), off + 1, nil
+		case n&0xc0 != 0:
+			return "", 0, fmt.Errorf("dns reply question name is compressed")
+		case off+1+n > len(msg):
+			return "", 0, fmt.Errorf("dns name runs past end of reply")
+		}
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += 1 + n
+	}
+}
+
+// skipDNSName returns the offset just past the
+// possibly compressed name starting at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, fmt.Errorf("dns name runs past end of reply")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			// a pointer ends the name.
+			return off + 2, nil
+		}
+		off += 1 + n
+	}
+}
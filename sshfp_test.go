@@ -0,0 +1,192 @@
+package sshego
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// fakeSSHFPResolver answers every query on udp with
+// the SSHFP records in fps, setting the AD bit if signed.
+type fakeSSHFPResolver struct {
+	conn   net.PacketConn
+	fps    [][]byte
+	alg    byte
+	signed bool
+}
+
+func newFakeSSHFPResolver() *fakeSSHFPResolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	panicOn(err)
+	r := &fakeSSHFPResolver{conn: conn}
+	go r.serve()
+	return r
+}
+
+func (r *fakeSSHFPResolver) Addr() string { return r.conn.LocalAddr().String() }
+
+func (r *fakeSSHFPResolver) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := buf[:n]
+		end, err := skipDNSName(q, 12)
+		if err != nil {
+			continue
+		}
+		end += 4
+		flags := uint16(dnsFlagQR | dnsFlagRD | 1<<7)
+		if r.signed {
+			flags |= dnsFlagAD
+		}
+		reply := make([]byte, 12, 512)
+		copy(reply, q[:2])
+		binary.BigEndian.PutUint16(reply[2:], flags)
+		binary.BigEndian.PutUint16(reply[4:], 1)
+		binary.BigEndian.PutUint16(reply[6:], uint16(len(r.fps)))
+		reply = append(reply, q[12:end]...)
+		for _, fp := range r.fps {
+			rr := make([]byte, 12)
+			binary.BigEndian.PutUint16(rr, 0xc00c)
+			binary.BigEndian.PutUint16(rr[2:], dnsTypeSSHFP)
+			binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+			binary.BigEndian.PutUint32(rr[6:], 300)
+			binary.BigEndian.PutUint16(rr[10:], uint16(2+len(fp)))
+			reply = append(reply, rr...)
+			reply = append(reply, r.alg, sshfpSHA256)
+			reply = append(reply, fp...)
+		}
+		r.conn.WriteTo(reply, from)
+	}
+}
+
+func Test308SSHFPVouchesForUnknownHostKeys(t *testing.T) {
+
+	cv.Convey("With VerifySSHFP, an unknown sshd host key should be accepted only when a DNSSEC-validated SSHFP record matches it, and SSHFPPin should then store it in the known hosts.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		hostKey := s.SrvCfg.HostDb.HostSshSigner.PublicKey()
+		goodFP := sha256.Sum256(hostKey.Marshal())
+
+		dns := newFakeSSHFPResolver()
+		defer dns.conn.Close()
+		dns.alg = sshfpAlgorithm(hostKey.Type())
+		cv.So(dns.alg, cv.ShouldNotEqual, 0)
+
+		s.CliCfg.AddIfNotKnown = false
+		s.CliCfg.TestAllowOneshotConnect = false
+		s.CliCfg.VerifySSHFP = true
+		s.CliCfg.SSHFPPin = true
+		s.CliCfg.SSHFPResolver = dns.Addr()
+		s.CliCfg.LocalToRemote.Listen.Addr = ""
+		s.CliCfg.DirectTcp = true
+
+		ctx := context.Background()
+		connect := func() error {
+			halt := ssh.NewHalter()
+			defer func() {
+				halt.RequestStop()
+				halt.MarkDone()
+			}()
+			_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			return err
+		}
+		pubBytes := string(ssh.MarshalAuthorizedKey(hostKey))
+		pinned := func() bool {
+			s.CliCfg.KnownHosts.Mut.Lock()
+			defer s.CliCfg.KnownHosts.Mut.Unlock()
+			_, ok := s.CliCfg.KnownHosts.Hosts[pubBytes]
+			return ok
+		}
+
+		// a matching record, but without DNSSEC.
+		dns.fps = [][]byte{goodFP[:]}
+		dns.signed = false
+		cv.So(connect(), cv.ShouldNotBeNil)
+
+		// signed, but for some other key.
+		wrong := sha256.Sum256([]byte("not the host key"))
+		dns.fps = [][]byte{wrong[:]}
+		dns.signed = true
+		cv.So(connect(), cv.ShouldNotBeNil)
+		cv.So(pinned(), cv.ShouldBeFalse)
+
+		// signed and matching, among others.
+		dns.fps = [][]byte{wrong[:], goodFP[:]}
+		cv.So(connect(), cv.ShouldBeNil)
+		cv.So(pinned(), cv.ShouldBeTrue)
+
+		// once pinned, DNS is no longer needed.
+		s.CliCfg.VerifySSHFP = false
+		cv.So(connect(), cv.ShouldBeNil)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test323SSHFPRepliesMustAnswerTheQuery(t *testing.T) {
+
+	cv.Convey("parseSSHFPResponse should take only a reply with our id, asking about our name, for type SSHFP and class IN.", t, func() {
+
+		query, err := dnsQuery(0x1234, "host.example.com", dnsTypeSSHFP)
+		panicOn(err)
+		fp := sha256.Sum256([]byte("a host key"))
+
+		// reply echoes the header and question of q,
+		// with one SSHFP answer.
+		reply := func(q []byte) []byte {
+			end, err := skipDNSName(q, 12)
+			panicOn(err)
+			end += 4
+			r := append([]byte{}, q[:end]...)
+			binary.BigEndian.PutUint16(r[2:], dnsFlagQR|dnsFlagRD|dnsFlagAD)
+			binary.BigEndian.PutUint16(r[6:], 1)
+			binary.BigEndian.PutUint16(r[10:], 0)
+			rr := make([]byte, 12)
+			binary.BigEndian.PutUint16(rr, 0xc00c)
+			binary.BigEndian.PutUint16(rr[2:], dnsTypeSSHFP)
+			binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+			binary.BigEndian.PutUint32(rr[6:], 300)
+			binary.BigEndian.PutUint16(rr[10:], uint16(2+len(fp)))
+			r = append(r, rr...)
+			r = append(r, 4, sshfpSHA256)
+			return append(r, fp[:]...)
+		}
+
+		recs, ad, err := parseSSHFPResponse(0x1234, "host.example.com", reply(query))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ad, cv.ShouldBeTrue)
+		cv.So(len(recs), cv.ShouldEqual, 1)
+
+		_, _, err = parseSSHFPResponse(0x4321, "host.example.com", reply(query))
+		cv.So(err, cv.ShouldNotBeNil)
+
+		_, _, err = parseSSHFPResponse(0x1234, "other.example.com", reply(query))
+		cv.So(err, cv.ShouldNotBeNil)
+
+		otherType, err := dnsQuery(0x1234, "host.example.com", 1)
+		panicOn(err)
+		_, _, err = parseSSHFPResponse(0x1234, "host.example.com", reply(otherType))
+		cv.So(err, cv.ShouldNotBeNil)
+
+		otherClass := reply(query)
+		end, _ := skipDNSName(otherClass, 12)
+		binary.BigEndian.PutUint16(otherClass[end+2:], 3)
+		_, _, err = parseSSHFPResponse(0x1234, "host.example.com", otherClass)
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+}
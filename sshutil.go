@@ -2,44 +2,179 @@ package sshego
 
 import (
 	"context"
+	"crypto/md5"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
 	"github.com/pquerna/otp/totp"
 )
 
+// ChallengeResolver answers the prompts that an sshd
+// poses during keyboard-interactive authentication.
+// Implement it to support arbitrary MFA systems,
+// and set it on SshegoConfig.ChallengeResolver
+// (or DialConfig.ChallengeResolver) before
+// calling SSHConnect().
+//
+// Resolve is called once per question. echo
+// reports whether the server suggests the answer
+// may be displayed as it is typed. Returning
+// an error aborts the authentication attempt.
+type ChallengeResolver interface {
+	Resolve(instruction, question string, echo bool) (string, error)
+}
+
+// kiCliHelp is the default ChallengeResolver. It
+// answers the password and TOTP (or HOTP) challenges
+// posed by our embedded sshd.
 type kiCliHelp struct {
 	passphrase string
 	toptUrl    string
+
+	// key is toptUrl already parsed, by SSHConnect.
+	// If nil, Resolve parses toptUrl itself.
+	key *otp.Key
+
+	// hotpCounter is the next HOTP counter, for an
+	// otpauth://hotp/ toptUrl; see SshegoConfig.HOTPCounter.
+	hotpCounter *uint64
+
+	// counterPath, if set, is the config file
+	// each advance of *hotpCounter is saved to.
+	counterPath string
+
+	// clockOffset is added to time.Now() for a TOTP
+	// code; see SshegoConfig.TOTPClockOffset.
+	clockOffset time.Duration
 }
 
-// helper assists ssh client with keyboard-interactive
-// password and TOPT login. Must match the
-// prototype KeyboardInteractiveChallenge.
-func (ki *kiCliHelp) helper(ctx context.Context, user string, instruction string, questions []string, echos []bool) ([]string, error) {
-	var answers []string
-	for _, q := range questions {
-		switch q {
-		case passwordChallenge: // "password: "
-			answers = append(answers, ki.passphrase)
-		case gauthChallenge: // "google-authenticator-code: "
-			w, err := otp.NewKeyFromURL(strings.TrimSpace(ki.toptUrl))
-			panicOn(err)
-			code, err := totp.GenerateCode(w.Secret(), time.Now())
-			panicOn(err)
-			answers = append(answers, code)
-		default:
-			panic(fmt.Sprintf("unrecognized challenge: '%v'", q))
+// Resolve answers passwordChallenge with the passphrase
+// and gauthChallenge with a freshly computed TOTP code,
+// or the next HOTP code if toptUrl is for HOTP.
+func (ki *kiCliHelp) Resolve(instruction, question string, echo bool) (string, error) {
+	switch question {
+	case passwordChallenge: // "password: "
+		return ki.passphrase, nil
+	case gauthChallenge: // "google-authenticator-code: "
+		w := ki.key
+		if w == nil {
+			var err error
+			w, err = parseOtpURL(ki.toptUrl)
+			if err != nil {
+				return "", err
+			}
+		}
+		if w.Type() == "hotp" {
+			return ki.nextHOTP(w)
+		}
+		return totp.GenerateCodeCustom(w.Secret(), time.Now().Add(ki.clockOffset), totpOpts(w))
+	}
+	return "", fmt.Errorf("unrecognized challenge: '%v'", question)
+}
+
+// passwordPrompt reports whether a keyboard-interactive
+// question asks for a password, as our esshd's and
+// OpenSSH's PAM prompts do, rather than a one-time code.
+func passwordPrompt(question string) bool {
+	return question == passwordChallenge ||
+		strings.Contains(strings.ToLower(question), "password")
+}
+
+// ErrBadOtpURL is returned, wrapped, by SSHConnect when its
+// toptUrl is not a usable otpauth://totp/ or otpauth://hotp/ url.
+var ErrBadOtpURL = fmt.Errorf("malformed otpauth url")
+
+// parseOtpURL parses toptUrl, and checks that it
+// is an otpauth url we can compute codes from.
+func parseOtpURL(toptUrl string) (*otp.Key, error) {
+	w, err := otp.NewKeyFromURL(strings.TrimSpace(toptUrl))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadOtpURL, err)
+	}
+	u, err := url.Parse(w.String())
+	if err != nil || u.Scheme != "otpauth" {
+		return nil, fmt.Errorf("%w: scheme must be otpauth://", ErrBadOtpURL)
+	}
+	if w.Secret() == "" {
+		return nil, fmt.Errorf("%w: no secret", ErrBadOtpURL)
+	}
+	switch w.Type() {
+	case "totp":
+		_, err = totp.GenerateCode(w.Secret(), time.Now())
+	case "hotp":
+		_, err = hotp.GenerateCode(w.Secret(), 0)
+	default:
+		return nil, fmt.Errorf("%w: type '%s' is neither totp nor hotp", ErrBadOtpURL, w.Type())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: secret: %v", ErrBadOtpURL, err)
+	}
+	return w, nil
+}
+
+// nextHOTP returns the HOTP code for the next counter, and
+// advances it, saving it to counterPath if set. A zero
+// counter starts from the counter= of the url instead.
+func (ki *kiCliHelp) nextHOTP(w *otp.Key) (string, error) {
+	if ki.hotpCounter == nil {
+		ki.hotpCounter = new(uint64)
+	}
+	if atomic.LoadUint64(ki.hotpCounter) == 0 {
+		if u, err := url.Parse(w.String()); err == nil {
+			if c, err := strconv.ParseUint(u.Query().Get("counter"), 10, 64); err == nil {
+				atomic.CompareAndSwapUint64(ki.hotpCounter, 0, c)
+			}
 		}
 	}
-	return answers, nil
+	c := atomic.AddUint64(ki.hotpCounter, 1) - 1
+	if ki.counterPath != "" {
+		if err := saveHOTPCounter(ki.counterPath, ki.hotpCounter); err != nil {
+			return "", fmt.Errorf("could not save the HOTP counter to '%s': %v", ki.counterPath, err)
+		}
+	}
+	return hotp.GenerateCode(w.Secret(), c)
+}
+
+// challengeHelper adapts a ChallengeResolver to
+// the prototype KeyboardInteractiveChallenge.
+func challengeHelper(r ChallengeResolver) ssh.KeyboardInteractiveChallenge {
+	return func(ctx context.Context, user string, instruction string, questions []string, echos []bool) ([]string, error) {
+		var answers []string
+		for i, q := range questions {
+			ans, err := r.Resolve(instruction, q, echos[i])
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, ans)
+		}
+		return answers, nil
+	}
+}
+
+// signNoter is a Signer that notes in *signed
+// when it is asked to sign.
+type signNoter struct {
+	ssh.Signer
+	signed *bool
+}
+
+func (s *signNoter) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	*s.signed = true
+	return s.Signer.Sign(rand, data)
 }
 
 func defaultFileFormat() KnownHostsPersistFormat {
@@ -88,6 +223,11 @@ func (s HostState) String() string {
 	return ""
 }
 
+// ErrNewNotNeeded is returned by HostAlreadyKnown, along
+// with KnownOK, when addIfNotKnown was requested for a host
+// that is already known. See SshegoConfig.NewOKIfKnown.
+var ErrNewNotNeeded = fmt.Errorf("error: flag -new given but not needed. Re-run without -new : this is important to prevent MITM attacks; TofuAddIfNotKnown must be false once the server/host is known.")
+
 // HostAlreadyKnown checks the given host details against our
 // known hosts file.
 func (h *KnownHosts) HostAlreadyKnown(hostname string, remote net.Addr, key ssh.PublicKey, pubBytes []byte, addIfNotKnown bool, allowOneshotConnect bool) (HostState, *ServerPubKey, error) {
@@ -106,7 +246,7 @@ func (h *KnownHosts) HostAlreadyKnown(hostname string, remote net.Addr, key ssh.
 			return Banned, record, err
 		}
 
-		if strings.HasPrefix(hostname, "localhost") || strings.HasPrefix(hostname, "127.0.0.1") {
+		if h.lenientLocalhost(hostname) {
 			// no host checking when coming from localhost
 			p("in HostAlreadyKnown, no host checking when coming from localhost, returning KnownOK")
 			/*
@@ -121,17 +261,9 @@ func (h *KnownHosts) HostAlreadyKnown(hostname string, remote net.Addr, key ssh.
 				return h.AddNeeded(addIfNotKnown, allowOneshotConnect, hostname, remote, strPubBytes, key, record)
 			}
 		}
-		if record.Hostname != hostname {
-			// check all the SplitHostnames before failing
-			found := false
-			record.Mut.Lock()
-			for hn := range record.SplitHostnames {
-				if hn == hostname {
-					found = true
-					record.Mut.Unlock()
-					break
-				}
-			}
+		if !hostNameMatches(record.Hostname, hostname) {
+			// check all the SplitHostnames, hashed ones too, before failing
+			found := record.knownAs(hostname)
 
 			if addIfNotKnown {
 				return h.AddNeeded(addIfNotKnown, allowOneshotConnect, hostname, remote, strPubBytes, key, record)
@@ -147,25 +279,105 @@ func (h *KnownHosts) HostAlreadyKnown(hostname string, remote net.Addr, key ssh.
 		}
 		p("in HostAlreadyKnown, returning KnownOK.")
 		if addIfNotKnown {
-			msg := fmt.Errorf("error: flag -new given but not needed. Re-run without -new : this is important to prevent MITM attacks; TofuAddIfNotKnown must be false once the server/host is known.")
-			p(msg.Error())
-			return KnownOK, record, msg
+			p("%s", ErrNewNotNeeded)
+			return KnownOK, record, ErrNewNotNeeded
 		}
 		return KnownOK, record, nil
 	}
 
+	// a new key from a host we hold other keys for has been
+	// changed, not rotated: a rotated key is staged first
+	// with AddHostKey. -new still takes it.
+	if !addIfNotKnown && !h.lenientLocalhost(hostname) && h.hasHost(hostname) {
+		err := fmt.Errorf("host key for '%s' has changed: '%s' matches none of the keys we hold for it", hostname, strPubBytes)
+		return KnownRecordMismatch, nil, err
+	}
 	return h.AddNeeded(addIfNotKnown, allowOneshotConnect, hostname, remote, strPubBytes, key, record)
 }
 
+// ErrMFARequired is wrapped in the error from SSHConnect()
+// under RequireMFA, when it has not both a key and a one-time
+// code to give, or when the sshd did not ask for both.
+var ErrMFARequired = fmt.Errorf("RequireMFA: both a public key and a one-time code are required")
+
+// ErrHostKeyRejected is wrapped in the error from SSHConnect()
+// when the server's host key was refused: unknown to us,
+// banned, or not the key on record for the host.
+var ErrHostKeyRejected = fmt.Errorf("host key rejected")
+
+// ErrAuthFailed is wrapped in the error from SSHConnect()
+// when the sshd took none of the ways we offered to log in.
+var ErrAuthFailed = fmt.Errorf("authentication failed")
+
+// ErrConnectTimeout is wrapped in the error from SSHConnect()
+// when it does not finish within cfg.OverallTimeout, its tcp
+// dial within cfg.ConnectTimeout, or its handshake within
+// cfg.HandshakeTimeout; so that errors.Is can tell a host
+// that is down or unreachable from one that refused us.
+var ErrConnectTimeout = fmt.Errorf("connect timed out")
+
+// dialTimeoutError wraps ErrConnectTimeout into err,
+// from a tcp dial to addr, if it timed out.
+func dialTimeoutError(addr string, timeout time.Duration, err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return fmt.Errorf("dial to '%s': %w after %v: %v", addr, ErrConnectTimeout, timeout, err)
+	}
+	return err
+}
+
+// Timeouts holds per-sshd overrides of the
+// SshegoConfig timeouts of the same names.
+type Timeouts struct {
+	Connect   time.Duration
+	Handshake time.Duration
+	Overall   time.Duration
+}
+
+// TimeoutsFor returns the timeouts that SSHConnect uses
+// for the sshd at hostport: cfg.HostTimeouts[hostport]
+// where set, otherwise the config-wide values.
+func (cfg *SshegoConfig) TimeoutsFor(hostport string) Timeouts {
+	t := Timeouts{
+		Connect:   cfg.ConnectTimeout,
+		Handshake: cfg.HandshakeTimeout,
+		Overall:   cfg.OverallTimeout,
+	}
+	o := cfg.HostTimeouts[hostport]
+	if o.Connect > 0 {
+		t.Connect = o.Connect
+	}
+	if o.Handshake > 0 {
+		t.Handshake = o.Handshake
+	}
+	if o.Overall > 0 {
+		t.Overall = o.Overall
+	}
+	return t
+}
+
 // SSHConnect is the main entry point for the gosshtun library,
 // establishing an ssh tunnel between two hosts.
 //
 // passphrase and toptUrl (one-time password used in challenge/response)
 // are optional, but will be offered to the server if set.
 //
+// Cancelling ctxPar aborts a dial or handshake still in
+// progress, closes the connection once made, and closes
+// its forward, reverse and SOCKS listeners, as does a stop
+// request on halt. So ctxPar is the lifetime of the tunnels,
+// not a deadline for the connect; bound the connect alone
+// with OverallTimeout.
+//
 func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, username string, keypath string, sshdHost string, sshdPort int64, passphrase string, toptUrl string, halt *ssh.Halter) (sshClient *ssh.Client, nc net.Conn, err error) {
+	return cfg.sshConnect(ctxPar, h, username, keypath, sshdHost, sshdPort, passphrase, toptUrl, halt, false)
+}
+
+// sshConnect does the work of SSHConnect, and of
+// SSHCheck, which passes checkOnly.
+func (cfg *SshegoConfig) sshConnect(ctxPar context.Context, h *KnownHosts, username string, keypath string, sshdHost string, sshdPort int64, passphrase string, toptUrl string, halt *ssh.Halter, checkOnly bool) (sshClient *ssh.Client, nc net.Conn, err error) {
 	cfg.Mut.Lock()
 	defer cfg.Mut.Unlock()
+	validateOnly := checkOnly || cfg.ValidateOnly
 
 	if !cfg.SkipKeepAlive {
 		if cfg.KeepAliveEvery <= 0 {
@@ -180,197 +392,601 @@ func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, usern
 
 	p("SSHConnect sees sshdHost:port = %s:%v. cfg=%#v", sshdHost, sshdPort, cfg)
 	if h == nil {
-		panic("h cannot be nil!")
+		return nil, nil, fmt.Errorf("SSHConnect() error: KnownHosts h cannot be nil")
 	}
 
-	// the callback just after key-exchange to validate server is here
-	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-
-		pubBytes := ssh.MarshalAuthorizedKey(key)
-		fingerprint := ssh.FingerprintSHA256(key)
-
-		hostStatus, spubkey, err := h.HostAlreadyKnown(hostname, remote, key, pubBytes, cfg.AddIfNotKnown, cfg.TestAllowOneshotConnect)
-		//log.Printf("SshegoConfig.SSHConnect(): in hostKeyCallback(), hostStatus: '%s', hostname='%s', remote='%s', key.Type='%s'  server.host.pub.key='%s' and host-key sha256.fingerprint='%s'\n", hostStatus, hostname, remote, key.Type(), pubBytes, fingerprint)
-		_ = fingerprint
-		//log.Printf("server '%s' has host-key sha256.fingerprint='%s'", hostname, fingerprint)
-		h.Mut.Lock()
-		h.curStatus = hostStatus
-		h.curHost = spubkey
-		h.Mut.Unlock()
-
+	// a bad toptUrl is reported now, not mid-handshake.
+	var otpKey *otp.Key
+	if toptUrl != "" && cfg.ChallengeResolver == nil {
+		otpKey, err = parseOtpURL(toptUrl)
 		if err != nil {
-			// this is strict checking of hosts here, any non-nil error
-			// will fail the ssh handshake.
-			p("err not nil at line 178 of sshutil.go: '%v'", err)
-			return err
+			return nil, nil, fmt.Errorf("SSHConnect() error: bad toptUrl: %w", err)
 		}
+	}
+	if err = cfg.Crypto.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("SSHConnect() error: %w", err)
+	}
+	if cfg.RequireMFA && (keypath == "" || (toptUrl == "" && cfg.ChallengeResolver == nil)) {
+		return nil, nil, fmt.Errorf("SSHConnect() error: %w, but keypath or toptUrl is missing", ErrMFARequired)
+	}
 
-		switch hostStatus {
-		case Banned:
-			return fmt.Errorf("banned server")
-
-		case KnownRecordMismatch:
-			return fmt.Errorf("known record mismatch")
-
-		case KnownOK:
-			p("in hostKeyCallback(), hostStatus is KnownOK.")
-			return nil
-
-		case Unknown:
-			// do we allow?
-			return fmt.Errorf("unknown server; could be Man-In-The-Middle attack.  If this is first time setup, you must use -new to allow the new host")
+	// tr stays nil unless we actually dial out.
+	var tr *ConnectTrace
+	defer func() {
+		if tr == nil {
+			return
+		}
+		tr.Total = time.Since(tr.Start)
+		tr.Err = err
+		if err == nil {
+			atomic.AddInt64(&cfg.stats.Connects, 1)
+			if cfg.LogAuthMethod {
+				cfg.logger().Infof("sshego: authenticated to %s as '%s' by %v", tr.HostPort, username, tr.AuthMethods)
+			}
+		} else {
+			atomic.AddInt64(&cfg.stats.ConnectFailures, 1)
 		}
+		cfg.LastConnectTrace = tr
+		if cfg.ConnectTraceHook != nil {
+			cfg.ConnectTraceHook(tr)
+		}
+	}()
 
-		return nil
+	// the callback just after key-exchange to validate server is here
+	verify := cfg.hostKeyChain(h)
+	var hostKeyRejected bool
+	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if tr != nil {
+			tr.Kex = tr.lap()
+		}
+		_, err := verify(ctx, hostname, remote, key)
+		if err != nil {
+			hostKeyRejected = true
+		}
+		return err
 	}
 	// end hostKeyCallback closure definition. Has to be a closure to access h.
 
-	// EMBEDDED SSHD server
-	if cfg.EmbeddedSSHd.Addr != "" {
-		// only start Esshd if not already:
-		if cfg.Esshd == nil {
-
-			log.Printf("%v starting -esshd with addr: %s",
-				cfg.Nickname, cfg.EmbeddedSSHd.Addr)
-			err := cfg.EmbeddedSSHd.ParseAddr()
+	// dialCtx bounds the dial, handshake, and listener
+	// setup, so that OverallTimeout can abort them without
+	// also stopping an embedded sshd that shares ctx. The
+	// connection, once made, lives on ctx.
+	dialCtx, cancelDial := context.WithCancel(ctx)
+	defer cancelDial()
+	hostport := net.JoinHostPort(sshdHost, strconv.FormatInt(sshdPort, 10))
+	timeouts := cfg.TimeoutsFor(hostport)
+	if timeouts.Overall > 0 {
+		expired := time.AfterFunc(timeouts.Overall, cancelDial)
+		defer func() {
+			if expired.Stop() {
+				// finished in time.
+				return
+			}
+			if sshClient != nil {
+				sshClient.Close()
+				if cfg.SshClient == sshClient {
+					cfg.SshClient = nil
+					cfg.Underlying = nil
+				}
+				if cfg.SharedClient != nil && cfg.SharedClient.Client == sshClient {
+					cfg.SharedClient = nil
+				}
+			}
+			if nc != nil {
+				nc.Close()
+			}
+			sshClient, nc = nil, nil
 			if err != nil {
-				panic(err)
+				err = fmt.Errorf("SSHConnect() to '%s:%v': %w after %v: %v", sshdHost, sshdPort, ErrConnectTimeout, timeouts.Overall, err)
+			} else {
+				err = fmt.Errorf("SSHConnect() to '%s:%v': %w after %v", sshdHost, sshdPort, ErrConnectTimeout, timeouts.Overall)
 			}
-			cfg.NewEsshd()
-			go cfg.Esshd.Start(ctx)
+		}()
+	}
+
+	// EMBEDDED SSHD server
+	if !validateOnly {
+		if err := cfg.startEsshd(ctx); err != nil {
+			return nil, nil, err
 		}
 	}
 
 	p("got to direct test. cfg.DirectTcp=%v", cfg.DirectTcp)
-	if !cfg.DirectTcp &&
+	if !validateOnly &&
+		!cfg.DirectTcp &&
 		cfg.RemoteToLocal.Listen.Addr == "" &&
-		cfg.LocalToRemote.Listen.Addr == "" {
+		cfg.LocalToRemote.Listen.Addr == "" &&
+		len(cfg.RemoteToLocals) == 0 &&
+		len(cfg.LocalToRemotes) == 0 &&
+		cfg.DynamicSOCKS.Addr == "" {
 		//panic("nothing to do?!")
 		// when starting an esshd, we just listen,
 		// no active outgoing connection.
 		return nil, nil, nil
 	}
 
-	if cfg.DirectTcp ||
+	if validateOnly ||
+		cfg.DirectTcp ||
 		cfg.RemoteToLocal.Listen.Addr != "" ||
-		cfg.LocalToRemote.Listen.Addr != "" {
+		cfg.LocalToRemote.Listen.Addr != "" ||
+		len(cfg.RemoteToLocals) > 0 ||
+		len(cfg.LocalToRemotes) > 0 ||
+		cfg.DynamicSOCKS.Addr != "" {
 
 		p("inside direct test")
 
-		useRSA := true
+		useKey := true
 		var privkey ssh.Signer
 		var err error
-		// to test that we fail without rsa key,
+		// to test that we fail without a key,
 		// allow submitting auth without it
 		// if the keypath == ""
 		if keypath == "" {
-			useRSA = false
+			useKey = false
 		} else {
-			// client forward tunnel with this RSA key
-			privkey, err = LoadRSAPrivateKey(keypath)
+			// client forward tunnel with this key, of any supported type.
+			privkey, err = LoadEncryptedPrivateKey(keypath, cfg.PrivateKeyPassphrase)
 			if err != nil {
-				return nil, nil, fmt.Errorf("error in SshegoConfig.SSHConnect() to '%s@%s:%v', LoadRSAPrivateKey(keypath='%v') errored with: '%v'", username, sshdHost, sshdPort, keypath, err)
+				return nil, nil, fmt.Errorf("error in SshegoConfig.SSHConnect() to '%s@%s:%v', LoadEncryptedPrivateKey(keypath='%v') errored with: '%w'", username, sshdHost, sshdPort, keypath, err)
 			}
 		}
 
+		// offeredKey and answeredCode note which factors
+		// the sshd took from us, for RequireMFA: a key it
+		// had us sign with, and a one-time code it asked for.
+		var offeredKey, answeredCode bool
+
 		auth := []ssh.AuthMethod{}
-		if useRSA {
-			auth = append(auth, ssh.PublicKeys(privkey))
+		var agentSigners func() ([]ssh.Signer, error)
+		if cfg.UseAgent {
+			var agentConn net.Conn
+			agentSigners, agentConn, err = cfg.dialAgent()
+			if err != nil {
+				return nil, nil, fmt.Errorf("error in SshegoConfig.SSHConnect() to '%s@%s:%v': %w", username, sshdHost, sshdPort, err)
+			}
+			// the agent signs only during the handshake.
+			defer agentConn.Close()
 		}
-		if passphrase != "" {
+		if useKey || agentSigners != nil {
+			// one publickey method, offering the key file and
+			// then the agent's keys: only the first method of
+			// each kind is ever tried.
+			auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				var signers []ssh.Signer
+				if useKey {
+					signers = append(signers, privkey)
+				}
+				if agentSigners != nil {
+					held, err := agentSigners()
+					if err != nil {
+						if len(signers) == 0 {
+							return nil, err
+						}
+						cfg.logger().Errorf("%s SSHConnect: could not list the ssh-agent's keys, offering only '%s': %v", cfg.Nickname, keypath, err)
+					}
+					signers = append(signers, held...)
+				}
+				// a key only counts once the sshd has taken
+				// it and asked us to sign.
+				for i := range signers {
+					signers[i] = &signNoter{Signer: signers[i], signed: &offeredKey}
+				}
+				return signers, nil
+			}))
+		}
+		if passphrase != "" && !cfg.RequireMFA {
 			auth = append(auth, ssh.Password(passphrase))
 		}
-		if toptUrl != "" {
-			ans := kiCliHelp{
-				passphrase: passphrase,
-				toptUrl:    toptUrl,
+		var challenge ssh.KeyboardInteractiveChallenge
+		if cfg.ChallengeResolver != nil {
+			challenge = challengeHelper(cfg.ChallengeResolver)
+		} else if toptUrl != "" {
+			ans := &kiCliHelp{
+				passphrase:  passphrase,
+				toptUrl:     toptUrl,
+				key:         otpKey,
+				hotpCounter: &cfg.HOTPCounter,
+				counterPath: cfg.ConfigPath,
+				clockOffset: cfg.TOTPClockOffset,
+			}
+			challenge = challengeHelper(ans)
+		}
+		if challenge != nil {
+			codeAuth := ssh.KeyboardInteractiveChallenge(func(ctx context.Context, user string, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers, err := challenge(ctx, user, instruction, questions, echos)
+				if err == nil {
+					// any prompt but a password's is taken to be
+					// for a one-time code, whatever the sshd calls it.
+					for i, q := range questions {
+						if i < len(answers) && answers[i] != "" && !passwordPrompt(q) {
+							answeredCode = true
+						}
+					}
+				}
+				return answers, err
+			})
+			if cfg.RequireMFA {
+				// the code goes first: an sshd wanting both, as
+				// esshd does, then has us sign with the key,
+				// rather than only asking if it is one we hold.
+				auth = append([]ssh.AuthMethod{codeAuth}, auth...)
+			} else {
+				auth = append(auth, codeAuth)
 			}
-			auth = append(auth, ssh.KeyboardInteractiveChallenge(ans.helper))
 		}
 
 		cliCfg := &ssh.ClientConfig{
 			User:     username,
-			HostPort: fmt.Sprintf("%v:%v", sshdHost, sshdPort),
+			HostPort: hostport,
 			Auth:     auth,
 			// HostKeyCallback, if not nil, is called during the cryptographic
 			// handshake to validate the server's host key. A nil HostKeyCallback
 			// implies that all host keys are accepted.
 			HostKeyCallback: hostKeyCallback,
+			BannerCallback:  cfg.BannerCallback,
+			Timeout:         timeouts.Connect,
 			Config: ssh.Config{
-				Ciphers: getCiphers(),
-				Halt:    halt,
+				Halt:              halt,
+				ChannelWindowSize: cfg.ChannelWindowSize,
+				ChannelMaxPacket:  cfg.ChannelMaxPacket,
 			},
 		}
-		hostport := fmt.Sprintf("%s:%d", sshdHost, sshdPort)
+		cfg.Crypto.apply(&cliCfg.Config)
 		p("about to ssh.Dial hostport='%s'", hostport)
-		sshClient, nc, err = cfg.mySSHDial(ctx, "tcp", hostport, cliCfg, halt)
+		tr = newConnectTrace(hostport)
+		var jumps *jumpChain
+		if len(cfg.JumpHosts) > 0 {
+			jumps, err = cfg.dialJumps(ctx, dialCtx, hostport, cliCfg, halt)
+			if err != nil {
+				err = classifyDialError(err, hostKeyRejected)
+				return nil, nil, fmt.Errorf("sshConnect() errored at dial to '%s': '%w' ", hostport, err)
+			}
+			// RequireMFA is about the sshd, not the jump hosts.
+			offeredKey, answeredCode = false, false
+		}
+		sshClient, nc, err = cfg.mySSHDial(ctx, dialCtx, "tcp", hostport, cliCfg, halt, tr, jumps)
 		p("sshClient back from mySSHDial() = %p, err=%v", sshClient, err)
 
 		if err != nil {
 			p("returning early on %v", err)
-			return nil, nil, fmt.Errorf("sshConnect() errored at dial to '%s': '%s' ", hostport, err.Error())
+			err = classifyDialError(err, hostKeyRejected)
+			return nil, nil, fmt.Errorf("sshConnect() errored at dial to '%s': '%w' ", hostport, err)
 		}
 		if sshClient == nil {
-			panic("mySSHDial must give us sshClient if err == nil")
+			return nil, nil, fmt.Errorf("sshConnect() errored at dial to '%s': mySSHDial gave neither client nor error", hostport)
+		}
+		if cfg.RequireMFA && !(offeredKey && answeredCode) {
+			// the sshd let us in on one factor alone.
+			sshClient.Close()
+			err = fmt.Errorf("sshConnect() to '%s': %w, but the sshd accepted us without both (signed with key: %v, code answered: %v)", hostport, ErrMFARequired, offeredKey, answeredCode)
+			return nil, nil, err
 		}
 		p("sshClient good = %p", sshClient)
-
+		tr.lap()
+		if validateOnly {
+			// mySSHDial's first keepalive, unless SkipKeepAlive,
+			// has already made a round trip over the connection.
+			sshClient.Close()
+			return nil, nil, nil
+		}
+		cfg.SharedClient = NewSharedClient(sshClient)
+
+		// a listener setup still waiting on the sshd when
+		// dialCtx is cancelled is let go by closing the client.
+		cli := sshClient
+		stopAbort := context.AfterFunc(dialCtx, func() { cli.Close() })
+		defer stopAbort()
+
+		// if a listener fails to start, those already up
+		// are taken down again, along with the client.
+		var bound []net.Listener
+		failed := func(err error) (*ssh.Client, net.Conn, error) {
+			for _, ln := range bound {
+				ln.Close()
+			}
+			sshClient.Close()
+			if cfg.SharedClient != nil && cfg.SharedClient.Client == sshClient {
+				cfg.SharedClient = nil
+			}
+			return nil, nil, err
+		}
 		if cfg.RemoteToLocal.Listen.Addr != "" {
-			err = cfg.StartupReverseListener(ctx, sshClient)
+			_, err = cfg.StartupReverseListener(ctx, sshClient)
 			if err != nil {
-				return nil, nil, fmt.Errorf("StartupReverseListener failed: %s", err)
+				return failed(fmt.Errorf("StartupReverseListener failed: %s", err))
 			}
 		}
 		if cfg.LocalToRemote.Listen.Addr != "" {
 			err = cfg.StartupForwardListener(ctx, sshClient)
 			if err != nil {
-				return nil, nil, fmt.Errorf("StartupFowardListener failed: %s", err)
+				return failed(fmt.Errorf("StartupFowardListener failed: %s", err))
+			}
+			cfg.fwdLnMu.Lock()
+			bound = append(bound, cfg.fwdLn)
+			cfg.fwdLnMu.Unlock()
+		}
+		for i := range cfg.RemoteToLocals {
+			_, err = cfg.startupReverseListener(ctx, &cfg.RemoteToLocals[i], sshClient)
+			if err != nil {
+				return failed(fmt.Errorf("StartupReverseListener for RemoteToLocals[%v] failed: %s", i, err))
 			}
 		}
+		for i := range cfg.LocalToRemotes {
+			spec := &cfg.LocalToRemotes[i]
+			ln, err := cfg.listenForward(spec)
+			if err != nil {
+				return failed(fmt.Errorf("StartupFowardListener for LocalToRemotes[%v] failed: %s", i, err))
+			}
+			bound = append(bound, ln)
+			go cfg.serveForwards(ctx, spec, ln, sshClient, nil)
+		}
+		if cfg.DynamicSOCKS.Addr != "" {
+			err = cfg.StartupSOCKSListener(ctx, sshClient)
+			if err != nil {
+				return failed(fmt.Errorf("StartupSOCKSListener failed: %s", err))
+			}
+		}
+		tr.ListenerReady = tr.lap()
 	}
 	cfg.Underlying = nc
 	cfg.SshClient = sshClient
 	return sshClient, nc, nil
 }
 
+// SSHCheck dials sshdHost and logs in just as SSHConnect() would,
+// checking the host key against h, and then hangs up, without
+// starting any listeners. It returns nil if all went well. It
+// is SSHConnect() with cfg.ValidateOnly set.
+func (cfg *SshegoConfig) SSHCheck(ctx context.Context, h *KnownHosts, username string, keypath string, sshdHost string, sshdPort int64, passphrase string, toptUrl string) error {
+	halt := ssh.NewHalter()
+	defer func() {
+		halt.RequestStop()
+		halt.MarkDone()
+	}()
+	_, _, err := cfg.sshConnect(ctx, h, username, keypath, sshdHost, sshdPort, passphrase, toptUrl, halt, true)
+	return err
+}
+
 // StartupForwardListener is called when a forward tunnel is to
-// be listened for.
+// be listened for. ctx is the lifetime of the listener: once
+// ctx is done, the listener is closed and its accept loop ends.
 func (cfg *SshegoConfig) StartupForwardListener(ctx context.Context, sshClientConn *ssh.Client) error {
+	cfg.fwdLnMu.Lock()
+	defer cfg.fwdLnMu.Unlock()
+	return cfg.startForwardListener(ctx, sshClientConn)
+}
 
-	p("sshego: StartupForwardListener: about to listen on %s\n", cfg.LocalToRemote.Listen.Addr)
-	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(cfg.LocalToRemote.Listen.Host), Port: int(cfg.LocalToRemote.Listen.Port)})
+// ErrNoSuchForward is returned by RestartForward when
+// no forward listener goes by the name given.
+var ErrNoSuchForward = fmt.Errorf("no such forward")
+
+// RestartForward closes the forward listener called name, if
+// it is still open, and binds cfg.LocalToRemote.Listen again
+// over the ssh.Client we already have, without reconnecting.
+// Forwards already accepted are left running. A config has
+// one forward, and it goes by cfg.Nickname, as with
+// Forwarder.Name.
+func (cfg *SshegoConfig) RestartForward(name string) error {
+	if name != cfg.Nickname || cfg.LocalToRemote.Listen.Addr == "" {
+		return fmt.Errorf("RestartForward('%s'): %w", name, ErrNoSuchForward)
+	}
+	cfg.fwdLnMu.Lock()
+	defer cfg.fwdLnMu.Unlock()
+
+	sshClient := cfg.SshClient
+	if cfg.fwdLn == nil || sshClient == nil {
+		return fmt.Errorf("RestartForward('%s'): not connected, call SSHConnect() first", name)
+	}
+	// the accept loop notices the close and exits;
+	// if it already died, Close just errors.
+	cfg.fwdLn.Close()
+	return cfg.startForwardListener(cfg.fwdCtx, sshClient)
+}
+
+// startForwardListener does the work of StartupForwardListener.
+// The caller must hold cfg.fwdLnMu.
+func (cfg *SshegoConfig) startForwardListener(ctx context.Context, sshClientConn *ssh.Client) error {
+	ln, err := cfg.listenForward(&cfg.LocalToRemote)
 	if err != nil {
-		return fmt.Errorf("could not -listen on %s: %s", cfg.LocalToRemote.Listen.Addr, err)
+		return err
 	}
+	cfg.fwdLn, cfg.fwdCtx = ln, ctx
+	go cfg.serveForwards(ctx, &cfg.LocalToRemote, ln, sshClientConn, cfg.fwdQuota)
+	return nil
+}
 
-	go func() {
-		for {
-			p("sshego: about to accept on local port %s\n", cfg.LocalToRemote.Listen.Addr)
-			timeoutMillisec := 10000
-			err = ln.SetDeadline(time.Now().Add(time.Duration(timeoutMillisec) * time.Millisecond))
-			panicOn(err) // TODO handle error
-			fromBrowser, err := ln.Accept()
-			if err != nil {
-				if _, ok := err.(*net.OpError); ok {
-					continue
-					//break
-				}
-				p("ln.Accept err = '%s'  aka '%#v'\n", err, err)
-				panic(err) // todo handle error
+// listenForward binds the local end of the forward tunnel
+// spec: a TCP port, or a unix-domain socket if Listen names
+// a path (see AddrHostPort.ParseAddr).
+func (cfg *SshegoConfig) listenForward(spec *TunnelSpec) (net.Listener, error) {
+	p("sshego: StartupForwardListener: about to listen on %s\n", spec.Listen.Addr)
+	if path := spec.Listen.UnixDomainPath; path != "" {
+		ln, err := listenUnix(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not -listen on %s: %s", spec.Listen.Addr, err)
+		}
+		return ln, nil
+	}
+	laddr, err := net.ResolveTCPAddr("tcp", spec.Listen.HostPort())
+	if err != nil {
+		return nil, fmt.Errorf("could not -listen on %s: %s", spec.Listen.Addr, err)
+	}
+	ln, err := cfg.listenTCP(laddr)
+	if err != nil {
+		return nil, fmt.Errorf("could not -listen on %s: %s", spec.Listen.Addr, err)
+	}
+	return ln, nil
+}
+
+// serveForwards is the accept loop of the forward tunnel
+// spec, listening on ln, until ctx is done. quota, if not
+// nil, limits how many connections it takes.
+func (cfg *SshegoConfig) serveForwards(ctx context.Context, spec *TunnelSpec, ln net.Listener, sshClientConn *ssh.Client, quota *forwardQuota) {
+
+	// forwards hold a reference to the client, so that
+	// closing one of them leaves the others running.
+	var shared *SharedClient
+	if cfg.SharedClient != nil && cfg.SharedClient.Client == sshClientConn {
+		shared = cfg.SharedClient
+	}
+
+	for {
+		if err := cfg.waitBreaker(ctx, spec); err != nil {
+			ln.Close()
+			return
+		}
+		if err := cfg.waitAcceptRate(ctx, spec); err != nil {
+			ln.Close()
+			return
+		}
+		if err := cfg.waitForwardSlot(ctx); err != nil {
+			ln.Close()
+			return
+		}
+		p("sshego: about to accept on local port %s\n", spec.Listen.Addr)
+		fromBrowser, err := acceptWithContext(ctx, ln)
+		if err != nil {
+			p("ln.Accept err = '%s'  aka '%#v'\n", err, err)
+			cfg.logger().Errorf("sshego: forward listener on %s stopping: Accept error: '%s'", spec.Listen.Addr, err)
+			ln.Close()
+			cfg.acceptStopped(ctx, "forward listener on "+spec.Listen.Addr, err)
+			return
+		}
+		if cfg.overAcceptRate(spec) {
+			if !cfg.Quiet {
+				cfg.logger().Infof("sshego: forward listener on %s: over %v accepts/sec, refusing connection from %s", spec.Listen.Addr, cfg.MaxAcceptsPerSec, fromBrowser.RemoteAddr())
 			}
+			fromBrowser.Close()
+			continue
+		}
+		if cfg.ConnFilter != nil && !cfg.ConnFilter(fromBrowser.RemoteAddr()) {
 			if !cfg.Quiet {
-				log.Printf("sshego: accepted forward connection on %s, forwarding --> to sshd host %s, and thence --> to remote %s\n", cfg.LocalToRemote.Listen.Addr, cfg.SSHdServer.Addr, cfg.LocalToRemote.Remote.Addr)
+				cfg.logger().Infof("sshego: forward listener on %s: ConnFilter refused connection from %s", spec.Listen.Addr, fromBrowser.RemoteAddr())
 			}
+			fromBrowser.Close()
+			continue
+		}
+		took, err := cfg.takeForwardSlot(ctx)
+		if err != nil {
+			fromBrowser.Close()
+			ln.Close()
+			return
+		}
+		if !took {
+			if !cfg.Quiet {
+				cfg.logger().Infof("sshego: forward listener on %s: %v connections already forwarding, refusing connection from %s", spec.Listen.Addr, cfg.MaxConcurrentForwards, fromBrowser.RemoteAddr())
+			}
+			fromBrowser.Close()
+			continue
+		}
+		cfg.noteForwardAccept()
+		if !cfg.Quiet {
+			cfg.logger().Infof("sshego: accepted forward connection on %s, forwarding --> to sshd host %s, and thence --> to remote %s\n", spec.Listen.Addr, cfg.SSHdServer.Addr, spec.Remote.Addr)
+		}
 
-			// if you want to collect them...
-			//cfg.Fwd = append(cfg.Fwd, NewForward(cfg, sshClientConn, fromBrowser))
-			// or just fire and forget...
-			NewForward(ctx, cfg, sshClientConn, fromBrowser)
+		// if you want to collect them...
+		//cfg.Fwd = append(cfg.Fwd, NewForward(cfg, sshClientConn, fromBrowser))
+		// or just fire and forget...
+		var fwd *Forwarder
+		switch {
+		case shared == nil:
+			fwd = cfg.newForward(ctx, spec, sshClientConn, fromBrowser)
+		case shared.Acquire() != nil:
+			// client is gone, nothing to forward over.
+			fromBrowser.Close()
+		default:
+			fwd = cfg.newForward(ctx, spec, sshClientConn, fromBrowser)
+			if fwd == nil {
+				shared.Release()
+				break
+			}
+			fwd.shared = shared
+			go func() {
+				// drop our reference once the forward finishes by itself.
+				<-fwd.shovelPair.Halt.DoneChan()
+				fwd.Close()
+			}()
 		}
-	}()
+		if fwd == nil {
+			cfg.fwdSlots.release()
+		} else {
+			go func() {
+				<-fwd.shovelPair.Halt.DoneChan()
+				cfg.fwdSlots.release()
+			}()
+		}
+		if quota != nil && quota.served(fwd) {
+			ln.Close()
+			return
+		}
+	}
+}
 
-	//fmt.Printf("\n returning from SSHConnect().\n")
-	return nil
+// acceptStopped hands err, the reason that the accept loop
+// called what stopped, to cfg.OnAcceptError, unless the
+// loop was only told to stop.
+func (cfg *SshegoConfig) acceptStopped(ctx context.Context, what string, err error) {
+	if cfg.OnAcceptError == nil || ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	cfg.OnAcceptError(fmt.Errorf("sshego: %s: Accept error: %w", what, err))
+}
+
+// acceptWithContext returns the next connection on ln, or
+// ctx.Err() once ctx is done. A done ctx closes ln, so
+// that a blocked Accept returns at once. Passing errors,
+// such as running out of file descriptors, are retried
+// after a short pause rather than ending the accept loop;
+// see retryableAcceptError.
+func acceptWithContext(ctx context.Context, ln net.Listener) (net.Conn, error) {
+	var pause time.Duration
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				ln.Close()
+			case <-stop:
+			}
+		}()
+		conn, err := ln.Accept()
+		close(stop)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if retryableAcceptError(err) {
+			if pause == 0 {
+				pause = 5 * time.Millisecond
+			} else if pause *= 2; pause > time.Second {
+				pause = time.Second
+			}
+			time.Sleep(pause)
+			continue
+		}
+		return nil, err
+	}
+}
+
+// retryableAcceptError reports whether err, from Accept,
+// is one that may pass: the process or system is out of
+// file descriptors or buffers, or the peer went away
+// before we got to its connection.
+func retryableAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
 }
 
 // Fingerprint performs a SHA256 BASE64 fingerprint of the PublicKey, similar to OpenSSH.
@@ -381,22 +997,143 @@ func Fingerprint(k ssh.PublicKey) string {
 	return r
 }
 
+// FingerprintMD5 is the legacy MD5 fingerprint of the PublicKey,
+// in colon-separated hex, as ssh-keygen -E md5 prints it but
+// without the "MD5:" prefix; prepend that if wanted.
+func FingerprintMD5(k ssh.PublicKey) string {
+	hash := md5.Sum(k.Marshal())
+	hexes := make([]string, len(hash))
+	for i, b := range hash {
+		hexes[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hexes, ":")
+}
+
 // Forwarder represents one bi-directional forward (sshego to sshd) tcp connection.
 type Forwarder struct {
+	// ID is unique among the Forwarders in this process.
+	ID int64
+
+	// Name identifies the tunnel this forward belongs
+	// to; it defaults to the SshegoConfig.Nickname.
+	Name string
+
 	shovelPair *shovelPair
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	// shared, if set, is released on Close.
+	shared    *SharedClient
+	closeOnce sync.Once
+}
+
+// LocalAddr returns the address of the local peer
+// whose connection this Forwarder is tunneling.
+func (f *Forwarder) LocalAddr() net.Addr {
+	return f.localAddr
+}
+
+// RemoteAddr returns the target address that the
+// sshd forwards our traffic on to.
+func (f *Forwarder) RemoteAddr() net.Addr {
+	return f.remoteAddr
+}
+
+func (f *Forwarder) String() string {
+	return fmt.Sprintf("Forwarder{ID:%v, Name:'%s', %v -> %v}", f.ID, f.Name, f.localAddr, f.remoteAddr)
+}
+
+// lastForwarderID issues Forwarder IDs.
+var lastForwarderID int64
+
+// hostPortAddr is a net.Addr for a host:port that
+// we have not resolved, such as a target that
+// only the far sshd will dial.
+type hostPortAddr struct {
+	network string
+	addr    string
+}
+
+func (a *hostPortAddr) Network() string { return a.network }
+func (a *hostPortAddr) String() string  { return a.addr }
+
+// Close stops the forward, closing only its own
+// local connection and ssh channel. The ssh.Client
+// it ran over is left up for other tunnels; if that
+// client is shared, our reference to it is released.
+func (f *Forwarder) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		f.shovelPair.Stop()
+		if f.shared != nil {
+			err = f.shared.Release()
+		}
+	})
+	return err
+}
+
+// Stats returns the bytes the forward has carried so far:
+// up, from the local client toward the sshd, and down, back
+// to the client. It may be called while the forward runs.
+func (f *Forwarder) Stats() (bytesUp, bytesDown int64) {
+	down, up := f.shovelPair.bytes()
+	return up, down
 }
 
 // NewForward is called to produce a Forwarder structure for each new forward connection.
+// If the remote cannot be reached, it closes fromBrowser and returns nil.
 func NewForward(ctx context.Context, cfg *SshegoConfig, sshClientConn *ssh.Client, fromBrowser net.Conn) *Forwarder {
+	return cfg.newForward(ctx, &cfg.LocalToRemote, sshClientConn, fromBrowser)
+}
 
+// newForward is NewForward for the forward tunnel spec.
+func (cfg *SshegoConfig) newForward(ctx context.Context, spec *TunnelSpec, sshClientConn *ssh.Client, fromBrowser net.Conn) *Forwarder {
 	sp := newShovelPair(false)
+	sp.setClass(cfg.FairShare, spec.Class)
+	sp.setIdleTimeout(cfg.IdleTimeoutDur)
+	sp.setRateLimit(cfg.RateLimitBytesPerSec)
 	sshClientConn.TmpCtx = ctx
-	channelToSSHd, err := sshClientConn.Dial("tcp", cfg.LocalToRemote.Remote.Addr)
+
+	// a -remote that names a unix-domain socket on the
+	// sshd host, such as /var/run/docker.sock, is reached
+	// with a direct-streamlocal@openssh.com channel.
+	network, raddr := "tcp", spec.Remote.Addr
+	var remoteAddr net.Addr = &hostPortAddr{network: network, addr: raddr}
+	if path := spec.Remote.UnixDomainPath; path != "" {
+		network, raddr = "unix", path
+		remoteAddr = &net.UnixAddr{Name: path, Net: network}
+	}
+	channelToSSHd, err := sshClientConn.Dial(network, raddr)
+	cfg.noteForwardDial(spec, err)
 	if err != nil {
-		msg := fmt.Errorf("Remote dial to '%s' error: %s", cfg.LocalToRemote.Remote.Addr, err)
-		log.Printf(msg.Error())
+		msg := fmt.Errorf("Remote dial to '%s' error: %s", raddr, err)
+		cfg.logger().Errorf("%s", msg.Error())
+		fromBrowser.Close()
 		return nil
 	}
+	var toRemote net.Conn = channelToSSHd
+	if shadow := spec.Shadow; shadow.Addr != "" {
+		snet, saddr := "tcp", shadow.Addr
+		if shadow.UnixDomainPath != "" {
+			snet, saddr = "unix", shadow.UnixDomainPath
+		}
+		channelToShadow, err := sshClientConn.Dial(snet, saddr)
+		if err != nil {
+			// the client must not notice; forward without it.
+			cfg.logger().Errorf("sshego: shadow dial to '%s' error, forwarding to '%s' alone: %s", saddr, raddr, err)
+		} else {
+			toRemote = newShadowConn(channelToSSHd, channelToShadow, raddr, cfg.logger())
+		}
+	}
+	if len(spec.Preface) > 0 {
+		if _, err := toRemote.Write(spec.Preface); err != nil {
+			cfg.logger().Errorf("sshego: writing preface to '%s' error: %s", raddr, err)
+			toRemote.Close()
+			fromBrowser.Close()
+			return nil
+		}
+	}
 
 	// here is the heart of the ssh-secured tunnel functionality:
 	// we start the two shovels that keep traffic flowing
@@ -405,78 +1142,169 @@ func NewForward(ctx context.Context, cfg *SshegoConfig, sshClientConn *ssh.Clien
 	// reads on channelToSSHd are forwarded to fromBrowser.
 
 	//sp.DoLog = true
-	sp.Start(fromBrowser, channelToSSHd, "fromBrowser<-channelToSSHd", "channelToSSHd<-fromBrowser")
-	return &Forwarder{shovelPair: sp}
+	sp.countInto(&cfg.stats.BytesDown, &cfg.stats.BytesUp)
+	sp.Start(fromBrowser, toRemote, "fromBrowser<-channelToSSHd", "channelToSSHd<-fromBrowser")
+	cfg.trackTunnel("forward", fromBrowser.RemoteAddr(), remoteAddr, sp.BA, sp.AB, sp)
+	atomic.AddInt64(&cfg.stats.Forwards, 1)
+	return &Forwarder{
+		ID:         atomic.AddInt64(&lastForwarderID, 1),
+		Name:       cfg.Nickname,
+		shovelPair: sp,
+		localAddr:  fromBrowser.RemoteAddr(),
+		remoteAddr: remoteAddr,
+	}
 }
 
 // Reverse represents one bi-directional (initiated at sshd, tunneled to sshego) tcp connection.
 type Reverse struct {
 	shovelPair *shovelPair
+	closeOnce  sync.Once
+}
+
+// Close stops the reverse connection, closing both the
+// ssh channel it arrived on and our connection to the
+// local -revfwd service.
+func (r *Reverse) Close() error {
+	r.closeOnce.Do(r.shovelPair.Stop)
+	return nil
+}
+
+// Stats returns the bytes the reverse tunnel has carried so
+// far: up, from the local -revfwd side toward the sshd, and
+// down, from the sshd to it. It may be called while it runs.
+func (r *Reverse) Stats() (bytesUp, bytesDown int64) {
+	return r.shovelPair.bytes()
 }
 
 // StartupReverseListener is called when a reverse tunnel is requested, to listen
-// and tunnel those connections.
-func (cfg *SshegoConfig) StartupReverseListener(ctx context.Context, sshClientConn *ssh.Client) error {
+// and tunnel those connections. It returns the address the sshd listens on,
+// which is also kept in cfg.RemoteToLocal.GrantedAddr: given port 0 in
+// -revlisten, the sshd picks the port, and this is how to learn it.
+func (cfg *SshegoConfig) StartupReverseListener(ctx context.Context, sshClientConn *ssh.Client) (net.Addr, error) {
+	return cfg.startupReverseListener(ctx, &cfg.RemoteToLocal, sshClientConn)
+}
+
+// startupReverseListener is StartupReverseListener
+// for the reverse tunnel spec.
+func (cfg *SshegoConfig) startupReverseListener(ctx context.Context, spec *TunnelSpec, sshClientConn *ssh.Client) (net.Addr, error) {
 	p("StartupReverseListener called")
 
-	addr, err := net.ResolveTCPAddr("tcp", cfg.RemoteToLocal.Listen.Addr)
-	if err != nil {
-		return err
+	// a local unix-domain socket to deliver to must be
+	// there before we take connections for it.
+	if path := spec.Remote.UnixDomainPath; path != "" {
+		if err := checkUnixSocket(path); err != nil {
+			return nil, fmt.Errorf("-revfwd to unix-domain socket: %w", err)
+		}
 	}
 
-	lsn, err := sshClientConn.ListenTCP(ctx, addr)
-	if err != nil {
-		return err
+	var lsn net.Listener
+	if path := spec.Listen.UnixDomainPath; path != "" {
+		// publish a unix-domain socket on the sshd host,
+		// via streamlocal-forward@openssh.com.
+		var err error
+		lsn, err = sshClientConn.ListenUnix(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		addr, err := net.ResolveTCPAddr("tcp", spec.Listen.Addr)
+		if err != nil {
+			return nil, err
+		}
+		lsn, err = sshClientConn.ListenTCP(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	spec.GrantedAddr = lsn.Addr()
+	if !cfg.Quiet {
+		cfg.logger().Infof("sshego: sshd is listening on %s for the reverse tunnel to %s", spec.GrantedAddr, spec.Remote.Addr)
 	}
 
-	// service "forwarded-tcpip" requests
+	// service "forwarded-tcpip" and "forwarded-streamlocal@openssh.com" requests
 	go func() {
 		for {
-			p("sshego: about to accept for remote addr %s\n", cfg.RemoteToLocal.Listen.Addr)
-			fromRemote, err := lsn.Accept()
+			p("sshego: about to accept for remote addr %s\n", spec.Listen.Addr)
+			fromRemote, err := acceptWithContext(ctx, lsn)
 			if err != nil {
-				if _, ok := err.(*net.OpError); ok {
-					continue
-					//break
-				}
+				// ctx is done, the listener is closed, or the
+				// ssh connection is gone: either way, done.
 				p("rev.Lsn.Accept err = '%s'  aka '%#v'\n", err, err)
-				panic(err) // TODO handle error
+				cfg.logger().Errorf("sshego: reverse listener for %s stopping: Accept error: '%s'", spec.Listen.Addr, err)
+				lsn.Close()
+				cfg.acceptStopped(ctx, "reverse listener for "+spec.Listen.Addr, err)
+				return
 			}
 			if !cfg.Quiet {
-				log.Printf("sshego: accepted reverse connection from remote on  %s, forwarding to --> to %s\n",
-					cfg.RemoteToLocal.Listen.Addr, cfg.RemoteToLocal.Remote.Addr)
+				cfg.logger().Infof("sshego: accepted reverse connection from remote on  %s, forwarding to --> to %s\n",
+					spec.Listen.Addr, spec.Remote.Addr)
 			}
-			_, err = cfg.StartNewReverse(sshClientConn, fromRemote)
+			_, err = cfg.startNewReverse(spec, sshClientConn, fromRemote)
 			if err != nil {
-				log.Printf("error: StartNewReverse got error '%s'", err)
+				cfg.logger().Errorf("error: StartNewReverse got error '%s'", err)
 			}
 		}
 	}()
-	return nil
+	return spec.GrantedAddr, nil
 }
 
 // StartNewReverse is invoked once per reverse connection made to generate
 // a new Reverse structure.
 func (cfg *SshegoConfig) StartNewReverse(sshClientConn *ssh.Client, fromRemote net.Conn) (*Reverse, error) {
+	return cfg.startNewReverse(&cfg.RemoteToLocal, sshClientConn, fromRemote)
+}
+
+// startNewReverse is StartNewReverse for the reverse tunnel spec.
+func (cfg *SshegoConfig) startNewReverse(spec *TunnelSpec, sshClientConn *ssh.Client, fromRemote net.Conn) (*Reverse, error) {
 
-	channelToLocalFwd, err := net.Dial("tcp", cfg.RemoteToLocal.Remote.Addr)
+	network, raddr := "tcp", spec.Remote.Addr
+	if path := spec.Remote.UnixDomainPath; path != "" {
+		network, raddr = "unix", path
+	}
+	channelToLocalFwd, err := cfg.dialer(0).Dial(network, raddr)
 	if err != nil {
-		msg := fmt.Errorf("Remote dial to '%s' error: %s", cfg.RemoteToLocal.Remote.Addr, err)
-		log.Printf(msg.Error())
+		fromRemote.Close()
+		msg := fmt.Errorf("Remote dial to '%s' error: %s", raddr, err)
+		cfg.logger().Errorf("%s", msg.Error())
 		return nil, msg
 	}
+	if spec.ProxyProtocol {
+		hdr := proxyHeaderV1(fromRemote.RemoteAddr(), fromRemote.LocalAddr())
+		if _, err := io.WriteString(channelToLocalFwd, hdr); err != nil {
+			fromRemote.Close()
+			channelToLocalFwd.Close()
+			return nil, fmt.Errorf("writing PROXY header to '%s' error: %s", raddr, err)
+		}
+	}
+	if len(spec.Preface) > 0 {
+		if _, err := channelToLocalFwd.Write(spec.Preface); err != nil {
+			fromRemote.Close()
+			channelToLocalFwd.Close()
+			return nil, fmt.Errorf("writing preface to '%s' error: %s", raddr, err)
+		}
+	}
 
 	sp := newShovelPair(false)
+	sp.setClass(cfg.FairShare, spec.Class)
+	sp.setIdleTimeout(cfg.IdleTimeoutDur)
+	sp.setRateLimit(cfg.RateLimitBytesPerSec)
+	sp.countInto(&cfg.stats.BytesUp, &cfg.stats.BytesDown)
 	rev := &Reverse{shovelPair: sp}
 	sp.Start(fromRemote, channelToLocalFwd, "fromRemoter<-channelToLocalFwd", "channelToLocalFwd<-fromRemote")
+	cfg.trackTunnel("reverse", fromRemote.RemoteAddr(), channelToLocalFwd.RemoteAddr(), sp.AB, sp.BA, sp)
+	atomic.AddInt64(&cfg.stats.Reverses, 1)
 	return rev, nil
 }
 
 func (h *KnownHosts) AddNeeded(addIfNotKnown, allowOneshotConnect bool, hostname string, remote net.Addr, strPubBytes string, key ssh.PublicKey, record *ServerPubKey) (HostState, *ServerPubKey, error) {
 	p("top of KnownHosts.AddNeeded(addIfNotKnown=%v, allowOneshotConnect=%v, hostname='%s', remote=%#v)", addIfNotKnown, allowOneshotConnect, hostname, remote)
+	if addIfNotKnown && h.ReadOnly {
+		return Unknown, record, fmt.Errorf("refusing to add sshd host '%v' (%s): %w; it must be added by whoever manages the store", hostname, strings.TrimSpace(strPubBytes), ErrKnownHostsReadOnly)
+	}
 	if addIfNotKnown {
 		record := &ServerPubKey{
-			Hostname: hostname,
+			Hostname: h.storedHostName(hostname),
 			remote:   remote,
 			//key:      key,
 			HumanKey: strPubBytes,
@@ -489,7 +1317,27 @@ func (h *KnownHosts) AddNeeded(addIfNotKnown, allowOneshotConnect bool, hostname
 			SplitHostnames: make(map[string]bool),
 		}
 		//pp("hostname = '%v'", hostname)
-		record.AddHostPort(hostname)
+		record.AddHostPort(record.Hostname)
+
+		if h.ConfirmAdds {
+			// hold it back until ConfirmAdd.
+			h.Mut.Lock()
+			if h.pending == nil {
+				h.pending = make(map[string]*ServerPubKey)
+			}
+			if prior, already := h.pending[strPubBytes]; already {
+				h.Mut.Unlock()
+				h.addHostName(prior, hostname)
+				record = prior
+			} else {
+				h.pending[strPubBytes] = record
+				h.Mut.Unlock()
+			}
+			if allowOneshotConnect {
+				return KnownOK, record, nil
+			}
+			return AddedNew, record, fmt.Errorf("sshd host '%v' has key %s: %w", remote, ssh.FingerprintSHA256(key), ErrAddPending)
+		}
 
 		// host with same key may show up under an IP address and
 		// a FQHN, so combine under the key if we see that.
@@ -506,7 +1354,7 @@ func (h *KnownHosts) AddNeeded(addIfNotKnown, allowOneshotConnect bool, hostname
 			h.Mut.Unlock()
 			// two or more names under the same key.
 			//pp("two names under one key, hostname = '%#v'. prior='%#v'\n", hostname, prior)
-			prior.AddHostPort(hostname)
+			h.addHostName(prior, hostname)
 			h.Sync()
 		}
 		if allowOneshotConnect {
@@ -534,39 +1382,124 @@ func getCiphers() []string {
 	*/
 }
 
-func (cfg *SshegoConfig) mySSHDial(ctx context.Context, network, addr string, config *ssh.ClientConfig, halt *ssh.Halter) (*ssh.Client, net.Conn, error) {
-	//pp("starting SshegoConfig.mySSHDial().")
-	netconn, err := net.DialTimeout(network, addr, config.Timeout)
+// mySSHDial fills in the TCPDial and Auth phases of tr, if tr is not nil.
+// Given jumps, it handshakes over jumps.conn rather than dialing addr,
+// and hangs up on the jump hosts along with the client.
+// classifyDialError wraps err from a dial in ErrHostKeyRejected
+// if our hostKeyCallback refused the server, or in ErrAuthFailed
+// if the sshd refused us, so that callers can tell these from
+// a network failure.
+func classifyDialError(err error, hostKeyRejected bool) error {
+	switch {
+	case hostKeyRejected:
+		return fmt.Errorf("%w: %w", ErrHostKeyRejected, err)
+	case strings.Contains(err.Error(), "ssh: unable to authenticate"):
+		return fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	return err
+}
+
+// startEsshd starts the embedded sshd under ctx, if
+// cfg.EmbeddedSSHd.Addr asks for one and it is not
+// already running. The caller holds cfg.Mut.
+func (cfg *SshegoConfig) startEsshd(ctx context.Context) error {
+	if cfg.EmbeddedSSHd.Addr == "" || cfg.Esshd != nil {
+		return nil
+	}
+	cfg.logger().Infof("%v starting -esshd with addr: %s",
+		cfg.Nickname, cfg.EmbeddedSSHd.Addr)
+	err := cfg.EmbeddedSSHd.ParseAddr()
 	if err != nil {
+		return fmt.Errorf("SSHConnect() error: bad embedded sshd address: %w", err)
+	}
+	cfg.NewEsshd()
+	go cfg.Esshd.Start(ctx)
+	return nil
+}
+
+func (cfg *SshegoConfig) mySSHDial(ctx, dialCtx context.Context, network, addr string, config *ssh.ClientConfig, halt *ssh.Halter, tr *ConnectTrace, jumps *jumpChain) (*ssh.Client, net.Conn, error) {
+	//pp("starting SshegoConfig.mySSHDial().")
+	// hold a slot under SetMaxClients() until the client closes.
+	if err := clientLimit.acquire(dialCtx); err != nil {
+		jumps.close()
 		return nil, nil, err
 	}
+	var netconn net.Conn
+	var err error
+	if jumps != nil {
+		// already dialed, through the jump hosts.
+		netconn = jumps.conn
+	} else {
+		netconn, err = cfg.dialer(config.Timeout).DialContext(dialCtx, network, addr)
+		if err != nil {
+			clientLimit.release()
+			return nil, nil, dialTimeoutError(addr, config.Timeout, err)
+		}
+	}
+	if tr != nil {
+		tr.TCPDial = tr.lap()
+	}
 
-	// Close netconn when when get a shutdown request.
+	// Close netconn when when get a shutdown request,
+	// or ctx is done, even mid-handshake.
 	// This close on the underlying TCP connection
 	// is essential to unblock some reads deep in
 	// the ssh codebash that otherwise won't timeout.
-	// Any of three flavors of close work.
-	if config.Halt != nil || halt != nil {
-		go func() {
-			var h1, h2 chan struct{}
-			if config.Halt != nil {
-				h1 = config.Halt.ReqStopChan()
-			}
-			if halt != nil {
-				h2 = halt.ReqStopChan()
-			}
-			select {
-			case <-h1:
-			case <-h2:
-			case <-ctx.Done():
-			}
-			netconn.Close()
-		}()
+	// Any of three flavors of close work. connDone
+	// lets the goroutine go once the client has closed.
+	connDone := make(chan struct{})
+	go func() {
+		var h1, h2 chan struct{}
+		if config.Halt != nil {
+			h1 = config.Halt.ReqStopChan()
+		}
+		if halt != nil {
+			h2 = halt.ReqStopChan()
+		}
+		select {
+		case <-h1:
+		case <-h2:
+		case <-ctx.Done():
+		case <-connDone:
+		}
+		netconn.Close()
+		jumps.close()
+	}()
+	var handshakeExpired *time.Timer
+	handshake := cfg.TimeoutsFor(addr).Handshake
+	if handshake > 0 {
+		handshakeExpired = time.AfterFunc(handshake, func() { netconn.Close() })
 	}
+	// until we return, cancelling dialCtx hangs up.
+	stopAbort := context.AfterFunc(dialCtx, func() { netconn.Close() })
+	defer stopAbort()
 	c, chans, reqs, err := ssh.NewClientConn(ctx, netconn, addr, config)
+	if handshakeExpired != nil && !handshakeExpired.Stop() {
+		if err == nil {
+			c.Close()
+		}
+		clientLimit.release()
+		close(connDone)
+		return nil, nil, fmt.Errorf("handshake with '%s': %w after %v", addr, ErrConnectTimeout, handshake)
+	}
 	if err != nil {
+		clientLimit.release()
+		close(connDone)
 		return nil, nil, err
 	}
+	go func() {
+		c.Wait()
+		clientLimit.release()
+		close(connDone)
+	}()
+	if tr != nil {
+		// the hostKeyCallback has already
+		// ended the Kex lap.
+		tr.Auth = tr.lap()
+		if am, ok := c.(interface{ AuthMethods() []string }); ok {
+			tr.AuthMethods = am.AuthMethods()
+		}
+	}
 	cli := cfg.NewSSHClient(ctx, c, chans, reqs, halt)
 
 	if cfg.KeepAliveEvery > 0 {
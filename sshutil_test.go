@@ -0,0 +1,1921 @@
+package sshego
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	cryptrand "crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/testdata"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+)
+
+// countingResolver answers like the default,
+// but remembers the questions it was asked.
+type countingResolver struct {
+	ki   kiCliHelp
+	seen []string
+}
+
+func (c *countingResolver) Resolve(instruction, question string, echo bool) (string, error) {
+	c.seen = append(c.seen, question)
+	return c.ki.Resolve(instruction, question, echo)
+}
+
+func Test104ChallengeResolverAnswersPrompts(t *testing.T) {
+
+	cv.Convey("A user supplied ChallengeResolver should be asked to answer the keyboard-interactive prompts, and the default resolver should error rather than panic on an unknown prompt.", t, func() {
+
+		ki := &kiCliHelp{passphrase: "secret"}
+		ans, err := ki.Resolve("", passwordChallenge, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ans, cv.ShouldEqual, "secret")
+		_, err = ki.Resolve("", "favorite color? ", true)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		res := &countingResolver{ki: kiCliHelp{passphrase: s.Pw, toptUrl: s.Totp}}
+		s.CliCfg.ChallengeResolver = res
+
+		// note that no toptUrl is passed; only the resolver knows it.
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, "", halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.seen, cv.ShouldContain, gauthChallenge)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test105SharedClientClosesOnLastRelease(t *testing.T) {
+
+	cv.Convey("The ssh.Client from SSHConnect should be reference counted, staying up while any user still holds a reference, and closing on the last Release.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		shared := s.CliCfg.SharedClient
+		cv.So(shared.Client, cv.ShouldEqual, cli)
+		cv.So(shared.Refs(), cv.ShouldEqual, 1)
+
+		// a second user, say a Forwarder.
+		cv.So(shared.Acquire(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.ReleaseClient(), cv.ShouldBeNil)
+		cv.So(shared.Refs(), cv.ShouldEqual, 1)
+
+		waited := make(chan error)
+		go func() { waited <- cli.Wait() }()
+		select {
+		case <-waited:
+			panic("client closed while still referenced")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		cv.So(shared.Release(), cv.ShouldBeNil)
+		select {
+		case <-waited:
+		case <-time.After(10 * time.Second):
+			panic("client not closed after last Release")
+		}
+		cv.So(shared.Acquire(), cv.ShouldEqual, ErrClientClosed)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test107ForwarderReportsItsEndpoints(t *testing.T) {
+
+	cv.Convey("A Forwarder should report its local peer, its remote target, a Name, and a unique ID.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// the forward target, dialed by the sshd.
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.Nickname = "fwd-test"
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		// a local tcp connection for the Forwarder to carry.
+		lsn, lsnPort := GetAvailPort()
+		defer lsn.Close()
+		browser, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", lsnPort))
+		panicOn(err)
+		defer browser.Close()
+		fromBrowser, err := lsn.Accept()
+		panicOn(err)
+
+		fwd := NewForward(ctx, s.CliCfg, cli, fromBrowser)
+		cv.So(fwd, cv.ShouldNotBeNil)
+		cv.So(fwd.LocalAddr().String(), cv.ShouldEqual, browser.LocalAddr().String())
+		cv.So(fwd.RemoteAddr().String(), cv.ShouldEqual, s.CliCfg.LocalToRemote.Remote.Addr)
+		cv.So(fwd.Name, cv.ShouldEqual, "fwd-test")
+
+		fromBrowser2, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", targetPort))
+		panicOn(err)
+		fwd2 := NewForward(ctx, s.CliCfg, cli, fromBrowser2)
+		cv.So(fwd2.ID, cv.ShouldBeGreaterThan, fwd.ID)
+
+		fwd.Close()
+		fwd2.Close()
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test108PublicKeyAsKeypathIsATypedError(t *testing.T) {
+
+	cv.Convey("Pointing SSHConnect's keypath at a public key, or at a non-key file, should return a NotPrivateKeyError rather than panic.", t, func() {
+
+		s := MakeTestSshClientAndServer(false)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath+".pub",
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		var npk *NotPrivateKeyError
+		cv.So(errors.As(err, &npk), cv.ShouldBeTrue)
+		cv.So(npk.IsPublicKey, cv.ShouldBeTrue)
+		cv.So(npk.Path, cv.ShouldEqual, s.RsaPath+".pub")
+
+		notakey := s.CliCfg.Tempdir + "/notakey"
+		panicOn(ioutil.WriteFile(notakey, []byte("hello\n"), 0600))
+		_, err = LoadRSAPrivateKey(notakey)
+		npk = nil
+		cv.So(errors.As(err, &npk), cv.ShouldBeTrue)
+		cv.So(npk.IsPublicKey, cv.ShouldBeFalse)
+
+		_, err = LoadRSAPrivateKey(s.RsaPath)
+		cv.So(err, cv.ShouldBeNil)
+		halt.RequestStop()
+		halt.MarkDone()
+	})
+}
+
+func Test109BadKeypathIsAnErrorNotAPanic(t *testing.T) {
+
+	cv.Convey("SSHConnect should return, not panic, when the private key at keypath cannot be loaded.", t, func() {
+
+		s := MakeTestSshClientAndServer(false)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+
+		empty := s.CliCfg.Tempdir + "/empty_key"
+		panicOn(ioutil.WriteFile(empty, nil, 0600))
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		for _, keypath := range []string{s.CliCfg.Tempdir + "/no/such/key", empty} {
+			var err error
+			cv.So(func() {
+				_, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, keypath,
+					s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			}, cv.ShouldNotPanic)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, keypath)
+		}
+		halt.RequestStop()
+		halt.MarkDone()
+	})
+}
+
+func Test110SSHConnectReturnsErrorsInsteadOfPanics(t *testing.T) {
+
+	cv.Convey("SSHConnect should return errors, rather than panic, given a nil KnownHosts or a malformed embedded sshd address.", t, func() {
+
+		cfg := NewSshegoConfig()
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+
+		var err error
+		cv.So(func() {
+			_, _, err = cfg.SSHConnect(ctx, nil, "bob", "", "127.0.0.1", 22, "", "", halt)
+		}, cv.ShouldNotPanic)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		cfg.EmbeddedSSHd.Title = "esshd"
+		cfg.EmbeddedSSHd.Addr = "not-an-address"
+		h := &KnownHosts{Hosts: make(map[string]*ServerPubKey)}
+		cv.So(func() {
+			_, _, err = cfg.SSHConnect(ctx, h, "bob", "", "127.0.0.1", 22, "", "", halt)
+		}, cv.ShouldNotPanic)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "-esshd")
+		cv.So(cfg.Esshd, cv.ShouldBeNil)
+
+		halt.RequestStop()
+		halt.MarkDone()
+	})
+}
+
+func Test111WaitFirstForwardConn(t *testing.T) {
+
+	cv.Convey("WaitFirstForwardConn should block until the forward listener accepts its first connection, and OnFirstAccept should fire exactly once.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.Nickname = "first-test"
+		s.CliCfg.Quiet = true
+
+		fired := make(chan string, 10)
+		s.CliCfg.OnFirstAccept = func(name string) {
+			fired <- name
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		// listening, but no connection yet.
+		short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		cv.So(errors.Is(s.CliCfg.WaitFirstForwardConn(short), context.DeadlineExceeded), cv.ShouldBeTrue)
+		cancel()
+
+		waited := make(chan error)
+		go func() { waited <- s.CliCfg.WaitFirstForwardConn(ctx) }()
+
+		for i := 0; i < 2; i++ {
+			c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+			panicOn(err)
+			defer c.Close()
+		}
+		select {
+		case err = <-waited:
+			cv.So(err, cv.ShouldBeNil)
+		case <-time.After(10 * time.Second):
+			panic("WaitFirstForwardConn did not return after a connection")
+		}
+		cv.So(<-fired, cv.ShouldEqual, "first-test")
+		time.Sleep(100 * time.Millisecond)
+		cv.So(len(fired), cv.ShouldEqual, 0)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test117OverallTimeoutBoundsSSHConnect(t *testing.T) {
+
+	cv.Convey("With OverallTimeout set, an SSHConnect to a peer that never completes the handshake should give up with ErrConnectTimeout, while a healthy connect is unaffected.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// accepts the TCP connection, but never speaks ssh.
+		stall, stallPort := GetAvailPort()
+		defer stall.Close()
+
+		s.CliCfg.OverallTimeout = 500 * time.Millisecond
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		t0 := time.Now()
+		cli, nc, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			"127.0.0.1", int64(stallPort), s.Pw, s.Totp, halt)
+		cv.So(errors.Is(err, ErrConnectTimeout), cv.ShouldBeTrue)
+		cv.So(cli, cv.ShouldBeNil)
+		cv.So(nc, cv.ShouldBeNil)
+		cv.So(time.Since(t0), cv.ShouldBeLessThan, 10*time.Second)
+
+		s.CliCfg.OverallTimeout = time.Minute
+		cli, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli, cv.ShouldNotBeNil)
+
+		// the bound on the connect does not end the connection.
+		sess, err := cli.NewSession(ctx)
+		cv.So(err, cv.ShouldBeNil)
+		sess.Close()
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test127RestartForwardRebindsTheListener(t *testing.T) {
+
+	cv.Convey("After the forward listener dies, RestartForward should bind it again over the same ssh.Client, and new connections should be forwarded once more.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.Nickname = "restart-test"
+		s.CliCfg.Quiet = true
+
+		// nothing to restart before we connect.
+		err := s.CliCfg.RestartForward("restart-test")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(errors.Is(err, ErrNoSuchForward), cv.ShouldBeFalse)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli, cv.ShouldNotBeNil)
+
+		// the target echoes one line back on each connection.
+		go func() {
+			for {
+				c, err := target.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					line, err := bufio.NewReader(c).ReadString('\n')
+					if err == nil {
+						c.Write([]byte(line))
+					}
+				}(c)
+			}
+		}()
+		roundTrip := func() error {
+			c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			fmt.Fprintf(c, "ping\n")
+			line, err := bufio.NewReader(c).ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if line != "ping\n" {
+				return fmt.Errorf("got '%s'", line)
+			}
+			return nil
+		}
+		cv.So(roundTrip(), cv.ShouldBeNil)
+
+		// kill the listener out from under the tunnel.
+		s.CliCfg.fwdLnMu.Lock()
+		s.CliCfg.fwdLn.Close()
+		s.CliCfg.fwdLnMu.Unlock()
+		cv.So(roundTrip(), cv.ShouldNotBeNil)
+
+		err = s.CliCfg.RestartForward("no-such-name")
+		cv.So(errors.Is(err, ErrNoSuchForward), cv.ShouldBeTrue)
+
+		cv.So(s.CliCfg.RestartForward("restart-test"), cv.ShouldBeNil)
+		cv.So(roundTrip(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.SshClient, cv.ShouldEqual, cli)
+
+		// restarting a live listener works too.
+		cv.So(s.CliCfg.RestartForward("restart-test"), cv.ShouldBeNil)
+		cv.So(roundTrip(), cv.ShouldBeNil)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test131HostTimeoutsOverrideTheGlobalOnes(t *testing.T) {
+
+	cv.Convey("HostTimeouts should override the config-wide timeouts for the sshd it names, field by field, and a per-host HandshakeTimeout should cut short a stalled handshake with ErrConnectTimeout.", t, func() {
+
+		cfg := NewSshegoConfig()
+		cfg.ConnectTimeout = time.Second
+		cfg.HandshakeTimeout = 2 * time.Second
+		cfg.OverallTimeout = 3 * time.Second
+		cfg.HostTimeouts = map[string]Timeouts{
+			"far.example.com:22": {Handshake: 20 * time.Second},
+		}
+		cv.So(cfg.TimeoutsFor("far.example.com:22"), cv.ShouldResemble,
+			Timeouts{Connect: time.Second, Handshake: 20 * time.Second, Overall: 3 * time.Second})
+		cv.So(cfg.TimeoutsFor("near.example.com:22"), cv.ShouldResemble,
+			Timeouts{Connect: time.Second, Handshake: 2 * time.Second, Overall: 3 * time.Second})
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// accepts the TCP connection, but never speaks ssh.
+		stall, stallPort := GetAvailPort()
+		defer stall.Close()
+		stallAddr := fmt.Sprintf("127.0.0.1:%v", stallPort)
+
+		s.CliCfg.HandshakeTimeout = time.Minute
+		s.CliCfg.HostTimeouts = map[string]Timeouts{
+			stallAddr: {Handshake: 300 * time.Millisecond},
+		}
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		t0 := time.Now()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			"127.0.0.1", int64(stallPort), s.Pw, s.Totp, halt)
+		cv.So(errors.Is(err, ErrConnectTimeout), cv.ShouldBeTrue)
+		cv.So(time.Since(t0), cv.ShouldBeLessThan, 10*time.Second)
+
+		// the healthy sshd gets the generous global value.
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli, cv.ShouldNotBeNil)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test132AcceptLoopStopsPromptlyOnCancel(t *testing.T) {
+
+	cv.Convey("An accept loop built on acceptWithContext should hand out connections until its ctx is cancelled, and then exit within a few milliseconds, closing the listener.", t, func() {
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		panicOn(err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		accepted := make(chan net.Conn, 1)
+		exited := make(chan error, 1)
+		go func() {
+			for {
+				conn, err := acceptWithContext(ctx, ln)
+				if err != nil {
+					exited <- err
+					return
+				}
+				accepted <- conn
+			}
+		}()
+
+		c, err := net.Dial("tcp", ln.Addr().String())
+		panicOn(err)
+		defer c.Close()
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		case <-time.After(5 * time.Second):
+			panic("never accepted")
+		}
+
+		// let the loop block in Accept again.
+		time.Sleep(20 * time.Millisecond)
+		t0 := time.Now()
+		cancel()
+		var loopErr error
+		select {
+		case loopErr = <-exited:
+		case <-time.After(5 * time.Second):
+			panic("accept loop did not exit")
+		}
+		cv.So(time.Since(t0), cv.ShouldBeLessThan, 50*time.Millisecond)
+		cv.So(errors.Is(loopErr, context.Canceled), cv.ShouldBeTrue)
+
+		// the listener is closed.
+		_, err = ln.Accept()
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// running out of descriptors is waited out; other errors end the loop.
+		ln2, err := net.Listen("tcp", "127.0.0.1:0")
+		panicOn(err)
+		c2, err := net.Dial("tcp", ln2.Addr().String())
+		panicOn(err)
+		defer c2.Close()
+		emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+		flaky := &errListener{Listener: ln2, errs: []error{emfile, emfile}}
+		conn, err := acceptWithContext(context.Background(), flaky)
+		cv.So(err, cv.ShouldBeNil)
+		conn.Close()
+		flaky.Close()
+		_, err = acceptWithContext(context.Background(), flaky)
+		cv.So(errors.Is(err, net.ErrClosed), cv.ShouldBeTrue)
+	})
+}
+
+// errListener fails its first Accepts with errs.
+type errListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func Test134PrefaceIsSentBeforeTheClientsBytes(t *testing.T) {
+
+	cv.Convey("LocalToRemote.Preface should reach the remote on each forwarded connection ahead of the client's data, and survive a SaveConfig/LoadConfig round trip with its escapes.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		got := make(chan string, 1)
+		go func() {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			br := bufio.NewReader(c)
+			a, _ := br.ReadString('\n')
+			b, _ := br.ReadString('\n')
+			got <- a + b
+			c.Write([]byte("ok\n"))
+		}()
+
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.LocalToRemote.Preface = []byte("HELO\x00 \"x\"\r\n")
+		s.CliCfg.Quiet = true
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+		panicOn(err)
+		defer c.Close()
+		fmt.Fprintf(c, "data\n")
+		line, err := bufio.NewReader(c).ReadString('\n')
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(line, cv.ShouldEqual, "ok\n")
+		cv.So(<-got, cv.ShouldEqual, "HELO\x00 \"x\"\r\ndata\n")
+
+		var buf bytes.Buffer
+		panicOn(s.CliCfg.SaveConfig(&buf))
+		path := s.SrvCfg.Tempdir + "/preface.cfg"
+		panicOn(ioutil.WriteFile(path, buf.Bytes(), 0600))
+		back := NewSshegoConfig()
+		panicOn(back.LoadConfig(path))
+		cv.So(string(back.LocalToRemote.Preface), cv.ShouldEqual, string(s.CliCfg.LocalToRemote.Preface))
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test135BreakerPausesAcceptsAfterRepeatedDialFailures(t *testing.T) {
+
+	cv.Convey("With BreakerFailures set, a forward whose remote keeps refusing should stop accepting for BreakerCooldown after that many failed dials in a row, calling OnBreakerTrip; a good dial resets the count.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// the sshd refuses to dial the remote.
+		dead, deadPort := GetAvailPort()
+		dead.Close()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", deadPort)
+		s.SrvCfg.DirectTCPIPHandler = func(user, target string) error {
+			if target == s.CliCfg.LocalToRemote.Remote.Addr {
+				return fmt.Errorf("refused")
+			}
+			return nil
+		}
+		s.CliCfg.Nickname = "breaker-test"
+		s.CliCfg.Quiet = true
+		cooldown := 2 * time.Second
+		s.CliCfg.BreakerFailures = 2
+		s.CliCfg.BreakerCooldown = cooldown
+		tripped := make(chan int, 10)
+		s.CliCfg.OnBreakerTrip = func(name string, failures int, cd time.Duration) {
+			if name == "breaker-test" && cd == cooldown {
+				tripped <- failures
+			}
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		// how long until the forward gives up on a connection.
+		refused := func() time.Duration {
+			t0 := time.Now()
+			c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+			panicOn(err)
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = c.Read(make([]byte, 1))
+			cv.So(err, cv.ShouldNotBeNil)
+			return time.Since(t0)
+		}
+		cv.So(refused(), cv.ShouldBeLessThan, cooldown/2)
+		cv.So(len(tripped), cv.ShouldEqual, 0)
+		cv.So(refused(), cv.ShouldBeLessThan, cooldown/2)
+		cv.So(<-tripped, cv.ShouldEqual, 2)
+
+		// the next is not even accepted until the cooldown is over.
+		cv.So(refused(), cv.ShouldBeGreaterThan, cooldown/2)
+
+		// a good dial in between resets the count.
+		spec := &s.CliCfg.LocalToRemote
+		s.CliCfg.noteForwardDial(spec, nil)
+		s.CliCfg.noteForwardDial(spec, fmt.Errorf("refused"))
+		s.CliCfg.noteForwardDial(spec, nil)
+		s.CliCfg.noteForwardDial(spec, fmt.Errorf("refused"))
+		cv.So(len(tripped), cv.ShouldEqual, 0)
+
+		// each forward has a breaker of its own.
+		other := &TunnelSpec{Listen: AddrHostPort{Addr: "127.0.0.1:1"}}
+		s.CliCfg.noteForwardDial(other, fmt.Errorf("refused"))
+		cv.So(len(tripped), cv.ShouldEqual, 0)
+		_, fails := s.CliCfg.breakerOpen(other, time.Now())
+		cv.So(fails, cv.ShouldEqual, 1)
+		_, fails = s.CliCfg.breakerOpen(spec, time.Now())
+		cv.So(fails, cv.ShouldEqual, 1)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test136LoadPrivateKeyTakesEveryKeyType(t *testing.T) {
+
+	cv.Convey("LoadPrivateKey, and LoadRSAPrivateKey through it, should load RSA, EC, DSA, OpenSSH-format ed25519 and rsa, and PKCS#8 ed25519 keys, each giving a signer that works.", t, func() {
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+
+		_, edPriv, err := ed25519.GenerateKey(cryptrand.Reader)
+		panicOn(err)
+		der, err := x509.MarshalPKCS8PrivateKey(edPriv)
+		panicOn(err)
+		pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+		keys := map[string][]byte{
+			"ssh-rsa":             testdata.PEMBytes["rsa"],
+			"ecdsa-sha2-nistp256": testdata.PEMBytes["ecdsa"],
+			"ssh-dss":             testdata.PEMBytes["dsa"],
+			"ssh-ed25519":         testdata.PEMBytes["ed25519"],
+			"rsa-openssh":         testdata.PEMBytes["rsa-openssh-format"],
+			"pkcs8":               pkcs8,
+		}
+		for name, by := range keys {
+			path := tmpdir + "/" + name
+			panicOn(ioutil.WriteFile(path, by, 0600))
+			for _, load := range []func(string) (ssh.Signer, error){LoadPrivateKey, LoadRSAPrivateKey} {
+				signer, err := load(path)
+				cv.So(err, cv.ShouldBeNil)
+				switch name {
+				case "rsa-openssh":
+					cv.So(signer.PublicKey().Type(), cv.ShouldEqual, "ssh-rsa")
+				case "pkcs8":
+					cv.So(signer.PublicKey().Type(), cv.ShouldEqual, "ssh-ed25519")
+				default:
+					cv.So(signer.PublicKey().Type(), cv.ShouldEqual, name)
+				}
+				msg := []byte("sign me")
+				sig, err := signer.Sign(cryptrand.Reader, msg)
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(signer.PublicKey().Verify(msg, sig), cv.ShouldBeNil)
+			}
+		}
+	})
+}
+
+func Test137EncryptedPrivateKeysNeedTheirPassphrase(t *testing.T) {
+
+	cv.Convey("A passphrase-protected client key, in the legacy PEM or the OpenSSH format, should fail to load without its passphrase with an *EncryptedKeyError, and with PrivateKeyPassphrase set should let SSHConnect log in.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		plain, err := ioutil.ReadFile(s.RsaPath)
+		panicOn(err)
+		block, _ := pem.Decode(plain)
+		cv.So(block, cv.ShouldNotBeNil)
+		enc, err := x509.EncryptPEMBlock(cryptrand.Reader, block.Type, block.Bytes, []byte("key secret"), x509.PEMCipherAES256)
+		panicOn(err)
+		encPath := s.SrvCfg.Tempdir + "/id_encrypted"
+		panicOn(ioutil.WriteFile(encPath, pem.EncodeToMemory(enc), 0600))
+
+		var encErr *EncryptedKeyError
+		_, err = LoadPrivateKey(encPath)
+		cv.So(errors.As(err, &encErr), cv.ShouldBeTrue)
+		cv.So(encErr.Path, cv.ShouldEqual, encPath)
+		_, err = LoadEncryptedPrivateKey(encPath, "")
+		cv.So(errors.As(err, &encErr), cv.ShouldBeTrue)
+		_, err = LoadEncryptedPrivateKey(encPath, "wrong")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		want, err := LoadPrivateKey(s.RsaPath)
+		panicOn(err)
+		got, err := LoadEncryptedPrivateKey(encPath, "key secret")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(got.PublicKey().Marshal(), cv.ShouldResemble, want.PublicKey().Marshal())
+
+		// an unencrypted key ignores the passphrase.
+		_, err = LoadEncryptedPrivateKey(s.RsaPath, "key secret")
+		cv.So(err, cv.ShouldBeNil)
+
+		// keys in the OpenSSH format ssh-keygen writes by
+		// default, encrypted with aes256-ctr and aes256-cbc.
+		for _, name := range []string{"id_rsa_e_encrypted", "id_ed25519_f_encrypted"} {
+			path := s.SrvCfg.Origdir + "/testdata/" + name
+			_, err = LoadPrivateKey(path)
+			cv.So(errors.As(err, &encErr), cv.ShouldBeTrue)
+			_, err = LoadEncryptedPrivateKey(path, "wrong")
+			cv.So(errors.Is(err, x509.IncorrectPasswordError), cv.ShouldBeTrue)
+
+			got, err := LoadEncryptedPrivateKey(path, "key secret")
+			cv.So(err, cv.ShouldBeNil)
+			pub, err := ioutil.ReadFile(path + ".pub")
+			panicOn(err)
+			wantPub, _, _, _, err := ssh.ParseAuthorizedKey(pub)
+			panicOn(err)
+			cv.So(got.PublicKey().Marshal(), cv.ShouldResemble, wantPub.Marshal())
+		}
+
+		s.CliCfg.LocalToRemote.Listen.Addr = ""
+		s.CliCfg.DirectTcp = true
+		ctx := context.Background()
+		connect := func() error {
+			halt := ssh.NewHalter()
+			defer func() {
+				halt.RequestStop()
+				halt.MarkDone()
+			}()
+			_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, encPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			return err
+		}
+		err = connect()
+		cv.So(errors.As(err, &encErr), cv.ShouldBeTrue)
+
+		s.CliCfg.PrivateKeyPassphrase = "key secret"
+		cv.So(connect(), cv.ShouldBeNil)
+
+		// the passphrase is never written to a config file.
+		var buf bytes.Buffer
+		panicOn(s.CliCfg.SaveConfig(&buf))
+		cv.So(buf.String(), cv.ShouldNotContainSubstring, "key secret")
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test139RunForwardOnceServesNConnectionsThenReturns(t *testing.T) {
+
+	cv.Convey("RunForwardOnce should forward exactly ForwardOnceConns connections, return once they have finished, and leave neither the listener nor the ssh connection behind.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// echoes one line per connection.
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		go func() {
+			for {
+				c, err := target.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					line, err := bufio.NewReader(c).ReadString('\n')
+					if err == nil {
+						fmt.Fprintf(c, "echo:%s", line)
+					}
+				}(c)
+			}
+		}()
+
+		cfg := s.CliCfg
+		cfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		cfg.SSHdServer.Addr = s.SrvCfg.EmbeddedSSHd.Addr
+		cv.So(cfg.SSHdServer.ParseAddr(), cv.ShouldBeNil)
+		cfg.Username, cfg.PrivateKeyPath = s.Mylogin, s.RsaPath
+		cfg.Pw, cfg.TotpUrl = s.Pw, s.Totp
+		cfg.ForwardOnceConns = 2
+		cfg.Quiet = true
+
+		ran := make(chan error, 1)
+		go func() { ran <- RunForwardOnce(context.Background(), cfg) }()
+
+		for i := 0; i < 2; i++ {
+			// not WaitUntilAddrListening: its probe
+			// would use up one of the connections.
+			var c net.Conn
+			var err error
+			for j := 0; j < 300; j++ {
+				c, err = net.Dial("tcp", cfg.LocalToRemote.Listen.Addr)
+				if err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			panicOn(err)
+			fmt.Fprintf(c, "hi%v\n", i)
+			line, err := bufio.NewReader(c).ReadString('\n')
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(line, cv.ShouldEqual, fmt.Sprintf("echo:hi%v\n", i))
+			c.Close()
+		}
+		select {
+		case err := <-ran:
+			cv.So(err, cv.ShouldBeNil)
+		case <-time.After(10 * time.Second):
+			panic("RunForwardOnce did not return after its connections finished")
+		}
+		_, err := net.Dial("tcp", cfg.LocalToRemote.Listen.Addr)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(cfg.SshClient, cv.ShouldBeNil)
+
+		// a done ctx ends a run still waiting for its connections.
+		cfg.ForwardOnceConns = 0
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		err = RunForwardOnce(ctx, cfg)
+		cv.So(errors.Is(err, context.DeadlineExceeded), cv.ShouldBeTrue)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test145MaxAcceptsPerSecSpacesOutOrRefusesNewConnections(t *testing.T) {
+
+	cv.Convey("With MaxAcceptsPerSec, a burst of clients beyond AcceptBurst should reach the remote only at the set rate, or with RefuseExcessAccepts be hung up on.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// echoes one line per connection, and notes when each arrived.
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		arrived := make(chan time.Time, 20)
+		go func() {
+			for {
+				c, err := target.Accept()
+				if err != nil {
+					return
+				}
+				arrived <- time.Now()
+				go func(c net.Conn) {
+					defer c.Close()
+					line, err := bufio.NewReader(c).ReadString('\n')
+					if err == nil {
+						fmt.Fprintf(c, "echo:%s", line)
+					}
+				}(c)
+			}
+		}()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.Quiet = true
+		s.CliCfg.MaxAcceptsPerSec = 4
+		s.CliCfg.AcceptBurst = 2
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		// served reports whether a client got its echo.
+		served := func(c net.Conn) bool {
+			defer c.Close()
+			fmt.Fprintf(c, "hi\n")
+			c.SetReadDeadline(time.Now().Add(10 * time.Second))
+			line, err := bufio.NewReader(c).ReadString('\n')
+			return err == nil && line == "echo:hi\n"
+		}
+		burst := func(n int) []net.Conn {
+			var cs []net.Conn
+			for i := 0; i < n; i++ {
+				c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+				panicOn(err)
+				cs = append(cs, c)
+			}
+			return cs
+		}
+
+		// 2 at once from the burst, then one every 250 msec.
+		t0 := time.Now()
+		for _, c := range burst(6) {
+			cv.So(served(c), cv.ShouldBeTrue)
+		}
+		var last time.Time
+		for i := 0; i < 6; i++ {
+			last = <-arrived
+		}
+		cv.So(last.Sub(t0), cv.ShouldBeGreaterThanOrEqualTo, 900*time.Millisecond)
+
+		// with RefuseExcessAccepts, only a fresh burst's worth get through.
+		s.CliCfg.RefuseExcessAccepts = true
+		s.CliCfg.MaxAcceptsPerSec = 0.1
+		b := &s.CliCfg.guardFor(&s.CliCfg.LocalToRemote).accepts
+		b.mut.Lock()
+		b.last = time.Time{}
+		b.mut.Unlock()
+		n := 0
+		for _, c := range burst(5) {
+			if served(c) {
+				n++
+			}
+		}
+		cv.So(n, cv.ShouldEqual, 2)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test174MaxConcurrentForwardsHoldsBackOrRefusesConnections(t *testing.T) {
+
+	cv.Convey("With MaxConcurrentForwards, a client beyond the cap should wait in the backlog until a forward finishes, or with RefuseExcessForwards be hung up on.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// echoes the first line, then holds the
+		// connection open until the client closes it.
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		var arrived int64
+		go func() {
+			for {
+				c, err := target.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt64(&arrived, 1)
+				go func(c net.Conn) {
+					defer c.Close()
+					r := bufio.NewReader(c)
+					line, err := r.ReadString('\n')
+					if err == nil {
+						fmt.Fprintf(c, "echo:%s", line)
+						io.Copy(ioutil.Discard, r)
+					}
+				}(c)
+			}
+		}()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.Quiet = true
+		s.CliCfg.MaxConcurrentForwards = 2
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		dial := func() net.Conn {
+			c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+			panicOn(err)
+			fmt.Fprintf(c, "hi\n")
+			return c
+		}
+		// echoed reports whether c got its echo within wait.
+		echoed := func(c net.Conn, wait time.Duration) bool {
+			c.SetReadDeadline(time.Now().Add(wait))
+			line, err := bufio.NewReader(c).ReadString('\n')
+			return err == nil && line == "echo:hi\n"
+		}
+
+		c1, c2 := dial(), dial()
+		defer c1.Close()
+		defer c2.Close()
+		cv.So(echoed(c1, 10*time.Second), cv.ShouldBeTrue)
+		cv.So(echoed(c2, 10*time.Second), cv.ShouldBeTrue)
+		cv.So(s.CliCfg.DebugDump(), cv.ShouldContainSubstring, "forwards open: 2 (max 2)")
+
+		// the third waits in the backlog until the first is done.
+		c3 := dial()
+		defer c3.Close()
+		cv.So(echoed(c3, 500*time.Millisecond), cv.ShouldBeFalse)
+		cv.So(atomic.LoadInt64(&arrived), cv.ShouldEqual, 2)
+		c1.Close()
+		cv.So(echoed(c3, 10*time.Second), cv.ShouldBeTrue)
+
+		// with RefuseExcessForwards, one over the cap is hung up on.
+		s.CliCfg.RefuseExcessForwards = true
+		c2.Close()
+		c4 := dial()
+		defer c4.Close()
+		cv.So(echoed(c4, 10*time.Second), cv.ShouldBeTrue)
+		c5 := dial()
+		defer c5.Close()
+		cv.So(echoed(c5, 10*time.Second), cv.ShouldBeFalse)
+		cv.So(atomic.LoadInt64(&arrived), cv.ShouldEqual, 4)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test146ExtraTunnelsShareOneSSHConnect(t *testing.T) {
+
+	cv.Convey("LocalToRemotes and RemoteToLocals should each get their own listener over the one ssh connection, alongside LocalToRemote.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.SrvCfg.AllowReverseTCP = true
+
+		// each backend answers one line with its name prefixed.
+		serve := func(name string) int {
+			ln, port := GetAvailPort()
+			go func() {
+				defer ln.Close()
+				for {
+					c, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go func(c net.Conn) {
+						defer c.Close()
+						line, err := bufio.NewReader(c).ReadString('\n')
+						if err == nil {
+							fmt.Fprintf(c, "%s:%s", name, line)
+						}
+					}(c)
+				}
+			}()
+			return port
+		}
+		freeAddr := func() string {
+			ln, port := GetAvailPort()
+			ln.Close()
+			return fmt.Sprintf("127.0.0.1:%v", port)
+		}
+		ask := func(addr string) string {
+			c, err := net.Dial("tcp", addr)
+			panicOn(err)
+			defer c.Close()
+			fmt.Fprintf(c, "hi\n")
+			c.SetReadDeadline(time.Now().Add(10 * time.Second))
+			line, _ := bufio.NewReader(c).ReadString('\n')
+			return line
+		}
+
+		cfg := s.CliCfg
+		cfg.Quiet = true
+		cfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", serve("a"))
+		cfg.LocalToRemotes = []TunnelSpec{{
+			Listen: AddrHostPort{Addr: freeAddr()},
+			Remote: AddrHostPort{Addr: fmt.Sprintf("127.0.0.1:%v", serve("b"))},
+		}}
+		cfg.RemoteToLocals = []TunnelSpec{{
+			Listen: AddrHostPort{Addr: freeAddr()},
+			Remote: AddrHostPort{Addr: fmt.Sprintf("127.0.0.1:%v", serve("c"))},
+		}}
+		for i := range cfg.LocalToRemotes {
+			cv.So(cfg.LocalToRemotes[i].parseAddrs("LocalToRemotes[0]"), cv.ShouldBeNil)
+			cv.So(cfg.RemoteToLocals[i].parseAddrs("RemoteToLocals[0]"), cv.ShouldBeNil)
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := cfg.SSHConnect(ctx, cfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.So(ask(cfg.LocalToRemote.Listen.Addr), cv.ShouldEqual, "a:hi\n")
+		cv.So(ask(cfg.LocalToRemotes[0].Listen.Addr), cv.ShouldEqual, "b:hi\n")
+		cv.So(ask(cfg.RemoteToLocals[0].Listen.Addr), cv.ShouldEqual, "c:hi\n")
+
+		cv.So(len(cfg.Topology().Listeners), cv.ShouldEqual, 3)
+
+		// an extra tunnel must say where it goes.
+		bad := TunnelSpec{Listen: AddrHostPort{Addr: "127.0.0.1:1"}}
+		cv.So(bad.parseAddrs("LocalToRemotes[1]"), cv.ShouldNotBeNil)
+
+		halt.RequestStop()
+		halt.MarkDone()
+
+		// if a listener cannot be bound, those already
+		// bound are closed again.
+		taken, takenPort := GetAvailPort()
+		defer taken.Close()
+		cfg.LocalToRemote.Listen.Addr = ""
+		cfg.RemoteToLocals = nil
+		cfg.LocalToRemotes = []TunnelSpec{{
+			Listen: AddrHostPort{Addr: freeAddr()},
+			Remote: AddrHostPort{Addr: fmt.Sprintf("127.0.0.1:%v", serve("d"))},
+		}, {
+			Listen: AddrHostPort{Addr: fmt.Sprintf("127.0.0.1:%v", takenPort)},
+			Remote: AddrHostPort{Addr: fmt.Sprintf("127.0.0.1:%v", serve("e"))},
+		}}
+		for i := range cfg.LocalToRemotes {
+			cv.So(cfg.LocalToRemotes[i].parseAddrs(fmt.Sprintf("LocalToRemotes[%v]", i)), cv.ShouldBeNil)
+		}
+		halt = ssh.NewHalter()
+		_, _, err = cfg.SSHConnect(ctx, cfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		again, err := net.Listen("tcp", cfg.LocalToRemotes[0].Listen.Addr)
+		cv.So(err, cv.ShouldBeNil)
+		again.Close()
+		halt.RequestStop()
+		halt.MarkDone()
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test149DefaultResolverAnswersHOTPWithAnAdvancingCounter(t *testing.T) {
+
+	cv.Convey("Given an otpauth://hotp/ url, the default resolver should answer each challenge with the code for the next counter, starting from the url's counter= when HOTPCounter is zero; TOTP urls are answered as before.", t, func() {
+
+		key, err := hotp.Generate(hotp.GenerateOpts{Issuer: "sshego", AccountName: "alice"})
+		panicOn(err)
+		want := func(c uint64) string {
+			code, err := hotp.GenerateCode(key.Secret(), c)
+			panicOn(err)
+			return code
+		}
+
+		cfg := NewSshegoConfig()
+		ki := &kiCliHelp{toptUrl: key.String(), hotpCounter: &cfg.HOTPCounter}
+		for c := uint64(0); c < 3; c++ {
+			ans, err := ki.Resolve("", gauthChallenge, false)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(ans, cv.ShouldEqual, want(c))
+		}
+		cv.So(cfg.HOTPCounter, cv.ShouldEqual, 3)
+
+		// the counter is kept in the saved config.
+		var buf bytes.Buffer
+		panicOn(cfg.SaveConfig(&buf))
+		cv.So(buf.String(), cv.ShouldContainSubstring, `SSH_HOTP_COUNTER="3"`)
+
+		ki = &kiCliHelp{toptUrl: key.String() + "&counter=7"}
+		ans, err := ki.Resolve("", gauthChallenge, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ans, cv.ShouldEqual, want(7))
+		ans, err = ki.Resolve("", gauthChallenge, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ans, cv.ShouldEqual, want(8))
+
+		tkey, err := totp.Generate(totp.GenerateOpts{Issuer: "sshego", AccountName: "alice"})
+		panicOn(err)
+		ki = &kiCliHelp{toptUrl: tkey.String(), hotpCounter: &cfg.HOTPCounter}
+		ans, err = ki.Resolve("", gauthChallenge, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(totp.Validate(ans, tkey.Secret()), cv.ShouldBeTrue)
+		cv.So(cfg.HOTPCounter, cv.ShouldEqual, 3)
+
+		// with a config file, each advance is written back
+		// to it at once, and its other lines are kept.
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+		path := tmpdir + "/config"
+		panicOn(ioutil.WriteFile(path, []byte("# mine\nSSHD_LOGIN_USERNAME=\"alice\"\nSSH_HOTP_COUNTER=\"3\"\n"), 0600))
+		ki = &kiCliHelp{toptUrl: key.String(), hotpCounter: &cfg.HOTPCounter, counterPath: path}
+		ans, err = ki.Resolve("", gauthChallenge, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ans, cv.ShouldEqual, want(3))
+		back := NewSshegoConfig()
+		panicOn(back.LoadConfig(path))
+		cv.So(back.HOTPCounter, cv.ShouldEqual, 4)
+		cv.So(back.Username, cv.ShouldEqual, "alice")
+		by, err := ioutil.ReadFile(path)
+		panicOn(err)
+		cv.So(string(by), cv.ShouldStartWith, "# mine\n")
+		cv.So(strings.Count(string(by), "SSH_HOTP_COUNTER="), cv.ShouldEqual, 1)
+
+		// a symlinked config stays a symlink, and the
+		// file it points to keeps its mode.
+		target := tmpdir + "/real-config"
+		panicOn(ioutil.WriteFile(target, []byte("SSH_HOTP_COUNTER=\"5\"\n"), 0640))
+		panicOn(os.Chmod(target, 0640))
+		link := tmpdir + "/link-config"
+		panicOn(os.Symlink(target, link))
+		ki = &kiCliHelp{toptUrl: key.String(), hotpCounter: &cfg.HOTPCounter, counterPath: link}
+		cfg.HOTPCounter = 5
+		ans, err = ki.Resolve("", gauthChallenge, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ans, cv.ShouldEqual, want(5))
+		lfi, err := os.Lstat(link)
+		panicOn(err)
+		cv.So(lfi.Mode()&os.ModeSymlink, cv.ShouldNotEqual, 0)
+		rfi, err := os.Stat(target)
+		panicOn(err)
+		cv.So(rfi.Mode().Perm(), cv.ShouldEqual, os.FileMode(0640))
+		back = NewSshegoConfig()
+		panicOn(back.LoadConfig(link))
+		cv.So(back.HOTPCounter, cv.ShouldEqual, 6)
+	})
+}
+
+func Test151FingerprintMD5MatchesSshKeygen(t *testing.T) {
+
+	cv.Convey("FingerprintMD5() should give the colon-hex MD5 that ssh-keygen -E md5 -l prints, less its MD5: prefix, and Fingerprint() should be unchanged.", t, func() {
+		by, err := ioutil.ReadFile("./testdata/id_ed25519_d.pub")
+		panicOn(err)
+		key, _, _, _, err := ssh.ParseAuthorizedKey(by)
+		panicOn(err)
+
+		// from ssh-keygen -E md5 -lf testdata/id_ed25519_d.pub
+		cv.So(FingerprintMD5(key), cv.ShouldEqual, "1c:02:5c:db:43:e4:2c:35:e3:b8:18:f3:36:de:ac:4f")
+		cv.So(Fingerprint(key), cv.ShouldEqual, "SHA256:O11dwR6xkX/lMdQuFYK3Yt8Z7tAZpKn/dqOegZByd0M=")
+	})
+}
+
+func Test152RandomArtMatchesSshKeygen(t *testing.T) {
+
+	cv.Convey("RandomArt() should draw the same picture, borders and titles as ssh-keygen -lv.", t, func() {
+		art := func(path string) string {
+			by, err := ioutil.ReadFile(path)
+			panicOn(err)
+			key, _, _, _, err := ssh.ParseAuthorizedKey(by)
+			panicOn(err)
+			return RandomArt(key)
+		}
+
+		// from ssh-keygen -lvf on each.
+		cv.So(art("./testdata/id_ed25519_d.pub"), cv.ShouldEqual, `+--[ED25519 256]--+
+|            ..o*=|
+|           . ..BB|
+|            .E*=B|
+|          .o.=.==|
+|       .S+..=o=.*|
+|        oooooo.* |
+|        o ....o  |
+|         .   .o+.|
+|            .++.o|
++----[SHA256]-----+`)
+		cv.So(art("./testdata/id_rsa_a.pub"), cv.ShouldEqual, `+---[RSA 4096]----+
+|+o. ..*.         |
+|o*o+.o B         |
+|+oo.= + o        |
+| o = + .         |
+|. . B . S        |
+| . + B ..        |
+|  . B +. . .     |
+| ..+ . .+ o .    |
+|.o. .  o+Eo.     |
++----[SHA256]-----+`)
+		cv.So(art("./testdata/id_ecdsa_c.pub"), cv.ShouldStartWith, "+---[ECDSA 256]---+\n|...+*o=**...     |\n")
+	})
+}
+
+// freezingRelay relays one TCP connection to dest until
+// freeze is closed, after which it carries nothing either
+// way, but keeps the connection open: a network drop.
+func freezingRelay(lsn net.Listener, dest string, freeze chan struct{}) {
+	a, err := lsn.Accept()
+	if err != nil {
+		return
+	}
+	b, err := net.Dial("tcp", dest)
+	if err != nil {
+		a.Close()
+		return
+	}
+	pipe := func(dst, src net.Conn) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := src.Read(buf)
+			select {
+			case <-freeze:
+				return
+			default:
+			}
+			if n > 0 {
+				dst.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+}
+
+func Test154UnansweredKeepalivesCloseTheConnection(t *testing.T) {
+
+	cv.Convey("When the sshd stops answering, KeepAliveMaxMissed unanswered keepalives in a row should close the client connection, and tell ClientReconnectNeededTower.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		relay, relayPort := GetAvailPort()
+		defer relay.Close()
+		freeze := make(chan struct{})
+		go freezingRelay(relay, s.SrvCfg.EmbeddedSSHd.Addr, freeze)
+
+		s.CliCfg.LocalToRemote.Listen.Addr = ""
+		s.CliCfg.DirectTcp = true
+		s.CliCfg.KeepAliveEvery = 100 * time.Millisecond
+		s.CliCfg.KeepAliveTimeout = 200 * time.Millisecond
+		s.CliCfg.KeepAliveMaxMissed = 3
+		reconnect := s.CliCfg.ClientReconnectNeededTower.Subscribe(nil)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			"127.0.0.1", int64(relayPort), s.Pw, s.Totp, halt)
+		panicOn(err)
+
+		closed := make(chan struct{})
+		go func() {
+			cli.Wait()
+			close(closed)
+		}()
+
+		// healthy: the keepalives are answered.
+		select {
+		case <-closed:
+			panic("connection closed while the sshd still answered")
+		case <-time.After(time.Second):
+		}
+
+		t0 := time.Now()
+		close(freeze)
+		select {
+		case <-closed:
+		case <-time.After(10 * time.Second):
+			panic("connection still open 10s after the sshd went silent")
+		}
+		cv.So(time.Since(t0), cv.ShouldBeGreaterThanOrEqualTo, 500*time.Millisecond)
+
+		select {
+		case <-reconnect:
+		case <-time.After(5 * time.Second):
+			panic("no reconnect-needed notice")
+		}
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test156CancellingTheContextTearsDownSSHConnect(t *testing.T) {
+
+	cv.Convey("Cancelling the ctx given to SSHConnect should abort a handshake in progress, and once connected, close the client and the forward listener, without waiting on a stop request to its halt.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// accepts the TCP connection, but never speaks ssh.
+		stall, stallPort := GetAvailPort()
+		defer stall.Close()
+
+		halt := ssh.NewHalter()
+		defer func() {
+			halt.RequestStop()
+			halt.MarkDone()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		t0 := time.Now()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			"127.0.0.1", int64(stallPort), s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(cli, cv.ShouldBeNil)
+		cv.So(time.Since(t0), cv.ShouldBeLessThan, 10*time.Second)
+
+		// the done ctx stopped halt too.
+		halt2 := ssh.NewHalter()
+		defer func() {
+			halt2.RequestStop()
+			halt2.MarkDone()
+		}()
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		cli, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt2)
+		panicOn(err)
+		cv.So(WaitUntilAddrListening(s.CliCfg.LocalToRemote.Listen.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		closed := make(chan struct{})
+		go func() {
+			cli.Wait()
+			close(closed)
+		}()
+		cancel()
+		select {
+		case <-closed:
+		case <-time.After(10 * time.Second):
+			panic("client still open 10s after its ctx was cancelled")
+		}
+		cv.So(WaitUntilAddrAvailable(s.CliCfg.LocalToRemote.Listen.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test160TOTPClockOffsetShiftsTheCodeWeAnswerWith(t *testing.T) {
+
+	cv.Convey("the default resolver should answer a TOTP challenge with the code for our clock plus TOTPClockOffset, and the offset should be kept in the saved config.", t, func() {
+
+		key, err := totp.Generate(totp.GenerateOpts{Issuer: "sshego", AccountName: "alice"})
+		panicOn(err)
+
+		// ten minutes out is well past the sshd's one
+		// step of leeway either way.
+		skew := 10 * time.Minute
+		ki := &kiCliHelp{toptUrl: key.String(), clockOffset: skew}
+		ans, err := ki.Resolve("", gauthChallenge, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(totp.Validate(ans, key.Secret()), cv.ShouldBeFalse)
+		valid, err := totp.ValidateCustom(ans, key.Secret(), time.Now().Add(skew), totp.ValidateOpts{Period: 30, Skew: 1, Digits: otp.DigitsSix})
+		panicOn(err)
+		cv.So(valid, cv.ShouldBeTrue)
+
+		cfg := NewSshegoConfig()
+		cfg.TOTPClockOffset = -20 * time.Second
+		var buf bytes.Buffer
+		panicOn(cfg.SaveConfig(&buf))
+		cv.So(buf.String(), cv.ShouldContainSubstring, `SSH_TOTP_CLOCK_OFFSET="-20s"`)
+
+		origdir, tmpdir := MakeAndMoveToTempDir()
+		defer TempDirCleanup(origdir, tmpdir)
+		path := tmpdir + "/config"
+		panicOn(ioutil.WriteFile(path, buf.Bytes(), 0600))
+		back := NewSshegoConfig()
+		panicOn(back.LoadConfig(path))
+		cv.So(back.TOTPClockOffset, cv.ShouldEqual, -20*time.Second)
+	})
+}
+
+func Test161MalformedToptUrlIsAnErrorBeforeDialing(t *testing.T) {
+
+	cv.Convey("SSHConnect should return ErrBadOtpURL, without dialing or panicking, given a toptUrl that is not a usable otpauth url.", t, func() {
+
+		cfg := NewSshegoConfig()
+		ctx := context.Background()
+		h := &KnownHosts{Hosts: make(map[string]*ServerPubKey)}
+
+		// nothing listens here, so a dial would fail differently.
+		lsn, port := GetAvailPort()
+		lsn.Close()
+
+		for _, bad := range []string{
+			"not a url",
+			"https://example.com/totp/alice?secret=JBSWY3DPEHPK3PXP",
+			"otpauth://totp/alice?issuer=sshego",
+			"otpauth://totp/alice?secret=not*base32",
+			"otpauth://motp/alice?secret=JBSWY3DPEHPK3PXP",
+		} {
+			halt := ssh.NewHalter()
+			var err error
+			cv.So(func() {
+				_, _, err = cfg.SSHConnect(ctx, h, "bob", "", "127.0.0.1", int64(port), "", bad, halt)
+			}, cv.ShouldNotPanic)
+			cv.So(errors.Is(err, ErrBadOtpURL), cv.ShouldBeTrue)
+			cv.So(cfg.LastConnectTrace, cv.ShouldBeNil)
+			halt.RequestStop()
+			halt.MarkDone()
+		}
+
+		key, err := parseOtpURL(" otpauth://totp/alice?secret=JBSWY3DPEHPK3PXP\n")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(key.Secret(), cv.ShouldEqual, "JBSWY3DPEHPK3PXP")
+	})
+}
+
+func Test162RequireMFAInsistsOnBothKeyAndOneTimeCode(t *testing.T) {
+
+	cv.Convey("under RequireMFA, SSHConnect should fail before dialing without both a keypath and a toptUrl, succeed when the sshd takes both, and fail when the sshd lets us in on the key alone.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		ctx := context.Background()
+		connect := func(keypath, totp string) error {
+			halt := ssh.NewHalter()
+			defer halt.RequestStop()
+			cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, keypath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, totp, halt)
+			if err == nil {
+				cli.Close()
+			}
+			return err
+		}
+		s.CliCfg.RequireMFA = true
+
+		s.CliCfg.LastConnectTrace = nil
+		err := connect(s.RsaPath, "")
+		cv.So(errors.Is(err, ErrMFARequired), cv.ShouldBeTrue)
+		err = connect("", s.Totp)
+		cv.So(errors.Is(err, ErrMFARequired), cv.ShouldBeTrue)
+		// neither dialed.
+		cv.So(s.CliCfg.LastConnectTrace, cv.ShouldBeNil)
+
+		cv.So(connect(s.RsaPath, s.Totp), cv.ShouldBeNil)
+
+		// an sshd content with the key and password: the
+		// password challenge is no one-time code.
+		s.SrvCfg.Mut.Lock()
+		s.SrvCfg.SkipTOTP = true
+		s.SrvCfg.Mut.Unlock()
+		err = connect(s.RsaPath, s.Totp)
+		cv.So(errors.Is(err, ErrMFARequired), cv.ShouldBeTrue)
+
+		// an sshd content with the key alone.
+		s.SrvCfg.Mut.Lock()
+		s.SrvCfg.SkipPassphrase = true
+		s.SrvCfg.Mut.Unlock()
+		err = connect(s.RsaPath, s.Totp)
+		cv.So(errors.Is(err, ErrMFARequired), cv.ShouldBeTrue)
+
+		s.CliCfg.RequireMFA = false
+		cv.So(connect(s.RsaPath, s.Totp), cv.ShouldBeNil)
+
+		// other sshds name the code prompt otherwise; any
+		// prompt but a password's counts as the code.
+		cv.So(passwordPrompt(passwordChallenge), cv.ShouldBeTrue)
+		cv.So(passwordPrompt("(alice@host) Password: "), cv.ShouldBeTrue)
+		cv.So(passwordPrompt(gauthChallenge), cv.ShouldBeFalse)
+		cv.So(passwordPrompt("Verification code: "), cv.ShouldBeFalse)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test163SSHCheckLogsInWithoutStartingListeners(t *testing.T) {
+
+	cv.Convey("SSHCheck, and SSHConnect under ValidateOnly, should dial, check the host key and log in, then hang up, leaving the forward listener unstarted; bad credentials should still be an error.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		cfg := s.CliCfg
+		ctx := context.Background()
+		host, port := s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port
+
+		err := cfg.SSHCheck(ctx, cfg.KnownHosts, s.Mylogin, s.RsaPath, host, port, s.Pw, s.Totp)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cfg.LastConnectTrace, cv.ShouldNotBeNil)
+		cv.So(cfg.LastConnectTrace.Err, cv.ShouldBeNil)
+		cv.So(cfg.SshClient, cv.ShouldBeNil)
+		cv.So(cfg.ValidateOnly, cv.ShouldBeFalse)
+
+		// nothing listens on the forward address.
+		_, err = net.Dial("tcp", cfg.LocalToRemote.Listen.Addr)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		err = cfg.SSHCheck(ctx, cfg.KnownHosts, s.Mylogin, s.RsaPath, host, port, "wrong", s.Totp)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		cfg.ValidateOnly = true
+		halt := ssh.NewHalter()
+		cli, nc, err := cfg.SSHConnect(ctx, cfg.KnownHosts, s.Mylogin, s.RsaPath, host, port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli, cv.ShouldBeNil)
+		cv.So(nc, cv.ShouldBeNil)
+		_, err = net.Dial("tcp", cfg.LocalToRemote.Listen.Addr)
+		cv.So(err, cv.ShouldNotBeNil)
+		halt.RequestStop()
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test165BracketedIPv6AddressesParseAndForward(t *testing.T) {
+
+	cv.Convey("An IPv6 -listen and -remote given as [::1]:port should parse to the bare host, and forward over IPv6; an unbracketed one should be refused with a hint.", t, func() {
+
+		a := &AddrHostPort{Title: "listen", Addr: "[::1]:8080"}
+		cv.So(a.ParseAddr(), cv.ShouldBeNil)
+		cv.So(a.Host, cv.ShouldEqual, "::1")
+		cv.So(a.Port, cv.ShouldEqual, 8080)
+		cv.So(a.HostPort(), cv.ShouldEqual, "[::1]:8080")
+
+		a = &AddrHostPort{Title: "listen", Addr: "::1:8080"}
+		err := a.ParseAddr()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "must be in brackets")
+
+		a = &AddrHostPort{Title: "listen", Addr: "127.0.0.1:8080"}
+		cv.So(a.ParseAddr(), cv.ShouldBeNil)
+		cv.So(a.HostPort(), cv.ShouldEqual, "127.0.0.1:8080")
+
+		remote, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skipf("no IPv6 loopback here: %v", err)
+		}
+		defer remote.Close()
+		go func() {
+			c, err := remote.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			fmt.Fprintf(c, "over %s\n", c.LocalAddr())
+		}()
+		lsn, err := net.Listen("tcp", "[::1]:0")
+		panicOn(err)
+		listenPort := lsn.Addr().(*net.TCPAddr).Port
+		lsn.Close()
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.CliCfg.LocalToRemote.Listen.Addr = fmt.Sprintf("[::1]:%v", listenPort)
+		s.CliCfg.LocalToRemote.Remote.Addr = remote.Addr().String()
+		cv.So(s.CliCfg.LocalToRemote.Listen.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.LocalToRemote.Remote.ParseAddr(), cv.ShouldBeNil)
+		s.CliCfg.Quiet = true
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+		cv.So(err, cv.ShouldBeNil)
+		line, err := bufio.NewReader(c).ReadString('\n')
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(line, cv.ShouldEqual, fmt.Sprintf("over %s\n", remote.Addr()))
+		c.Close()
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test166JumpHostsAreChainedAndEachHostKeyChecked(t *testing.T) {
+
+	cv.Convey("With JumpHosts set, SSHConnect should log in to each jump host in turn, reach the next hop through a direct-tcpip channel from the one before, and check every hop's host key, as ssh -J does.", t, func() {
+
+		hops, err := ParseJumpHosts("ops@bastion.example.com, [::1]:2200,10.0.0.5")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(hops, cv.ShouldResemble, []HostSpec{
+			{Host: "bastion.example.com", Port: 22, User: "ops"},
+			{Host: "::1", Port: 2200},
+			{Host: "10.0.0.5", Port: 22},
+		})
+		cv.So(jumpHostsString(hops), cv.ShouldEqual, "ops@bastion.example.com:22,[::1]:2200,10.0.0.5:22")
+		_, err = ParseJumpHosts("/var/run/sshd.sock")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// the test sshd is its own bastion, twice over.
+		srv := HostSpec{Host: s.SrvCfg.EmbeddedSSHd.Host, Port: s.SrvCfg.EmbeddedSSHd.Port}
+		s.CliCfg.JumpHosts = []HostSpec{srv, srv}
+		var targets []string
+		var mut sync.Mutex
+		s.SrvCfg.DirectTCPIPHandler = func(user, target string) error {
+			mut.Lock()
+			targets = append(targets, target)
+			mut.Unlock()
+			return nil
+		}
+
+		// with nothing known, and nothing to be added, the first
+		// jump host is refused.
+		empty, err := NewKnownHosts(s.SrvCfg.Tempdir+"/jump_known_hosts", KHJson)
+		panicOn(err)
+		s.CliCfg.TestAllowOneshotConnect = false
+		s.CliCfg.AddIfNotKnown = false
+		connect := func() (*ssh.Client, error) {
+			halt := ssh.NewHalter()
+			cli, _, err := s.CliCfg.SSHConnect(context.Background(), empty, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+			return cli, err
+		}
+		_, err = connect()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "jump host")
+
+		// every hop's key goes past the verifiers.
+		var asked []string
+		s.CliCfg.HostKeyVerifiers = []HostKeyVerifier{func(ctx context.Context, hostname string, remote net.Addr, key ssh.PublicKey) (HostKeyVerdict, error) {
+			asked = append(asked, hostname)
+			return HostKeyAccept, nil
+		}}
+		cli, err := connect()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli, cv.ShouldNotBeNil)
+		addr := srv.HostPort()
+		cv.So(asked, cv.ShouldResemble, []string{addr, addr, addr})
+		mut.Lock()
+		cv.So(targets, cv.ShouldResemble, []string{addr, addr})
+		mut.Unlock()
+		cli.Close()
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test168CryptoConfigRestrictsTheAlgorithmsOffered(t *testing.T) {
+
+	cv.Convey("Crypto should set the ciphers, MACs, and key exchanges SSHConnect offers, so that an sshd with none in common is refused, and an algorithm xcryptossh does not know should be an ErrUnsupportedAlgorithm before dialing.", t, func() {
+
+		all := ssh.AllAlgorithms()
+		cv.So(stringInSlice("aes128-gcm@openssh.com", all.Ciphers), cv.ShouldBeTrue)
+		cv.So(stringInSlice("hmac-sha2-256", all.MACs), cv.ShouldBeTrue)
+		cv.So(stringInSlice("curve25519-sha256@libssh.org", all.KeyExchanges), cv.ShouldBeTrue)
+
+		bad := &CryptoConfig{Ciphers: []string{"aes128-gcm@openssh.com", "blowfish-cbc"}}
+		err := bad.Validate()
+		cv.So(errors.Is(err, ErrUnsupportedAlgorithm), cv.ShouldBeTrue)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "blowfish-cbc")
+		bad = &CryptoConfig{KeyExchanges: []string{"diffie-hellman-group-exchange-sha256"}}
+		cv.So(errors.Is(bad.Validate(), ErrUnsupportedAlgorithm), cv.ShouldBeTrue)
+		cv.So(splitCommaList(" aes128-ctr, ,aes256-ctr"), cv.ShouldResemble, []string{"aes128-ctr", "aes256-ctr"})
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		connect := func() error {
+			cli, _, err := s.CliCfg.SSHConnect(context.Background(), s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+				s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, ssh.NewHalter())
+			if cli != nil {
+				cli.Close()
+			}
+			return err
+		}
+
+		s.CliCfg.Crypto = CryptoConfig{Ciphers: []string{"no-such-cipher"}}
+		err = connect()
+		cv.So(errors.Is(err, ErrUnsupportedAlgorithm), cv.ShouldBeTrue)
+
+		// the test sshd takes only aes128-gcm and curve25519.
+		s.CliCfg.Crypto = CryptoConfig{Ciphers: []string{"aes256-ctr"}}
+		err = connect()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "no common algorithm")
+
+		s.CliCfg.Crypto = CryptoConfig{KeyExchanges: []string{"ecdh-sha2-nistp256"}}
+		err = connect()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "no common algorithm")
+
+		s.CliCfg.Crypto = CryptoConfig{
+			Ciphers:      []string{"aes128-gcm@openssh.com"},
+			MACs:         []string{"hmac-sha2-256"},
+			KeyExchanges: []string{"curve25519-sha256@libssh.org"},
+		}
+		cv.So(connect(), cv.ShouldBeNil)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test169ConnFilterVetsEachForwardConnection(t *testing.T) {
+
+	cv.Convey("ConnFilter should be asked, with the source address, about each connection the forward listener accepts, and one it refuses should be closed without being forwarded.", t, func() {
+
+		remote, err := net.Listen("tcp", "127.0.0.1:0")
+		panicOn(err)
+		defer remote.Close()
+		var forwarded int64
+		go func() {
+			for {
+				c, err := remote.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt64(&forwarded, 1)
+				fmt.Fprintf(c, "hello\n")
+				c.Close()
+			}
+		}()
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.CliCfg.LocalToRemote.Remote.Addr = remote.Addr().String()
+		cv.So(s.CliCfg.LocalToRemote.Remote.ParseAddr(), cv.ShouldBeNil)
+		s.CliCfg.Quiet = true
+		var mut sync.Mutex
+		var asked []net.Addr
+		s.CliCfg.ConnFilter = func(src net.Addr) bool {
+			mut.Lock()
+			defer mut.Unlock()
+			asked = append(asked, src)
+			// refuse the first, allow the rest.
+			return len(asked) > 1
+		}
+
+		halt := ssh.NewHalter()
+		_, _, err = s.CliCfg.SSHConnect(context.Background(), s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		readLine := func() (string, net.Addr) {
+			c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+			panicOn(err)
+			defer c.Close()
+			line, _ := bufio.NewReader(c).ReadString('\n')
+			return line, c.LocalAddr()
+		}
+		line, refusedSrc := readLine()
+		cv.So(line, cv.ShouldEqual, "")
+		line, allowedSrc := readLine()
+		cv.So(line, cv.ShouldEqual, "hello\n")
+		cv.So(atomic.LoadInt64(&forwarded), cv.ShouldEqual, 1)
+
+		mut.Lock()
+		cv.So(len(asked), cv.ShouldEqual, 2)
+		cv.So(asked[0].String(), cv.ShouldEqual, refusedSrc.String())
+		cv.So(asked[1].String(), cv.ShouldEqual, allowedSrc.String())
+		mut.Unlock()
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
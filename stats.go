@@ -0,0 +1,55 @@
+package sshego
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Stats holds cumulative counters for the outgoing
+// connections and tunnels made by one SshegoConfig.
+// Up is toward the sshd; Down is back from it.
+type Stats struct {
+	Connects        int64 // SSHConnect() calls that succeeded.
+	ConnectFailures int64 // SSHConnect() calls that dialed but failed.
+	Forwards        int64 // forward tunnel connections started.
+	Reverses        int64 // reverse tunnel connections started.
+	BytesUp         int64
+	BytesDown       int64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("Stats{Connects:%v, ConnectFailures:%v, Forwards:%v, Reverses:%v, BytesUp:%v, BytesDown:%v}",
+		s.Connects, s.ConnectFailures, s.Forwards, s.Reverses, s.BytesUp, s.BytesDown)
+}
+
+// Stats returns the cumulative counters since
+// cfg was created or last ResetStats().
+func (cfg *SshegoConfig) Stats() Stats {
+	c := &cfg.stats
+	return Stats{
+		Connects:        atomic.LoadInt64(&c.Connects),
+		ConnectFailures: atomic.LoadInt64(&c.ConnectFailures),
+		Forwards:        atomic.LoadInt64(&c.Forwards),
+		Reverses:        atomic.LoadInt64(&c.Reverses),
+		BytesUp:         atomic.LoadInt64(&c.BytesUp),
+		BytesDown:       atomic.LoadInt64(&c.BytesDown),
+	}
+}
+
+// ResetStats zeroes the counters and returns their
+// values just before the reset. Each counter is
+// swapped atomically, so an update racing with
+// ResetStats lands in exactly one interval: either
+// in the returned Stats or in the next Stats().
+// Scrape with ResetStats alone to lose nothing.
+func (cfg *SshegoConfig) ResetStats() Stats {
+	c := &cfg.stats
+	return Stats{
+		Connects:        atomic.SwapInt64(&c.Connects, 0),
+		ConnectFailures: atomic.SwapInt64(&c.ConnectFailures, 0),
+		Forwards:        atomic.SwapInt64(&c.Forwards, 0),
+		Reverses:        atomic.SwapInt64(&c.Reverses, 0),
+		BytesUp:         atomic.SwapInt64(&c.BytesUp, 0),
+		BytesDown:       atomic.SwapInt64(&c.BytesDown, 0),
+	}
+}
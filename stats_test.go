@@ -0,0 +1,244 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test116ResetStatsReturnsAndZeroesTheCounters(t *testing.T) {
+
+	cv.Convey("Stats() should count connects, forwards, and bytes each way; ResetStats() should hand back those totals and start a fresh interval from zero.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		serverDone := make(chan bool)
+		udpath := startBackgroundTestUnixDomainServer(
+			serverDone,
+			payloadByteCount,
+			confirmationPayload,
+			confirmationReply)
+		defer os.Remove(udpath)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.SrvCfg.AllowDirectStreamLocal = true
+		s.CliCfg.LocalToRemote.Remote.Addr = udpath
+		cv.So(s.CliCfg.LocalToRemote.Remote.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.Stats(), cv.ShouldResemble, Stats{})
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, "wrong-password", s.Totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		lsn, lsnPort := GetAvailPort()
+		defer lsn.Close()
+		browser, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", lsnPort))
+		panicOn(err)
+		defer browser.Close()
+		fromBrowser, err := lsn.Accept()
+		panicOn(err)
+
+		fwd := NewForward(ctx, s.CliCfg, cli, fromBrowser)
+		cv.So(fwd, cv.ShouldNotBeNil)
+		VerifyClientServerExchangeAcrossSshd(browser, confirmationPayload, confirmationReply, payloadByteCount)
+		<-serverDone
+
+		// the shovels count just after each write
+		// completes, so give them a moment.
+		var st Stats
+		for i := 0; i < 100; i++ {
+			st = s.CliCfg.Stats()
+			if st.BytesUp == int64(payloadByteCount) && st.BytesDown == int64(payloadByteCount) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cv.So(st.Connects, cv.ShouldEqual, 1)
+		cv.So(st.ConnectFailures, cv.ShouldEqual, 1)
+		cv.So(st.Forwards, cv.ShouldEqual, 1)
+		cv.So(st.Reverses, cv.ShouldEqual, 0)
+		cv.So(st.BytesUp, cv.ShouldEqual, payloadByteCount)
+		cv.So(st.BytesDown, cv.ShouldEqual, payloadByteCount)
+
+		cv.So(s.CliCfg.ResetStats(), cv.ShouldResemble, st)
+		cv.So(s.CliCfg.Stats(), cv.ShouldResemble, Stats{})
+
+		fwd.Close()
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test138DebugDumpListsOpenTunnelsAndTheirBytes(t *testing.T) {
+
+	cv.Convey("DebugDump() should describe the ssh connection and each open forward, with the bytes it has moved each way, and drop the forward once it is closed.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		serverDone := make(chan bool)
+		udpath := startBackgroundTestUnixDomainServer(
+			serverDone,
+			payloadByteCount,
+			confirmationPayload,
+			confirmationReply)
+		defer os.Remove(udpath)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.SrvCfg.AllowDirectStreamLocal = true
+		s.CliCfg.LocalToRemote.Remote.Addr = udpath
+		cv.So(s.CliCfg.LocalToRemote.Remote.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.DebugDump(), cv.ShouldContainSubstring, "ssh client: not connected")
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		lsn, lsnPort := GetAvailPort()
+		defer lsn.Close()
+		browser, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", lsnPort))
+		panicOn(err)
+		defer browser.Close()
+		fromBrowser, err := lsn.Accept()
+		panicOn(err)
+
+		fwd := NewForward(ctx, s.CliCfg, cli, fromBrowser)
+		cv.So(fwd, cv.ShouldNotBeNil)
+		VerifyClientServerExchangeAcrossSshd(browser, confirmationPayload, confirmationReply, payloadByteCount)
+		<-serverDone
+
+		want := fmt.Sprintf("up %v bytes, down %v bytes", payloadByteCount, payloadByteCount)
+		var dump string
+		for i := 0; i < 100; i++ {
+			dump = s.CliCfg.DebugDump()
+			if strings.Contains(dump, want) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cv.So(dump, cv.ShouldContainSubstring, "ssh client: connected")
+		cv.So(dump, cv.ShouldContainSubstring, "open tunnel connections: 1")
+		cv.So(dump, cv.ShouldContainSubstring, "forward "+browser.LocalAddr().String()+" -> "+udpath)
+		cv.So(dump, cv.ShouldContainSubstring, want)
+
+		fwd.Close()
+		for i := 0; i < 100; i++ {
+			dump = s.CliCfg.DebugDump()
+			if strings.Contains(dump, "open tunnel connections: 0") {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cv.So(dump, cv.ShouldContainSubstring, "open tunnel connections: 0")
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test150ForwarderAndReverseStatsCountEachDirection(t *testing.T) {
+
+	cv.Convey("Forwarder.Stats() and Reverse.Stats() should report the bytes carried up and down by that one tunnel, readable while it runs.", t, func() {
+
+		// answers 4 bytes with 6.
+		backend, port := GetAvailPort()
+		defer backend.Close()
+		go func() {
+			for {
+				c, err := backend.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					buf := make([]byte, 4)
+					if _, err := io.ReadFull(c, buf); err == nil {
+						c.Write([]byte("pong!!"))
+					}
+				}(c)
+			}
+		}()
+		exchange := func(c net.Conn, send string, want int) {
+			_, err := c.Write([]byte(send))
+			panicOn(err)
+			_, err = io.ReadFull(c, make([]byte, want))
+			panicOn(err)
+		}
+		settled := func(stats func() (int64, int64), up, down int64) bool {
+			for i := 0; i < 100; i++ {
+				u, d := stats()
+				if u == up && d == down {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+
+		// reverse: the sshd side sends 4, the local side replies 6.
+		cfg := NewSshegoConfig()
+		cfg.RemoteToLocal.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", port)
+		cv.So(cfg.RemoteToLocal.Remote.ParseAddr(), cv.ShouldBeNil)
+		remoteSide, fromRemote := net.Pipe()
+		rev, err := cfg.StartNewReverse(nil, fromRemote)
+		panicOn(err)
+		exchange(remoteSide, "ping", 6)
+		cv.So(settled(rev.Stats, 6, 4), cv.ShouldBeTrue)
+		rev.Close()
+
+		// forward: the local client sends 4, the remote replies 6.
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+		s.CliCfg.LocalToRemote.Listen.Addr = ""
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", port)
+		panicOn(s.CliCfg.LocalToRemote.Remote.ParseAddr())
+		s.CliCfg.DirectTcp = true
+		s.CliCfg.Quiet = true
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		client, fromBrowser := net.Pipe()
+		fwd := NewForward(ctx, s.CliCfg, cli, fromBrowser)
+		cv.So(fwd, cv.ShouldNotBeNil)
+		exchange(client, "ping", 6)
+		cv.So(settled(fwd.Stats, 4, 6), cv.ShouldBeTrue)
+		fwd.Close()
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,292 @@
+package sshego
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// streamLocalForwardMsg is the payload of the
+// "streamlocal-forward@openssh.com" and
+// "cancel-streamlocal-forward@openssh.com" global
+// requests, per openssh-portable/PROTOCOL section 2.4.
+type streamLocalForwardMsg struct {
+	SocketPath string
+}
+
+// forwardedStreamLocalMsg is the payload of the
+// "forwarded-streamlocal@openssh.com" channels that
+// we open back to the client for each connection made
+// to a forwarded socket.
+type forwardedStreamLocalMsg struct {
+	SocketPath string
+	Reserved0  string
+}
+
+// tcpipForwardMsg is the payload of the "tcpip-forward"
+// and "cancel-tcpip-forward" global requests, per
+// RFC 4254 section 7.1.
+type tcpipForwardMsg struct {
+	Addr  string
+	Rport uint32
+}
+
+// forwardedTCPMsg is the payload of the "forwarded-tcpip"
+// channels that we open back to the client for each
+// connection made to a forwarded port, per RFC 4254
+// section 7.2.
+type forwardedTCPMsg struct {
+	Addr       string
+	Rport      uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// remoteForwards tracks the unix-domain sockets and
+// tcp ports that one client connection has asked the
+// esshd to listen on, so they can be cancelled or
+// cleaned up when the connection goes away.
+type remoteForwards struct {
+	mut  sync.Mutex
+	lsns map[string]net.Listener
+	log  Logger
+
+	// gatewayPorts lets tcpip-forward bind other
+	// than loopback. See SshegoConfig.GatewayPorts.
+	gatewayPorts bool
+}
+
+// handleGlobalRequests services the global requests on one
+// esshd connection. It does what DiscardRequestsExceptKeepalives
+// does, and in addition, with AllowReverseStreamLocal, honors
+// streamlocal-forward requests by listening on the requested
+// unix-domain socket and tunneling each connection to it back
+// to the client. With AllowReverseTCP, tcpip-forward requests
+// are likewise honored for tcp ports.
+func (cfg *SshegoConfig) handleGlobalRequests(ctx context.Context, in <-chan *ssh.Request, sshConn ssh.Conn, reqStop chan struct{}) {
+
+	fwds := &remoteForwards{lsns: make(map[string]net.Listener), log: cfg.logger(), gatewayPorts: cfg.GatewayPorts}
+	defer fwds.closeAll()
+
+	for {
+		select {
+		case req, stillOpen := <-in:
+			if !stillOpen {
+				return
+			}
+			if req == nil {
+				continue
+			}
+			switch req.Type {
+			case "streamlocal-forward@openssh.com":
+				ok := cfg.AllowReverseStreamLocal && fwds.listen(ctx, req.Payload, sshConn, cfg.Halt)
+				if req.WantReply {
+					req.Reply(ok, nil)
+				}
+			case "cancel-streamlocal-forward@openssh.com":
+				ok := cfg.AllowReverseStreamLocal && fwds.cancel(req.Payload)
+				if req.WantReply {
+					req.Reply(ok, nil)
+				}
+			case "tcpip-forward":
+				var ok bool
+				var reply []byte
+				if cfg.AllowReverseTCP {
+					ok, reply = fwds.listenTCP(ctx, req.Payload, sshConn, cfg.Halt)
+				}
+				if req.WantReply {
+					req.Reply(ok, reply)
+				}
+			case "cancel-tcpip-forward":
+				ok := cfg.AllowReverseTCP && fwds.cancelTCP(req.Payload)
+				if req.WantReply {
+					req.Reply(ok, nil)
+				}
+			default:
+				if req.WantReply {
+					replyToKeepalive(req)
+				}
+			}
+		case <-sshConn.Done():
+			return
+		case <-reqStop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *remoteForwards) listen(ctx context.Context, payload []byte, sshConn ssh.Conn, halt *ssh.Halter) bool {
+	var m streamLocalForwardMsg
+	if err := ssh.Unmarshal(payload, &m); err != nil || m.SocketPath == "" {
+		return false
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if _, already := f.lsns[m.SocketPath]; already {
+		return false
+	}
+	lsn, err := net.Listen("unix", m.SocketPath)
+	if err != nil {
+		f.log.Errorf("esshd: streamlocal-forward could not listen on '%s': %s", m.SocketPath, err)
+		return false
+	}
+	f.lsns[m.SocketPath] = lsn
+	f.log.Infof("esshd: streamlocal-forward listening on unix domain socket '%s'", m.SocketPath)
+
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				// closed by cancel or connection teardown.
+				return
+			}
+			go f.forwardStreamLocal(ctx, conn, m.SocketPath, sshConn, halt)
+		}
+	}()
+	return true
+}
+
+func (f *remoteForwards) cancel(payload []byte) bool {
+	var m streamLocalForwardMsg
+	if err := ssh.Unmarshal(payload, &m); err != nil {
+		return false
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	lsn, ok := f.lsns[m.SocketPath]
+	if !ok {
+		return false
+	}
+	delete(f.lsns, m.SocketPath)
+	lsn.Close()
+	return true
+}
+
+// listenTCP honors a tcpip-forward request. When the client
+// asked for port 0, the reply carries the port we got. Unless
+// gatewayPorts, an address other than loopback is bound on
+// 127.0.0.1 instead, as OpenSSH does with GatewayPorts no.
+func (f *remoteForwards) listenTCP(ctx context.Context, payload []byte, sshConn ssh.Conn, halt *ssh.Halter) (bool, []byte) {
+	var m tcpipForwardMsg
+	if err := ssh.Unmarshal(payload, &m); err != nil || m.Rport > 65535 {
+		return false, nil
+	}
+	bindAddr := m.Addr
+	if !f.gatewayPorts && !isLoopbackHost(m.Addr) {
+		bindAddr = "127.0.0.1"
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	lsn, err := net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(int(m.Rport))))
+	if err != nil {
+		f.log.Errorf("esshd: tcpip-forward could not listen on '%s' port %v: %s", bindAddr, m.Rport, err)
+		return false, nil
+	}
+	port := uint32(lsn.Addr().(*net.TCPAddr).Port)
+	f.lsns[tcpipForwardKey(m.Addr, port)] = lsn
+	f.log.Infof("esshd: tcpip-forward listening on '%s'", lsn.Addr())
+
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				// closed by cancel or connection teardown.
+				return
+			}
+			go f.forwardTCP(ctx, conn, m.Addr, port, sshConn, halt)
+		}
+	}()
+
+	var reply []byte
+	if m.Rport == 0 {
+		reply = ssh.Marshal(&struct{ Port uint32 }{port})
+	}
+	return true, reply
+}
+
+func (f *remoteForwards) cancelTCP(payload []byte) bool {
+	var m tcpipForwardMsg
+	if err := ssh.Unmarshal(payload, &m); err != nil {
+		return false
+	}
+	key := tcpipForwardKey(m.Addr, m.Rport)
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	lsn, ok := f.lsns[key]
+	if !ok {
+		return false
+	}
+	delete(f.lsns, key)
+	lsn.Close()
+	return true
+}
+
+// isLoopbackHost reports whether host, as given in a
+// tcpip-forward request, names the loopback interface.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// tcpipForwardKey keeps tcp forwards apart from
+// the unix-domain socket paths in lsns.
+func tcpipForwardKey(addr string, port uint32) string {
+	return "tcp:" + net.JoinHostPort(addr, strconv.Itoa(int(port)))
+}
+
+func (f *remoteForwards) closeAll() {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for path, lsn := range f.lsns {
+		lsn.Close()
+		delete(f.lsns, path)
+	}
+}
+
+// forwardStreamLocal tunnels conn, accepted on the
+// forwarded socket at path, back to the client.
+func (f *remoteForwards) forwardStreamLocal(ctx context.Context, conn net.Conn, path string, sshConn ssh.Conn, halt *ssh.Halter) {
+	msg := forwardedStreamLocalMsg{SocketPath: path}
+	ch, reqs, err := sshConn.OpenChannel(ctx, "forwarded-streamlocal@openssh.com", ssh.Marshal(&msg), halt)
+	if err != nil {
+		f.log.Errorf("esshd: could not open forwarded-streamlocal channel for '%s': %s", path, err)
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(ctx, reqs, halt)
+
+	sp := newShovelPair(false)
+	halt.AddDownstream(sp.Halt)
+	sp.Start(conn, ch, "fromClient<-forwardedSocket", "forwardedSocket<-fromClient")
+}
+
+// forwardTCP tunnels conn, accepted on the forwarded
+// port, back to the client as a forwarded-tcpip channel.
+func (f *remoteForwards) forwardTCP(ctx context.Context, conn net.Conn, addr string, port uint32, sshConn ssh.Conn, halt *ssh.Halter) {
+	msg := forwardedTCPMsg{Addr: addr, Rport: port}
+	if origin, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		msg.OriginAddr = origin.IP.String()
+		msg.OriginPort = uint32(origin.Port)
+	}
+	ch, reqs, err := sshConn.OpenChannel(ctx, "forwarded-tcpip", ssh.Marshal(&msg), halt)
+	if err != nil {
+		f.log.Errorf("esshd: could not open forwarded-tcpip channel for '%s': %s", conn.LocalAddr(), err)
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(ctx, reqs, halt)
+
+	sp := newShovelPair(false)
+	halt.AddDownstream(sp.Halt)
+	sp.Start(conn, ch, "fromClient<-forwardedPort", "forwardedPort<-fromClient")
+}
@@ -177,6 +177,22 @@ func WaitUntilAddrAvailable(addr string, dur time.Duration, tries int) int {
 	return -1
 }
 
+// WaitUntilAddrListening returns -1 if nobody was
+// accepting tcp connections on addr after tries sleeps
+// of dur time. Otherwise it returns the number of
+// tries it took.
+func WaitUntilAddrListening(addr string, dur time.Duration, tries int) int {
+	for i := 0; i < tries; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return i
+		}
+		time.Sleep(dur)
+	}
+	return -1
+}
+
 func IsAlreadyBound(addr string) bool {
 
 	ln, err := net.Listen("tcp", addr)
@@ -0,0 +1,33 @@
+package sshego
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// tfoQueueLen is how many TCP Fast Open requests a
+// listener holds pending before new clients fall back
+// to the ordinary three-way handshake.
+const tfoQueueLen = 256
+
+// listenTCP is net.ListenTCP, but with TCP Fast Open
+// turned on if cfg.TCPFastOpen and the platform has it.
+func (cfg *SshegoConfig) listenTCP(laddr *net.TCPAddr) (net.Listener, error) {
+	var lc net.ListenConfig
+	if cfg.TCPFastOpen {
+		lc.Control = tfoListenControl
+	}
+	return lc.Listen(context.Background(), "tcp", laddr.String())
+}
+
+// dialer returns a net.Dialer with timeout that, if
+// cfg.TCPFastOpen and the platform has it, sends its
+// first data along with the SYN.
+func (cfg *SshegoConfig) dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if cfg.TCPFastOpen {
+		d.Control = tfoDialControl
+	}
+	return d
+}
@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+package sshego
+
+import (
+	"syscall"
+)
+
+// from linux/tcp.h; package syscall lacks them.
+const (
+	tcpFastOpen        = 23
+	tcpFastOpenConnect = 30
+)
+
+// tfoListenControl turns on TCP Fast Open for a listener.
+// A kernel that refuses, say with net.ipv4.tcp_fastopen
+// off, leaves the listener working without it.
+func tfoListenControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, tfoQueueLen)
+		if err != nil {
+			p("sshego: TCP Fast Open not available on %s listener %s: %s", network, address, err)
+		}
+	})
+}
+
+// tfoDialControl turns on TCP Fast Open for an outgoing
+// connection, on the same terms as tfoListenControl.
+func tfoDialControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+		if err != nil {
+			p("sshego: TCP Fast Open not available dialing %s %s: %s", network, address, err)
+		}
+	})
+}
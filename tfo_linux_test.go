@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package sshego
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test142TCPFastOpenSetsTheSocketOptions(t *testing.T) {
+
+	cv.Convey("With TCPFastOpen, listenTCP should set TCP_FASTOPEN on the listener and dialer() TCP_FASTOPEN_CONNECT on the dial, and the two should still talk.", t, func() {
+
+		cfg := NewSshegoConfig()
+		cfg.TCPFastOpen = true
+
+		sockopt := func(sc syscall.Conn, opt int) int {
+			rc, err := sc.SyscallConn()
+			panicOn(err)
+			var v int
+			var gerr error
+			panicOn(rc.Control(func(fd uintptr) {
+				v, gerr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+			}))
+			panicOn(gerr)
+			return v
+		}
+
+		ln, err := cfg.listenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+		cv.So(err, cv.ShouldBeNil)
+		defer ln.Close()
+		cv.So(sockopt(ln.(*net.TCPListener), tcpFastOpen), cv.ShouldEqual, tfoQueueLen)
+
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(c, c)
+			c.Close()
+		}()
+		c, err := cfg.dialer(10*time.Second).Dial("tcp", ln.Addr().String())
+		cv.So(err, cv.ShouldBeNil)
+		defer c.Close()
+		cv.So(sockopt(c.(*net.TCPConn), tcpFastOpenConnect), cv.ShouldEqual, 1)
+
+		_, err = c.Write([]byte("ping"))
+		cv.So(err, cv.ShouldBeNil)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(c, buf)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(buf), cv.ShouldEqual, "ping")
+
+		// off by default.
+		plain, err := NewSshegoConfig().listenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+		cv.So(err, cv.ShouldBeNil)
+		defer plain.Close()
+		cv.So(sockopt(plain.(*net.TCPListener), tcpFastOpen), cv.ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package sshego
+
+import (
+	"syscall"
+)
+
+// TCP Fast Open is only wired up on linux;
+// elsewhere TCPFastOpen changes nothing.
+var (
+	tfoListenControl func(network, address string, c syscall.RawConn) error
+	tfoDialControl   func(network, address string, c syscall.RawConn) error
+)
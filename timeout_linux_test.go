@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package sshego
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// blackholeListener listens on loopback with a backlog of
+// zero, and fills it, so that later dials to its address
+// hang as though to an unreachable host.
+func blackholeListener() (addr *net.TCPAddr, closer func()) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	panicOn(err)
+	panicOn(syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	panicOn(syscall.Listen(fd, 0))
+	sa, err := syscall.Getsockname(fd)
+	panicOn(err)
+	addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*syscall.SockaddrInet4).Port}
+	filler, err := net.Dial("tcp", addr.String())
+	panicOn(err)
+	return addr, func() {
+		filler.Close()
+		syscall.Close(fd)
+	}
+}
+
+func Test167ConnectTimeoutBoundsTheTCPDial(t *testing.T) {
+
+	cv.Convey("With ConnectTimeout set, an SSHConnect to an sshd that never answers the SYN should give up after ConnectTimeout with ErrConnectTimeout, rather than wait on the OS.", t, func() {
+
+		addr, closer := blackholeListener()
+		defer closer()
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.CliCfg.ConnectTimeout = 300 * time.Millisecond
+		halt := ssh.NewHalter()
+		defer halt.RequestStop()
+		t0 := time.Now()
+		_, _, err := s.CliCfg.SSHConnect(context.Background(), s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			"127.0.0.1", int64(addr.Port), s.Pw, s.Totp, halt)
+		elap := time.Since(t0)
+		cv.So(errors.Is(err, ErrConnectTimeout), cv.ShouldBeTrue)
+		cv.So(err.Error(), cv.ShouldContainSubstring, fmt.Sprintf("dial to '%s'", addr))
+		cv.So(elap, cv.ShouldBeGreaterThanOrEqualTo, 300*time.Millisecond)
+		cv.So(elap, cv.ShouldBeLessThan, 5*time.Second)
+
+		// a refused dial is not a timeout.
+		ln, port := GetAvailPort()
+		ln.Close()
+		_, _, err = s.CliCfg.SSHConnect(context.Background(), s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			"127.0.0.1", int64(port), s.Pw, s.Totp, ssh.NewHalter())
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(errors.Is(err, ErrConnectTimeout), cv.ShouldBeFalse)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,186 @@
+package sshego
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TunnelTopology is a snapshot of everything that one
+// SshegoConfig has set up, with the live status of each
+// part, for a dashboard to draw. It holds only plain
+// exported fields, so encoding/json can serialize it as is.
+// See Topology().
+type TunnelTopology struct {
+	Name string
+	At   time.Time
+
+	// SSH is our outgoing connection to the sshd,
+	// or nil if none has been asked for.
+	SSH *SSHNode
+
+	// Listeners are the forward, reverse and SOCKS
+	// listeners configured; Conns the connections
+	// open through them now, oldest first.
+	Listeners []ListenerNode
+	Conns     []ConnNode
+
+	// Esshd is the embedded sshd, or nil if none.
+	Esshd *EsshdNode
+}
+
+// SSHNode is the ssh connection in a TunnelTopology.
+// Status is "connected", "connecting" while SSHConnect
+// is at work, or "down".
+type SSHNode struct {
+	Server        string
+	Status        string
+	LocalAddr     string
+	RemoteAddr    string
+	ServerVersion string
+}
+
+// ListenerNode is one listener in a TunnelTopology.
+// Kind is "forward" (Listen -> sshd -> Remote),
+// "reverse" (Listen, on the sshd, -> Remote, here), or
+// "socks" (Listen -> sshd -> where each client asks).
+// Status is "listening", "paused" while the forward's
+// breaker is tripped, or "down".
+type ListenerNode struct {
+	Kind   string
+	Listen string
+	Remote string
+	Status string
+}
+
+// ConnNode is one open tunnel connection in a
+// TunnelTopology. Up is toward the sshd. Status
+// is "running" or "stopping".
+type ConnNode struct {
+	Kind      string
+	Local     string
+	Remote    string
+	Started   time.Time
+	BytesUp   int64
+	BytesDown int64
+	Status    string
+}
+
+// EsshdNode is the embedded sshd in a TunnelTopology.
+// Status is "running", "stopping" or "stopped".
+type EsshdNode struct {
+	Addr   string
+	Status string
+}
+
+// Topology gathers the ssh connection, the listeners,
+// the open tunnel connections and the embedded sshd of
+// cfg into one TunnelTopology. Like DebugDump, it never
+// waits on a connect in progress.
+func (cfg *SshegoConfig) Topology() TunnelTopology {
+	now := time.Now()
+	top := TunnelTopology{
+		Name: cfg.Nickname,
+		At:   now,
+	}
+
+	node := &SSHNode{Server: cfg.SSHdServer.Addr, Status: "down"}
+	// SSHConnect holds cfg.Mut throughout.
+	if cfg.Mut.TryLock() {
+		cli, nc := cfg.SshClient, cfg.Underlying
+		cfg.Mut.Unlock()
+		if cli != nil {
+			node.Status = "connected"
+			node.ServerVersion = string(cli.ServerVersion())
+			if nc != nil {
+				node.LocalAddr = nc.LocalAddr().String()
+				node.RemoteAddr = nc.RemoteAddr().String()
+			}
+		}
+	} else {
+		node.Status = "connecting"
+	}
+	if node.Server != "" || node.Status != "down" {
+		top.SSH = node
+	}
+	connected := node.Status == "connected"
+	status := func(up bool) string {
+		if up {
+			return "listening"
+		}
+		return "down"
+	}
+
+	if cfg.LocalToRemote.Listen.Addr != "" {
+		cfg.fwdLnMu.Lock()
+		up := cfg.fwdLn != nil && cfg.fwdCtx != nil && cfg.fwdCtx.Err() == nil
+		cfg.fwdLnMu.Unlock()
+		st := status(up && connected)
+		if open, _ := cfg.breakerOpen(&cfg.LocalToRemote, now); st == "listening" && open > 0 {
+			st = "paused"
+		}
+		top.Listeners = append(top.Listeners, ListenerNode{
+			Kind:   "forward",
+			Listen: cfg.LocalToRemote.Listen.Addr,
+			Remote: cfg.LocalToRemote.Remote.Addr,
+			Status: st,
+		})
+	}
+	// the others live as long as the
+	// ssh connection they were made on.
+	for i := range cfg.LocalToRemotes {
+		spec := &cfg.LocalToRemotes[i]
+		st := status(connected)
+		if open, _ := cfg.breakerOpen(spec, now); st == "listening" && open > 0 {
+			st = "paused"
+		}
+		top.Listeners = append(top.Listeners, ListenerNode{
+			Kind:   "forward",
+			Listen: spec.Listen.Addr,
+			Remote: spec.Remote.Addr,
+			Status: st,
+		})
+	}
+	reverses := cfg.RemoteToLocals
+	if cfg.RemoteToLocal.Listen.Addr != "" {
+		reverses = append([]TunnelSpec{cfg.RemoteToLocal}, reverses...)
+	}
+	for _, spec := range reverses {
+		top.Listeners = append(top.Listeners, ListenerNode{
+			Kind:   "reverse",
+			Listen: spec.Listen.Addr,
+			Remote: spec.Remote.Addr,
+			Status: status(connected),
+		})
+	}
+	if cfg.DynamicSOCKS.Addr != "" {
+		top.Listeners = append(top.Listeners, ListenerNode{
+			Kind:   "socks",
+			Listen: cfg.DynamicSOCKS.Addr,
+			Status: status(connected),
+		})
+	}
+
+	for _, lt := range cfg.live.snapshot() {
+		top.Conns = append(top.Conns, ConnNode{
+			Kind:      lt.kind,
+			Local:     lt.local.String(),
+			Remote:    lt.remote.String(),
+			Started:   lt.started,
+			BytesUp:   atomic.LoadInt64(&lt.up.written),
+			BytesDown: atomic.LoadInt64(&lt.down.written),
+			Status:    lt.state(),
+		})
+	}
+
+	if e := cfg.Esshd; e != nil {
+		st := "running"
+		switch {
+		case e.Halt.IsDone():
+			st = "stopped"
+		case e.Halt.IsStopRequested():
+			st = "stopping"
+		}
+		top.Esshd = &EsshdNode{Addr: cfg.EmbeddedSSHd.Addr, Status: st}
+	}
+	return top
+}
@@ -0,0 +1,97 @@
+package sshego
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test143TopologyShowsConnectionListenersConnsAndEsshd(t *testing.T) {
+
+	cv.Convey("Topology() should report the ssh connection, the forward listener, each open forward with its bytes, and the embedded sshd, each with its status, and serialize to JSON.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		go func() {
+			for {
+				c, err := target.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					io.Copy(c, c)
+				}(c)
+			}
+		}()
+		s.CliCfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		s.CliCfg.Quiet = true
+
+		top := s.CliCfg.Topology()
+		cv.So(top.Conns, cv.ShouldBeEmpty)
+		cv.So(top.Esshd, cv.ShouldBeNil)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		c, err := net.Dial("tcp", s.CliCfg.LocalToRemote.Listen.Addr)
+		panicOn(err)
+		defer c.Close()
+		_, err = c.Write([]byte("hello"))
+		panicOn(err)
+		_, err = io.ReadFull(c, make([]byte, 5))
+		panicOn(err)
+
+		for i := 0; i < 100; i++ {
+			top = s.CliCfg.Topology()
+			if len(top.Conns) == 1 && top.Conns[0].BytesDown == 5 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cv.So(top.SSH, cv.ShouldNotBeNil)
+		cv.So(top.SSH.Status, cv.ShouldEqual, "connected")
+		cv.So(top.SSH.RemoteAddr, cv.ShouldEqual, s.SrvCfg.EmbeddedSSHd.Addr)
+		cv.So(top.Listeners, cv.ShouldResemble, []ListenerNode{{
+			Kind:   "forward",
+			Listen: s.CliCfg.LocalToRemote.Listen.Addr,
+			Remote: s.CliCfg.LocalToRemote.Remote.Addr,
+			Status: "listening",
+		}})
+		cv.So(len(top.Conns), cv.ShouldEqual, 1)
+		cv.So(top.Conns[0].Kind, cv.ShouldEqual, "forward")
+		cv.So(top.Conns[0].Local, cv.ShouldEqual, c.LocalAddr().String())
+		cv.So(top.Conns[0].BytesUp, cv.ShouldEqual, 5)
+		cv.So(top.Conns[0].BytesDown, cv.ShouldEqual, 5)
+		cv.So(top.Conns[0].Status, cv.ShouldEqual, "running")
+
+		by, err := json.Marshal(top)
+		cv.So(err, cv.ShouldBeNil)
+		var back TunnelTopology
+		cv.So(json.Unmarshal(by, &back), cv.ShouldBeNil)
+		cv.So(back.Listeners, cv.ShouldResemble, top.Listeners)
+
+		srvTop := s.SrvCfg.Topology()
+		cv.So(srvTop.Esshd, cv.ShouldResemble, &EsshdNode{Addr: s.SrvCfg.EmbeddedSSHd.Addr, Status: "running"})
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+		cv.So(s.SrvCfg.Topology().Esshd.Status, cv.ShouldEqual, "stopped")
+	})
+}
@@ -0,0 +1,79 @@
+package sshego
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConnectTrace records how long each phase of
+// establishing a client connection took in SSHConnect().
+// Use it to tell whether a slow connect is due
+// to the network (TCPDial), the key exchange (Kex),
+// or authentication (Auth).
+//
+// Each duration is measured from the end of the
+// previous phase, so they sum to approximately Total.
+// A zero duration means that phase was not reached.
+type ConnectTrace struct {
+	HostPort string
+
+	// Start is when SSHConnect() began dialing.
+	Start time.Time
+
+	// TCPDial is the time to establish the TCP connection.
+	TCPDial time.Duration
+
+	// Kex is the time for the ssh version exchange and
+	// key exchange, up to the host key being verified.
+	Kex time.Duration
+
+	// Auth is the time for user authentication.
+	Auth time.Duration
+
+	// AuthMethods lists the methods the sshd accepted,
+	// in order, e.g. ["publickey", "keyboard-interactive"].
+	AuthMethods []string
+
+	// ListenerReady is the time to get the forward
+	// or reverse listener(s) up, if any were requested.
+	ListenerReady time.Duration
+
+	// Total is the wall-clock time from Start
+	// until SSHConnect() returned.
+	Total time.Duration
+
+	// Err is the error, if any, that SSHConnect() returned.
+	Err error
+
+	last time.Time
+}
+
+// ConnectTraceHook, if set on the SshegoConfig,
+// is called once at the end of every SSHConnect()
+// attempt that dials out, successful or not.
+type ConnectTraceHook func(tr *ConnectTrace)
+
+func newConnectTrace(hostport string) *ConnectTrace {
+	now := time.Now()
+	return &ConnectTrace{
+		HostPort: hostport,
+		Start:    now,
+		last:     now,
+	}
+}
+
+// lap returns the time since the previous lap, and
+// resets the lap timer. Safe to call on a nil trace.
+func (tr *ConnectTrace) lap() time.Duration {
+	if tr == nil {
+		return 0
+	}
+	now := time.Now()
+	d := now.Sub(tr.last)
+	tr.last = now
+	return d
+}
+
+func (tr *ConnectTrace) String() string {
+	return fmt.Sprintf("ConnectTrace{HostPort:%s, TCPDial:%v, Kex:%v, Auth:%v, AuthMethods:%v, ListenerReady:%v, Total:%v, Err:%v}", tr.HostPort, tr.TCPDial, tr.Kex, tr.Auth, tr.AuthMethods, tr.ListenerReady, tr.Total, tr.Err)
+}
@@ -0,0 +1,55 @@
+package sshego
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test103ConnectTraceRecordsPhases(t *testing.T) {
+
+	cv.Convey("SSHConnect should record the TCP dial, KEX, auth, and listener-ready timings, and hand them to the ConnectTraceHook.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		var hooked *ConnectTrace
+		s.CliCfg.ConnectTraceHook = func(tr *ConnectTrace) {
+			hooked = tr
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		tr := s.CliCfg.LastConnectTrace
+		cv.So(tr, cv.ShouldNotBeNil)
+		cv.So(hooked, cv.ShouldEqual, tr)
+		cv.So(tr.Err, cv.ShouldBeNil)
+		cv.So(tr.TCPDial, cv.ShouldBeGreaterThan, 0)
+		cv.So(tr.Kex, cv.ShouldBeGreaterThan, 0)
+		cv.So(tr.Auth, cv.ShouldBeGreaterThan, 0)
+		cv.So(tr.AuthMethods, cv.ShouldResemble, []string{"keyboard-interactive"})
+		cv.So(tr.ListenerReady, cv.ShouldBeGreaterThan, 0)
+		cv.So(tr.Total, cv.ShouldBeGreaterThanOrEqualTo, tr.TCPDial+tr.Kex+tr.Auth+tr.ListenerReady)
+
+		// a failed auth should still be traced, with the error.
+		_, _, err = s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, "", "", halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(s.CliCfg.LastConnectTrace, cv.ShouldNotEqual, tr)
+		cv.So(s.CliCfg.LastConnectTrace.Err, cv.ShouldEqual, err)
+		cv.So(s.CliCfg.LastConnectTrace.Kex, cv.ShouldBeGreaterThan, 0)
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -72,7 +74,7 @@ func NewTricorder(dc *DialConfig, halt *ssh.Halter, name string) (tri *Tricorder
 	if err != nil {
 		return nil, err
 	}
-	sshdHostPort := fmt.Sprintf("%v:%v", dc.Sshdhost, dc.Sshdport)
+	sshdHostPort := net.JoinHostPort(dc.Sshdhost, strconv.FormatInt(dc.Sshdport, 10))
 
 	tri = &Tricorder{
 		Name:         name,
@@ -154,7 +156,7 @@ func (t *Tricorder) startReconnectLoop() error {
 			case <-t.Halt.ReqStopChan():
 				return
 			case uhp := <-t.reconnectNeededCh:
-				pp("%s Tricorder sees reconnectNeeded to '%#v'!!", uhp, t.Name)
+				t.cfg.logger().Debugf("%s Tricorder sees reconnectNeeded to '%#v'!!", uhp, t.Name)
 
 				if uhp.User != t.uhp.User {
 					panic(fmt.Sprintf("%s yikes, bad! uhp from reconnectNeededChan asks for change of user: '%v' != '%v' previous", t.Name, uhp.User, t.uhp.User))
@@ -164,7 +166,7 @@ func (t *Tricorder) startReconnectLoop() error {
 				}
 				now := time.Now()
 				if now.Sub(t.lastConnectTime) < time.Second {
-					pp("%s Tricorder ignoring reconnectNeeded within "+
+					t.cfg.logger().Debugf("%s Tricorder ignoring reconnectNeeded within "+
 						"1 second of successful connection.", t.Name)
 					continue
 				}
@@ -191,7 +193,7 @@ func (t *Tricorder) startReconnectLoop() error {
 				// provide current state
 			case t.getCliCh <- t.cli:
 			case t.getNcCh <- t.nc:
-				pp("%s tri sent t.nc='%#v'", t.Name, t.nc)
+				t.cfg.logger().Debugf("%s tri sent t.nc='%#v'", t.Name, t.nc)
 
 				// bring up a new channel
 			case tk := <-t.getChannelCh:
@@ -205,7 +207,7 @@ func (t *Tricorder) startReconnectLoop() error {
 // only reconnect, don't open any new channels!
 func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 
-	pp("%s Tricorder.helperNewClientConnect starting! t.uhp='%#v'.", t.Name, t.uhp)
+	t.cfg.logger().Debugf("%s Tricorder.helperNewClientConnect starting! t.uhp='%#v'.", t.Name, t.uhp)
 
 	defer func() {
 		if err != nil {
@@ -237,7 +239,7 @@ func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 	var okCtx context.Context
 
 	for i := 0; i < tries; i++ {
-		pp("%s Tricorder.helperNewClientConnect() calling t.dc.Dial(), i=%v", t.Name, i)
+		t.cfg.logger().Debugf("%s Tricorder.helperNewClientConnect() calling t.dc.Dial(), i=%v", t.Name, i)
 
 		// check for shutdown request
 		select {
@@ -275,12 +277,14 @@ func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 				return err
 			}
 			if strings.Contains(errs, "getsockopt: connection refused") {
-				pp("%s Tricorder.helperNewClientConnect: ignoring 'connection refused' and retrying after %v. connecting to '%#v'", t.Name, pause, t.uhp)
-				time.Sleep(pause)
+				wait := t.cfg.jitter(pause)
+				t.cfg.logger().Debugf("%s Tricorder.helperNewClientConnect: ignoring 'connection refused' and retrying after %v. connecting to '%#v'", t.Name, wait, t.uhp)
+				time.Sleep(wait)
 				continue
 			}
-			pp("%s Tricorder: err = '%v'. retrying after %v", t.Name, err, pause)
-			time.Sleep(pause)
+			wait := t.cfg.jitter(pause)
+			t.cfg.logger().Debugf("%s Tricorder: err = '%v'. retrying after %v", t.Name, err, wait)
+			time.Sleep(wait)
 			continue
 		}
 	} // end i over tries
@@ -291,7 +295,7 @@ func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 	if err != nil {
 		return err
 	}
-	pp("good: %s Tricorder.helperNewClientConnect succeeded to '%#v'.", t.Name, t.uhp)
+	t.cfg.logger().Debugf("good: %s Tricorder.helperNewClientConnect succeeded to '%#v'.", t.Name, t.uhp)
 	t.cli = sshcli
 	if t.cli != nil {
 		t.nc = t.cli.NcCloser()
@@ -301,15 +305,32 @@ func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 	return nil
 }
 
+// DefaultReconnectJitter is the default
+// of the -reconnect-jitter flag.
+const DefaultReconnectJitter = 0.2
+
+// jitter scales pause by a random factor in
+// [1-j, 1+j], where j is cfg.ReconnectJitter.
+func (cfg *SshegoConfig) jitter(pause time.Duration) time.Duration {
+	j := cfg.ReconnectJitter
+	switch {
+	case j <= 0:
+		return pause
+	case j > 1:
+		j = 1
+	}
+	return time.Duration(float64(pause) * (1 + j*(2*rand.Float64()-1)))
+}
+
 func (t *Tricorder) helperGetChannel(tk *getChannelTicket) {
 
-	pp("%s Tricorder.helperGetChannel starting! t.uhp='%#v'", t.Name, t.uhp)
+	t.cfg.logger().Debugf("%s Tricorder.helperGetChannel starting! t.uhp='%#v'", t.Name, t.uhp)
 
 	var ch ssh.Channel
 	var in <-chan *ssh.Request
 	var err error
 	if t.cli == nil {
-		pp("%s Tricorder.helperGetChannel: saw nil cli, so making new client", t.Name)
+		t.cfg.logger().Debugf("%s Tricorder.helperGetChannel: saw nil cli, so making new client", t.Name)
 		err = t.helperNewClientConnect(tk.ctx)
 		if err != nil {
 			tk.err = err
@@ -318,13 +339,13 @@ func (t *Tricorder) helperGetChannel(tk *getChannelTicket) {
 		}
 	}
 
-	pp("%s Tricorder.helperGetChannel: had cli already, so calling t.cli.Dial()", t.Name)
+	t.cfg.logger().Debugf("%s Tricorder.helperGetChannel: had cli already, so calling t.cli.Dial()", t.Name)
 	discardCtx, discardCtxCancel := context.WithCancel(tk.ctx)
 
 	if tk.typ == "direct-tcpip" {
 		hp := strings.Trim(tk.targetHostPort, "\n\r\t ")
 
-		pp("%s Tricorder.helperGetChannel dialing hp='%v'", t.Name, hp)
+		t.cfg.logger().Debugf("%s Tricorder.helperGetChannel dialing hp='%v'", t.Name, hp)
 		ch, err = t.cli.DialWithContext(discardCtx, "tcp", hp)
 
 	} else {
@@ -1,5 +1,13 @@
 package sshego
 
+import (
+	"flag"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
 // Going through a NAT, if
 // origin -> dest is established by origin
 // initiating, then how do we know at dest
@@ -9,3 +17,33 @@ package sshego
 // it is available to us, we should be able
 // to use it to open new channels to speak
 // with origin directly as needed.
+
+func Test128ReconnectJitterSpreadsRetryPauses(t *testing.T) {
+
+	cv.Convey("Reconnect pauses should be scaled by a random factor within the ReconnectJitter fraction, which the -reconnect-jitter flag defaults to DefaultReconnectJitter, and left alone when jitter is zero or negative.", t, func() {
+		cfg := NewSshegoConfig()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg.DefineFlags(fs)
+		panicOn(fs.Parse(nil))
+		cv.So(cfg.ReconnectJitter, cv.ShouldEqual, DefaultReconnectJitter)
+		pause := time.Second
+
+		for _, frac := range []float64{DefaultReconnectJitter, 0.5} {
+			cfg.ReconnectJitter = frac
+			lo := time.Duration(float64(pause) * (1 - frac))
+			hi := time.Duration(float64(pause) * (1 + frac))
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 100; i++ {
+				d := cfg.jitter(pause)
+				cv.So(d, cv.ShouldBeBetweenOrEqual, lo, hi)
+				seen[d] = true
+			}
+			cv.So(len(seen), cv.ShouldBeGreaterThan, 50)
+		}
+
+		cfg.ReconnectJitter = 0
+		cv.So(cfg.jitter(pause), cv.ShouldEqual, pause)
+		cfg.ReconnectJitter = -1
+		cv.So(cfg.jitter(pause), cv.ShouldEqual, pause)
+	})
+}
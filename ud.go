@@ -3,7 +3,9 @@ package sshego
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"os"
 	"time"
 
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
@@ -97,3 +99,38 @@ func (t *unixDomainChanConn) SetReadDeadline(deadline time.Time) error {
 func (t *unixDomainChanConn) SetWriteDeadline(deadline time.Time) error {
 	return errors.New("ssh: unixDomainChanConn: deadline not supported")
 }
+
+// checkUnixSocket returns an error unless
+// path is there and is a unix-domain socket.
+func checkUnixSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("'%s' is not a unix-domain socket", path)
+	}
+	return nil
+}
+
+// listenUnix listens on the unix-domain socket path. A socket
+// left at path by a listener that is gone, such as one that
+// crashed, is removed first; one still being listened on, or
+// a file that is not a socket, is left alone and is an error.
+// Closing the listener removes the socket file.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("'%s' exists and is not a unix-domain socket", path)
+		}
+		c, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("unix-domain socket '%s' is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -1,13 +1,17 @@
 package sshego
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
 
 // ud_test.go: unix domain socket test.
@@ -32,6 +36,7 @@ func Test401UnixDomainSocketListening(t *testing.T) {
 
 		s := MakeTestSshClientAndServer(true)
 		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
 
 		dest := udpath
 
@@ -78,6 +83,139 @@ func Test401UnixDomainSocketListening(t *testing.T) {
 	})
 }
 
+func Test114ForwardToRemoteUnixDomainSocket(t *testing.T) {
+
+	cv.Convey("A -remote given as a path should forward over direct-streamlocal to that unix domain socket on the sshd host, as for reaching a remote docker daemon, once the -esshd allows it with AllowDirectStreamLocal and the DirectTCPIPHandler does not veto it.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		serverDone := make(chan bool)
+		udpath := startBackgroundTestUnixDomainServer(
+			serverDone,
+			payloadByteCount,
+			confirmationPayload,
+			confirmationReply)
+		defer os.Remove(udpath)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		s.CliCfg.LocalToRemote.Remote.Addr = udpath
+		cv.So(s.CliCfg.LocalToRemote.Remote.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.LocalToRemote.Remote.UnixDomainPath, cv.ShouldEqual, udpath)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		lsn, lsnPort := GetAvailPort()
+		defer lsn.Close()
+		dialPair := func() (browser, fromBrowser net.Conn) {
+			browser, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", lsnPort))
+			panicOn(err)
+			fromBrowser, err = lsn.Accept()
+			panicOn(err)
+			return browser, fromBrowser
+		}
+
+		// off by default.
+		browser, fromBrowser := dialPair()
+		cv.So(NewForward(ctx, s.CliCfg, cli, fromBrowser), cv.ShouldBeNil)
+		browser.Close()
+
+		// vetoed.
+		s.SrvCfg.AllowDirectStreamLocal = true
+		var vetoed []string
+		s.SrvCfg.DirectTCPIPHandler = func(user, target string) error {
+			vetoed = append(vetoed, target)
+			return fmt.Errorf("not that socket")
+		}
+		browser, fromBrowser = dialPair()
+		cv.So(NewForward(ctx, s.CliCfg, cli, fromBrowser), cv.ShouldBeNil)
+		browser.Close()
+		cv.So(vetoed, cv.ShouldResemble, []string{udpath})
+
+		s.SrvCfg.DirectTCPIPHandler = nil
+		browser, fromBrowser = dialPair()
+		defer browser.Close()
+		fwd := NewForward(ctx, s.CliCfg, cli, fromBrowser)
+		cv.So(fwd, cv.ShouldNotBeNil)
+		cv.So(fwd.RemoteAddr().Network(), cv.ShouldEqual, "unix")
+		cv.So(fwd.RemoteAddr().String(), cv.ShouldEqual, udpath)
+
+		VerifyClientServerExchangeAcrossSshd(browser, confirmationPayload, confirmationReply, payloadByteCount)
+		<-serverDone
+
+		fwd.Close()
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test115ReverseForwardOfUnixDomainSocket(t *testing.T) {
+
+	cv.Convey("A -revlisten given as a path should publish, via streamlocal-forward, a unix domain socket on the sshd host that tunnels back to our local -revfwd socket, once the -esshd allows it with AllowReverseStreamLocal.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		serverDone := make(chan bool)
+		localpath := startBackgroundTestUnixDomainServer(
+			serverDone,
+			payloadByteCount,
+			confirmationPayload,
+			confirmationReply)
+		defer os.Remove(localpath)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		cli, _, err := s.CliCfg.SSHConnect(ctx, s.CliCfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		remotepath := "/tmp/ud_rev_test.sock." + RandomString(20)
+		defer os.Remove(remotepath)
+		s.CliCfg.RemoteToLocal.Listen.Addr = remotepath
+		s.CliCfg.RemoteToLocal.Remote.Addr = localpath
+		cv.So(s.CliCfg.RemoteToLocal.Listen.ParseAddr(), cv.ShouldBeNil)
+		cv.So(s.CliCfg.RemoteToLocal.Remote.ParseAddr(), cv.ShouldBeNil)
+
+		// off by default: the esshd refuses.
+		_, err = s.CliCfg.StartupReverseListener(ctx, cli)
+		cv.So(err, cv.ShouldNotBeNil)
+		_, err = os.Stat(remotepath)
+		cv.So(os.IsNotExist(err), cv.ShouldBeTrue)
+
+		s.SrvCfg.AllowReverseStreamLocal = true
+		_, err = s.CliCfg.StartupReverseListener(ctx, cli)
+		cv.So(err, cv.ShouldBeNil)
+
+		fromRemoteSide, err := net.Dial("unix", remotepath)
+		cv.So(err, cv.ShouldBeNil)
+		defer fromRemoteSide.Close()
+
+		VerifyClientServerExchangeAcrossSshd(fromRemoteSide, confirmationPayload, confirmationReply, payloadByteCount)
+		<-serverDone
+
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
 func udUnencPingPong(dest, confirmationPayload, confirmationReply string, payloadByteCount int) {
 	conn, err := net.Dial("unix", dest)
 	panicOn(err)
@@ -138,3 +276,147 @@ func startBackgroundTestUnixDomainServer(serverDone chan bool, payloadByteCount
 
 	return udpath
 }
+
+func Test157ForwardListenerOnAUnixDomainSocket(t *testing.T) {
+
+	cv.Convey("A -listen given as unix:path should take forward connections on that unix domain socket, replacing a stale socket file left behind, and remove the socket file when it stops.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		cv.So(WaitUntilAddrListening(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 300), cv.ShouldBeGreaterThanOrEqualTo, 0)
+
+		// echoes one line per connection.
+		target, targetPort := GetAvailPort()
+		defer target.Close()
+		go func() {
+			for {
+				c, err := target.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					line, err := bufio.NewReader(c).ReadString('\n')
+					if err == nil {
+						fmt.Fprintf(c, "echo:%s", line)
+					}
+				}(c)
+			}
+		}()
+
+		dir, err := os.MkdirTemp("", "sshego-ud")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		udpath := dir + "/app.sock"
+
+		// a crashed listener leaves its socket file behind.
+		stale, err := net.Listen("unix", udpath)
+		panicOn(err)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+		_, err = os.Stat(udpath)
+		cv.So(err, cv.ShouldBeNil)
+
+		cfg := s.CliCfg
+		cfg.LocalToRemote.Listen.Addr = "unix:" + udpath
+		cv.So(cfg.LocalToRemote.Listen.ParseAddr(), cv.ShouldBeNil)
+		cv.So(cfg.LocalToRemote.Listen.UnixDomainPath, cv.ShouldEqual, udpath)
+		cfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", targetPort)
+		cv.So(cfg.LocalToRemote.Remote.ParseAddr(), cv.ShouldBeNil)
+		cfg.Quiet = true
+
+		echo := func(msg string) string {
+			c, err := net.Dial("unix", udpath)
+			panicOn(err)
+			defer c.Close()
+			fmt.Fprintf(c, "%s\n", msg)
+			line, _ := bufio.NewReader(c).ReadString('\n')
+			return line
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err = cfg.SSHConnect(ctx, cfg.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		panicOn(err)
+		cv.So(echo("one"), cv.ShouldEqual, "echo:one\n")
+
+		// a second listener on the same socket is refused.
+		_, err = listenUnix(udpath)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		cv.So(cfg.RestartForward(cfg.Nickname), cv.ShouldBeNil)
+		cv.So(echo("two"), cv.ShouldEqual, "echo:two\n")
+
+		halt.RequestStop()
+		halt.MarkDone()
+		gone := false
+		for i := 0; i < 300 && !gone; i++ {
+			_, err = os.Stat(udpath)
+			gone = os.IsNotExist(err)
+			time.Sleep(10 * time.Millisecond)
+		}
+		cv.So(gone, cv.ShouldBeTrue)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test158ReverseDeliversToALocalUnixDomainSocket(t *testing.T) {
+
+	cv.Convey("A -revfwd given as unix:path should deliver reverse connections to that local unix domain socket, and the reverse listener should refuse to start unless the path is a socket.", t, func() {
+
+		dir, err := os.MkdirTemp("", "sshego-ud")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		udpath := dir + "/docker.sock"
+
+		// echoes one line per connection.
+		local, err := net.Listen("unix", udpath)
+		panicOn(err)
+		defer local.Close()
+		go func() {
+			for {
+				c, err := local.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					line, err := bufio.NewReader(c).ReadString('\n')
+					if err == nil {
+						fmt.Fprintf(c, "echo:%s", line)
+					}
+				}(c)
+			}
+		}()
+
+		cfg := NewSshegoConfig()
+		cfg.RemoteToLocal.Remote.Addr = "unix:" + udpath
+		cv.So(cfg.RemoteToLocal.Remote.ParseAddr(), cv.ShouldBeNil)
+		cv.So(cfg.RemoteToLocal.Remote.UnixDomainPath, cv.ShouldEqual, udpath)
+
+		// stands in for the ssh channel from the sshd.
+		remoteSide, fromRemote := net.Pipe()
+		rev, err := cfg.StartNewReverse(nil, fromRemote)
+		panicOn(err)
+		defer rev.Close()
+		fmt.Fprintf(remoteSide, "hi\n")
+		line, err := bufio.NewReader(remoteSide).ReadString('\n')
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(line, cv.ShouldEqual, "echo:hi\n")
+
+		// checked before any listening is asked of the sshd.
+		cfg.RemoteToLocal.Remote.UnixDomainPath = dir + "/missing.sock"
+		_, err = cfg.StartupReverseListener(context.Background(), nil)
+		cv.So(os.IsNotExist(errors.Unwrap(err)), cv.ShouldBeTrue)
+
+		plain := dir + "/plain"
+		panicOn(os.WriteFile(plain, []byte("not a socket"), 0600))
+		cfg.RemoteToLocal.Remote.UnixDomainPath = plain
+		_, err = cfg.StartupReverseListener(context.Background(), nil)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "not a unix-domain socket")
+	})
+}
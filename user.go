@@ -365,20 +365,10 @@ func (h *HostDb) finishUserBuildout(user *User) (toptPath, qrPath, rsaPath strin
 	}
 
 	if !h.cfg.SkipTOTP {
-		var w *TOTP
-		w, err = NewTOTP(user.MyEmail, fmt.Sprintf("%s/%s", user.MyLogin, user.Issuer))
-		if err != nil {
-			panic(err)
-		}
-		toptPath = h.toptpath(user.MyLogin)
-		user.TOTPpath = toptPath
-		makeway(toptPath)
-
-		user.TOTPorig = w.Key.String()
-		_, qrPath, err = w.SaveToFile(toptPath)
+		_, err = h.setTOTP(user)
 		panicOn(err)
-		user.oneTime = w
-		user.QrPath = qrPath
+		toptPath = user.TOTPpath
+		qrPath = user.QrPath
 	}
 
 	if !h.cfg.SkipRSA {
@@ -418,6 +408,68 @@ func (h *HostDb) finishUserBuildout(user *User) (toptPath, qrPath, rsaPath strin
 	return
 }
 
+// setTOTP gives user a new TOTP secret, written with
+// its QR code under h.toptpath() as AddUser does.
+// The caller saves the HostDb.
+func (h *HostDb) setTOTP(user *User) (*TOTP, error) {
+	w, err := NewTOTP(user.MyEmail, fmt.Sprintf("%s/%s", user.MyLogin, user.Issuer))
+	if err != nil {
+		return nil, err
+	}
+	toptPath := h.toptpath(user.MyLogin)
+	makeway(toptPath)
+	_, qrPath, err := w.SaveToFile(toptPath)
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPpath = toptPath
+	user.TOTPorig = w.Key.String()
+	user.QrPath = qrPath
+	user.oneTime = w
+	return w, nil
+}
+
+// EnrollTOTP gives the existing user mylogin a new
+// TOTP secret, replacing any they had, and saves it in
+// the HostDb. It returns the otpauth:// url and its QR
+// code as a PNG, for the user's authenticator app.
+// From then on the esshd asks for codes from the new
+// secret, unless cfg.SkipTOTP is set.
+func (h *HostDb) EnrollTOTP(mylogin string) (otpauthURL string, qrPNG []byte, err error) {
+	user, ok := h.Persist.Users.Get2(mylogin)
+	if !ok {
+		return "", nil, fmt.Errorf("EnrollTOTP: user '%s' not found", mylogin)
+	}
+	user.mut.Lock()
+	w, err := h.setTOTP(user)
+	user.mut.Unlock()
+	if err != nil {
+		return "", nil, err
+	}
+	err = h.save(lockit)
+	if err != nil {
+		return "", nil, err
+	}
+	return w.Key.String(), w.QRcodePng, nil
+}
+
+// ValidateTOTP reports whether code is a good one-time
+// code for user mylogin's TOTP secret just now. It is
+// false for an unknown user, or one with no secret.
+func (h *HostDb) ValidateTOTP(mylogin, code string) bool {
+	user, ok := h.Persist.Users.Get2(mylogin)
+	if !ok || code == "" {
+		return false
+	}
+	user.mut.Lock()
+	defer user.mut.Unlock()
+	user.RestoreTotp()
+	if user.oneTime == nil {
+		return false
+	}
+	return user.oneTime.IsValid(code, mylogin)
+}
+
 func (h *HostDb) DelUser(mylogin string) error {
 
 	ok, err := h.ValidLogin(mylogin)
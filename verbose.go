@@ -20,12 +20,11 @@ func tSPrintf(format string, a ...interface{}) {
 	fmt.Printf(format+"\n", a...)
 }
 
-// VPrintf is like fmt.Printf, but only prints if Verbose is true. Uses TSPrint
-// to mark each print with a timestamp.
+// p is debug tracing, handed to DefaultLogger.Debugf. The
+// stock DefaultLogger only prints it if Verbose is true, and
+// then with a timestamp from TSPrint.
 func p(format string, a ...interface{}) {
-	if Verbose {
-		tSPrintf(format, a...)
-	}
+	DefaultLogger.Debugf(format, a...)
 }
 
 func pp(format string, a ...interface{}) {
@@ -24,6 +24,10 @@ const (
 	channelMaxPacket = 1 << 15
 	// We follow OpenSSH here.
 	channelWindowSize = 64 * channelMaxPacket
+
+	// maxChannelMaxPacket leaves room within maxPacket
+	// for the channel data header and the padding.
+	maxChannelMaxPacket = maxPacket - 1024
 )
 
 // verify interface satisfied.
@@ -167,6 +171,14 @@ type Channel interface {
 	// progress.
 	Status() *RunStatus
 
+	// BytesRead returns the total payload bytes returned
+	// by Read and ReadExtended so far, stderr included.
+	BytesRead() int64
+
+	// BytesWritten returns the total payload bytes sent
+	// by Write and WriteExtended so far, stderr included.
+	BytesWritten() int64
+
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 }
@@ -241,6 +253,11 @@ const (
 // channel is an implementation of the Channel interface that works
 // with the mux class.
 type channel struct {
+	// bytesRead and bytesWritten count payload bytes,
+	// updated atomically; first, for 64-bit alignment.
+	bytesRead    int64
+	bytesWritten int64
+
 	// R/O after creation
 	chanType          string
 	extraData         []byte
@@ -394,6 +411,7 @@ func (c *channel) WriteExtended(data []byte, extendedCode uint32) (n int, err er
 			return n, err
 		}
 		c.idleW.AttemptOK()
+		atomic.AddInt64(&c.bytesWritten, int64(len(todo)))
 
 		n += len(todo)
 		data = data[len(todo):]
@@ -481,6 +499,7 @@ func (c *channel) ReadExtended(data []byte, extended uint32) (n int, err error)
 	}
 
 	if n > 0 {
+		atomic.AddInt64(&c.bytesRead, int64(n))
 		err = c.adjustWindow(uint32(n))
 		// sendWindowAdjust can return io.EOF if the remote
 		// peer has closed the connection, however we want to
@@ -630,7 +649,7 @@ func (m *mux) newChannel(chanType string, direction channelDirection, extraData
 	idleR, idleW := NewIdleTimer(nil, 0), NewIdleTimer(nil, 0)
 	ch := &channel{
 		remoteWin:        window{Cond: newCond(), idle: idleR},
-		myWindow:         channelWindowSize,
+		myWindow:         m.windowSize,
 		pending:          newBuffer(idleR),
 		extPending:       newBuffer(idleR),
 		direction:        direction,
@@ -670,7 +689,7 @@ func (c *channel) Accept() (Channel, <-chan *Request, error) {
 	if c.decided {
 		return nil, nil, errDecidedAlready
 	}
-	c.maxIncomingPayload = channelMaxPacket
+	c.maxIncomingPayload = c.mux.maxPacket
 	confirm := channelOpenConfirmMsg{
 		PeersId:       c.remoteId,
 		MyId:          c.localId,
@@ -959,6 +978,14 @@ func (c *channel) GetReadIdleTimer() *IdleTimer {
 	return c.idleR
 }
 
+func (c *channel) BytesRead() int64 {
+	return atomic.LoadInt64(&c.bytesRead)
+}
+
+func (c *channel) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.bytesWritten)
+}
+
 func (c *channel) GetWriteIdleTimer() *IdleTimer {
 	return c.idleW
 }
@@ -89,10 +89,10 @@ func NewClientConn(ctx context.Context, c net.Conn, addr string, config *ClientC
 	// on conn in.
 	if err := conn.clientHandshake(ctx, addr, &fullConf); err != nil {
 		c.Close()
-		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %v", err)
+		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %w", err)
 	}
 
-	conn.mux = newMux(ctx, conn.transport, conn.halt)
+	conn.mux = newMuxWithLimits(ctx, conn.transport, conn.halt, &fullConf.Config)
 	return conn, conn.mux.incomingChannels, conn.mux.incomingRequests, nil
 }
 
@@ -149,7 +149,10 @@ func (c *Client) HandleGlobalRequests(ctx context.Context, incoming <-chan *Requ
 
 	for {
 		select {
-		case r := <-incoming:
+		case r, stillOpen := <-incoming:
+			if !stillOpen {
+				return
+			}
 			if r != nil {
 				// This handles keepalive messages and matches
 				// the behaviour of OpenSSH.
@@ -176,7 +179,10 @@ func (c *Client) HandleChannelOpens(ctx context.Context, in <-chan NewChannel) {
 			return
 		case <-ctx.Done():
 			return
-		case ch := <-in:
+		case ch, stillOpen := <-in:
+			if !stillOpen {
+				return
+			}
 			if ch != nil {
 				c.Mu.Lock()
 				handler := c.ChannelHandlers[ch.ChannelType()]
@@ -269,8 +275,17 @@ type ClientConfig struct {
 	//
 	// A Timeout of zero means no timeout.
 	Timeout time.Duration
+
+	// BannerCallback, if non-nil, is called with any banner
+	// the server sends during authentication. If it returns
+	// an error, authentication is abandoned with that error.
+	BannerCallback BannerCallback
 }
 
+// BannerCallback is the function type used for
+// presenting the server's pre-auth banner.
+type BannerCallback func(message string) error
+
 // InsecureIgnoreHostKey returns a function that can be used for
 // ClientConfig.HostKeyCallback to accept any host key. It should
 // not be used for production code.
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"sync"
 
 	_ "crypto/sha1"
@@ -62,6 +63,35 @@ var supportedMACs = []string{
 
 var supportedCompressions = []string{compressionNone}
 
+// Algorithms names the ciphers, MACs, and key
+// exchanges that a Config can ask for.
+type Algorithms struct {
+	Ciphers      []string
+	MACs         []string
+	KeyExchanges []string
+}
+
+// AllAlgorithms returns, sorted, every algorithm this package can
+// negotiate if a Config asks for it, including those, such as
+// aes128-cbc, that it does not offer by default. A name not
+// listed here is ignored when it appears in a Config.
+func AllAlgorithms() Algorithms {
+	var a Algorithms
+	for name := range cipherModes {
+		a.Ciphers = append(a.Ciphers, name)
+	}
+	for name := range macModes {
+		a.MACs = append(a.MACs, name)
+	}
+	for name := range kexAlgoMap {
+		a.KeyExchanges = append(a.KeyExchanges, name)
+	}
+	sort.Strings(a.Ciphers)
+	sort.Strings(a.MACs)
+	sort.Strings(a.KeyExchanges)
+	return a
+}
+
 // hashFuncs keeps the mapping of supported algorithms to their respective
 // hashes needed for signature verification.
 var hashFuncs = map[string]crypto.Hash{
@@ -204,6 +234,17 @@ type Config struct {
 
 	// Halt is for shutdown
 	Halt *Halter
+
+	// ChannelWindowSize is the initial flow-control window
+	// we grant the peer on each channel: the most unread data
+	// it may have in flight to us. Raise it for links with a
+	// large bandwidth-delay product. If zero, 2MB is used.
+	ChannelWindowSize uint32
+
+	// ChannelMaxPacket is the largest data packet we accept on
+	// each channel. If zero, 32KB is used. Values above
+	// 256KB, less packet overhead, are reduced to fit.
+	ChannelMaxPacket uint32
 }
 
 // SetDefaults sets sensible values for unset fields in config. This is
@@ -95,7 +95,11 @@ func DiscardRequests(ctx context.Context, in <-chan *Request, halt *Halter) {
 	}
 	for {
 		select {
-		case req := <-in:
+		case req, ok := <-in:
+			if !ok {
+				// the channel or connection is gone.
+				return
+			}
 			if req != nil && req.WantReply {
 				req.Reply(false, nil)
 			}
@@ -146,6 +150,19 @@ func (c *connection) Close() error {
 	return c.sshConn.conn.Close()
 }
 
+// Disconnect sends the peer an SSH_MSG_DISCONNECT with
+// reason and message, then closes the connection. The
+// peer's Wait() returns an error that DisconnectReason
+// can take apart.
+func (c *connection) Disconnect(reason uint32, message string) error {
+	err := c.transport.writePacket(Marshal(&disconnectMsg{
+		Reason:  reason,
+		Message: message,
+	}))
+	c.Close()
+	return err
+}
+
 func (c *connection) Done() <-chan struct{} {
 	return c.halt.ReqStopChan()
 }
@@ -159,6 +176,10 @@ type sshConn struct {
 	sessionID     []byte
 	clientVersion []byte
 	serverVersion []byte
+
+	// for client connections, the auth
+	// methods the server accepted.
+	authMethods []string
 }
 
 func dup(src []byte) []byte {
@@ -191,6 +212,15 @@ func (c *sshConn) SessionID() []byte {
 	return dup(c.sessionID)
 }
 
+// AuthMethods returns, for a client connection, the
+// authentication methods that the server accepted, in
+// order. This is normally just one, such as "publickey";
+// a server that requires several methods in turn, by
+// way of partial success, gives one entry for each.
+func (c *sshConn) AuthMethods() []string {
+	return c.authMethods
+}
+
 func (c *sshConn) ClientVersion() []byte {
 	return dup(c.clientVersion)
 }
@@ -79,6 +79,9 @@ type handshakeTransport struct {
 	dialAddress     string
 	remoteAddr      net.Addr
 
+	// for presenting the server's banner, on the client.
+	bannerCallback BannerCallback
+
 	// Algorithms agreed in the last key exchange.
 	algorithms *algorithms
 
@@ -135,6 +138,7 @@ func newClientTransport(ctx context.Context, conn keyingTransport, clientVersion
 	t.dialAddress = dialAddr
 	t.remoteAddr = addr
 	t.hostKeyCallback = config.HostKeyCallback
+	t.bannerCallback = config.BannerCallback
 	if config.HostKeyAlgorithms != nil {
 		t.hostKeyAlgorithms = config.HostKeyAlgorithms
 	} else {
@@ -390,9 +394,16 @@ write:
 		defer func() {
 			t.config.Halt.MarkDone()
 		}()
+		startKex := t.startKex
 		for {
 			select {
-			case init := <-t.startKex:
+			case init, ok := <-startKex:
+				if !ok {
+					// closed by readLoop; stop
+					// receiving rather than spin.
+					startKex = nil
+					continue
+				}
 				if init != nil {
 					select {
 					case init.done <- t.writeError:
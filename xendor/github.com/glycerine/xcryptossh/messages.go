@@ -51,6 +51,39 @@ func (d *disconnectMsg) Error() string {
 	return fmt.Sprintf("ssh: disconnect, reason %d: %s", d.Reason, d.Message)
 }
 
+// Disconnect reason codes, from RFC 4253, section 11.1.
+// Code 4 is reserved.
+const (
+	DisconnectHostNotAllowedToConnect     uint32 = 1
+	DisconnectProtocolError               uint32 = 2
+	DisconnectKeyExchangeFailed           uint32 = 3
+	DisconnectMacError                    uint32 = 5
+	DisconnectCompressionError            uint32 = 6
+	DisconnectServiceNotAvailable         uint32 = 7
+	DisconnectProtocolVersionNotSupported uint32 = 8
+	DisconnectHostKeyNotVerifiable        uint32 = 9
+	DisconnectConnectionLost              uint32 = 10
+	DisconnectByApplication               uint32 = 11
+	DisconnectTooManyConnections          uint32 = 12
+	DisconnectAuthCancelledByUser         uint32 = 13
+	DisconnectNoMoreAuthMethodsAvailable  uint32 = 14
+	DisconnectIllegalUserName             uint32 = 15
+)
+
+// DisconnectReason reports whether err, such as from
+// Wait(), came from an SSH_MSG_DISCONNECT sent by the
+// peer, and if so gives the peer's reason code and
+// message. This tells a deliberate disconnect, such
+// as an idle timeout or an administrator's kick, apart
+// from a network failure.
+func DisconnectReason(err error) (reason uint32, message string, ok bool) {
+	var d *disconnectMsg
+	if errors.As(err, &d) {
+		return d.Reason, d.Message, true
+	}
+	return 0, "", false
+}
+
 // See RFC 4253, section 7.1.
 const msgKexInit = 20
 
@@ -137,6 +170,13 @@ type userAuthFailureMsg struct {
 	PartialSuccess bool
 }
 
+// See RFC 4252, section 5.4
+type userAuthBannerMsg struct {
+	Message string `sshtype:"53"`
+	// unused, but required to allow message parsing
+	Language string
+}
+
 // See RFC 4256, section 3.2
 const msgUserAuthInfoRequest = 60
 const msgUserAuthInfoResponse = 61
@@ -101,6 +101,10 @@ type mux struct {
 	err     error
 
 	halt *Halter
+
+	// per-channel flow control limits, from Config.
+	windowSize uint32
+	maxPacket  uint32
 }
 
 // When debugging, each new chanList instantiation has a different
@@ -118,6 +122,12 @@ func (m *mux) Wait() error {
 
 // newMux returns a mux that runs over the given connection.
 func newMux(ctx context.Context, p packetConn, halt *Halter) *mux {
+	return newMuxWithLimits(ctx, p, halt, nil)
+}
+
+// newMuxWithLimits is newMux, but taking the channel window
+// and packet sizes from config. config may be nil.
+func newMuxWithLimits(ctx context.Context, p packetConn, halt *Halter, config *Config) *mux {
 	// idle is nil on server
 	m := &mux{
 		conn:             p,
@@ -126,6 +136,22 @@ func newMux(ctx context.Context, p packetConn, halt *Halter) *mux {
 		incomingRequests: make(chan *Request, chanSize),
 		errCond:          newCond(),
 		halt:             halt,
+		windowSize:       channelWindowSize,
+		maxPacket:        channelMaxPacket,
+	}
+	if config != nil {
+		if config.ChannelWindowSize > 0 {
+			m.windowSize = config.ChannelWindowSize
+		}
+		if config.ChannelMaxPacket > 0 {
+			m.maxPacket = config.ChannelMaxPacket
+		}
+	}
+	if m.maxPacket > maxChannelMaxPacket {
+		m.maxPacket = maxChannelMaxPacket
+	}
+	if m.windowSize < m.maxPacket {
+		m.windowSize = m.maxPacket
 	}
 
 	if debugMux {
@@ -352,7 +378,7 @@ func (m *mux) OpenChannel(ctx context.Context, chanType string, extra []byte, pa
 func (m *mux) openChannel(ctx context.Context, chanType string, extra []byte, parentHalt *Halter) (*channel, error) {
 	ch := m.newChannel(chanType, channelOutbound, extra)
 
-	ch.maxIncomingPayload = channelMaxPacket
+	ch.maxIncomingPayload = m.maxPacket
 
 	open := channelOpenMsg{
 		ChanType:         chanType,
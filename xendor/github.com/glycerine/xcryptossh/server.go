@@ -92,6 +92,12 @@ type ServerConfig struct {
 	// attempts.
 	AuthLogCallback func(conn ConnMetadata, method string, err error)
 
+	// BannerCallback, if non-nil, is called once, before any
+	// authentication is attempted, and any message it returns
+	// is sent to the client as the pre-auth banner (RFC 4252,
+	// section 5.4). An empty message sends no banner.
+	BannerCallback func(conn ConnMetadata) string
+
 	// ServerVersion is the version identification string to announce in
 	// the public handshake.
 	// If empty, a reasonable default is used.
@@ -248,7 +254,7 @@ func (s *connection) serverHandshake(ctx context.Context, config *ServerConfig)
 	if err != nil {
 		return nil, err
 	}
-	s.mux = newMux(ctx, s.transport, config.Halt)
+	s.mux = newMuxWithLimits(ctx, s.transport, config.Halt, &config.Config)
 	return perms, err
 }
 
@@ -291,6 +297,32 @@ func checkSourceAddress(addr net.Addr, sourceAddrs string) error {
 	return fmt.Errorf("ssh: remote address %v is not allowed because of source-address restriction", addr)
 }
 
+// ServerAuthCallbacks are the authentication callbacks
+// in force for the next round of a multi-step login.
+// See PartialSuccessError.
+type ServerAuthCallbacks struct {
+	PasswordCallback            func(conn ConnMetadata, password []byte) (*Permissions, error)
+	PublicKeyCallback           func(conn ConnMetadata, key PublicKey) (*Permissions, error)
+	KeyboardInteractiveCallback func(ctx context.Context, conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error)
+}
+
+// PartialSuccessError can be returned by any of the
+// ServerConfig authentication callbacks to accept that
+// method while still requiring another before login
+// succeeds, as with publickey followed by a one-time
+// password. The client is sent SSH_MSG_USERAUTH_FAILURE
+// with partial success set, listing the methods of Next,
+// and the following attempts are checked against Next
+// rather than the ServerConfig callbacks. See RFC 4252
+// section 5.1.
+type PartialSuccessError struct {
+	Next ServerAuthCallbacks
+}
+
+func (p *PartialSuccessError) Error() string {
+	return "ssh: authenticated with partial success"
+}
+
 // ServerAuthError implements the error interface. It appends any authentication
 // errors that may occur, and is returned if all of the authentication methods
 // provided by the user failed to authenticate.
@@ -315,6 +347,14 @@ func (s *connection) serverAuthenticate(ctx context.Context, config *ServerConfi
 
 	authFailures := 0
 	var authErrs []error
+	var displayedBanner bool
+
+	// the callbacks change after a PartialSuccessError.
+	callbacks := ServerAuthCallbacks{
+		PasswordCallback:            config.PasswordCallback,
+		PublicKeyCallback:           config.PublicKeyCallback,
+		KeyboardInteractiveCallback: config.KeyboardInteractiveCallback,
+	}
 
 userAuthLoop:
 	for {
@@ -346,6 +386,17 @@ userAuthLoop:
 		}
 
 		s.user = userAuthReq.User
+
+		if !displayedBanner && config.BannerCallback != nil {
+			displayedBanner = true
+			if msg := config.BannerCallback(s); msg != "" {
+				bannerMsg := &userAuthBannerMsg{Message: msg}
+				if err := s.transport.writePacket(Marshal(bannerMsg)); err != nil {
+					return nil, err
+				}
+			}
+		}
+
 		perms = nil
 		authErr := errors.New("no auth passed yet")
 
@@ -360,7 +411,7 @@ userAuthLoop:
 				authFailures--
 			}
 		case "password":
-			if config.PasswordCallback == nil {
+			if callbacks.PasswordCallback == nil {
 				authErr = errors.New("ssh: password auth not configured")
 				break
 			}
@@ -374,17 +425,17 @@ userAuthLoop:
 				return nil, parseError(msgUserAuthRequest)
 			}
 
-			perms, authErr = config.PasswordCallback(s, password)
+			perms, authErr = callbacks.PasswordCallback(s, password)
 		case "keyboard-interactive":
-			if config.KeyboardInteractiveCallback == nil {
+			if callbacks.KeyboardInteractiveCallback == nil {
 				authErr = errors.New("ssh: keyboard-interactive auth not configubred")
 				break
 			}
 
 			prompter := &sshClientKeyboardInteractive{s}
-			perms, authErr = config.KeyboardInteractiveCallback(ctx, s, prompter.Challenge)
+			perms, authErr = callbacks.KeyboardInteractiveCallback(ctx, s, prompter.Challenge)
 		case "publickey":
-			if config.PublicKeyCallback == nil {
+			if callbacks.PublicKeyCallback == nil {
 				authErr = errors.New("ssh: publickey auth not configured")
 				break
 			}
@@ -418,7 +469,7 @@ userAuthLoop:
 			if !ok {
 				candidate.user = s.user
 				candidate.pubKeyData = pubKeyData
-				candidate.perms, candidate.result = config.PublicKeyCallback(s, pubKey)
+				candidate.perms, candidate.result = callbacks.PublicKeyCallback(s, pubKey)
 				if candidate.result == nil && candidate.perms != nil && candidate.perms.CriticalOptions != nil && candidate.perms.CriticalOptions[sourceAddressCriticalOption] != "" {
 					candidate.result = checkSourceAddress(
 						s.RemoteAddr(),
@@ -435,7 +486,7 @@ userAuthLoop:
 					return nil, parseError(msgUserAuthRequest)
 				}
 
-				if candidate.result == nil {
+				if _, partial := candidate.result.(*PartialSuccessError); candidate.result == nil || partial {
 					okMsg := userAuthPubKeyOkMsg{
 						Algo:   algo,
 						PubKey: pubKeyData,
@@ -482,16 +533,23 @@ userAuthLoop:
 			break userAuthLoop
 		}
 
-		authFailures++
-
 		var failureMsg userAuthFailureMsg
-		if config.PasswordCallback != nil {
+		if partial, ok := authErr.(*PartialSuccessError); ok {
+			// this method passed; move on to the next set.
+			callbacks = partial.Next
+			cache = pubKeyCache{}
+			failureMsg.PartialSuccess = true
+		} else {
+			authFailures++
+		}
+
+		if callbacks.PasswordCallback != nil {
 			failureMsg.Methods = append(failureMsg.Methods, "password")
 		}
-		if config.PublicKeyCallback != nil {
+		if callbacks.PublicKeyCallback != nil {
 			failureMsg.Methods = append(failureMsg.Methods, "publickey")
 		}
-		if config.KeyboardInteractiveCallback != nil {
+		if callbacks.KeyboardInteractiveCallback != nil {
 			failureMsg.Methods = append(failureMsg.Methods, "keyboard-interactive")
 		}
 
@@ -136,7 +136,7 @@ func (c *Client) ListenTCP(ctx context.Context, laddr *net.TCPAddr) (*tcpListene
 		laddr:  laddr,
 		conn:   c,
 		in:     ch,
-		TmpCtx: c.TmpCtx}, nil
+		TmpCtx: ctx}, nil
 }
 
 // forwardList stores a mapping between remote